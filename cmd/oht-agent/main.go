@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"lib/oht/accounts/agent"
+	"lib/oht/core/common"
+)
+
+var (
+	socket = flag.String("socket", agent.DefaultSocket(common.DefaultDataDir("oht")), "Specify the socket clients connect to")
+)
+
+// oht-agent holds unlocked account keys for oht-console and the node, keys
+// are added with /agent add in the console. Keys added with confirmation
+// ask on this terminal before every use.
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	keyAgent := agent.InitializeAgent(*socket)
+	cli := bufio.NewScanner(os.Stdin)
+	keyAgent.Confirm = func(use agent.Use) bool {
+		fmt.Printf("Agent: Allow %s? [y/N] ", use)
+		if !cli.Scan() {
+			return false
+		}
+		answer := strings.ToLower(strings.TrimSpace(cli.Text()))
+		return answer == "y" || answer == "yes"
+	}
+	if err := keyAgent.Start(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s=%s; export %s;\n", agent.SocketEnv, keyAgent.Socket, agent.SocketEnv)
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	<-shutdown
+	keyAgent.Stop()
+	log.Println("Agent: Stopped, every key was forgotten.")
+}
@@ -8,9 +8,13 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"lib/oht/core"
+
+	"golang.org/x/term"
 )
 
 var (
@@ -49,6 +53,7 @@ func main() {
 	cli := bufio.NewScanner(os.Stdin)
 	fmt.Printf(prompt)
 	username := *username
+	oht.Interface.SetUsername(username)
 	for cli.Scan() {
 		body := cli.Text()
 		if body == "/help" || body == "/h" {
@@ -62,6 +67,11 @@ func main() {
 			fmt.Println("    /tor [start|stop]            - Start or stop tor process")
 			fmt.Println("    /newtor                      - Obtain new Tor identity (Not Implemented)")
 			fmt.Println("    /newonions                   - Obtain new onion address")
+			fmt.Println("    /nameproxy [start|stop]      - Start or stop SOCKS proxy resolving .oht names")
+			fmt.Println("    /private                     - List private onion services and their clients")
+			fmt.Println("    /private [name] [port]       - Add onion service for local port only authorized contacts reach")
+			fmt.Println("    /authorize [name] [id]       - Send contact a key to reach private onion service")
+			fmt.Println("    /deauthorize [name] [id]     - Revoke the key of contact to private onion service")
 			fmt.Println("\n  NETWORK:")
 			fmt.Println("    /connect [onion address]     - Join identifier ring by connecting to peer")
 			fmt.Println("    /peers                       - List all connected peers (Not Implemented)")
@@ -69,36 +79,74 @@ func main() {
 			fmt.Println("    /predecessor                 - Previous peer in identifier ring (Not Implemented)")
 			fmt.Println("    /ftable                      - List ftable peers (Not Implemented)")
 			fmt.Println("    /create                      - Create new ring (Not Implemented)")
-			fmt.Println("    /lookup [id]                 - Find onion address of account with id (Not Implemented)")
+			fmt.Println("    /lookup [id]                 - Find onion address of account with id from its profile")
 			fmt.Println("    /ping [onion address|id]     - Ping peer (Not Implemented)")
 			fmt.Println("    /ringcast [message]          - Message every peer in ring (Not Implemented)")
 			fmt.Println("\n  DHT:")
 			fmt.Println("    /put [key] [value]           - Put key and value into database (Not Implemented)")
 			fmt.Println("    /get [key]                   - Get value of key (Not Implemented)")
 			fmt.Println("    /delete [key]                - Delete value of key (Not Implemented)")
+			fmt.Println("\n  NAMES:")
+			fmt.Println("    /resolve [name]              - Find the onion address registered for name")
+			fmt.Println("    /register [id] [name]        - Register name for account pointing to this node")
+			fmt.Println("    /renew [id] [name]           - Extend the expiry of a name owned by account")
+			fmt.Println("    /transfer [id] [name] [to]   - Transfer a name owned by account to another account")
 			fmt.Println("\n  WEBUI:")
 			fmt.Println("    /webui [start|stop]          - Start or stop webUI server")
 			fmt.Println("\n  ACCOUNT:")
-			fmt.Println("    /accounts                    - List all accounts (Not Implemented)")
-			fmt.Println("    /generate                    - Generate new account key pair (Not Implemented)")
-			fmt.Println("    /delete                      - Delete an account key pair (Not Implemented)")
-			fmt.Println("    /sign [id] [message]         - Sign with account key pair (Not Implemented)")
-			fmt.Println("    /verify [id] [message]       - Verify a signed message with keypair (Not Implemented)")
-			fmt.Println("    /encrypt [id] [message]      - Encrypt a message with keypair (Not Implemented)")
-			fmt.Println("    /decrypt [id] [message]      - Decrypt a message with keypair (Not Implemented)")
+			fmt.Println("    /accounts                    - List all accounts with their index and unlock state")
+			fmt.Println("    /generate [type]             - Generate new account key pair, secp256k1, ed25519 or x25519")
+			fmt.Println("    /delete [id]                 - Delete an account key pair")
+			fmt.Println("    /label [id] [label]          - Name account in its key file")
+			fmt.Println("    /sign [id] [message]         - Sign with account key pair")
+			fmt.Println("    /verify [id] [sig] [message] - Verify a signed message with keypair")
+			fmt.Println("    /encrypt [id] [message]      - Encrypt a message with keypair")
+			fmt.Println("    /decrypt [id] [message]      - Decrypt a message with keypair")
+			fmt.Println("    /seed                        - Generate seed phrase new accounts are derived from")
+			fmt.Println("    /export                      - Show seed phrase to back up derived accounts")
+			fmt.Println("    /import [count]              - Restore first count accounts from a seed phrase")
+			fmt.Println("    /nodekey                     - Restore node key from seed phrase")
+			fmt.Println("    /agent                       - List accounts held by oht-agent")
+			fmt.Println("    /agent add [id] [min] [ask]  - Hand account to oht-agent for min minutes, ask before each use")
+			fmt.Println("    /agent rm [id]               - Remove account from oht-agent")
+			fmt.Println("    /agent lock                  - Remove every account from oht-agent")
+			fmt.Println("\n  IDENTITIES:")
+			fmt.Println("    /identities                  - List identities with their account and onion address")
+			fmt.Println("    /identity [name] [id]        - Host account as an identity with its own onion address")
+			fmt.Println("    /switch [name]               - Make contacts, channels and names act as identity")
 			fmt.Println("\n  CONTACTS:")
-			fmt.Println("    /contacts                    - List all saved contacts (Not Implemented)")
-			fmt.Println("    /request [id] [message]      - Request account to add your id to their contacts (Not Implemented)")
-			fmt.Println("    /add [id]                    - Add account to contacts (Not Implemented)")
-			fmt.Println("    /rm [id]                     - Remove account from contacts (Not Implemented)")
-			fmt.Println("    /whisper [id] [message]      - Direct message peer (Not Implemented)")
+			fmt.Println("    /contacts                    - List all saved contacts and pending requests")
+			fmt.Println("    /request [id] [message]      - Request account to add your id to their contacts")
+			fmt.Println("    /add [id]                    - Add account to contacts, accepting its request")
+			fmt.Println("    /rm [id]                     - Remove account from contacts, rejecting its request")
+			fmt.Println("    /whisper [id] [message]      - Direct message contact, end-to-end encrypted")
+			fmt.Println("    /avatar [path]               - Publish the hash of an avatar image in your profile")
+			fmt.Println("    /safety [id]                 - Show safety number to compare with contact in person")
+			fmt.Println("    /trust [id]                  - Mark contact verified once safety numbers match")
+			fmt.Println("    /vouch [id]                  - Publish that you verified contact, their contacts trust them")
+			fmt.Println("    /untrust [id]                - Forget contact was verified, withdrawing your vouch")
 			fmt.Println("    /contactcast [message]       - Message all contacts (Not Implemented)")
+			fmt.Println("\n  RECOVERY:")
+			fmt.Println("    /backup [threshold] [id]...  - Give contacts shares of account key, threshold recover it")
+			fmt.Println("    /recovery                    - List backups, shares held for contacts and recoveries")
+			fmt.Println("    /release [id]                - Return share held for account, confirm it is them first")
+			fmt.Println("    /recover [id] [contact]...   - Ask contacts holding shares of account to return them")
+			fmt.Println("    /restore [id]                - Store account key rebuilt from returned shares")
+			fmt.Println("    /revoke [id] [reason]        - Publish revocation of account key, contacts stop trusting it")
+			fmt.Println("    /rotate [id] [new] [reason]  - Publish statement of account key endorsing new account")
 			fmt.Println("\n  CHANNELS:")
-			fmt.Println("    /channels                    - List all known channels (Not Implemented)")
-			fmt.Println("    /channel                     - Generates a new channel (Not Implemented)")
-			fmt.Println("    /join [id]                   - Join channel with id (Not Implemented)")
-			fmt.Println("    /leave [id]                  - Leave channel with id (Not Implemented)")
-			fmt.Println("    /channelcast [id] [message]  - Message all channel subscribers (Not Implemented)")
+			fmt.Println("    /channels                    - List all joined channels and their invites")
+			fmt.Println("    /channels [id]               - Show members and recent messages of channel with id or name")
+			fmt.Println("    /channel [name]              - Generates a new channel")
+			fmt.Println("    /join [invite]               - Join channel with invite, or geo:[geohash] for an area")
+			fmt.Println("    /geo [lat] [long] [1-6]      - Join public channel of your area at geohash precision")
+			fmt.Println("    /nearby [geohash]            - List areas within geohash with nodes present")
+			fmt.Println("    /leave [id]                  - Leave channel with id or name")
+			fmt.Println("    /channelcast [id] [message]  - Message all channel subscribers")
+			fmt.Println("    /kick [id] [member]          - Remove member from channel, moderators only")
+			fmt.Println("    /ban [id] [member]           - Remove member from channel and keep them out")
+			fmt.Println("    /role [id] [member] [role]   - Make member a moderator, member or banned")
+			fmt.Println("    /erase [id] [message id]     - Delete message from the history of all members")
 			fmt.Println("\n    /quit\n")
 			//
 			// CONFIG
@@ -172,6 +220,63 @@ func main() {
 			log.Println("Tor: Purging Tor onion service addresses.")
 			oht.Interface.TorCycleOnionAddresses()
 			log.Println("WebUI Listening: " + oht.Interface.TorWebUIOnionHost() + ":" + oht.Interface.TorWebUIPort())
+		} else if len(body) > 10 && body[0:10] == "/nameproxy" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 {
+				if parts[1] == "start" {
+					if oht.Interface.NameProxyOnline() == false {
+						if oht.Interface.NameProxyStart() {
+							fmt.Println("Name proxy: Started. SOCKS5 listening on 127.0.0.1:" + oht.Interface.NameProxyPort())
+						} else {
+							fmt.Println("Name proxy: Failed to start.")
+						}
+					} else {
+						fmt.Println("Name proxy: Already started.")
+					}
+				} else {
+					if oht.Interface.NameProxyOnline() {
+						oht.Interface.NameProxyStop()
+						fmt.Println("Name proxy: Stopped.")
+					} else {
+						fmt.Println("Name proxy: Already stopped.")
+					}
+				}
+			}
+		} else if body == "/private" {
+			onionServices := oht.Interface.TorPrivateServices()
+			if len(onionServices) == 0 {
+				fmt.Println("Tor: No private onion services.")
+			}
+			for _, onionService := range onionServices {
+				fmt.Println(onionService)
+			}
+		} else if len(body) > 9 && body[0:9] == "/private " {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 {
+				if onionHost, err := oht.Interface.TorAddPrivateService(parts[1], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Tor: Added " + onionHost + ", authorize contacts with /authorize " + parts[1] + " [id]")
+				}
+			}
+		} else if len(body) > 10 && body[0:10] == "/authorize" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 && unlockIdentity(cli, oht) {
+				if err := oht.Interface.AuthorizeContact(parts[1], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Tor: Sent " + parts[2] + " a key to " + parts[1])
+				}
+			}
+		} else if len(body) > 12 && body[0:12] == "/deauthorize" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 {
+				if err := oht.Interface.DeauthorizeContact(parts[1], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Tor: Revoked the key of " + parts[2] + " to " + parts[1])
+				}
+			}
 			//
 			// NETWORK
 		} else if len(body) > 8 && body[0:8] == "/connect" {
@@ -183,6 +288,487 @@ func main() {
 				}
 				oht.Interface.ConnectToPeer(parts[1])
 			}
+		} else if len(body) > 7 && body[0:7] == "/lookup" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 {
+				if onionHost := oht.Interface.RingLookupPeerById(parts[1]); onionHost == "" {
+					fmt.Println("Profile: No current profile found for " + parts[1])
+				} else {
+					fmt.Println("Profile: " + parts[1] + " is reachable at " + onionHost)
+				}
+			}
+			//
+			// NAMES
+		} else if len(body) > 8 && body[0:8] == "/resolve" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 {
+				onionHost, err := oht.Interface.ResolveName(strings.TrimSuffix(parts[1], ".oht"))
+				if err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Name: " + parts[1] + " resolves to " + onionHost)
+				}
+			}
+		} else if len(body) > 9 && body[0:9] == "/register" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 {
+				if err := oht.Interface.RegisterName(parts[1], readPassphrase(cli), parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Name: Registered " + parts[2] + " to " + parts[1])
+				}
+			}
+		} else if len(body) > 6 && body[0:6] == "/renew" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 {
+				if err := oht.Interface.RenewName(parts[1], readPassphrase(cli), parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Name: Renewed " + parts[2])
+				}
+			}
+		} else if len(body) > 9 && body[0:9] == "/transfer" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 4 {
+				if err := oht.Interface.TransferName(parts[1], readPassphrase(cli), parts[2], parts[3]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Name: Transferred " + parts[2] + " to " + parts[3])
+				}
+			}
+			//
+			// ACCOUNT
+		} else if body == "/accounts" {
+			accounts := oht.Interface.Accounts().ListAccounts()
+			if len(accounts) == 0 {
+				fmt.Println("Accounts: None, generate one with /generate.")
+			}
+			for _, account := range accounts {
+				fmt.Println(account)
+			}
+		} else if body == "/generate" || (len(body) > 10 && body[0:10] == "/generate ") {
+			algorithm := strings.TrimSpace(body[9:])
+			passphrase := readPassphrase(cli)
+			if readSecret(cli, "Repeat passphrase: ") != passphrase {
+				fmt.Println("Accounts: Passphrases do not match.")
+			} else if account, err := oht.Interface.Accounts().GenerateAccountOfAlgorithm(algorithm, passphrase); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Accounts: Generated " + account)
+			}
+		} else if len(body) > 7 && body[0:7] == "/delete" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 {
+				if err := oht.Interface.Accounts().DeleteAccount(parts[1], readPassphrase(cli)); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Accounts: Deleted " + parts[1])
+				}
+			}
+		} else if len(body) > 6 && body[0:6] == "/label" {
+			parts := strings.SplitN(body, " ", 3)
+			if len(parts) == 3 {
+				if err := oht.Interface.Accounts().LabelAccount(parts[1], readPassphrase(cli), parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Accounts: Labeled " + parts[1])
+				}
+			}
+		} else if len(body) > 5 && body[0:5] == "/sign" {
+			parts := strings.SplitN(body, " ", 3)
+			if len(parts) == 3 && unlockAccount(cli, oht, parts[1]) {
+				if signature, err := oht.Interface.Accounts().Sign(parts[1], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Signature: " + signature)
+				}
+			}
+		} else if len(body) > 7 && body[0:7] == "/verify" {
+			parts := strings.SplitN(body, " ", 4)
+			if len(parts) == 4 {
+				if err := oht.Interface.Accounts().Verify(parts[1], parts[3], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Accounts: Signature is valid, signed by " + parts[1])
+				}
+			}
+		} else if len(body) > 8 && body[0:8] == "/encrypt" {
+			parts := strings.SplitN(body, " ", 3)
+			if len(parts) == 3 && unlockAccount(cli, oht, parts[1]) {
+				if encrypted, err := oht.Interface.Accounts().Encrypt(parts[1], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Encrypted: " + encrypted)
+				}
+			}
+		} else if len(body) > 8 && body[0:8] == "/decrypt" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 && unlockAccount(cli, oht, parts[1]) {
+				if decrypted, err := oht.Interface.Accounts().Decrypt(parts[1], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Decrypted: " + decrypted)
+				}
+			}
+		} else if body == "/seed" {
+			passphrase := readPassphrase(cli)
+			if readSecret(cli, "Repeat passphrase: ") != passphrase {
+				fmt.Println("Accounts: Passphrases do not match.")
+			} else if phrase, account, err := oht.Interface.Accounts().GenerateSeed(passphrase); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Accounts: Write down the seed phrase, it restores every account generated from now on:")
+				fmt.Println(phrase)
+				fmt.Println("Accounts: Generated " + account)
+			}
+		} else if body == "/export" {
+			if phrase, err := oht.Interface.Accounts().ExportSeed(readPassphrase(cli)); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println(phrase)
+			}
+		} else if len(body) >= 7 && body[0:7] == "/import" {
+			parts := strings.Split(body, " ")
+			count := 1
+			var err error
+			if len(parts) == 2 {
+				count, err = strconv.Atoi(parts[1])
+			}
+			if err != nil || count < 1 {
+				fmt.Println("Accounts: The count of accounts to restore is a number from 1.")
+			} else {
+				fmt.Printf("Seed phrase: ")
+				cli.Scan()
+				phrase := cli.Text()
+				if accounts, err := oht.Interface.Accounts().ImportSeed(phrase, readPassphrase(cli), count); err != nil {
+					fmt.Println(err)
+				} else {
+					for _, account := range accounts {
+						fmt.Println("Accounts: Restored " + account)
+					}
+				}
+			}
+		} else if body == "/nodekey" {
+			if err := oht.Interface.RestoreNodeKey(readPassphrase(cli)); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Accounts: Restored the node key from the seed phrase.")
+			}
+		} else if body == "/agent" {
+			if keys, err := oht.Interface.Accounts().AgentKeys(); err != nil {
+				fmt.Println(err)
+			} else if len(keys) == 0 {
+				fmt.Println("Agent: No accounts.")
+			} else {
+				for _, key := range keys {
+					fmt.Println(key)
+				}
+			}
+		} else if len(body) > 10 && body[0:10] == "/agent add" {
+			parts := strings.Split(body, " ")
+			if len(parts) >= 3 {
+				minutes := 0
+				if len(parts) >= 4 {
+					minutes, _ = strconv.Atoi(parts[3])
+				}
+				confirm := len(parts) == 5 && parts[4] == "ask"
+				if err := oht.Interface.Accounts().AddToAgent(parts[2], readPassphrase(cli), (time.Duration(minutes) * time.Minute), confirm); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Agent: Holding " + parts[2])
+				}
+			}
+		} else if len(body) > 9 && body[0:9] == "/agent rm" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 {
+				if err := oht.Interface.Accounts().RemoveFromAgent(parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Agent: Removed " + parts[2])
+				}
+			}
+		} else if body == "/agent lock" {
+			if err := oht.Interface.Accounts().LockAgent(); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Agent: Removed every account.")
+			}
+			//
+			// IDENTITIES
+		} else if body == "/identities" {
+			for _, identity := range oht.Interface.ListIdentities() {
+				fmt.Println(identity)
+			}
+		} else if len(body) > 9 && body[0:9] == "/identity" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 {
+				if err := oht.Interface.CreateIdentity(parts[1], parts[2]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Identity: Created " + parts[1] + ", switch to it with /switch " + parts[1])
+				}
+			}
+		} else if len(body) > 7 && body[0:7] == "/switch" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 {
+				if err := oht.Interface.UseIdentity(parts[1]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Identity: Acting as " + parts[1])
+				}
+			}
+			//
+			// CONTACTS
+		} else if body == "/contacts" {
+			contacts := oht.Interface.Contacts().ListContacts()
+			if len(contacts) == 0 {
+				fmt.Println("Contacts: None.")
+			}
+			for _, contact := range contacts {
+				fmt.Println(contact)
+			}
+		} else if len(body) > 8 && body[0:8] == "/request" {
+			parts := strings.SplitN(body, " ", 3)
+			if len(parts) >= 2 && unlockIdentity(cli, oht) {
+				message := ""
+				if len(parts) == 3 {
+					message = parts[2]
+				}
+				if oht.Interface.Contacts().RequestContact(parts[1], message) {
+					fmt.Println("Contacts: Request sent to " + parts[1])
+				}
+			}
+		} else if len(body) > 4 && body[0:4] == "/add" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if oht.Interface.Contacts().AddContact(parts[1]) {
+					fmt.Println("Contacts: Added " + parts[1])
+				}
+			}
+		} else if len(body) > 3 && body[0:3] == "/rm" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if oht.Interface.Contacts().RemoveContact(parts[1]) {
+					fmt.Println("Contacts: Removed " + parts[1])
+				}
+			}
+		} else if len(body) > 8 && body[0:8] == "/whisper" {
+			parts := strings.SplitN(body, " ", 3)
+			if len(parts) == 3 && unlockIdentity(cli, oht) {
+				if oht.Interface.Contacts().WhisperToContact(parts[1], parts[2]) {
+					fmt.Println("Whisper: Sent to " + parts[1])
+				}
+			}
+		} else if len(body) > 7 && body[0:7] == "/avatar" {
+			parts := strings.SplitN(body, " ", 2)
+			if len(parts) == 2 {
+				if err := oht.Interface.SetAvatar(parts[1]); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Profile: Avatar set.")
+				}
+			}
+		} else if len(body) > 7 && body[0:7] == "/safety" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if safetyNumber := oht.Interface.Contacts().SafetyNumber(parts[1]); safetyNumber != "" {
+					fmt.Println("Contacts: Safety number with " + parts[1] + ": " + safetyNumber)
+				}
+			}
+		} else if len(body) > 6 && body[0:6] == "/trust" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				safetyNumber := oht.Interface.Contacts().SafetyNumber(parts[1])
+				if safetyNumber != "" {
+					fmt.Println("Contacts: Safety number with " + parts[1] + ": " + safetyNumber)
+					fmt.Printf("Does it match the number shown to them? [y/N]: ")
+					cli.Scan()
+					if strings.ToLower(strings.TrimSpace(cli.Text())) == "y" && oht.Interface.Contacts().VerifyContact(parts[1]) {
+						fmt.Println("Contacts: Verified " + parts[1] + ", publish it with /vouch " + parts[1])
+					}
+				}
+			}
+		} else if len(body) > 6 && body[0:6] == "/vouch" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if oht.Interface.Contacts().VouchForContact(parts[1]) {
+					fmt.Println("Contacts: Vouched for " + parts[1])
+				}
+			}
+		} else if len(body) > 8 && body[0:8] == "/untrust" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if oht.Interface.Contacts().UnverifyContact(parts[1]) {
+					fmt.Println("Contacts: " + parts[1] + " is no longer verified")
+				}
+			}
+			//
+			// RECOVERY
+		} else if len(body) > 7 && body[0:7] == "/backup" {
+			parts := strings.Split(body, " ")
+			if len(parts) >= 4 && unlockIdentity(cli, oht) {
+				threshold, _ := strconv.Atoi(parts[1])
+				if oht.Interface.Contacts().BackupAccount(threshold, parts[2:]) {
+					fmt.Printf("Recovery: Gave %d contacts a share, %d of them recover the account.\n", len(parts[2:]), threshold)
+				}
+			}
+		} else if body == "/recovery" {
+			recovery := oht.Interface.Contacts().ListRecovery()
+			if len(recovery) == 0 {
+				fmt.Println("Recovery: None.")
+			}
+			for _, line := range recovery {
+				fmt.Println(line)
+			}
+		} else if len(body) > 8 && body[0:8] == "/release" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if oht.Interface.Contacts().ReleaseShare(parts[1]) {
+					fmt.Println("Recovery: Returned share of " + parts[1])
+				}
+			}
+		} else if len(body) > 8 && body[0:8] == "/recover" {
+			parts := strings.Split(body, " ")
+			if len(parts) >= 2 {
+				fmt.Printf("Message to contacts: ")
+				cli.Scan()
+				if oht.Interface.Contacts().RecoverAccount(parts[1], parts[2:], cli.Text()) {
+					fmt.Println("Recovery: Asked contacts for their shares, restore the account with /restore " + parts[1] + " once enough returned.")
+				}
+			}
+		} else if len(body) > 8 && body[0:8] == "/restore" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 {
+				if err := oht.Interface.RestoreAccount(parts[1], readPassphrase(cli)); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Recovery: Restored " + parts[1])
+				}
+			}
+		} else if len(body) > 7 && body[0:7] == "/revoke" {
+			parts := strings.SplitN(body, " ", 3)
+			if len(parts) >= 2 {
+				reason := ""
+				if len(parts) == 3 {
+					reason = parts[2]
+				}
+				if err := oht.Interface.RevokeAccount(parts[1], readPassphrase(cli), reason); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Revocation: Published revocation of " + parts[1])
+				}
+			}
+		} else if len(body) > 7 && body[0:7] == "/rotate" {
+			parts := strings.SplitN(body, " ", 4)
+			if len(parts) >= 3 {
+				reason := ""
+				if len(parts) == 4 {
+					reason = parts[3]
+				}
+				passphrase := readPassphrase(cli)
+				fmt.Printf("New account ")
+				if err := oht.Interface.RotateAccount(parts[1], passphrase, parts[2], readPassphrase(cli), reason); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Revocation: Published rotation of " + parts[1] + " to " + parts[2])
+				}
+			}
+			//
+			// CHANNELS
+		} else if body == "/channels" {
+			channels := oht.Interface.Channels().ListChannels()
+			if len(channels) == 0 {
+				fmt.Println("Channels: None.")
+			}
+			for _, channel := range channels {
+				fmt.Println(channel)
+			}
+		} else if len(body) > 10 && body[0:10] == "/channels " {
+			channelId := strings.TrimSpace(body[10:])
+			for _, member := range oht.Interface.Channels().ChannelMembers(channelId) {
+				fmt.Println(member)
+			}
+			for _, message := range oht.Interface.Channels().ChannelHistory(channelId) {
+				fmt.Println(message)
+			}
+		} else if len(body) > 12 && body[0:12] == "/channelcast" {
+			parts := strings.SplitN(body, " ", 3)
+			if len(parts) == 3 && unlockIdentity(cli, oht) {
+				oht.Interface.Channels().ChannelCast(parts[1], parts[2])
+			}
+		} else if len(body) >= 8 && body[0:8] == "/channel" {
+			parts := strings.SplitN(body, " ", 2)
+			if unlockIdentity(cli, oht) {
+				name := ""
+				if len(parts) == 2 {
+					name = parts[1]
+				}
+				if invite, ok := oht.Interface.Channels().Channel(name); ok {
+					fmt.Println("Channels: Created, others join with /join " + invite)
+				}
+			}
+		} else if len(body) > 5 && body[0:5] == "/join" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if oht.Interface.Channels().JoinChannel(parts[1]) {
+					fmt.Println("Channels: Joined " + strings.SplitN(parts[1], "#", 2)[0])
+				}
+			}
+		} else if len(body) > 6 && body[0:6] == "/leave" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 2 && unlockIdentity(cli, oht) {
+				if oht.Interface.Channels().LeaveChannel(parts[1]) {
+					fmt.Println("Channels: Left " + parts[1])
+				}
+			}
+		} else if len(body) > 4 && body[0:4] == "/geo" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 4 && unlockIdentity(cli, oht) {
+				latitude, latitudeErr := strconv.ParseFloat(parts[1], 64)
+				longitude, longitudeErr := strconv.ParseFloat(parts[2], 64)
+				precision, precisionErr := strconv.Atoi(parts[3])
+				if latitudeErr != nil || longitudeErr != nil || precisionErr != nil {
+					fmt.Println("Channels: Location must be a latitude, longitude and precision.")
+				} else if area, ok := oht.Interface.Channels().JoinArea(latitude, longitude, precision); ok {
+					fmt.Println("Channels: Joined area geo:" + area)
+				}
+			}
+		} else if len(body) >= 7 && body[0:7] == "/nearby" {
+			areas := oht.Interface.Channels().NearbyAreas(strings.TrimSpace(body[7:]))
+			if len(areas) == 0 {
+				fmt.Println("Channels: No areas known yet, peers are asked for more.")
+			}
+			for _, area := range areas {
+				fmt.Println(area)
+			}
+		} else if len(body) > 5 && body[0:5] == "/kick" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 && unlockIdentity(cli, oht) {
+				if oht.Interface.Channels().KickFromChannel(parts[1], parts[2]) {
+					fmt.Println("Channels: Kicked " + parts[2] + " from " + parts[1])
+				}
+			}
+		} else if len(body) > 4 && body[0:4] == "/ban" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 && unlockIdentity(cli, oht) {
+				if oht.Interface.Channels().BanFromChannel(parts[1], parts[2]) {
+					fmt.Println("Channels: Banned " + parts[2] + " from " + parts[1])
+				}
+			}
+		} else if len(body) > 5 && body[0:5] == "/role" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 4 && unlockIdentity(cli, oht) {
+				if oht.Interface.Channels().SetChannelRole(parts[1], parts[2], parts[3]) {
+					fmt.Println("Channels: " + parts[2] + " is now " + parts[3] + " in " + parts[1])
+				}
+			}
+		} else if len(body) > 6 && body[0:6] == "/erase" {
+			parts := strings.Split(body, " ")
+			if len(parts) == 3 && unlockIdentity(cli, oht) {
+				if oht.Interface.Channels().DeleteChannelMessage(parts[1], parts[2]) {
+					fmt.Println("Channels: Deleted message " + parts[2])
+				}
+			}
 			//
 			// WEBUI
 		} else if len(body) > 6 && body[0:6] == "/webui" {
@@ -212,3 +798,57 @@ func main() {
 		fmt.Printf(prompt)
 	}
 }
+
+// readPassphrase reads the account passphrase from the next console line,
+// without echoing it when stdin is a terminal.
+func readPassphrase(cli *bufio.Scanner) string {
+	return readSecret(cli, "Passphrase: ")
+}
+
+// readSecret prompts for a line that is not echoed when reading from a
+// terminal.
+func readSecret(cli *bufio.Scanner, prompt string) string {
+	fmt.Print(prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err == nil {
+			return string(secret)
+		}
+	}
+	cli.Scan()
+	return cli.Text()
+}
+
+// unlockIdentity asks for the account contacts are made as the first time
+// one is needed, identities bound to an account only ask for its
+// passphrase.
+func unlockIdentity(cli *bufio.Scanner, oht *oht.OHT) bool {
+	if oht.Interface.IdentityUnlocked() {
+		return true
+	}
+	account := oht.Interface.IdentityAccount()
+	if account == "" {
+		fmt.Printf("Account: ")
+		cli.Scan()
+		account = cli.Text()
+	}
+	if err := oht.Interface.UnlockIdentity(account, readPassphrase(cli)); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// unlockAccount asks for the passphrase of an account when it is not
+// unlocked already, it stays unlocked for a few minutes.
+func unlockAccount(cli *bufio.Scanner, oht *oht.OHT, accountId string) bool {
+	if oht.Interface.Accounts().AccountUnlocked(accountId) {
+		return true
+	}
+	if err := oht.Interface.Accounts().UnlockAccount(accountId, readPassphrase(cli)); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
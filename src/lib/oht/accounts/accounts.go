@@ -1,18 +1,16 @@
 package accounts
 
-import oht "github.com/multiverse-os/oht/src/lib/oht/core"
+import "github.com/multiverse-os/libs/oht/core/crypto"
 
 type Accounts struct {
-	oht       *oht.OHT
 	manager   *Manager
 	Interface *Interface
 }
 
-func InitializeAccounts(oht *oht.OHT) *Accounts {
-	am := NewManager(oht.Interface.GenerateEncryptedKeyStore())
+func InitializeAccounts(keyStore crypto.KeyStore) *Accounts {
+	am := NewManager(keyStore)
 	return &Accounts{
-		oht:       oht,
 		manager:   am,
-		Interface: &Interface{Manager: am},
+		Interface: NewInterface(am),
 	}
 }
@@ -0,0 +1,365 @@
+// Package agent keeps unlocked account keys in a separate process that
+// signs and decrypts for clients on a Unix socket, like ssh-agent does for
+// ssh keys. The passphrase is entered once when a key is added, after that
+// oht-console and the node use the key through the agent until its policy
+// drops it. Keys never leave the agent once added.
+package agent
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+// SocketEnv names the environment variable holding the agent's socket,
+// oht-agent prints it on start like ssh-agent prints SSH_AUTH_SOCK.
+const SocketEnv = "OHT_AGENT_SOCK"
+
+const (
+	addRequestType       = "add"
+	removeRequestType    = "remove"
+	removeAllRequestType = "remove_all"
+	listRequestType      = "list"
+	signRequestType      = "sign"
+	decryptRequestType   = "decrypt"
+	publicKeyRequestType = "public_key"
+)
+
+// requestTimeout bounds a whole request, confirmations included.
+const requestTimeout = 2 * time.Minute
+
+var (
+	ErrNotHeld       = errors.New("Agent: The agent does not hold a key for that account")
+	ErrDenied        = errors.New("Agent: Use of the key was not confirmed")
+	ErrInvalidKey    = errors.New("Agent: Invalid private key")
+	ErrUnknownType   = errors.New("Agent: Unknown request type")
+	ErrNotListening  = errors.New("Agent: No agent is listening on the socket")
+	errAgentOnline   = errors.New("Agent: Agent is already online")
+	errSocketInUse   = errors.New("Agent: Another agent is listening on the socket")
+	errInvalidSocket = errors.New("Agent: Socket path is empty")
+)
+
+// knownErrors maps the errors a client can act on back from their message.
+var knownErrors = map[string]error{
+	ErrNotHeld.Error():     ErrNotHeld,
+	ErrDenied.Error():      ErrDenied,
+	ErrInvalidKey.Error():  ErrInvalidKey,
+	ErrUnknownType.Error(): ErrUnknownType,
+}
+
+// DefaultSocket is the socket named by SocketEnv, or agent.sock in a
+// directory only the user can enter under dataDirectory.
+func DefaultSocket(dataDirectory string) string {
+	if socket := os.Getenv(SocketEnv); socket != "" {
+		return socket
+	}
+	return filepath.Join(dataDirectory, "agent", "agent.sock")
+}
+
+// Policy limits how a key added to the agent is used.
+type Policy struct {
+	// Confirm asks the agent's user before every signature or decryption.
+	Confirm bool `json:"confirm"`
+	// Timeout drops the key after it passed, zero keeps it until removed.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// Use is what the agent's user is asked to confirm.
+type Use struct {
+	Address   common.Address
+	Operation string
+}
+
+func (u Use) String() string {
+	return fmt.Sprintf("%s with %s", u.Operation, u.Address.Hex())
+}
+
+// KeyInfo describes a key the agent holds.
+type KeyInfo struct {
+	Address common.Address `json:"address"`
+	Policy  Policy         `json:"policy"`
+	Expires int64          `json:"expires,omitempty"`
+}
+
+type request struct {
+	Type    string         `json:"type"`
+	Address common.Address `json:"address"`
+	Key     []byte         `json:"key,omitempty"`
+	Data    []byte         `json:"data,omitempty"`
+	Policy  Policy         `json:"policy"`
+}
+
+type response struct {
+	Error string    `json:"error,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+	Keys  []KeyInfo `json:"keys,omitempty"`
+}
+
+type heldKey struct {
+	privateKey *ecdsa.PrivateKey
+	policy     Policy
+	expires    time.Time
+	timer      *time.Timer
+}
+
+// Agent holds unlocked keys and uses them for clients of its socket.
+// Confirm is asked before every use of a key added with Policy.Confirm, a
+// nil Confirm denies them all.
+type Agent struct {
+	Online  bool
+	Socket  string
+	Confirm func(use Use) bool
+	keys    map[common.Address]*heldKey
+	// confirming serializes confirmations so the user is asked one at a time
+	confirming sync.Mutex
+	listener   net.Listener
+	mutex      sync.Mutex
+}
+
+func InitializeAgent(socket string) *Agent {
+	return &Agent{
+		Online: false,
+		Socket: socket,
+		keys:   make(map[common.Address]*heldKey),
+	}
+}
+
+// Start listens on the socket, which only the user running the agent can
+// connect to. A socket left behind by an agent that exited is replaced.
+func (agent *Agent) Start() error {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if agent.Online {
+		return errAgentOnline
+	}
+	if agent.Socket == "" {
+		return errInvalidSocket
+	}
+	if err := os.MkdirAll(filepath.Dir(agent.Socket), 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(agent.Socket); err == nil {
+		if conn, err := net.Dial("unix", agent.Socket); err == nil {
+			conn.Close()
+			return errSocketInUse
+		}
+		os.Remove(agent.Socket)
+	}
+	listener, err := net.Listen("unix", agent.Socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(agent.Socket, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	agent.listener = listener
+	agent.Online = true
+	go agent.serve(listener)
+	return nil
+}
+
+// Stop closes the socket and forgets every key.
+func (agent *Agent) Stop() bool {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if agent.Online {
+		agent.listener.Close()
+		agent.Online = false
+	}
+	agent.removeAll()
+	return !agent.Online
+}
+
+func (agent *Agent) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go agent.handle(conn)
+	}
+}
+
+func (agent *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	r := &request{}
+	if err := json.NewDecoder(conn).Decode(r); err != nil {
+		return
+	}
+	result, err := agent.dispatch(r)
+	if err != nil {
+		result = &response{Error: err.Error()}
+	}
+	json.NewEncoder(conn).Encode(result)
+}
+
+func (agent *Agent) dispatch(r *request) (*response, error) {
+	switch r.Type {
+	case addRequestType:
+		return &response{}, agent.add(r.Key, r.Policy)
+	case removeRequestType:
+		return &response{}, agent.remove(r.Address)
+	case removeAllRequestType:
+		agent.mutex.Lock()
+		agent.removeAll()
+		agent.mutex.Unlock()
+		return &response{}, nil
+	case listRequestType:
+		return &response{Keys: agent.list()}, nil
+	case publicKeyRequestType:
+		privateKey, err := agent.key(r.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &response{Data: crypto.FromECDSAPub(&privateKey.PublicKey)}, nil
+	case signRequestType:
+		privateKey, err := agent.use(Use{Address: r.Address, Operation: "Sign " + common.Bytes2Hex(r.Data)})
+		if err != nil {
+			return nil, err
+		}
+		defer zeroKey(privateKey)
+		signature, err := crypto.Sign(r.Data, privateKey)
+		return &response{Data: signature}, err
+	case decryptRequestType:
+		privateKey, err := agent.use(Use{Address: r.Address, Operation: "Decrypt"})
+		if err != nil {
+			return nil, err
+		}
+		defer zeroKey(privateKey)
+		plaintext, err := crypto.Decrypt(privateKey, r.Data)
+		return &response{Data: plaintext}, err
+	}
+	return nil, ErrUnknownType
+}
+
+// add holds a key under a policy, adding a key again replaces its policy.
+func (agent *Agent) add(d []byte, policy Policy) error {
+	privateKey := crypto.ToECDSA(d)
+	if privateKey == nil || privateKey.D.Sign() == 0 || privateKey.D.Cmp(crypto.S256().Params().N) >= 0 {
+		return ErrInvalidKey
+	}
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+	held := &heldKey{privateKey: privateKey, policy: policy}
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	agent.drop(address)
+	if policy.Timeout > 0 {
+		held.expires = time.Now().Add(policy.Timeout)
+		held.timer = time.AfterFunc(policy.Timeout, func() {
+			agent.mutex.Lock()
+			defer agent.mutex.Unlock()
+			// only drop the key this timer was started for, it may have
+			// been added again since
+			if agent.keys[address] == held {
+				agent.drop(address)
+			}
+		})
+	}
+	agent.keys[address] = held
+	return nil
+}
+
+func (agent *Agent) remove(address common.Address) error {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if _, ok := agent.keys[address]; !ok {
+		return ErrNotHeld
+	}
+	agent.drop(address)
+	return nil
+}
+
+func (agent *Agent) removeAll() {
+	for address := range agent.keys {
+		agent.drop(address)
+	}
+}
+
+// drop zeroes a held key and forgets it, the mutex is held by the caller.
+func (agent *Agent) drop(address common.Address) {
+	held, ok := agent.keys[address]
+	if !ok {
+		return
+	}
+	if held.timer != nil {
+		held.timer.Stop()
+	}
+	zeroKey(held.privateKey)
+	delete(agent.keys, address)
+}
+
+func (agent *Agent) list() (keys []KeyInfo) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	for address, held := range agent.keys {
+		info := KeyInfo{Address: address, Policy: held.policy}
+		if !held.expires.IsZero() {
+			info.Expires = held.expires.Unix()
+		}
+		keys = append(keys, info)
+	}
+	return keys
+}
+
+func (agent *Agent) key(address common.Address) (*ecdsa.PrivateKey, error) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	held, ok := agent.keys[address]
+	if !ok {
+		return nil, ErrNotHeld
+	}
+	return held.privateKey, nil
+}
+
+// use returns a held key once its policy allows the use. The key is copied
+// so removing it while it is in use does not zero it under the caller.
+func (agent *Agent) use(use Use) (*ecdsa.PrivateKey, error) {
+	agent.mutex.Lock()
+	held, ok := agent.keys[use.Address]
+	var privateKey *ecdsa.PrivateKey
+	if ok {
+		privateKey = crypto.ToECDSA(crypto.FromECDSA(held.privateKey))
+	}
+	agent.mutex.Unlock()
+	if !ok {
+		return nil, ErrNotHeld
+	}
+	if held.policy.Confirm {
+		agent.confirming.Lock()
+		confirmed := agent.Confirm != nil && agent.Confirm(use)
+		agent.confirming.Unlock()
+		if !confirmed {
+			zeroKey(privateKey)
+			return nil, ErrDenied
+		}
+		// the key may have expired or been removed while the user decided
+		if _, err := agent.key(use.Address); err != nil {
+			zeroKey(privateKey)
+			return nil, err
+		}
+	}
+	return privateKey, nil
+}
+
+// zeroKey zeroes a private key in memory.
+func zeroKey(k *ecdsa.PrivateKey) {
+	b := k.D.Bits()
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+func newTestAgent(t *testing.T) (*Agent, *Client, func()) {
+	directory, err := ioutil.TempDir("", "oht-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := InitializeAgent(filepath.Join(directory, "agent", "agent.sock"))
+	if err := agent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return agent, NewClient(agent.Socket), func() {
+		agent.Stop()
+		os.RemoveAll(directory)
+	}
+}
+
+func TestAgentSignsWithHeldKeys(t *testing.T) {
+	agent, client, cleanup := newTestAgent(t)
+	defer cleanup()
+	if info, err := os.Stat(agent.Socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the socket to be private, got %v %v", info.Mode(), err)
+	}
+	if err := InitializeAgent(agent.Socket).Start(); err != errSocketInUse {
+		t.Errorf("expected %v starting a second agent, got %v", errSocketInUse, err)
+	}
+	privateKey, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+	hash := crypto.Sha3([]byte("message"))
+	if _, err := client.Sign(address, hash); err != ErrNotHeld {
+		t.Errorf("expected %v, got %v", ErrNotHeld, err)
+	}
+	if err := client.Add(privateKey, Policy{}); err != nil {
+		t.Fatal(err)
+	}
+	if !client.Has(address) {
+		t.Error("expected the agent to hold the key")
+	}
+	signature, err := client.Sign(address, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKey, err := crypto.SigToPub(hash, signature); err != nil || crypto.PubkeyToAddress(*publicKey) != address {
+		t.Errorf("expected a signature by %s", address.Hex())
+	}
+	ciphertext, _ := crypto.Encrypt(&privateKey.PublicKey, []byte("secret"))
+	if plaintext, err := client.Decrypt(address, ciphertext); err != nil || string(plaintext) != "secret" {
+		t.Errorf("expected the plaintext, got %q %v", plaintext, err)
+	}
+	if err := client.Remove(address); err != nil || client.Has(address) {
+		t.Errorf("expected the key to be removed, %v", err)
+	}
+	if err := NewClient(filepath.Join(filepath.Dir(agent.Socket), "missing.sock")).Add(privateKey, Policy{}); err != ErrNotListening {
+		t.Errorf("expected %v, got %v", ErrNotListening, err)
+	}
+}
+
+func TestAgentPolicy(t *testing.T) {
+	agent, client, cleanup := newTestAgent(t)
+	defer cleanup()
+	confirm := false
+	var asked []Use
+	agent.Confirm = func(use Use) bool {
+		asked = append(asked, use)
+		return confirm
+	}
+	privateKey, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+	hash := crypto.Sha3([]byte("message"))
+	client.Add(privateKey, Policy{Confirm: true})
+	if _, err := client.Sign(address, hash); err != ErrDenied {
+		t.Errorf("expected %v, got %v", ErrDenied, err)
+	}
+	confirm = true
+	if _, err := client.Sign(address, hash); err != nil {
+		t.Error(err)
+	}
+	if len(asked) != 2 || asked[0].Address != address {
+		t.Errorf("expected to be asked for every use, got %v", asked)
+	}
+
+	client.Add(privateKey, Policy{Timeout: 50 * time.Millisecond})
+	keys, _ := client.List()
+	if len(keys) != 1 || keys[0].Expires == 0 || keys[0].Policy.Confirm {
+		t.Errorf("expected the policy to be replaced, got %+v", keys)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if client.Has(address) {
+		t.Error("expected the key to be dropped after its timeout")
+	}
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+// Client talks to the agent listening on Socket, every call is its own
+// connection so a client outlives agents being restarted.
+type Client struct {
+	Socket string
+}
+
+func NewClient(socket string) *Client {
+	return &Client{Socket: socket}
+}
+
+func (client *Client) call(r request) (*response, error) {
+	conn, err := net.DialTimeout("unix", client.Socket, 5*time.Second)
+	if err != nil {
+		return nil, ErrNotListening
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	if err := json.NewEncoder(conn).Encode(r); err != nil {
+		return nil, err
+	}
+	result := &response{}
+	if err := json.NewDecoder(conn).Decode(result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		if err, ok := knownErrors[result.Error]; ok {
+			return nil, err
+		}
+		return nil, errors.New(result.Error)
+	}
+	return result, nil
+}
+
+// Add hands an unlocked key to the agent, it is used under policy until
+// removed or its timeout passes.
+func (client *Client) Add(privateKey *ecdsa.PrivateKey, policy Policy) error {
+	_, err := client.call(request{Type: addRequestType, Key: crypto.FromECDSA(privateKey), Policy: policy})
+	return err
+}
+
+func (client *Client) Remove(address common.Address) error {
+	_, err := client.call(request{Type: removeRequestType, Address: address})
+	return err
+}
+
+// RemoveAll makes the agent forget every key it holds.
+func (client *Client) RemoveAll() error {
+	_, err := client.call(request{Type: removeAllRequestType})
+	return err
+}
+
+func (client *Client) List() ([]KeyInfo, error) {
+	result, err := client.call(request{Type: listRequestType})
+	if err != nil {
+		return nil, err
+	}
+	return result.Keys, nil
+}
+
+// Has reports whether an agent is listening and holds a key for address.
+func (client *Client) Has(address common.Address) bool {
+	keys, err := client.List()
+	if err != nil {
+		return false
+	}
+	for _, key := range keys {
+		if key.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (client *Client) PublicKey(address common.Address) (*ecdsa.PublicKey, error) {
+	result, err := client.call(request{Type: publicKeyRequestType, Address: address})
+	if err != nil {
+		return nil, err
+	}
+	publicKey := crypto.ToECDSAPub(result.Data)
+	if publicKey == nil || publicKey.X == nil {
+		return nil, ErrInvalidKey
+	}
+	return publicKey, nil
+}
+
+// Sign signs a hash with a held key, blocking while the agent's user is
+// asked to confirm it.
+func (client *Client) Sign(address common.Address, hash []byte) ([]byte, error) {
+	result, err := client.call(request{Type: signRequestType, Address: address, Data: hash})
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+// Decrypt opens an ECIES ciphertext with a held key.
+func (client *Client) Decrypt(address common.Address, ciphertext []byte) ([]byte, error) {
+	result, err := client.call(request{Type: decryptRequestType, Address: address, Data: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
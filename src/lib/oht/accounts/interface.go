@@ -1,6 +1,33 @@
 package accounts
 
-import ()
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/accounts/agent"
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+// UnlockTimeout is how long an account stays unlocked after its passphrase
+// was entered.
+const UnlockTimeout = 5 * time.Minute
+
+var (
+	ErrInvalidAccount   = errors.New("Accounts: Account ids are an address or an index from the account list")
+	ErrUnknownAccount   = errors.New("Accounts: No account with that id in the key store")
+	ErrInvalidHex       = errors.New("Accounts: Signatures and encrypted messages are hex encoded")
+	ErrInvalidSignature = errors.New("Accounts: Signature was not made by the account")
+)
+
+var (
+	addressPattern = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{40}$`)
+	hexPattern     = regexp.MustCompile(`^[0-9a-fA-F]*$`)
+)
 
 type Interface struct {
 	Manager *Manager
@@ -14,31 +41,296 @@ func NewInterface(am *Manager) (i *Interface) {
 
 func (i *Interface) AccountManager() *Manager { return i.Manager }
 
+// messageHash is what account signatures cover, prefixed so a signed
+// console message can not be passed off as a signed record.
+func messageHash(message string) []byte {
+	return crypto.Sha3([]byte("oht-signed-message"), []byte(message))
+}
+
+// address parses an account id, either an address or the index shown by
+// ListAccounts.
+func (i *Interface) address(accountId string) (common.Address, error) {
+	if addressPattern.MatchString(accountId) {
+		return common.HexToAddress(accountId), nil
+	}
+	index, err := strconv.Atoi(accountId)
+	if err != nil {
+		return common.Address{}, ErrInvalidAccount
+	}
+	address, err := i.Manager.AddressByIndex(index)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return common.HexToAddress(address), nil
+}
+
+// account resolves an account id to an account in the key store.
+func (i *Interface) account(accountId string) (Account, error) {
+	address, err := i.address(accountId)
+	if err != nil {
+		return Account{}, err
+	}
+	if !i.Manager.HasAccount(address) {
+		return Account{}, ErrUnknownAccount
+	}
+	return Account{Address: address}, nil
+}
+
 // ACCOUNT
 func (i *Interface) ListAccounts() (accounts []string) {
-	return
+	list, err := i.Manager.Accounts()
+	if err != nil {
+		return nil
+	}
+	held := make(map[common.Address]bool)
+	if i.Manager.agent != nil {
+		keys, _ := i.Manager.agent.List()
+		for _, key := range keys {
+			held[key.Address] = true
+		}
+	}
+	for index, account := range list {
+		status := "locked"
+		if i.Manager.unlockedKey(account.Address) != nil {
+			status = "unlocked"
+		} else if held[account.Address] {
+			status = "in agent"
+		}
+		// Keystore v3 files have no metadata until they are unlocked once
+		description := "keystore v3"
+		if metadata, err := i.Manager.Metadata(account.Address); err == nil && metadata.Purpose != "" {
+			description = metadata.Purpose
+			if metadata.Label != "" {
+				description += fmt.Sprintf(" %q", metadata.Label)
+			}
+		}
+		accounts = append(accounts, fmt.Sprintf("[%d] %s %s (%s)", index, account.Address.Hex(), description, status))
+	}
+	return accounts
+}
+
+// GenerateAccount creates an account, derived from the seed phrase when
+// there is one so the phrase restores it.
+func (i *Interface) GenerateAccount(passphrase string) (account string, err error) {
+	var generated Account
+	if i.Manager.HasSeed() {
+		generated, err = i.Manager.NewSeedAccount(passphrase)
+	} else {
+		generated, err = i.Manager.NewAccount(passphrase)
+	}
+	if err != nil {
+		return "", err
+	}
+	return generated.Address.Hex(), nil
+}
+
+// GenerateAccountOfAlgorithm creates an account with an ed25519 key, which
+// signs, or an x25519 key, which encrypts. Neither is derived from the seed
+// phrase.
+func (i *Interface) GenerateAccountOfAlgorithm(algorithm, passphrase string) (account string, err error) {
+	if algorithm == "" || algorithm == crypto.AlgorithmSecp256k1 {
+		return i.GenerateAccount(passphrase)
+	}
+	generated, err := i.Manager.NewAccountOfAlgorithm(algorithm, passphrase)
+	if err != nil {
+		return "", err
+	}
+	return generated.Address.Hex(), nil
+}
+
+// SEED PHRASE
+// GenerateSeed creates the seed phrase accounts are derived from and its
+// first account.
+func (i *Interface) GenerateSeed(passphrase string) (phrase, account string, err error) {
+	phrase, generated, err := i.Manager.NewSeed(passphrase)
+	if err != nil {
+		return "", "", err
+	}
+	return phrase, generated.Address.Hex(), nil
+}
+
+// ImportSeed restores the first count accounts of a seed phrase.
+func (i *Interface) ImportSeed(phrase, passphrase string, count int) (accounts []string, err error) {
+	restored, err := i.Manager.ImportSeed(phrase, passphrase, count)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range restored {
+		accounts = append(accounts, account.Address.Hex())
+	}
+	return accounts, nil
+}
+
+func (i *Interface) ExportSeed(passphrase string) (phrase string, err error) {
+	return i.Manager.ExportSeed(passphrase)
+}
+
+// DeleteAccount removes an account from the key store, the passphrase is
+// required to confirm it.
+func (i *Interface) DeleteAccount(accountId, passphrase string) error {
+	account, err := i.account(accountId)
+	if err != nil {
+		return err
+	}
+	return i.Manager.DeleteAccount(account.Address, passphrase)
 }
 
-func (i *Interface) GenerateAccount() (account string) {
-	return
+// LabelAccount names an account in its key file, the passphrase is
+// required since the key file is rewritten.
+func (i *Interface) LabelAccount(accountId, passphrase, label string) error {
+	account, err := i.account(accountId)
+	if err != nil {
+		return err
+	}
+	return i.Manager.Label(account.Address, passphrase, label)
+}
+
+// UnlockAccount keeps the key of an account in memory for UnlockTimeout, it
+// is needed to sign, encrypt and decrypt.
+func (i *Interface) UnlockAccount(accountId, passphrase string) error {
+	account, err := i.account(accountId)
+	if err != nil {
+		return err
+	}
+	return i.Manager.TimedUnlock(account.Address, passphrase, UnlockTimeout)
 }
 
-func (i *Interface) DeleteAccount(accountId string) (successful bool) {
-	return
+func (i *Interface) LockAccount(accountId string) error {
+	account, err := i.account(accountId)
+	if err != nil {
+		return err
+	}
+	i.Manager.Lock(account.Address)
+	return nil
 }
 
-func (i *Interface) Sign(accountId string) (signature string) {
-	return
+func (i *Interface) AccountUnlocked(accountId string) bool {
+	account, err := i.account(accountId)
+	return err == nil && i.Manager.IsUnlocked(account.Address)
 }
 
-func (i *Interface) Verify(accountId string, signature string) (successful bool) {
-	return
+// AGENT
+// AgentKeys lists the accounts the key agent holds and their policy.
+func (i *Interface) AgentKeys() (keys []string, err error) {
+	if i.Manager.agent == nil {
+		return nil, agent.ErrNotListening
+	}
+	held, err := i.Manager.agent.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(held, func(a, b int) bool { return held[a].Address.Hex() < held[b].Address.Hex() })
+	for _, key := range held {
+		policy := "until removed"
+		if key.Expires != 0 {
+			policy = "until " + time.Unix(key.Expires, 0).Format(time.RFC822)
+		}
+		if key.Policy.Confirm {
+			policy += ", confirming every use"
+		}
+		keys = append(keys, fmt.Sprintf("%s (%s)", key.Address.Hex(), policy))
+	}
+	return keys, nil
 }
 
-func (i *Interface) Encrypt(accountId string, data string) (encryptedData string) {
-	return
+// AddToAgent hands the key of an account to the key agent, which uses it
+// for timeout, or until removed when zero, asking before each use when
+// confirm is set.
+func (i *Interface) AddToAgent(accountId, passphrase string, timeout time.Duration, confirm bool) error {
+	account, err := i.account(accountId)
+	if err != nil {
+		return err
+	}
+	return i.Manager.AddToAgent(account.Address, passphrase, agent.Policy{Confirm: confirm, Timeout: timeout})
 }
 
-func (i *Interface) Decrypt(accountId string, encryptedData string) (data string) {
-	return
+func (i *Interface) RemoveFromAgent(accountId string) error {
+	if i.Manager.agent == nil {
+		return agent.ErrNotListening
+	}
+	address, err := i.address(accountId)
+	if err != nil {
+		return err
+	}
+	return i.Manager.agent.Remove(address)
+}
+
+// LockAgent makes the key agent forget every key it holds.
+func (i *Interface) LockAgent() error {
+	if i.Manager.agent == nil {
+		return agent.ErrNotListening
+	}
+	return i.Manager.agent.RemoveAll()
+}
+
+// Sign signs a message with an unlocked account, returning the hex encoded
+// signature.
+func (i *Interface) Sign(accountId string, message string) (signature string, err error) {
+	account, err := i.account(accountId)
+	if err != nil {
+		return "", err
+	}
+	signed, err := i.Manager.Sign(account, messageHash(message))
+	if err != nil {
+		return "", err
+	}
+	return common.Bytes2Hex(signed), nil
+}
+
+// Verify checks a signature of message was made by an account, which does
+// not have to be in the key store.
+func (i *Interface) Verify(accountId string, message string, signature string) error {
+	address, err := i.address(accountId)
+	if err != nil {
+		return err
+	}
+	signed, err := decodeHex(signature)
+	if err != nil {
+		return err
+	}
+	signer, err := crypto.SignatureAddress(messageHash(message), signed)
+	if err != nil || signer != address {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Encrypt encrypts data to an unlocked account, returning the hex encoded
+// ciphertext.
+func (i *Interface) Encrypt(accountId string, data string) (encryptedData string, err error) {
+	account, err := i.account(accountId)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := i.Manager.Encrypt(account, []byte(data))
+	if err != nil {
+		return "", err
+	}
+	return common.Bytes2Hex(ciphertext), nil
+}
+
+func (i *Interface) Decrypt(accountId string, encryptedData string) (data string, err error) {
+	account, err := i.account(accountId)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := decodeHex(encryptedData)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := i.Manager.Decrypt(account, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func decodeHex(value string) ([]byte, error) {
+	if len(value) > 1 && value[0:2] == "0x" {
+		value = value[2:]
+	}
+	if len(value)%2 != 0 || !hexPattern.MatchString(value) {
+		return nil, ErrInvalidHex
+	}
+	return common.Hex2Bytes(value), nil
 }
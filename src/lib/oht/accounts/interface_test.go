@@ -0,0 +1,162 @@
+package accounts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/accounts/agent"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+func TestAccountInterface(t *testing.T) {
+	directory, err := ioutil.TempDir("", "oht-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	i := InitializeAccounts(crypto.NewKeyStorePassphrase(directory, crypto.KDFLight)).Interface
+
+	account, err := i.GenerateAccount("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accounts := i.ListAccounts(); len(accounts) != 1 {
+		t.Fatalf("expected one account, got %v", accounts)
+	}
+	if err := i.LabelAccount(account, "secret", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if accounts := i.ListAccounts(); len(accounts) != 1 || !strings.Contains(accounts[0], `account "laptop" (locked)`) {
+		t.Errorf("expected the labeled account to be listed once, got %v", accounts)
+	}
+	if _, err := i.Sign("0", "hello"); err != ErrLocked {
+		t.Errorf("expected %v signing with a locked account, got %v", ErrLocked, err)
+	}
+	if err := i.UnlockAccount(account, "wrong"); err == nil {
+		t.Error("expected a wrong passphrase not to unlock")
+	}
+	if err := i.UnlockAccount("0", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := i.Sign(account, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Verify(account, "hello", signature); err != nil {
+		t.Error(err)
+	}
+	if err := i.Verify(account, "goodbye", signature); err != ErrInvalidSignature {
+		t.Errorf("expected %v for another message, got %v", ErrInvalidSignature, err)
+	}
+
+	encrypted, err := i.Encrypt(account, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := i.Decrypt(account, encrypted); err != nil || decrypted != "hello" {
+		t.Errorf("expected hello, got %q %v", decrypted, err)
+	}
+
+	i.LockAccount(account)
+	if _, err := i.Decrypt(account, encrypted); err != ErrLocked {
+		t.Errorf("expected %v decrypting with a locked account, got %v", ErrLocked, err)
+	}
+	if err := i.DeleteAccount(account, "wrong"); err == nil {
+		t.Error("expected a wrong passphrase not to delete the account")
+	}
+	if err := i.DeleteAccount(account, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Sign(account, "hello"); err != ErrUnknownAccount {
+		t.Errorf("expected %v after deleting, got %v", ErrUnknownAccount, err)
+	}
+}
+
+func TestAccountThroughAgent(t *testing.T) {
+	directory, err := ioutil.TempDir("", "oht-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	keyAgent := agent.InitializeAgent(filepath.Join(directory, "agent", "agent.sock"))
+	if err := keyAgent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer keyAgent.Stop()
+	i := InitializeAccounts(crypto.NewKeyStorePassphrase(directory, crypto.KDFLight)).Interface
+	i.Manager.SetAgent(agent.NewClient(keyAgent.Socket))
+
+	account, err := i.GenerateAccount("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.AddToAgent(account, "wrong", 0, false); err == nil {
+		t.Error("expected a wrong passphrase not to add the key")
+	}
+	if err := i.AddToAgent(account, "secret", time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	if !i.AccountUnlocked(account) || !strings.HasSuffix(i.ListAccounts()[0], "(in agent)") {
+		t.Errorf("expected the account to be usable through the agent, got %v", i.ListAccounts())
+	}
+	signature, err := i.Sign(account, "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Verify(account, "message", signature); err != nil {
+		t.Error(err)
+	}
+	if err := i.LockAgent(); err != nil || i.AccountUnlocked(account) {
+		t.Errorf("expected the agent to forget the key, %v", err)
+	}
+	if _, err := i.Sign(account, "message"); err != ErrLocked {
+		t.Errorf("expected %v, got %v", ErrLocked, err)
+	}
+}
+
+func TestAccountAlgorithms(t *testing.T) {
+	directory, err := ioutil.TempDir("", "oht-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	i := InitializeAccounts(crypto.NewKeyStorePassphrase(directory, crypto.KDFLight)).Interface
+
+	signing, err := i.GenerateAccountOfAlgorithm(crypto.AlgorithmEd25519, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.UnlockAccount(signing, "secret")
+	signature, err := i.Sign(signing, "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Verify(signing, "message", signature); err != nil {
+		t.Error(err)
+	}
+	if _, err := i.Encrypt(signing, "message"); err != crypto.ErrCannotEncrypt {
+		t.Errorf("expected %v, got %v", crypto.ErrCannotEncrypt, err)
+	}
+
+	encrypting, err := i.GenerateAccountOfAlgorithm(crypto.AlgorithmX25519, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.UnlockAccount(encrypting, "secret")
+	encrypted, err := i.Encrypt(encrypting, "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := i.Decrypt(encrypting, encrypted); err != nil || decrypted != "message" {
+		t.Errorf("expected the message, got %q %v", decrypted, err)
+	}
+	i.LockAccount(encrypting)
+	if _, err := i.GenerateAccountOfAlgorithm("rsa", "secret"); err != crypto.ErrUnknownAlgorithm {
+		t.Errorf("expected %v, got %v", crypto.ErrUnknownAlgorithm, err)
+	}
+}
@@ -15,13 +15,17 @@ import (
 	"sync"
 	"time"
 
-	"github.com/multiverse-os/libs/oht/common"
-	"github.com/multiverse-os/libs/oht/crypto"
+	"github.com/multiverse-os/libs/oht/accounts/agent"
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
 )
 
 var (
 	ErrLocked = errors.New("Accounts: Account is locked")
 	ErrNoKeys = errors.New("Accounts: No keys in store")
+	// ErrAlgorithm is returned using ed25519 and x25519 keys where only
+	// secp256k1 keys work.
+	ErrAlgorithm = errors.New("Accounts: Not possible with keys of this algorithm")
 )
 
 type Account struct {
@@ -29,9 +33,13 @@ type Account struct {
 }
 
 type Manager struct {
-	keyStore crypto.KeyStore
-	unlocked map[common.Address]*unlocked
-	mutex    sync.RWMutex
+	keyStore   crypto.KeyStore
+	unlocked   map[common.Address]*unlocked
+	mutex      sync.RWMutex
+	seedPath   string
+	seedKDF    string
+	seedSafety int
+	agent      *agent.Client
 }
 
 type unlocked struct {
@@ -57,18 +65,121 @@ func (am *Manager) HasAccount(addr common.Address) bool {
 }
 
 func (am *Manager) DeleteAccount(address common.Address, auth string) error {
-	return am.keyStore.DeleteKey(address, auth)
+	if err := am.keyStore.DeleteKey(address, auth); err != nil {
+		return err
+	}
+	am.Lock(address)
+	return nil
 }
 
-func (am *Manager) Sign(a Account, toSign []byte) (signature []byte, err error) {
+// SetAgent makes accounts the key agent holds usable as if unlocked here.
+func (am *Manager) SetAgent(client *agent.Client) {
+	am.agent = client
+}
+
+func (am *Manager) Agent() *agent.Client {
+	return am.agent
+}
+
+// unlockedKey returns the key of an account unlocked in this process, nil
+// when it is locked or only held by the agent.
+func (am *Manager) unlockedKey(addr common.Address) *crypto.Key {
 	am.mutex.RLock()
 	defer am.mutex.RUnlock()
-	unlockedKey, found := am.unlocked[a.Address]
-	if !found {
-		return nil, ErrLocked
+	if u, found := am.unlocked[addr]; found {
+		return u.Key
+	}
+	return nil
+}
+
+// inAgent reports whether the agent holds the key of a locked account.
+func (am *Manager) inAgent(addr common.Address) bool {
+	return am.agent != nil && am.agent.Has(addr)
+}
+
+func (am *Manager) Sign(a Account, toSign []byte) (signature []byte, err error) {
+	if key := am.unlockedKey(a.Address); key != nil {
+		return key.Sign(toSign)
+	}
+	if am.inAgent(a.Address) {
+		return am.agent.Sign(a.Address, toSign)
+	}
+	return nil, ErrLocked
+}
+
+// Encrypt encrypts a message to an unlocked account, with ECIES or to an
+// x25519 account as a sealed box.
+func (am *Manager) Encrypt(a Account, message []byte) (ciphertext []byte, err error) {
+	if key := am.unlockedKey(a.Address); key != nil {
+		return key.Encrypt(message)
+	}
+	publicKey, err := am.PublicKey(a)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Encrypt(publicKey, message)
+}
+
+// Decrypt opens a message encrypted to an unlocked account.
+func (am *Manager) Decrypt(a Account, ciphertext []byte) (plaintext []byte, err error) {
+	if key := am.unlockedKey(a.Address); key != nil {
+		return key.Decrypt(ciphertext)
+	}
+	if am.inAgent(a.Address) {
+		return am.agent.Decrypt(a.Address, ciphertext)
+	}
+	return nil, ErrLocked
+}
+
+// PublicKey returns the public key of an unlocked secp256k1 account, the
+// key store only keeps the address of locked ones in the clear.
+func (am *Manager) PublicKey(a Account) (*ecdsa.PublicKey, error) {
+	if key := am.unlockedKey(a.Address); key != nil {
+		if key.PrivateKey == nil {
+			return nil, ErrAlgorithm
+		}
+		return &key.PrivateKey.PublicKey, nil
+	}
+	if am.inAgent(a.Address) {
+		return am.agent.PublicKey(a.Address)
+	}
+	return nil, ErrLocked
+}
+
+// IsUnlocked reports whether the account can be used, unlocked here or
+// held by the agent.
+func (am *Manager) IsUnlocked(addr common.Address) bool {
+	return am.unlockedKey(addr) != nil || am.inAgent(addr)
+}
+
+// Lock drops the key of an unlocked account from memory.
+func (am *Manager) Lock(addr common.Address) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if u, found := am.unlocked[addr]; found {
+		if u.abort != nil {
+			close(u.abort)
+		}
+		u.Zero()
+		delete(am.unlocked, addr)
 	}
-	signature, err = crypto.Sign(toSign, unlockedKey.PrivateKey)
-	return signature, err
+}
+
+// AddToAgent decrypts the key of an account and hands it to the agent
+// under policy, the key is not kept in this process.
+func (am *Manager) AddToAgent(addr common.Address, keyAuth string, policy agent.Policy) error {
+	if am.agent == nil {
+		return agent.ErrNotListening
+	}
+	key, err := am.keyStore.GetKey(addr, keyAuth)
+	if err != nil {
+		return err
+	}
+	defer key.Zero()
+	if key.PrivateKey == nil {
+		return ErrAlgorithm
+	}
+	return am.agent.Add(key.PrivateKey, policy)
 }
 
 // Unlock unlocks the given account indefinitely.
@@ -121,7 +232,7 @@ func (am *Manager) expire(addr common.Address, u *unlocked, timeout time.Duratio
 		// because the map stores a new pointer every time the key is
 		// unlocked.
 		if am.unlocked[addr] == u {
-			zeroKey(u.PrivateKey)
+			u.Zero()
 			delete(am.unlocked, addr)
 		}
 		am.mutex.Unlock()
@@ -136,6 +247,19 @@ func (am *Manager) NewAccount(auth string) (Account, error) {
 	return Account{Address: key.Address}, nil
 }
 
+// NewAccountOfAlgorithm generates an account with a key of algorithm, one
+// of the crypto.Algorithm constants.
+func (am *Manager) NewAccountOfAlgorithm(algorithm, auth string) (Account, error) {
+	key, err := crypto.NewKeyOfAlgorithm(algorithm, crand.Reader)
+	if err != nil {
+		return Account{}, err
+	}
+	if err = am.keyStore.StoreKey(key, auth); err != nil {
+		return Account{}, err
+	}
+	return Account{Address: key.Address}, nil
+}
+
 func (am *Manager) AddressByIndex(index int) (addr string, err error) {
 	var addrs []common.Address
 	addrs, err = am.keyStore.GetKeyAddresses()
@@ -166,14 +290,6 @@ func (am *Manager) Accounts() ([]Account, error) {
 	return accounts, err
 }
 
-// zeroKey zeroes a private key in memory.
-func zeroKey(k *ecdsa.PrivateKey) {
-	b := k.D.Bits()
-	for i := range b {
-		b[i] = 0
-	}
-}
-
 // USE WITH CAUTION = this will save an unencrypted private key on disk
 // no cli or js interface
 func (am *Manager) Export(path string, addr common.Address, keyAuth string) error {
@@ -181,6 +297,9 @@ func (am *Manager) Export(path string, addr common.Address, keyAuth string) erro
 	if err != nil {
 		return err
 	}
+	if key.PrivateKey == nil {
+		return ErrAlgorithm
+	}
 	return crypto.SaveECDSA(path, key.PrivateKey)
 }
 
@@ -196,6 +315,38 @@ func (am *Manager) Import(path string, keyAuth string) (Account, error) {
 	return Account{Address: key.Address}, nil
 }
 
+// ImportKey stores a private key recovered some other way under auth.
+func (am *Manager) ImportKey(privateKey *ecdsa.PrivateKey, auth string) (Account, error) {
+	key := crypto.NewKeyFromECDSA(privateKey)
+	if am.HasAccount(key.Address) {
+		return Account{Address: key.Address}, nil
+	}
+	if err := am.keyStore.StoreKey(key, auth); err != nil {
+		return Account{}, err
+	}
+	return Account{Address: key.Address}, nil
+}
+
+// Metadata reads the metadata of an account's key file without unlocking
+// it.
+func (am *Manager) Metadata(addr common.Address) (crypto.KeyMetadata, error) {
+	return am.keyStore.GetKeyMetadata(addr)
+}
+
+// Label rewrites the key file of an account with a new label.
+func (am *Manager) Label(addr common.Address, auth, label string) error {
+	key, err := am.keyStore.GetKey(addr, auth)
+	if err != nil {
+		return err
+	}
+	defer key.Zero()
+	key.Metadata.Label = label
+	if err := am.keyStore.StoreKey(key, auth); err != nil {
+		return err
+	}
+	return am.keyStore.Cleanup(addr)
+}
+
 func (am *Manager) Update(addr common.Address, authFrom, authTo string) (err error) {
 	var key *crypto.Key
 	key, err = am.keyStore.GetKey(addr, authFrom)
@@ -0,0 +1,172 @@
+package accounts
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/crypto/mnemonic"
+)
+
+const seedVersion = 1
+
+var (
+	ErrNoSeed       = errors.New("Accounts: No seed phrase, generate or import one first")
+	ErrSeedExists   = errors.New("Accounts: A different seed phrase exists already")
+	ErrSeedAccounts = errors.New("Accounts: Restore at least one account")
+)
+
+// seedJSON is the seed phrase encrypted like a key file. Accounts counts the
+// accounts derived so far, the next one is derived at that index.
+type seedJSON struct {
+	Crypto   json.RawMessage `json:"crypto"`
+	Accounts int             `json:"accounts"`
+	Version  int             `json:"version"`
+}
+
+// SetSeedFile sets where the encrypted seed phrase is kept, the key
+// derivation function its passphrase is stretched with and how hard, one of
+// crypto.KDFStandard or crypto.KDFLight.
+func (am *Manager) SetSeedFile(path, kdf string, safety int) {
+	am.seedPath, am.seedKDF, am.seedSafety = path, kdf, safety
+}
+
+func (am *Manager) HasSeed() bool {
+	return am.seedPath != "" && common.FileExist(am.seedPath)
+}
+
+func (am *Manager) readSeed() (*seedJSON, error) {
+	file, err := ioutil.ReadFile(am.seedPath)
+	if os.IsNotExist(err) || am.seedPath == "" {
+		return nil, ErrNoSeed
+	} else if err != nil {
+		return nil, err
+	}
+	seed := &seedJSON{}
+	return seed, json.Unmarshal(file, seed)
+}
+
+func (am *Manager) writeSeed(phrase, auth string, accounts int) error {
+	sealed, err := crypto.EncryptData([]byte(mnemonic.Normalize(phrase)), auth, am.seedKDF, am.seedSafety)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(seedJSON{Crypto: sealed, Accounts: accounts, Version: seedVersion})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(am.seedPath, data, 0600)
+}
+
+// phrase decrypts the seed phrase, auth is the passphrase it was stored
+// with.
+func (am *Manager) phrase(auth string) (string, *seedJSON, error) {
+	seed, err := am.readSeed()
+	if err != nil {
+		return "", nil, err
+	}
+	phrase, err := crypto.DecryptData(seed.Crypto, auth)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(phrase), seed, nil
+}
+
+// storeSeedAccount derives the account at index and stores it under auth
+// unless the key store has it already.
+func (am *Manager) storeSeedAccount(phrase string, index int, auth string) (Account, error) {
+	privateKey, err := mnemonic.AccountKey(mnemonic.Seed(phrase, ""), index)
+	if err != nil {
+		return Account{}, err
+	}
+	key := crypto.NewKeyFromECDSA(privateKey)
+	if !am.HasAccount(key.Address) {
+		if err = am.keyStore.StoreKey(key, auth); err != nil {
+			return Account{}, err
+		}
+	}
+	return Account{Address: key.Address}, nil
+}
+
+// NewSeed generates a seed phrase and derives the first account from it,
+// both stored under auth. The phrase is returned once to be written down.
+func (am *Manager) NewSeed(auth string) (string, Account, error) {
+	if am.HasSeed() {
+		return "", Account{}, ErrSeedExists
+	}
+	entropy, err := mnemonic.NewEntropy(mnemonic.DefaultEntropyBits)
+	if err != nil {
+		return "", Account{}, err
+	}
+	phrase, err := mnemonic.NewMnemonic(entropy)
+	if err != nil {
+		return "", Account{}, err
+	}
+	account, err := am.storeSeedAccount(phrase, 0, auth)
+	if err != nil {
+		return "", Account{}, err
+	}
+	return phrase, account, am.writeSeed(phrase, auth, 1)
+}
+
+// ImportSeed restores the first count accounts of a seed phrase and keeps
+// the phrase so later accounts are derived from it too.
+func (am *Manager) ImportSeed(phrase, auth string, count int) ([]Account, error) {
+	if count < 1 {
+		return nil, ErrSeedAccounts
+	}
+	if _, err := mnemonic.Entropy(phrase); err != nil {
+		return nil, err
+	}
+	if seed, err := am.readSeed(); err == nil {
+		existing, err := crypto.DecryptData(seed.Crypto, auth)
+		if err != nil || string(existing) != mnemonic.Normalize(phrase) {
+			return nil, ErrSeedExists
+		}
+		if seed.Accounts > count {
+			count = seed.Accounts
+		}
+	}
+	accounts := make([]Account, count)
+	for index := range accounts {
+		account, err := am.storeSeedAccount(phrase, index, auth)
+		if err != nil {
+			return nil, err
+		}
+		accounts[index] = account
+	}
+	return accounts, am.writeSeed(phrase, auth, count)
+}
+
+// ExportSeed returns the seed phrase, which restores every account derived
+// from it.
+func (am *Manager) ExportSeed(auth string) (string, error) {
+	phrase, _, err := am.phrase(auth)
+	return phrase, err
+}
+
+// NewSeedAccount derives the next account from the seed phrase.
+func (am *Manager) NewSeedAccount(auth string) (Account, error) {
+	phrase, seed, err := am.phrase(auth)
+	if err != nil {
+		return Account{}, err
+	}
+	account, err := am.storeSeedAccount(phrase, seed.Accounts, auth)
+	if err != nil {
+		return Account{}, err
+	}
+	return account, am.writeSeed(phrase, auth, (seed.Accounts + 1))
+}
+
+// NodeKey derives the node key from the seed phrase.
+func (am *Manager) NodeKey(auth string) (*ecdsa.PrivateKey, error) {
+	phrase, _, err := am.phrase(auth)
+	if err != nil {
+		return nil, err
+	}
+	return mnemonic.NodeKey(mnemonic.Seed(phrase, ""))
+}
@@ -0,0 +1,67 @@
+package accounts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+func newSeedInterface(t *testing.T) (*Interface, func()) {
+	directory, err := ioutil.TempDir("", "oht-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := InitializeAccounts(crypto.NewKeyStorePassphrase(directory, crypto.KDFLight))
+	accounts.Interface.Manager.SetSeedFile(filepath.Join(directory, "seed.json"), crypto.KDFArgon2id, crypto.KDFLight)
+	return accounts.Interface, func() { os.RemoveAll(directory) }
+}
+
+func TestSeedRestoresAccounts(t *testing.T) {
+	i, cleanup := newSeedInterface(t)
+	defer cleanup()
+	phrase, first, err := i.GenerateSeed("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := i.GenerateAccount("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := i.GenerateSeed("secret"); err != ErrSeedExists {
+		t.Errorf("expected %v, got %v", ErrSeedExists, err)
+	}
+	if _, err := i.ExportSeed("wrong"); err == nil {
+		t.Error("expected a wrong passphrase not to export the seed phrase")
+	}
+	if exported, err := i.ExportSeed("secret"); err != nil || exported != phrase {
+		t.Errorf("expected the seed phrase, got %q %v", exported, err)
+	}
+	if seed, err := i.Manager.readSeed(); err != nil || !strings.Contains(string(seed.Crypto), `"kdf":"argon2id"`) {
+		t.Errorf("expected the seed phrase sealed with argon2id, got %s %v", seed.Crypto, err)
+	}
+
+	// Another node restores both accounts from the phrase alone
+	restore, cleanupRestore := newSeedInterface(t)
+	defer cleanupRestore()
+	accounts, err := restore.ImportSeed(phrase, "other", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(accounts, []string{first, second}) {
+		t.Errorf("expected %v, got %v", []string{first, second}, accounts)
+	}
+	if err := restore.UnlockAccount(second, "other"); err != nil {
+		t.Error(err)
+	}
+	if third, _ := restore.GenerateAccount("other"); third == first || third == second {
+		t.Error("expected the next account to be derived at the next index")
+	}
+	if _, err := restore.ImportSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "other", 1); err != ErrSeedExists {
+		t.Errorf("expected %v importing another phrase, got %v", ErrSeedExists, err)
+	}
+}
@@ -1,13 +1,314 @@
 package channels
 
-import ()
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+const (
+	channelIdLength  = 16
+	channelKeyLength = 32
+)
+
+var (
+	ErrChannelNotFound = errors.New("Channels: No channel with that id")
+	ErrChannelJoined   = errors.New("Channels: Channel already joined")
+	ErrIdentityLocked  = errors.New("Channels: No account is unlocked for channels")
+	ErrInvalidInvite   = errors.New("Channels: Invites are a channel id and key joined by #, followed by :epoch once rekeyed")
+)
+
+// MessageFunc is called with every message received in a joined channel.
+type MessageFunc func(channel Channel, message Message)
+
+// Channel is a group chat. Messages are encrypted with the channel key, so
+// anyone with the key is able to read and post, and are gossiped through
+// every peer, members or not, until all have seen them. The key is replaced
+// whenever a member leaves or is removed, Epoch counts the replacements.
+type Channel struct {
+	Id     string
+	Name   string
+	Key    string
+	Epoch  uint64 `json:",omitempty"`
+	Joined int64
+	// Owner created the channel, its id is derived from the owner address
+	// and Salt. Both are learned from the members present when joining.
+	Owner string                     `json:",omitempty"`
+	Salt  string                     `json:",omitempty"`
+	Roles map[string]*RoleAssignment `json:",omitempty"`
+	// Geohash is set for the public channel of an area, GeoTag is the random
+	// tag we are listed under in the area's DHT records.
+	Geohash string `json:",omitempty"`
+	GeoTag  string `json:",omitempty"`
+	// Members are the accounts seen posting to the channel since we joined,
+	// keyed by address.
+	Members map[string]*Member `json:",omitempty"`
+	// PreviousKey is the key of the epoch before, Rekeyer sent the rekey of
+	// the current epoch removing RekeyRemoved. A competing rekey of the same
+	// epoch is read under PreviousKey, see rekeyPrecedes.
+	PreviousKey  string   `json:",omitempty"`
+	Rekeyer      string   `json:",omitempty"`
+	RekeyRemoved []string `json:",omitempty"`
+}
+
+type Member struct {
+	Id    string
+	Alias string
+	// PublicKey is recovered from the member's signatures, new keys are
+	// encrypted to it.
+	PublicKey string `json:",omitempty"`
+	LastSeen  int64
+}
+
+// Invite is what is shared with others so they can join the channel, the
+// channel id and current key followed by the epoch once it was rekeyed.
+func (channel *Channel) Invite() string {
+	if channel.Geohash != "" {
+		return geoInvitePrefix + channel.Geohash
+	}
+	if channel.Epoch == 0 {
+		return channel.Id + "#" + channel.Key
+	}
+	return channel.Id + "#" + channel.Key + ":" + strconv.FormatUint(channel.Epoch, 10)
+}
+
+// clone copies a channel so it can be handed out while the original changes.
+func (channel *Channel) clone() Channel {
+	clone := *channel
+	clone.Members = make(map[string]*Member, len(channel.Members))
+	for id, member := range channel.Members {
+		copied := *member
+		clone.Members[id] = &copied
+	}
+	if channel.Roles != nil {
+		clone.Roles = make(map[string]*RoleAssignment, len(channel.Roles))
+		for id, assignment := range channel.Roles {
+			clone.Roles[id] = assignment
+		}
+	}
+	return clone
+}
+
+func (channel *Channel) key() []byte {
+	return common.Hex2Bytes(channel.Key)
+}
 
 type Channels struct {
 	Interface *Interface
+	Alias     string
+	OnMessage MessageFunc
+	path      string
+	channels  map[string]*Channel
+	db        database.Database
+	manager   *p2p.Manager
+	identity  *crypto.Key
+	directory *dht.Store
+	seen      map[string]int64
+	mutex     sync.RWMutex
+}
+
+// InitializeChannels loads the joined channels from channels.json, history
+// is kept in db.
+func InitializeChannels(dataDirectory string, db database.Database, manager *p2p.Manager) (*Channels, error) {
+	c := &Channels{
+		path:      common.AbsolutePath(dataDirectory, "channels.json"),
+		channels:  make(map[string]*Channel),
+		db:        db,
+		manager:   manager,
+		OnMessage: printMessage,
+		seen:      make(map[string]int64),
+	}
+	c.Interface = NewInterface(c)
+	file, err := ioutil.ReadFile(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err = json.Unmarshal(file, &c.channels); err != nil {
+			return nil, err
+		}
+	}
+	if manager != nil {
+		manager.Handle(channelMessageType, c.handleMessage)
+	}
+	return c, c.save()
+}
+
+// save writes channels.json, the caller holds the lock. The file holds the
+// channel keys so it is only readable by the user.
+func (c *Channels) save() error {
+	file, err := json.MarshalIndent(c.channels, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, file, 0600)
+}
+
+func (c *Channels) SetIdentity(key *crypto.Key) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.identity = key
+}
+
+func (c *Channels) Identity() *crypto.Key {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.identity
+}
+
+// Create generates a channel with a random key, owned by our identity, and
+// joins it.
+func (c *Channels) Create(name string) (Channel, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return Channel{}, ErrIdentityLocked
+	}
+	salt := make([]byte, channelIdLength)
+	key := make([]byte, channelKeyLength)
+	if _, err := rand.Read(salt); err != nil {
+		return Channel{}, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return Channel{}, err
+	}
+	return c.join(&Channel{
+		Id:    channelId(identity.Address, salt),
+		Name:  name,
+		Key:   hex.EncodeToString(key),
+		Owner: identity.Address.Hex(),
+		Salt:  hex.EncodeToString(salt),
+	})
+}
+
+// Join joins the channel of an invite and announces us to its members.
+// Geolocal channels are joined with geo: followed by the area's geohash.
+func (c *Channels) Join(invite string) (Channel, error) {
+	if strings.HasPrefix(invite, geoInvitePrefix) {
+		return c.joinGeohash(strings.TrimPrefix(invite, geoInvitePrefix))
+	}
+	parts := strings.SplitN(invite, "#", 2)
+	if len(parts) != 2 {
+		return Channel{}, ErrInvalidInvite
+	}
+	var epoch uint64
+	key := strings.SplitN(parts[1], ":", 2)
+	if len(key) == 2 {
+		var err error
+		if epoch, err = strconv.ParseUint(key[1], 10, 64); err != nil {
+			return Channel{}, ErrInvalidInvite
+		}
+	}
+	if len(common.Hex2Bytes(parts[0])) != channelIdLength || len(common.Hex2Bytes(key[0])) != channelKeyLength {
+		return Channel{}, ErrInvalidInvite
+	}
+	return c.join(&Channel{Id: strings.ToLower(parts[0]), Key: strings.ToLower(key[0]), Epoch: epoch})
+}
+
+func (c *Channels) join(channel *Channel) (Channel, error) {
+	if c.Identity() == nil {
+		return Channel{}, ErrIdentityLocked
+	}
+	c.mutex.Lock()
+	if _, ok := c.channels[channel.Id]; ok {
+		c.mutex.Unlock()
+		return Channel{}, ErrChannelJoined
+	}
+	if channel.Name == "" {
+		channel.Name = channel.Id[:8]
+	}
+	channel.Joined = time.Now().Unix()
+	channel.Members = make(map[string]*Member)
+	c.channels[channel.Id] = channel
+	err := c.save()
+	joined := channel.clone()
+	c.mutex.Unlock()
+	if err != nil {
+		return Channel{}, err
+	}
+	return joined, c.cast(channel.Id, joinMessage, c.Alias)
+}
+
+// Leave announces that we left a channel, then forgets it and its history.
+func (c *Channels) Leave(channelId string) error {
+	channel, ok := c.Channel(channelId)
+	if !ok {
+		return ErrChannelNotFound
+	}
+	err := c.cast(channel.Id, leaveMessage, c.Alias)
+	c.mutex.Lock()
+	delete(c.channels, channel.Id)
+	if saveErr := c.save(); saveErr != nil {
+		err = saveErr
+	}
+	c.mutex.Unlock()
+	c.deleteHistory(channel.Id)
+	return err
+}
+
+// Channel finds a joined channel by id or name.
+func (c *Channels) Channel(channelId string) (Channel, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	channel := c.find(channelId)
+	if channel == nil {
+		return Channel{}, false
+	}
+	return channel.clone(), true
+}
+
+// find is Channel for callers holding the lock.
+func (c *Channels) find(channelId string) *Channel {
+	if channel, ok := c.channels[strings.ToLower(channelId)]; ok {
+		return channel
+	}
+	for _, channel := range c.channels {
+		if channel.Name == channelId {
+			return channel
+		}
+	}
+	return nil
+}
+
+func (c *Channels) List() (channels []Channel) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, channel := range c.channels {
+		channels = append(channels, channel.clone())
+	}
+	return channels
 }
 
-func InitializeChannels() *Channels {
-	return &Channels{
-		Interface: &Interface{},
+// printMessage is the default OnMessage, printing to the console.
+func printMessage(channel Channel, message Message) {
+	name := message.Alias
+	if name == "" {
+		name = message.From
+	}
+	switch message.Type {
+	case joinMessage:
+		notify(fmt.Sprintf("[ %s ] %s joined", channel.Name, name))
+	case leaveMessage:
+		notify(fmt.Sprintf("[ %s ] %s left", channel.Name, name))
+	default:
+		notify(fmt.Sprintf("[ %s ] [ %d ] %s : %s", channel.Name, message.Timestamp/1000, name, message.Body))
 	}
 }
+
+func notify(event string) {
+	fmt.Println("")
+	fmt.Println(event)
+	fmt.Printf("oht> ")
+}
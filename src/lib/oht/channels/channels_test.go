@@ -0,0 +1,446 @@
+package channels
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pborman/uuid"
+
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/database"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+func newTestChannels(t *testing.T, alias string) (*Channels, string) {
+	directory, err := ioutil.TempDir("", "oht-channels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := database.NewMemDatabase()
+	c, err := InitializeChannels(directory, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetIdentity(&crypto.Key{
+		Id:         uuid.NewRandom(),
+		Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+		PrivateKey: privateKey,
+	})
+	c.Alias = alias
+	return c, directory
+}
+
+// gossip passes a message sealed by from to the channels of to as if it was
+// received from a peer.
+func gossip(t *testing.T, from, to *Channels, channel Channel, messageType, body string) p2p.Message {
+	e, _, err := from.sealMessage(channel, messageType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := json.Marshal(e)
+	message := p2p.NewMessage(channelMessageType, string(value))
+	to.handleMessage(nil, message)
+	return message
+}
+
+func TestChannelMessages(t *testing.T) {
+	alice, aliceDirectory := newTestChannels(t, "alice")
+	defer os.RemoveAll(aliceDirectory)
+	bob, bobDirectory := newTestChannels(t, "bob")
+	defer os.RemoveAll(bobDirectory)
+	carol, carolDirectory := newTestChannels(t, "carol")
+	defer os.RemoveAll(carolDirectory)
+
+	channel, err := alice.Create("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Join(channel.Id); err != ErrInvalidInvite {
+		t.Errorf("expected %v joining without the key, got %v", ErrInvalidInvite, err)
+	}
+	if _, err := bob.Join(channel.Invite()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Join(channel.Invite()); err != ErrChannelJoined {
+		t.Errorf("expected %v, got %v", ErrChannelJoined, err)
+	}
+
+	var bodies []string
+	bob.OnMessage = func(channel Channel, message Message) {
+		if message.Type == textMessage {
+			bodies = append(bodies, message.From+": "+message.Body)
+		}
+	}
+	carol.OnMessage = func(channel Channel, message Message) {
+		t.Errorf("carol is not a member but received %+v", message)
+	}
+	gossip(t, alice, bob, channel, joinMessage, "alice")
+	message := gossip(t, alice, bob, channel, textMessage, "hello")
+	// The same message arriving through another peer is dropped
+	bob.handleMessage(nil, message)
+	gossip(t, alice, carol, channel, textMessage, "hello")
+
+	aliceId := alice.Identity().Address.Hex()
+	if !reflect.DeepEqual(bodies, []string{aliceId + ": hello"}) {
+		t.Errorf("expected one message from alice, got %v", bodies)
+	}
+	joined, _ := bob.Channel(channel.Id)
+	if member, ok := joined.Members[aliceId]; !ok || member.Alias != "alice" {
+		t.Errorf("expected alice to be a member, got %+v", joined.Members)
+	}
+
+	if err := bob.Cast(channel.Id, "hi alice"); err != nil {
+		t.Fatal(err)
+	}
+	history, err := bob.History(channel.Id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Body != "hello" || history[1].Body != "hi alice" {
+		t.Errorf("expected the history in order, got %+v", history)
+	}
+	if history, _ := bob.History(channel.Id, 1); len(history) != 1 || history[0].Body != "hi alice" {
+		t.Errorf("expected only the latest message, got %+v", history)
+	}
+
+	gossip(t, alice, bob, channel, leaveMessage, "alice")
+	if joined, _ := bob.Channel(channel.Id); len(joined.Members) != 0 {
+		t.Errorf("expected alice to have left, got %+v", joined.Members)
+	}
+	if err := bob.Leave(channel.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bob.Channel(channel.Id); ok || len(bob.historyKeys(channel.Id)) != 0 {
+		t.Error("expected the channel and its history to be forgotten")
+	}
+
+	// Joined channels and their keys survive a restart
+	reloaded, err := InitializeChannels(aliceDirectory, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := reloaded.Channel("friends"); !ok || found.Key != channel.Key {
+		t.Errorf("expected the channel to be persisted, got %+v", found)
+	}
+}
+
+func TestChannelMessageForged(t *testing.T) {
+	alice, aliceDirectory := newTestChannels(t, "alice")
+	defer os.RemoveAll(aliceDirectory)
+	channel, err := alice.Create("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, message, err := alice.sealMessage(channel, textMessage, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(&channel, e); err != nil {
+		t.Fatal(err)
+	}
+	message.Body = "goodbye"
+	plaintext, _ := json.Marshal(message)
+	e.Ciphertext, _ = seal(channel.key(), plaintext)
+	if _, err := open(&channel, e); err != errChannelSignature {
+		t.Errorf("expected %v, got %v", errChannelSignature, err)
+	}
+	other, _ := alice.Create("")
+	if _, err := open(&other, e); err != errChannelDecrypt {
+		t.Errorf("expected %v, got %v", errChannelDecrypt, err)
+	}
+}
+
+// testNetwork passes the messages channels gossip between them, as if each
+// was connected to all others.
+type testNetwork []*Channels
+
+func newTestNetwork(t *testing.T, aliases ...string) (network testNetwork, cleanup func()) {
+	var directories []string
+	for _, alias := range aliases {
+		c, directory := newTestChannels(t, alias)
+		c.manager = p2p.InitializeP2PManager(&p2p.P2PConfig{MaxQueueSize: 64})
+		c.manager.Handle(channelMessageType, c.handleMessage)
+		c.OnMessage = func(channel Channel, message Message) {}
+		network = append(network, c)
+		directories = append(directories, directory)
+	}
+	return network, func() {
+		for _, directory := range directories {
+			os.RemoveAll(directory)
+		}
+	}
+}
+
+// settle delivers gossip until no node has anything left to send.
+func (network testNetwork) settle() {
+	for sent := true; sent; {
+		sent = false
+		for _, from := range network {
+			for len(from.manager.Broadcast) > 0 {
+				message := <-from.manager.Broadcast
+				sent = true
+				for _, to := range network {
+					if to != from {
+						to.handleMessage(to.manager, message)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestChannelRekeyOnRemoval(t *testing.T) {
+	network, cleanup := newTestNetwork(t, "alice", "bob", "carol")
+	defer cleanup()
+	alice, bob, carol := network[0], network[1], network[2]
+	channel, err := alice.Create("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Join(channel.Invite())
+	network.settle()
+	carol.Join(channel.Invite())
+	network.settle()
+	if joined, _ := alice.Channel(channel.Id); len(joined.Members) != 2 {
+		t.Fatalf("expected alice to know both members, got %+v", joined.Members)
+	}
+	removed, _ := carol.Channel(channel.Id)
+
+	if err := alice.Kick(channel.Id, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	network.settle()
+	aliceChannel, _ := alice.Channel(channel.Id)
+	bobChannel, _ := bob.Channel(channel.Id)
+	if aliceChannel.Epoch != 1 || bobChannel.Epoch != 1 || aliceChannel.Key != bobChannel.Key || aliceChannel.Key == channel.Key {
+		t.Fatalf("expected alice and bob to share a new key, got %+v and %+v", aliceChannel, bobChannel)
+	}
+	if _, ok := carol.Channel(channel.Id); ok {
+		t.Error("expected carol to forget the channel")
+	}
+	if _, ok := bobChannel.Members[carol.Identity().Address.Hex()]; ok {
+		t.Error("expected carol to be removed from bob's members")
+	}
+
+	// Carol still sees the gossip but can not read it with the old key
+	if err := alice.Cast(channel.Id, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	message := <-alice.manager.Broadcast
+	e := &envelope{}
+	json.Unmarshal([]byte(message.Body), e)
+	if _, err := open(&removed, e); err != errChannelEpoch {
+		t.Errorf("expected %v, got %v", errChannelEpoch, err)
+	}
+	removed.Epoch = e.Epoch
+	if _, err := open(&removed, e); err != errChannelDecrypt {
+		t.Errorf("expected %v, got %v", errChannelDecrypt, err)
+	}
+	if received, err := open(&bobChannel, e); err != nil || received.Body != "secret" {
+		t.Errorf("expected bob to read the message, got %v", err)
+	}
+
+	// A member leaving rekeys the channel as well
+	if err := bob.Leave(channel.Id); err != nil {
+		t.Fatal(err)
+	}
+	network.settle()
+	if aliceChannel, _ := alice.Channel(channel.Id); aliceChannel.Epoch != 2 || len(aliceChannel.Members) != 0 {
+		t.Errorf("expected alice to rekey after bob left, got %+v", aliceChannel)
+	}
+}
+
+func TestChannelModeration(t *testing.T) {
+	network, cleanup := newTestNetwork(t, "alice", "bob", "carol")
+	defer cleanup()
+	alice, bob, carol := network[0], network[1], network[2]
+	channel, err := alice.Create("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Join(channel.Invite())
+	network.settle()
+	carol.Join(channel.Invite())
+	network.settle()
+	aliceId, carolId := alice.Identity().Address.Hex(), carol.Identity().Address.Hex()
+	if joined, _ := carol.Channel(channel.Id); joined.Owner != aliceId || joined.Role(aliceId) != RoleOwner {
+		t.Fatalf("expected carol to learn alice owns the channel, got %+v", joined)
+	}
+
+	if err := carol.Kick(channel.Id, "bob"); err != ErrNotPermitted {
+		t.Errorf("expected %v kicking as a member, got %v", ErrNotPermitted, err)
+	}
+	if err := bob.SetRole(channel.Id, "carol", RoleModerator); err != ErrNotPermitted {
+		t.Errorf("expected %v appointing as a member, got %v", ErrNotPermitted, err)
+	}
+	if err := alice.SetRole(channel.Id, "bob", RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	network.settle()
+	if joined, _ := carol.Channel(channel.Id); joined.Role(bob.Identity().Address.Hex()) != RoleModerator {
+		t.Errorf("expected bob to be a moderator for carol, got %+v", joined.Roles)
+	}
+
+	// Moderators delete the messages of members
+	carol.Cast(channel.Id, "spam")
+	network.settle()
+	history, _ := bob.History(channel.Id, 0)
+	if len(history) != 1 {
+		t.Fatalf("expected carol's message, got %+v", history)
+	}
+	if err := bob.Delete(channel.Id, history[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	network.settle()
+	for _, c := range network {
+		if history, _ := c.History(channel.Id, 0); len(history) != 0 {
+			t.Errorf("expected the message to be deleted everywhere, got %+v", history)
+		}
+	}
+
+	// Role assignments carol signs herself are not accepted
+	joined, _ := alice.Channel(channel.Id)
+	forged := &RoleAssignment{Channel: channel.Id, Member: carolId, Role: RoleModerator, Sequence: 1, Issuer: carolId}
+	forged.Signature, _ = crypto.Sign(forged.hash(), carol.Identity().PrivateKey)
+	body, _ := json.Marshal(forged)
+	if err := alice.permitted(&joined, &Message{Type: roleMessage, From: carolId, Body: string(body)}); err != ErrNotPermitted {
+		t.Errorf("expected %v, got %v", ErrNotPermitted, err)
+	}
+
+	if err := bob.Ban(channel.Id, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	network.settle()
+	if _, ok := carol.Channel(channel.Id); ok {
+		t.Error("expected carol to be removed")
+	}
+	joined, _ = alice.Channel(channel.Id)
+	if joined.Role(carolId) != RoleBanned || joined.Epoch != 1 {
+		t.Errorf("expected carol to be banned and the channel rekeyed, got %+v", joined)
+	}
+
+	// A new invite does not get carol back in, members drop her messages
+	carol.Join(joined.Invite())
+	network.settle()
+	if joined, _ := alice.Channel(channel.Id); joined.member(carolId) != nil {
+		t.Error("expected carol's join to be dropped")
+	}
+	if rejoined, _ := carol.Channel(channel.Id); rejoined.Owner != "" {
+		t.Error("expected no member to answer carol")
+	}
+}
+
+func TestChannelConcurrentRekeys(t *testing.T) {
+	network, cleanup := newTestNetwork(t, "one", "two", "three", "four")
+	defer cleanup()
+	// lowest rekeys after a member leaves, it races the owner kicking kicked
+	sort.Slice(network, func(i, j int) bool {
+		return strings.ToLower(network[i].Identity().Address.Hex()) < strings.ToLower(network[j].Identity().Address.Hex())
+	})
+	lowest, owner, kicked, leaving := network[0], network[1], network[2], network[3]
+	channel, err := owner.Create("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Channels{lowest, kicked, leaving} {
+		c.Join(channel.Invite())
+		network.settle()
+	}
+
+	if err := owner.Kick(channel.Id, kicked.Identity().Address.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaving.Leave(channel.Id); err != nil {
+		t.Fatal(err)
+	}
+	// The leave is gossiped first, so lowest rekeys the same epoch as the
+	// kick before receiving it
+	network = testNetwork{leaving, lowest, kicked, owner}
+	network.settle()
+	ownerChannel, _ := owner.Channel(channel.Id)
+	lowestChannel, _ := lowest.Channel(channel.Id)
+	if ownerChannel.Epoch != lowestChannel.Epoch || ownerChannel.Key != lowestChannel.Key {
+		t.Fatalf("expected the remaining members to settle on one key, got epoch %d and %d", ownerChannel.Epoch, lowestChannel.Epoch)
+	}
+	if ownerChannel.Epoch != 2 {
+		t.Errorf("expected the losing rekey to be issued again, got epoch %d", ownerChannel.Epoch)
+	}
+	if _, ok := kicked.Channel(channel.Id); ok {
+		t.Error("expected the kicked member to forget the channel")
+	}
+	for _, id := range []string{kicked.Identity().Address.Hex(), leaving.Identity().Address.Hex()} {
+		if ownerChannel.member(id) != nil || lowestChannel.member(id) != nil {
+			t.Errorf("expected %s to be removed everywhere", id)
+		}
+	}
+	if err := owner.Cast(channel.Id, "still here"); err != nil {
+		t.Fatal(err)
+	}
+	network.settle()
+	if history, _ := lowest.History(channel.Id, 0); len(history) != 1 {
+		t.Errorf("expected the message under the settled key, got %+v", history)
+	}
+
+	// A member the key can not be encrypted to fails the rekey
+	owner.mutex.Lock()
+	owner.channels[channel.Id].Members[lowest.Identity().Address.Hex()].PublicKey = ""
+	owner.mutex.Unlock()
+	if err := owner.rekey(channel.Id, nil); err == nil {
+		t.Error("expected the rekey to fail instead of leaving out a member")
+	}
+	if unchanged, _ := owner.Channel(channel.Id); unchanged.Epoch != 2 {
+		t.Errorf("expected the epoch to stay, got %d", unchanged.Epoch)
+	}
+}
+
+func TestChannelRekeyEvictionRefused(t *testing.T) {
+	network, cleanup := newTestNetwork(t, "alice", "bob", "carol")
+	defer cleanup()
+	alice, bob, carol := network[0], network[1], network[2]
+	channel, err := alice.Create("friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Join(channel.Invite())
+	network.settle()
+	carol.Join(channel.Invite())
+	network.settle()
+	aliceId, bobId, carolId := alice.Identity().Address.Hex(), bob.Identity().Address.Hex(), carol.Identity().Address.Hex()
+
+	rekeyFrom := func(from string, keys ...string) *Message {
+		r := &rekey{Epoch: 1, Keys: make(map[string][]byte)}
+		for _, id := range keys {
+			r.Keys[id] = []byte("key")
+		}
+		body, _ := json.Marshal(r)
+		return &Message{Type: rekeyMessage, From: from, Body: string(body)}
+	}
+	// Bob is a plain member, leaving carol out of the keys would evict her
+	for _, c := range []*Channels{alice, carol} {
+		joined, _ := c.Channel(channel.Id)
+		if err := c.permitted(&joined, rekeyFrom(bobId, aliceId)); err != ErrNotPermitted {
+			t.Errorf("%s: expected %v for a member's rekey leaving out carol, got %v", c.Alias, ErrNotPermitted, err)
+		}
+		if err := c.permitted(&joined, rekeyFrom(bobId, aliceId, carolId)); err != nil {
+			t.Errorf("%s: expected a member's rekey keeping everyone to be permitted, got %v", c.Alias, err)
+		}
+	}
+	joined, _ := carol.Channel(channel.Id)
+	if err := carol.permitted(&joined, rekeyFrom(aliceId, bobId)); err != nil {
+		t.Errorf("expected the owner to leave carol out, got %v", err)
+	}
+
+	gossip(t, bob, carol, joined, rekeyMessage, rekeyFrom(bobId, aliceId).Body)
+	if _, ok := carol.Channel(channel.Id); !ok {
+		t.Error("expected carol to stay in the channel")
+	}
+}
@@ -0,0 +1,151 @@
+package channels
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+const (
+	geoInvitePrefix = "geo:"
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	// geoRefresh is how often the area records of joined geolocal channels
+	// are renewed, well within their TTL.
+	geoRefresh = dht.MaxGeoTTL / 2
+)
+
+var (
+	ErrInvalidLocation  = errors.New("Channels: Latitude must be within -90 and 90, longitude within -180 and 180")
+	ErrInvalidPrecision = errors.New("Channels: Geohash precision must be between 1 and 6")
+	ErrInvalidGeohash   = errors.New("Channels: Geohashes are up to 6 base32 characters")
+)
+
+// Geohash encodes a location as a geohash of precision characters. It is
+// computed locally, only the geohash is used in channel ids and records.
+func Geohash(latitude, longitude float64, precision int) (string, error) {
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return "", ErrInvalidLocation
+	}
+	if precision < 1 || precision > dht.MaxGeohashPrecision {
+		return "", ErrInvalidPrecision
+	}
+	latitudeRange, longitudeRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	geohash := make([]byte, 0, precision)
+	even, bit, index := true, 0, 0
+	for len(geohash) < precision {
+		// Bits alternate between longitude and latitude, starting with
+		// longitude
+		value, bounds := latitude, &latitudeRange
+		if even {
+			value, bounds = longitude, &longitudeRange
+		}
+		middle := (bounds[0] + bounds[1]) / 2
+		index <<= 1
+		if value >= middle {
+			index |= 1
+			bounds[0] = middle
+		} else {
+			bounds[1] = middle
+		}
+		even = !even
+		if bit++; bit == 5 {
+			geohash = append(geohash, geohashAlphabet[index])
+			bit, index = 0, 0
+		}
+	}
+	return string(geohash), nil
+}
+
+// geoChannel is the public channel of an area. Its id and key follow from
+// the geohash, so every node in the area joins the same channel without an
+// invite. Geolocal channels have no owner and are never rekeyed.
+func geoChannel(geohash string) *Channel {
+	return &Channel{
+		Id:      common.Bytes2Hex(crypto.Sha3([]byte("oht-geo-channel"), []byte(geohash))[:channelIdLength]),
+		Name:    geoInvitePrefix + geohash,
+		Key:     common.Bytes2Hex(crypto.Sha3([]byte("oht-geo-channel-key"), []byte(geohash))),
+		Geohash: geohash,
+	}
+}
+
+// SetDirectory lists the geolocal channels we join in the DHT, so nodes
+// looking for activity nearby find them.
+func (c *Channels) SetDirectory(store *dht.Store) {
+	c.mutex.Lock()
+	c.directory = store
+	c.mutex.Unlock()
+	go c.announceAreas()
+}
+
+func (c *Channels) Directory() *dht.Store {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.directory
+}
+
+// JoinArea joins the public channel of the area around a location, at a
+// precision of up to dht.MaxGeohashPrecision characters.
+func (c *Channels) JoinArea(latitude, longitude float64, precision int) (Channel, error) {
+	geohash, err := Geohash(latitude, longitude, precision)
+	if err != nil {
+		return Channel{}, err
+	}
+	return c.joinGeohash(geohash)
+}
+
+func (c *Channels) joinGeohash(geohash string) (Channel, error) {
+	geohash = strings.ToLower(geohash)
+	if !dht.ValidGeohash(geohash) {
+		return Channel{}, ErrInvalidGeohash
+	}
+	tag := make([]byte, 16)
+	if _, err := rand.Read(tag); err != nil {
+		return Channel{}, err
+	}
+	channel := geoChannel(geohash)
+	channel.GeoTag = hex.EncodeToString(tag)
+	joined, err := c.join(channel)
+	if err != nil {
+		return joined, err
+	}
+	c.announceArea(joined)
+	return joined, nil
+}
+
+// Nearby counts the nodes present in each area within geohash, as far as
+// this node knows, and asks the connected peers for more.
+func (c *Channels) Nearby(geohash string) (map[string]int, error) {
+	geohash = strings.ToLower(geohash)
+	if geohash != "" && !dht.ValidGeohash(geohash) {
+		return nil, ErrInvalidGeohash
+	}
+	directory := c.Directory()
+	if directory == nil {
+		return map[string]int{}, nil
+	}
+	directory.SyncAreas(geohash)
+	return directory.Areas(geohash), nil
+}
+
+func (c *Channels) announceArea(channel Channel) {
+	if directory := c.Directory(); directory != nil && channel.Geohash != "" {
+		directory.AnnounceArea(channel.Geohash, channel.GeoTag, dht.MaxGeoTTL)
+	}
+}
+
+// announceAreas renews the area records of the joined geolocal channels
+// until they expire on their own after we leave.
+func (c *Channels) announceAreas() {
+	for {
+		for _, channel := range c.List() {
+			c.announceArea(channel)
+		}
+		time.Sleep(geoRefresh)
+	}
+}
@@ -0,0 +1,73 @@
+package channels
+
+import (
+	"testing"
+
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+func TestGeohash(t *testing.T) {
+	tests := []struct {
+		latitude, longitude float64
+		precision           int
+		geohash             string
+		err                 error
+	}{
+		{57.64911, 10.40744, 6, "u4pruy", nil},
+		{42.6, -5.6, 5, "ezs42", nil},
+		{-25.382708, -49.265506, 4, "6gkz", nil},
+		{57.64911, 10.40744, 7, "", ErrInvalidPrecision},
+		{91, 0, 3, "", ErrInvalidLocation},
+	}
+	for _, test := range tests {
+		geohash, err := Geohash(test.latitude, test.longitude, test.precision)
+		if geohash != test.geohash || err != test.err {
+			t.Errorf("Geohash(%v, %v, %d) = %q, %v, expected %q, %v", test.latitude, test.longitude, test.precision, geohash, err, test.geohash, test.err)
+		}
+	}
+}
+
+func TestGeolocalChannel(t *testing.T) {
+	network, cleanup := newTestNetwork(t, "alice", "bob")
+	defer cleanup()
+	alice, bob := network[0], network[1]
+	db, _ := database.NewMemDatabase()
+	store := dht.NewStore(db, nil)
+	store.RegisterValidator(dht.GeoNamespace, dht.GeoValidator{})
+	alice.directory = store
+
+	area, err := alice.JoinArea(57.64911, 10.40744, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if area.Invite() != "geo:u4pru" {
+		t.Errorf("expected the area to be invited to by geohash, got %s", area.Invite())
+	}
+	joined, err := bob.Join(area.Invite())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.Id != area.Id || joined.Key != area.Key || joined.GeoTag == area.GeoTag {
+		t.Errorf("expected the same channel under another tag, got %+v and %+v", joined, area)
+	}
+	network.settle()
+	if nearby, _ := bob.Nearby("u4"); len(nearby) != 0 {
+		t.Errorf("expected bob without a directory to know no areas, got %v", nearby)
+	}
+	if nearby, _ := alice.Nearby("u4"); nearby["u4pru"] != 1 {
+		t.Errorf("expected alice's area to be listed, got %v", nearby)
+	}
+
+	bob.Cast(area.Id, "hi neighbour")
+	network.settle()
+	if history, _ := alice.History(area.Id, 0); len(history) != 1 {
+		t.Errorf("expected alice to receive bob's message, got %+v", history)
+	}
+	// Leaving a public channel does not rekey it
+	bob.Leave(area.Id)
+	network.settle()
+	if area, _ := alice.Channel(area.Id); area.Epoch != 0 {
+		t.Errorf("expected the geolocal channel to keep its key, got epoch %d", area.Epoch)
+	}
+}
@@ -0,0 +1,343 @@
+package channels
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+const (
+	channelMessageType = "channel_message"
+	// maxHops bounds how far a message is gossiped from the member who
+	// posted it.
+	maxHops = 8
+	// seenTimeout is how long message ids are remembered to stop gossip
+	// loops, older messages are dropped instead of relayed.
+	seenTimeout = 10 * time.Minute
+)
+
+// Message types, join and leave announce membership changes, present
+// answers a join so the new member learns who is in the channel and their
+// roles. Role and delete messages are sent by moderators.
+const (
+	textMessage    = "message"
+	joinMessage    = "join"
+	presentMessage = "present"
+	leaveMessage   = "leave"
+	rekeyMessage   = "rekey"
+	roleMessage    = "role"
+	deleteMessage  = "delete"
+)
+
+var (
+	errChannelDecrypt   = errors.New("Channels: Failed to decrypt")
+	errChannelSignature = errors.New("Channels: Invalid message signature")
+	errChannelStale     = errors.New("Channels: Message is too old")
+	errChannelEpoch     = errors.New("Channels: Message is not encrypted with the current key")
+)
+
+// envelope is what is gossiped. Peers outside the channel only see the
+// topic, a hash of the channel id, and relay it without being able to read
+// it. Epoch is the key it is encrypted with.
+type envelope struct {
+	Id         string
+	Topic      string
+	Epoch      uint64
+	Hops       int
+	Ciphertext []byte
+}
+
+// Message is a message posted to a channel, signed by the member who posted
+// it.
+type Message struct {
+	Id        string
+	Channel   string
+	Type      string
+	From      string
+	Alias     string `json:",omitempty"`
+	Timestamp int64
+	Body      string
+	Signature []byte
+	// publicKey is recovered from the signature when a message is opened
+	publicKey []byte
+}
+
+func (message *Message) hash() []byte {
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(message.Timestamp))
+	return crypto.Sha3([]byte("oht-channel"), []byte(message.Id), []byte(message.Channel), []byte(message.Type), []byte(message.From), []byte(message.Alias), timestamp[:], []byte(message.Body))
+}
+
+func topic(channelId string) string {
+	return hex.EncodeToString(crypto.Sha3([]byte("oht-channel-topic"), []byte(channelId)))
+}
+
+// Cast posts a message to a joined channel.
+func (c *Channels) Cast(channelId, body string) error {
+	channel, ok := c.Channel(channelId)
+	if !ok {
+		return ErrChannelNotFound
+	}
+	return c.cast(channel.Id, textMessage, body)
+}
+
+func (c *Channels) cast(channelId, messageType, body string) error {
+	channel, ok := c.Channel(channelId)
+	if !ok {
+		return ErrChannelNotFound
+	}
+	e, message, err := c.sealMessage(channel, messageType, body)
+	if err != nil {
+		return err
+	}
+	c.markSeen(message.Id)
+	if messageType == textMessage {
+		if err := c.storeHistory(*message); err != nil {
+			return err
+		}
+	}
+	c.publish(p2p.Message{}, e)
+	return nil
+}
+
+// sealMessage signs a message with our identity and encrypts it with the
+// channel key.
+func (c *Channels) sealMessage(channel Channel, messageType, body string) (*envelope, *Message, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return nil, nil, ErrIdentityLocked
+	}
+	message := &Message{
+		Id:        uuid.New(),
+		Channel:   channel.Id,
+		Type:      messageType,
+		From:      identity.Address.Hex(),
+		Alias:     c.Alias,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Body:      body,
+	}
+	signature, err := crypto.Sign(message.hash(), identity.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	message.Signature = signature
+	plaintext, err := json.Marshal(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := seal(channel.key(), plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &envelope{Id: message.Id, Topic: topic(channel.Id), Epoch: channel.Epoch, Ciphertext: ciphertext}, message, nil
+}
+
+// publish gossips an envelope to every peer but the one it was received
+// from.
+func (c *Channels) publish(received p2p.Message, e *envelope) {
+	if c.manager == nil {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	message := p2p.NewMessage(channelMessageType, string(body))
+	message.From = received.From
+	c.manager.Relay(message)
+}
+
+func (c *Channels) handleMessage(manager *p2p.Manager, received p2p.Message) {
+	e := &envelope{}
+	if err := json.Unmarshal([]byte(received.Body), e); err != nil || e.Id == "" {
+		return
+	}
+	if !c.markSeen(e.Id) {
+		return
+	}
+	if channel := c.subscribed(e.Topic); channel != nil {
+		if message, err := open(channel, e); err == nil {
+			if c.permitted(channel, message) != nil {
+				return
+			}
+			c.deliver(message)
+		}
+	}
+	if e.Hops++; e.Hops < maxHops {
+		c.publish(received, e)
+	}
+}
+
+// subscribed returns the joined channel with topic.
+func (c *Channels) subscribed(channelTopic string) *Channel {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, channel := range c.channels {
+		if topic(channel.Id) == channelTopic {
+			joined := channel.clone()
+			return &joined
+		}
+	}
+	return nil
+}
+
+// open decrypts an envelope with the channel key and checks the signature
+// of the message inside. Under the key of the previous epoch only leaves and
+// rekeys competing with the one of the current epoch are read, those were
+// sent before their sender learned of the new key.
+func open(channel *Channel, e *envelope) (*Message, error) {
+	key := channel.key()
+	if e.Epoch+1 == channel.Epoch && channel.PreviousKey != "" {
+		key = common.Hex2Bytes(channel.PreviousKey)
+	} else if e.Epoch != channel.Epoch {
+		return nil, errChannelEpoch
+	}
+	plaintext, err := unseal(key, e.Ciphertext)
+	if err != nil {
+		return nil, errChannelDecrypt
+	}
+	message := &Message{}
+	if err := json.Unmarshal(plaintext, message); err != nil {
+		return nil, err
+	}
+	if message.Id != e.Id || message.Channel != channel.Id {
+		return nil, errChannelSignature
+	}
+	if e.Epoch != channel.Epoch && message.Type != rekeyMessage && message.Type != leaveMessage {
+		return nil, errChannelEpoch
+	}
+	// Messages are only remembered for seenTimeout, older ones could be
+	// replays
+	age := time.Now().UnixNano()/int64(time.Millisecond) - message.Timestamp
+	if age > int64(seenTimeout/time.Millisecond) || -age > int64(seenTimeout/time.Millisecond) {
+		return nil, errChannelStale
+	}
+	publicKey, err := crypto.SigToPub(message.hash(), message.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != common.HexToAddress(message.From) {
+		return nil, errChannelSignature
+	}
+	message.publicKey = crypto.FromECDSAPub(publicKey)
+	return message, nil
+}
+
+// deliver records the sender as a member and keeps text messages in the
+// channel history before passing the message on.
+func (c *Channels) deliver(message *Message) {
+	switch message.Type {
+	case rekeyMessage:
+		c.applyRekey(message)
+		return
+	case roleMessage, deleteMessage:
+		c.moderate(message)
+		return
+	}
+	c.mutex.Lock()
+	channel := c.channels[message.Channel]
+	if channel == nil {
+		c.mutex.Unlock()
+		return
+	}
+	if channel.Members == nil {
+		channel.Members = make(map[string]*Member)
+	}
+	if message.Type == presentMessage {
+		var m metadata
+		if json.Unmarshal([]byte(message.Body), &m) == nil {
+			channel.mergeMetadata(m)
+		}
+	}
+	if message.Type == leaveMessage {
+		delete(channel.Members, message.From)
+	} else {
+		channel.Members[message.From] = &Member{
+			Id:        message.From,
+			Alias:     message.Alias,
+			PublicKey: common.Bytes2Hex(message.publicKey),
+			LastSeen:  message.Timestamp / 1000,
+		}
+	}
+	c.save()
+	delivered := channel.clone()
+	c.mutex.Unlock()
+	switch message.Type {
+	case textMessage:
+		if err := c.storeHistory(*message); err != nil {
+			return
+		}
+	case joinMessage:
+		if body, err := json.Marshal(delivered.metadata()); err == nil {
+			c.cast(delivered.Id, presentMessage, string(body))
+		}
+	case presentMessage:
+		return
+	case leaveMessage:
+		// One member rekeys so whoever left can not read what follows, the
+		// key of a geolocal channel is public anyway
+		if delivered.Geohash == "" && c.rekeyer(delivered) {
+			c.rekey(delivered.Id, []string{message.From})
+		}
+	}
+	c.OnMessage(delivered, *message)
+}
+
+// markSeen records a message id and reports whether it was new. Ids older
+// than seenTimeout are forgotten.
+func (c *Channels) markSeen(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now().Unix()
+	if _, ok := c.seen[id]; ok {
+		return false
+	}
+	for seenId, seen := range c.seen {
+		if now-seen > int64(seenTimeout/time.Second) {
+			delete(c.seen, seenId)
+		}
+	}
+	c.seen[id] = now
+	return true
+}
+
+// seal encrypts with AES-GCM under the channel key, the nonce is prepended
+// to the ciphertext.
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errChannelDecrypt
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,98 @@
+package channels
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// historyNamespace prefixes the database keys of channel history, keys sort
+// by channel then by the time a message was posted.
+const historyNamespace = "channel"
+
+func historyPrefix(channelId string) string {
+	return historyNamespace + "/" + channelId + "/"
+}
+
+func historyKey(message Message) string {
+	return fmt.Sprintf("%s%016x/%s", historyPrefix(message.Channel), message.Timestamp, message.Id)
+}
+
+func (c *Channels) storeHistory(message Message) error {
+	if c.db == nil {
+		return nil
+	}
+	message.Signature = nil
+	value, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return c.db.Put([]byte(historyKey(message)), value)
+}
+
+func (c *Channels) historyKeys(channelId string) (keys []string) {
+	if c.db == nil {
+		return nil
+	}
+	prefix := historyPrefix(channelId)
+	for _, key := range c.db.Keys() {
+		if strings.HasPrefix(string(key), prefix) {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// History returns up to limit of the latest messages of a joined channel,
+// oldest first.
+func (c *Channels) History(channelId string, limit int) (messages []Message, err error) {
+	channel, ok := c.Channel(channelId)
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	keys := c.historyKeys(channel.Id)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[len(keys)-limit:]
+	}
+	for _, key := range keys {
+		value, err := c.db.Get([]byte(key))
+		if err != nil {
+			continue
+		}
+		var message Message
+		if err := json.Unmarshal(value, &message); err == nil {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (c *Channels) deleteHistory(channelId string) {
+	for _, key := range c.historyKeys(channelId) {
+		c.db.Delete([]byte(key))
+	}
+}
+
+// historyMessage finds a message in the history of a channel by id.
+func (c *Channels) historyMessage(channelId, messageId string) (Message, bool) {
+	for _, key := range c.historyKeys(channelId) {
+		if !strings.HasSuffix(key, "/"+messageId) {
+			continue
+		}
+		var message Message
+		if value, err := c.db.Get([]byte(key)); err == nil && json.Unmarshal(value, &message) == nil {
+			return message, true
+		}
+	}
+	return Message{}, false
+}
+
+func (c *Channels) deleteFromHistory(channelId, messageId string) {
+	for _, key := range c.historyKeys(channelId) {
+		if strings.HasSuffix(key, "/"+messageId) {
+			c.db.Delete([]byte(key))
+		}
+	}
+}
@@ -1,31 +1,163 @@
 package channels
 
-import ()
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// historyLength is how many messages are shown when a channel is joined
+const historyLength = 20
 
 type Interface struct {
+	channels *Channels
 }
 
-func NewInterface() (i *Interface) {
-	return &Interface{}
+func NewInterface(c *Channels) (i *Interface) {
+	return &Interface{
+		channels: c,
+	}
 }
 
 // CHANNELS
 func (i *Interface) ListChannels() (channels []string) {
-	return
+	list := i.channels.List()
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	self := ""
+	if identity := i.channels.Identity(); identity != nil {
+		self = identity.Address.Hex()
+	}
+	for _, channel := range list {
+		joined := time.Unix(channel.Joined, 0).Format(time.RFC822)
+		channels = append(channels, fmt.Sprintf("%s %s [%d members, %s] joined %s", channel.Name, channel.Invite(), len(channel.Members), channel.Role(self), joined))
+	}
+	return channels
 }
 
-func (i *Interface) Channel() (successful bool) {
-	return
+// Channel generates a new channel and returns the invite others join it
+// with.
+func (i *Interface) Channel(name string) (invite string, successful bool) {
+	channel, err := i.channels.Create(name)
+	if err != nil {
+		log.Println(err)
+		return "", false
+	}
+	return channel.Invite(), true
 }
 
-func (i *Interface) JoinChannel(channelId string) (successful bool) {
-	return
+func (i *Interface) JoinChannel(invite string) (successful bool) {
+	if _, err := i.channels.Join(invite); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
 }
 
 func (i *Interface) LeaveChannel(channelId string) (successful bool) {
-	return
+	if err := i.channels.Leave(channelId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
 }
 
 func (i *Interface) ChannelCast(channelId string, message string) (successful bool) {
-	return
+	if err := i.channels.Cast(channelId, message); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// JoinArea joins the public channel of the area around a location, the
+// location itself never leaves the node.
+func (i *Interface) JoinArea(latitude, longitude float64, precision int) (area string, successful bool) {
+	channel, err := i.channels.JoinArea(latitude, longitude, precision)
+	if err != nil {
+		log.Println(err)
+		return "", false
+	}
+	return channel.Geohash, true
+}
+
+// NearbyAreas lists the areas within geohash with nodes present in them.
+func (i *Interface) NearbyAreas(geohash string) (areas []string) {
+	nearby, err := i.channels.Nearby(geohash)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	for area, nodes := range nearby {
+		areas = append(areas, fmt.Sprintf("%s%s [%d nodes]", geoInvitePrefix, area, nodes))
+	}
+	sort.Strings(areas)
+	return areas
+}
+
+// ChannelHistory returns the latest messages of a joined channel formatted
+// for display.
+func (i *Interface) ChannelHistory(channelId string) (history []string) {
+	messages, err := i.channels.History(channelId, historyLength)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	for _, message := range messages {
+		name := message.Alias
+		if name == "" {
+			name = message.From
+		}
+		history = append(history, fmt.Sprintf("[ %d ] %s : %s (%s)", message.Timestamp/1000, name, message.Body, message.Id))
+	}
+	return history
+}
+
+// ChannelMembers lists the members of a joined channel with their roles.
+func (i *Interface) ChannelMembers(channelId string) (members []string) {
+	channel, ok := i.channels.Channel(channelId)
+	if !ok {
+		log.Println(ErrChannelNotFound)
+		return nil
+	}
+	for _, member := range channel.Members {
+		members = append(members, fmt.Sprintf("%s %s [%s]", member.Alias, member.Id, channel.Role(member.Id)))
+	}
+	sort.Strings(members)
+	return members
+}
+
+// MODERATION
+func (i *Interface) KickFromChannel(channelId, memberId string) (successful bool) {
+	if err := i.channels.Kick(channelId, memberId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func (i *Interface) BanFromChannel(channelId, memberId string) (successful bool) {
+	if err := i.channels.Ban(channelId, memberId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// SetChannelRole makes a member a moderator, a member again or banned
+// without removing them.
+func (i *Interface) SetChannelRole(channelId, memberId, role string) (successful bool) {
+	if err := i.channels.SetRole(channelId, memberId, role); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func (i *Interface) DeleteChannelMessage(channelId, messageId string) (successful bool) {
+	if err := i.channels.Delete(channelId, messageId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
 }
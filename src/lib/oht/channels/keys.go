@@ -0,0 +1,257 @@
+package channels
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/crypto/ecies"
+)
+
+var (
+	ErrMemberNotFound  = errors.New("Channels: No member with that id")
+	ErrMessageNotFound = errors.New("Channels: No message with that id")
+	errRekeyMember     = errors.New("Channels: Can not encrypt the new key to a member, the channel was not rekeyed")
+)
+
+// rekey hands out the key of the next epoch. Each remaining member gets it
+// encrypted to their public key with ECIES, so whoever was removed can read
+// that a rekey happened but not the new key.
+type rekey struct {
+	Epoch   uint64
+	Removed []string `json:",omitempty"`
+	Keys    map[string][]byte
+}
+
+// keyInfo binds an encrypted key to its channel and epoch, so it can not be
+// replayed as the key of another channel or epoch.
+func keyInfo(channelId string, epoch uint64) []byte {
+	var number [8]byte
+	binary.BigEndian.PutUint64(number[:], epoch)
+	return crypto.Sha3([]byte("oht-channel-key"), []byte(channelId), number[:])
+}
+
+// Kick takes a member out of a channel by rekeying it for everyone else,
+// only moderators kick and only members with a lower role.
+func (c *Channels) Kick(channelId, memberId string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	channel, ok := c.Channel(channelId)
+	if !ok {
+		return ErrChannelNotFound
+	}
+	member := channel.member(memberId)
+	if member == nil {
+		return ErrMemberNotFound
+	}
+	if !channel.canModerate(identity.Address.Hex(), member.Id) {
+		return ErrNotPermitted
+	}
+	return c.rekey(channel.Id, []string{member.Id})
+}
+
+// member finds a member by address or alias.
+func (channel *Channel) member(memberId string) *Member {
+	if isAddress(memberId) {
+		return channel.Members[common.HexToAddress(memberId).Hex()]
+	}
+	for _, member := range channel.Members {
+		if member.Alias != "" && member.Alias == memberId {
+			return member
+		}
+	}
+	return nil
+}
+
+func isAddress(memberId string) bool {
+	memberId = strings.TrimPrefix(memberId, "0x")
+	return len(memberId) == 40 && len(common.Hex2Bytes(memberId)) == 20
+}
+
+// rekey replaces the key of a channel, sending the new one to every member
+// but the removed ones under the current key. It fails rather than leave
+// out a member the key can not be encrypted to. When another rekey of the
+// same epoch wins, the members we removed are rekeyed out again in the next
+// epoch.
+func (c *Channels) rekey(channelId string, removed []string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	self := identity.Address.Hex()
+	key := make([]byte, channelKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	channel := c.channels[channelId]
+	if channel == nil {
+		c.mutex.Unlock()
+		return ErrChannelNotFound
+	}
+	r := &rekey{Epoch: channel.Epoch + 1, Removed: removed, Keys: make(map[string][]byte)}
+	info := keyInfo(channel.Id, r.Epoch)
+	for id, member := range channel.Members {
+		if id == self || containsMember(removed, id) || channel.Role(id) == RoleBanned {
+			continue
+		}
+		if member.PublicKey == "" {
+			c.mutex.Unlock()
+			return fmt.Errorf("%v: %s has no known public key", errRekeyMember, id)
+		}
+		publicKey := ecies.ImportECDSAPublic(crypto.ToECDSAPub(common.Hex2Bytes(member.PublicKey)))
+		encrypted, err := ecies.Encrypt(rand.Reader, publicKey, key, info, nil)
+		if err != nil {
+			c.mutex.Unlock()
+			return fmt.Errorf("%v: %s: %v", errRekeyMember, id, err)
+		}
+		r.Keys[id] = encrypted
+	}
+	c.mutex.Unlock()
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// The rekey itself is sent under the current key, which every member
+	// still holds
+	if err := c.cast(channelId, rekeyMessage, string(body)); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	if c.channels[channelId] != channel {
+		c.mutex.Unlock()
+		return ErrChannelNotFound
+	}
+	if channel.Epoch+1 != r.Epoch && (channel.Epoch != r.Epoch || !channel.rekeyPrecedes(self)) {
+		// A rekey of the epoch that wins over ours arrived meanwhile
+		again := withoutMembers(removed, channel.RekeyRemoved)
+		c.mutex.Unlock()
+		if len(again) == 0 {
+			return nil
+		}
+		return c.rekey(channelId, again)
+	}
+	defer c.mutex.Unlock()
+	channel.useKey(key, r.Epoch, self, removed)
+	return c.save()
+}
+
+// applyRekey takes the key of the next epoch from a rekey, or replaces the
+// key of the current epoch with that of a rekey that wins over the one it
+// came from. Members left out of it can no longer read the channel and
+// forget it.
+func (c *Channels) applyRekey(message *Message) {
+	identity := c.Identity()
+	r := &rekey{}
+	if identity == nil || json.Unmarshal([]byte(message.Body), r) != nil {
+		return
+	}
+	self := identity.Address.Hex()
+	c.mutex.Lock()
+	channel := c.channels[message.Channel]
+	if channel == nil || channel.Geohash != "" {
+		c.mutex.Unlock()
+		return
+	}
+	replaces := r.Epoch == channel.Epoch && r.Epoch > 0 && channel.rekeyPrecedes(message.From)
+	if r.Epoch != channel.Epoch+1 && !replaces {
+		c.mutex.Unlock()
+		return
+	}
+	encrypted, ok := r.Keys[self]
+	if !ok {
+		delete(c.channels, channel.Id)
+		c.save()
+		c.mutex.Unlock()
+		notify(fmt.Sprintf("Channels: Removed from %s, a new invite is needed to rejoin", channel.Name))
+		return
+	}
+	key, err := ecies.ImportECDSA(identity.PrivateKey).Decrypt(rand.Reader, encrypted, keyInfo(channel.Id, r.Epoch), nil)
+	if err != nil || len(key) != channelKeyLength {
+		c.mutex.Unlock()
+		return
+	}
+	// Our rekey lost, the members it removed are rekeyed out again
+	var again []string
+	if replaces && channel.Rekeyer == self {
+		again = withoutMembers(channel.RekeyRemoved, r.Removed)
+	}
+	channel.useKey(key, r.Epoch, message.From, r.Removed)
+	c.save()
+	c.mutex.Unlock()
+	if len(again) > 0 {
+		if err := c.rekey(channel.Id, again); err != nil {
+			notify(fmt.Sprintf("Channels: Failed to rekey %s: %v", channel.Name, err))
+		}
+	}
+}
+
+// useKey makes key the key of epoch, handed out by rekeyer removing the
+// members in removed. The caller holds the lock.
+func (channel *Channel) useKey(key []byte, epoch uint64, rekeyer string, removed []string) {
+	if epoch != channel.Epoch {
+		channel.PreviousKey = channel.Key
+	}
+	channel.Key = common.Bytes2Hex(key)
+	channel.Epoch, channel.Rekeyer, channel.RekeyRemoved = epoch, rekeyer, removed
+	for _, id := range removed {
+		delete(channel.Members, id)
+	}
+}
+
+// rekeyPrecedes reports whether a rekey sent by from wins over the one the
+// current epoch was keyed with, so members that receive two rekeys of an
+// epoch in any order settle on the same key. The sender with the higher
+// role wins, between equal roles the lower address.
+func (channel *Channel) rekeyPrecedes(from string) bool {
+	if channel.Rekeyer == "" || from == channel.Rekeyer {
+		return false
+	}
+	rank, current := roleRanks[channel.Role(from)], roleRanks[channel.Role(channel.Rekeyer)]
+	if rank != current {
+		return rank > current
+	}
+	return strings.ToLower(from) < strings.ToLower(channel.Rekeyer)
+}
+
+func containsMember(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutMembers returns the ids that are not in excluded.
+func withoutMembers(ids, excluded []string) (remaining []string) {
+	for _, id := range ids {
+		if !containsMember(excluded, id) {
+			remaining = append(remaining, id)
+		}
+	}
+	return remaining
+}
+
+// rekeyer reports whether we are the member that rekeys a channel after
+// someone leaves, the remaining member with the lowest address.
+func (c *Channels) rekeyer(channel Channel) bool {
+	identity := c.Identity()
+	if identity == nil {
+		return false
+	}
+	self := identity.Address.Hex()
+	for id := range channel.Members {
+		if strings.ToLower(id) < strings.ToLower(self) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,325 @@
+package channels
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+// Roles of channel members. The owner is the account that created the
+// channel, it appoints moderators. Moderators kick, ban and delete the
+// messages of members.
+const (
+	RoleBanned    = "banned"
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+	RoleOwner     = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleBanned:    0,
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleOwner:     3,
+}
+
+var (
+	ErrNotPermitted  = errors.New("Channels: Role does not permit this")
+	ErrInvalidRole   = errors.New("Channels: Roles are member, moderator or banned")
+	ErrUnknownOwner  = errors.New("Channels: Owner of the channel is not known yet")
+	errRoleSignature = errors.New("Channels: Invalid role assignment signature")
+	errRoleSequence  = errors.New("Channels: Role assignment is older than the current one")
+	errChannelOwner  = errors.New("Channels: Owner does not match the channel id")
+)
+
+// RoleAssignment gives a member a role, signed by the owner or a moderator.
+// Assignments are self-verifying, so any member passes them on to those who
+// join later.
+type RoleAssignment struct {
+	Channel   string
+	Member    string
+	Role      string
+	Sequence  int64
+	Issuer    string
+	Signature []byte
+}
+
+func (a *RoleAssignment) hash() []byte {
+	var sequence [8]byte
+	binary.BigEndian.PutUint64(sequence[:], uint64(a.Sequence))
+	return crypto.Sha3([]byte("oht-channel-role"), []byte(a.Channel), []byte(a.Member), []byte(a.Role), sequence[:], []byte(a.Issuer))
+}
+
+// metadata is the body of present messages, it tells new members who owns
+// the channel and the roles assigned so far.
+type metadata struct {
+	Owner string            `json:",omitempty"`
+	Salt  string            `json:",omitempty"`
+	Roles []*RoleAssignment `json:",omitempty"`
+}
+
+// channelId derives the id of a channel from its owner, so the owner can not
+// be forged by anyone joining later.
+func channelId(owner common.Address, salt []byte) string {
+	return common.Bytes2Hex(crypto.Sha3([]byte("oht-channel-id"), owner[:], salt)[:channelIdLength])
+}
+
+// Role returns the role of an account in the channel, accounts without an
+// assigned role are members.
+func (channel *Channel) Role(id string) string {
+	if channel.Owner != "" && id == channel.Owner {
+		return RoleOwner
+	}
+	if assignment, ok := channel.Roles[id]; ok {
+		return assignment.Role
+	}
+	return RoleMember
+}
+
+// canModerate reports whether issuer may act on member, only on those with a
+// lower role and only as a moderator or owner.
+func (channel *Channel) canModerate(issuer, member string) bool {
+	rank := roleRanks[channel.Role(issuer)]
+	return rank >= roleRanks[RoleModerator] && rank > roleRanks[channel.Role(member)]
+}
+
+// validateRole checks an assignment against the current roles.
+func (channel *Channel) validateRole(a *RoleAssignment) error {
+	if channel.Owner == "" {
+		return ErrUnknownOwner
+	}
+	if a.Channel != channel.Id || a.Role == RoleOwner {
+		return ErrInvalidRole
+	}
+	if _, ok := roleRanks[a.Role]; !ok {
+		return ErrInvalidRole
+	}
+	publicKey, err := crypto.SigToPub(a.hash(), a.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != common.HexToAddress(a.Issuer) {
+		return errRoleSignature
+	}
+	// Only the owner appoints moderators
+	if !channel.canModerate(a.Issuer, a.Member) || roleRanks[a.Role] >= roleRanks[channel.Role(a.Issuer)] {
+		return ErrNotPermitted
+	}
+	if existing, ok := channel.Roles[a.Member]; ok && a.Sequence <= existing.Sequence {
+		return errRoleSequence
+	}
+	return nil
+}
+
+// assignRole validates and stores an assignment, the caller holds the lock.
+func (channel *Channel) assignRole(a *RoleAssignment) error {
+	if err := channel.validateRole(a); err != nil {
+		return err
+	}
+	if channel.Roles == nil {
+		channel.Roles = make(map[string]*RoleAssignment)
+	}
+	channel.Roles[a.Member] = a
+	return nil
+}
+
+// setOwner records the owner of a channel once it is shown to match the id.
+func (channel *Channel) setOwner(owner, salt string) error {
+	if channel.Owner != "" {
+		return nil
+	}
+	if !isAddress(owner) || channelId(common.HexToAddress(owner), common.Hex2Bytes(salt)) != channel.Id {
+		return errChannelOwner
+	}
+	channel.Owner, channel.Salt = common.HexToAddress(owner).Hex(), salt
+	return nil
+}
+
+func (channel *Channel) metadata() metadata {
+	m := metadata{Owner: channel.Owner, Salt: channel.Salt}
+	for _, assignment := range channel.Roles {
+		m.Roles = append(m.Roles, assignment)
+	}
+	return m
+}
+
+// mergeMetadata takes the owner and roles from a present message.
+func (channel *Channel) mergeMetadata(m metadata) {
+	if m.Owner != "" {
+		channel.setOwner(m.Owner, m.Salt)
+	}
+	// Assignments may depend on each other, moderators appointed by the
+	// owner assign roles in turn, so they are applied until none is left
+	for applied := true; applied; {
+		applied = false
+		for _, assignment := range m.Roles {
+			if channel.assignRole(assignment) == nil {
+				applied = true
+			}
+		}
+	}
+}
+
+// SetRole assigns a role to a member of a channel and announces it.
+func (c *Channels) SetRole(channelId, memberId, role string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	c.mutex.Lock()
+	channel := c.find(channelId)
+	if channel == nil {
+		c.mutex.Unlock()
+		return ErrChannelNotFound
+	}
+	member := channel.member(memberId)
+	if member == nil {
+		c.mutex.Unlock()
+		return ErrMemberNotFound
+	}
+	a := &RoleAssignment{
+		Channel:  channel.Id,
+		Member:   member.Id,
+		Role:     role,
+		Sequence: time.Now().UnixNano(),
+		Issuer:   identity.Address.Hex(),
+	}
+	signature, err := crypto.Sign(a.hash(), identity.PrivateKey)
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	a.Signature = signature
+	if err := channel.assignRole(a); err != nil {
+		c.mutex.Unlock()
+		if err == errRoleSignature || err == errRoleSequence {
+			return ErrNotPermitted
+		}
+		return err
+	}
+	err = c.save()
+	id := channel.Id
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return c.cast(id, roleMessage, string(body))
+}
+
+// Ban bans a member and removes them from the channel, they are kept out
+// even when they get hold of a new invite.
+func (c *Channels) Ban(channelId, memberId string) error {
+	if err := c.SetRole(channelId, memberId, RoleBanned); err != nil {
+		return err
+	}
+	return c.Kick(channelId, memberId)
+}
+
+// Delete removes a message from the history of every member, members delete
+// their own messages and moderators those of members.
+func (c *Channels) Delete(channelId, messageId string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	channel, ok := c.Channel(channelId)
+	if !ok {
+		return ErrChannelNotFound
+	}
+	message, ok := c.historyMessage(channel.Id, messageId)
+	if !ok {
+		return ErrMessageNotFound
+	}
+	if message.From != identity.Address.Hex() && !channel.canModerate(identity.Address.Hex(), message.From) {
+		return ErrNotPermitted
+	}
+	c.deleteFromHistory(channel.Id, messageId)
+	return c.cast(channel.Id, deleteMessage, messageId)
+}
+
+// permitted enforces the roles of a channel on a message. Messages that are
+// not permitted are neither delivered nor relayed by members.
+func (c *Channels) permitted(channel *Channel, message *Message) error {
+	if channel.Role(message.From) == RoleBanned {
+		return ErrNotPermitted
+	}
+	switch message.Type {
+	case roleMessage:
+		a := &RoleAssignment{}
+		if err := json.Unmarshal([]byte(message.Body), a); err != nil {
+			return err
+		}
+		if a.Issuer != message.From {
+			return ErrNotPermitted
+		}
+		return channel.validateRole(a)
+	case deleteMessage:
+		if original, ok := c.historyMessage(channel.Id, message.Body); ok && original.From == message.From {
+			return nil
+		}
+		if !channel.canModerate(message.From, "") {
+			return ErrNotPermitted
+		}
+	case rekeyMessage:
+		r := &rekey{}
+		if err := json.Unmarshal([]byte(message.Body), r); err != nil {
+			return err
+		}
+		// Members who left may be rekeyed out by anyone, everyone else
+		// only by a moderator, whether removed or left out of the keys.
+		// We are a member too, though not in Members.
+		members := make(map[string]bool, len(channel.Members)+1)
+		for id := range channel.Members {
+			members[id] = true
+		}
+		if identity := c.Identity(); identity != nil {
+			members[identity.Address.Hex()] = true
+		}
+		for _, id := range r.Removed {
+			if members[id] && !channel.canModerate(message.From, id) {
+				return ErrNotPermitted
+			}
+		}
+		for id := range members {
+			if _, ok := r.Keys[id]; ok || id == message.From || containsMember(r.Removed, id) || channel.Role(id) == RoleBanned {
+				continue
+			}
+			if !channel.canModerate(message.From, id) {
+				return ErrNotPermitted
+			}
+		}
+	}
+	return nil
+}
+
+// moderate applies a role or delete message that passed permitted.
+func (c *Channels) moderate(message *Message) {
+	switch message.Type {
+	case roleMessage:
+		a := &RoleAssignment{}
+		if json.Unmarshal([]byte(message.Body), a) != nil {
+			return
+		}
+		c.mutex.Lock()
+		channel := c.channels[message.Channel]
+		if channel == nil || channel.assignRole(a) != nil {
+			c.mutex.Unlock()
+			return
+		}
+		c.save()
+		name, member := channel.Name, a.Member
+		if m, ok := channel.Members[a.Member]; ok && m.Alias != "" {
+			member = m.Alias
+		}
+		c.mutex.Unlock()
+		notify(fmt.Sprintf("[ %s ] %s is now %s", name, member, a.Role))
+	case deleteMessage:
+		c.deleteFromHistory(message.Channel, message.Body)
+	}
+}
@@ -1,14 +1,44 @@
 package contacts
 
 import (
+	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/multiverse-os/libs/oht/common"
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/dht"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
 )
 
-type Contacts struct {
-	Interface *Interface
+// Request statuses, a request is either sent by us or received from the
+// contact and stays pending until the receiving side accepts or rejects it.
+const (
+	RequestSent = iota
+	RequestReceived
+	RequestAccepted
+	RequestRejected
+)
+
+var (
+	ErrContactNotFound = errors.New("Contacts: No contact with that id")
+	ErrContactExists   = errors.New("Contacts: Contact already added")
+	ErrIdentityLocked  = errors.New("Contacts: No account is unlocked for contacts")
+	ErrInvalidContact  = errors.New("Contacts: Contact ids are an account address and onion host joined by @, or a registered name")
+)
+
+var addressPattern = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{40}$`)
+
+var requestStatuses = map[int]string{
+	RequestSent:     "request sent",
+	RequestReceived: "request received",
+	RequestAccepted: "accepted",
+	RequestRejected: "rejected",
 }
 
 type Contact struct {
@@ -17,6 +47,29 @@ type Contact struct {
 	OnionHost      string
 	Alias          string
 	AddRequest     *Request
+	// SentSequence and ReceivedSequence number the whispers exchanged with
+	// the contact, so they are shown in the order they were sent.
+	SentSequence     uint64 `json:",omitempty"`
+	ReceivedSequence uint64 `json:",omitempty"`
+	// Skipped holds the sequence numbers of whispers given up on when a gap
+	// was skipped, they are delivered late should they still arrive.
+	Skipped []uint64 `json:",omitempty"`
+	// PublicKey is the contact's account public key, recovered from the
+	// signature of their request or response.
+	PublicKey string `json:",omitempty"`
+	// DisplayName and AvatarHash are what the contact published in their
+	// profile, as of ProfileSequence.
+	DisplayName     string `json:",omitempty"`
+	AvatarHash      string `json:",omitempty"`
+	ProfileSequence uint64 `json:",omitempty"`
+	// Revoked is set once the contact revoked their account key, Successor
+	// is the account they rotated it to if any, see revocations.go
+	Revoked   bool   `json:",omitempty"`
+	Successor string `json:",omitempty"`
+	// Attestation is ours for the contact, signed once their safety number
+	// was compared, and Vouched is set once it was published, see trust.go
+	Attestation *dht.AttestationRecord `json:",omitempty"`
+	Vouched     bool                   `json:",omitempty"`
 }
 
 type Request struct {
@@ -25,15 +78,205 @@ type Request struct {
 	Status  int
 }
 
-func InitializeContacts() *Contacts {
-	if _, err := ioutil.ReadFile(common.AbsolutePath(common.DefaultDataDir(), "contacts.json")); err != nil {
-		str := "{}"
-		if err = ioutil.WriteFile(common.AbsolutePath(common.DefaultDataDir(), "contacts.json"), []byte(str), 0644); err != nil {
-			log.Fatal(err)
+func (contact *Contact) Accepted() bool {
+	return contact.AddRequest != nil && contact.AddRequest.Status == RequestAccepted
+}
+
+func (contact *Contact) Status() string {
+	if contact.Successor != "" {
+		return "rotated to " + contact.Successor
+	} else if contact.Revoked {
+		return "revoked"
+	}
+	if contact.AddRequest == nil {
+		return ""
+	}
+	return requestStatuses[contact.AddRequest.Status]
+}
+
+// Locator finds the account address and onion host of a contact id that is
+// not in the address@onion form, such as a registered name.
+type Locator func(contactId string) (address common.Address, onionHost string, err error)
+
+type Contacts struct {
+	Interface *Interface
+	Alias     string
+	// AvatarHash is published in our profile, see PublishProfile
+	AvatarHash string
+	// LocalOnionHost returns the onion host contacts reach us at, it is only
+	// known once Tor is running.
+	LocalOnionHost func() string
+	ListenPort     string
+	Locate         Locator
+	OnWhisper      WhisperFunc
+	// AddClientAuth is given the keys of the private onion services contacts
+	// authorized us on, see onion_auth.go
+	AddClientAuth ClientAuthFunc
+	path          string
+	contacts      map[string]*Contact
+	manager       *p2p.Manager
+	// identity is the unlocked account contacts are made as
+	identity *crypto.Key
+	// store keeps whispers for contacts that are offline and the prekeys
+	// whisper sessions start from, see SetStore
+	store    *dht.Store
+	received map[string]*received
+	pending  map[string]*pendingWhisper
+	// queued holds the deposited whispers no peer has taken yet, by the key
+	// of their mailbox record
+	queued       map[string]*pendingWhisper
+	pendingMutex sync.Mutex
+	// prekeys and sessions hold the keys of whisper sessions by account and
+	// by session id, see sessions.go
+	prekeysPath  string
+	sessionsPath string
+	prekeys      map[string]*accountPrekeys
+	sessions     map[string]*session
+	recent       map[string]*recentWhisper
+	sessionMutex sync.Mutex
+	// recoveries holds the shares of account keys exchanged with contacts,
+	// see recovery.go
+	recoveries *recoveries
+	mutex      sync.RWMutex
+}
+
+func InitializeContacts(dataDirectory string, manager *p2p.Manager) (*Contacts, error) {
+	c := &Contacts{
+		path:           common.AbsolutePath(dataDirectory, "contacts.json"),
+		contacts:       make(map[string]*Contact),
+		manager:        manager,
+		LocalOnionHost: func() string { return "" },
+		OnWhisper:      printWhisper,
+		received:       make(map[string]*received),
+		pending:        make(map[string]*pendingWhisper),
+		queued:         make(map[string]*pendingWhisper),
+		prekeysPath:    common.AbsolutePath(dataDirectory, "prekeys.json"),
+		sessionsPath:   common.AbsolutePath(dataDirectory, "sessions.json"),
+		prekeys:        make(map[string]*accountPrekeys),
+		sessions:       make(map[string]*session),
+		recent:         make(map[string]*recentWhisper),
+	}
+	c.Interface = NewInterface(c)
+	if err := c.loadSessions(); err != nil {
+		return nil, err
+	}
+	recoveries, err := loadRecoveries(common.AbsolutePath(dataDirectory, "recovery.json"))
+	if err != nil {
+		return nil, err
+	}
+	c.recoveries = recoveries
+	file, err := ioutil.ReadFile(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err = json.Unmarshal(file, &c.contacts); err != nil {
+			return nil, err
+		}
+	}
+	if manager != nil {
+		manager.Handle(requestMessageType, c.handleRequest)
+		manager.Handle(responseMessageType, c.handleResponse)
+		manager.Handle(whisperMessageType, c.handleWhisper)
+		manager.Handle(whisperAckMessageType, c.handleWhisperAck)
+		manager.Handle(recoveryShareMessageType, c.handleRecoveryShare)
+		manager.Handle(recoveryRequestMessageType, c.handleRecoveryRequest)
+		manager.Handle(recoveryReturnMessageType, c.handleRecoveryReturn)
+		manager.Handle(onionAuthMessageType, c.handleOnionAuth)
+	}
+	return c, c.save()
+}
+
+// save writes contacts.json, the caller holds the lock.
+func (c *Contacts) save() error {
+	file, err := json.MarshalIndent(c.contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, file, 0600)
+}
+
+func (c *Contacts) SetIdentity(key *crypto.Key) {
+	c.mutex.Lock()
+	c.identity = key
+	store := c.store
+	c.mutex.Unlock()
+	if key != nil && store != nil {
+		go c.PublishPrekeys()
+		go c.PublishProfile()
+		go c.FetchMailbox()
+	}
+}
+
+func (c *Contacts) Identity() *crypto.Key {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.identity
+}
+
+// Contact finds a contact by account address or alias.
+func (c *Contacts) Contact(contactId string) (Contact, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	contact := c.find(contactId)
+	if contact == nil {
+		return Contact{}, false
+	}
+	return *contact, true
+}
+
+// find is Contact for callers holding the lock.
+func (c *Contacts) find(contactId string) *Contact {
+	if isAddress(contactId) {
+		return c.contacts[normalizeId(contactId)]
+	}
+	for _, contact := range c.contacts {
+		if contact.Alias != "" && contact.Alias == contactId {
+			return contact
 		}
 	}
+	return nil
+}
+
+func (c *Contacts) List() (contacts []Contact) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, contact := range c.contacts {
+		contacts = append(contacts, *contact)
+	}
+	return contacts
+}
 
-	return &Contacts{
-		Interface: &Interface{},
+// Seen records that a verified message from the contact was received.
+func (c *Contacts) Seen(contactId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if contact := c.find(contactId); contact != nil {
+		contact.LastConnection = time.Now().Unix()
+		c.save()
+	}
+}
+
+// locate turns a contact id into the contact's address and onion host.
+func (c *Contacts) locate(contactId string) (common.Address, string, error) {
+	if parts := strings.SplitN(contactId, "@", 2); len(parts) == 2 {
+		if !isAddress(parts[0]) || !strings.HasSuffix(parts[1], ".onion") {
+			return common.Address{}, "", ErrInvalidContact
+		}
+		return common.HexToAddress(parts[0]), parts[1], nil
 	}
+	if contact, ok := c.Contact(contactId); ok {
+		return common.HexToAddress(contact.Id), contact.OnionHost, nil
+	}
+	if c.Locate == nil {
+		return common.Address{}, "", ErrInvalidContact
+	}
+	return c.Locate(contactId)
+}
+
+func normalizeId(contactId string) string {
+	return common.HexToAddress(contactId).Hex()
+}
+
+func isAddress(contactId string) bool {
+	return addressPattern.MatchString(contactId)
 }
@@ -0,0 +1,119 @@
+package contacts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pborman/uuid"
+
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+func newTestContacts(t *testing.T, onionHost string) (*Contacts, string) {
+	directory, err := ioutil.TempDir("", "oht-contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := InitializeContacts(directory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetIdentity(&crypto.Key{
+		Id:         uuid.NewRandom(),
+		Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+		PrivateKey: privateKey,
+	})
+	c.LocalOnionHost = func() string { return onionHost }
+	return c, directory
+}
+
+func TestContactRequestAccepted(t *testing.T) {
+	alice, aliceDirectory := newTestContacts(t, "alicealicealicea.onion")
+	defer os.RemoveAll(aliceDirectory)
+	bob, bobDirectory := newTestContacts(t, "bobbobbobbobbobb.onion")
+	defer os.RemoveAll(bobDirectory)
+	alice.Alias, bob.Alias = "alice", "bob"
+	bobId := bob.Identity().Address.Hex()
+
+	// Without p2p the request is kept but can not be delivered
+	if err := alice.Request(bobId+"@bobbobbobbobbobb.onion", "hi"); err == nil {
+		t.Fatal("expected delivery to fail without p2p")
+	}
+	if contact, ok := alice.Contact(bobId); !ok || contact.AddRequest.Status != RequestSent {
+		t.Fatalf("expected a sent request, got %+v", contact.AddRequest)
+	}
+
+	request, err := alice.seal(requestMessageType, bob.Identity().Address, "hi", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.handleRequest(nil, request)
+	contact, ok := bob.Contact(alice.Identity().Address.Hex())
+	if !ok || contact.AddRequest.Status != RequestReceived || contact.AddRequest.Message != "hi" {
+		t.Fatalf("expected a received request, got %+v", contact.AddRequest)
+	}
+	if contact.OnionHost != "alicealicealicea.onion" || contact.PublicKey == "" || contact.LastConnection == 0 {
+		t.Errorf("expected the request to record the contact, got %+v", contact)
+	}
+	if contact, ok := bob.Contact("alice"); !ok || contact.Id != alice.Identity().Address.Hex() {
+		t.Error("expected the contact to be found by alias")
+	}
+
+	response, err := bob.seal(responseMessageType, alice.Identity().Address, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.handleResponse(nil, response)
+	if contact, _ := alice.Contact(bobId); !contact.Accepted() {
+		t.Errorf("expected the request to be accepted, got %+v", contact.AddRequest)
+	}
+
+	// The contact survives a restart
+	reloaded, err := InitializeContacts(aliceDirectory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact, ok := reloaded.Contact(bobId); !ok || !contact.Accepted() || contact.PublicKey == "" {
+		t.Errorf("expected the accepted contact to be persisted, got %+v", contact)
+	}
+}
+
+func TestContactMessageVerification(t *testing.T) {
+	alice, aliceDirectory := newTestContacts(t, "alicealicealicea.onion")
+	defer os.RemoveAll(aliceDirectory)
+	bob, bobDirectory := newTestContacts(t, "bobbobbobbobbobb.onion")
+	defer os.RemoveAll(bobDirectory)
+	carol, carolDirectory := newTestContacts(t, "carolcarolcarolc.onion")
+	defer os.RemoveAll(carolDirectory)
+
+	forCarol, _ := alice.seal(requestMessageType, carol.Identity().Address, "hi", false)
+	if _, _, err := bob.open(requestMessageType, forCarol.Body); err != errEnvelopeRecipient {
+		t.Errorf("expected %v, got %v", errEnvelopeRecipient, err)
+	}
+
+	request, _ := alice.seal(requestMessageType, bob.Identity().Address, "hi", false)
+	var e envelope
+	json.Unmarshal([]byte(request.Body), &e)
+	e.OnionHost = "attackerattacker.onion"
+	tampered, _ := json.Marshal(e)
+	if _, _, err := bob.open(requestMessageType, string(tampered)); err != errEnvelopeSignature {
+		t.Errorf("expected %v, got %v", errEnvelopeSignature, err)
+	}
+	// A request can not be passed off as an acceptance
+	if _, _, err := bob.open(responseMessageType, request.Body); err != errEnvelopeSignature {
+		t.Errorf("expected %v, got %v", errEnvelopeSignature, err)
+	}
+
+	// Unsolicited acceptances do not add a contact
+	response, _ := alice.seal(responseMessageType, bob.Identity().Address, "", true)
+	bob.handleResponse(nil, response)
+	if _, ok := bob.Contact(alice.Identity().Address.Hex()); ok {
+		t.Error("expected an unsolicited response to be ignored")
+	}
+}
@@ -1,35 +1,147 @@
 package contacts
 
-import ()
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
 
 type Interface struct {
+	contacts *Contacts
 }
 
-func NewInterface() (i *Interface) {
-	return &Interface{}
+func NewInterface(c *Contacts) (i *Interface) {
+	return &Interface{
+		contacts: c,
+	}
 }
 
 // CONTACTS
-func (ohtInterface *Interface) ListContacts() (contacts []string) {
-	return
+func (i *Interface) ListContacts() (contacts []string) {
+	list := i.contacts.List()
+	sort.Slice(list, func(a, b int) bool { return list[a].Id < list[b].Id })
+	for _, contact := range list {
+		lastConnection := "never"
+		if contact.LastConnection != 0 {
+			lastConnection = time.Unix(contact.LastConnection, 0).Format(time.RFC822)
+		}
+		alias := contact.Alias
+		if contact.DisplayName != "" && contact.DisplayName != contact.Alias {
+			alias += " (" + contact.DisplayName + ")"
+		}
+		contacts = append(contacts, fmt.Sprintf("%s %s@%s [%s] [%s] last seen %s", alias, contact.Id, contact.OnionHost, contact.Status(), i.contacts.TrustStatus(contact.Id), lastConnection))
+	}
+	return contacts
 }
 
-func (ohtInterface *Interface) RequestContact(contactId string, message string) (successful bool) {
-	return
+func (i *Interface) RequestContact(contactId string, message string) (successful bool) {
+	if err := i.contacts.Request(contactId, message); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
 }
 
-func (ohtInterface *Interface) AddContact(contactId string) (successful bool) {
-	return
+func (i *Interface) AddContact(contactId string) (successful bool) {
+	if err := i.contacts.Accept(contactId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
 }
 
-func (ohtInterface *Interface) RemoveContact(contactId string) (successful bool) {
-	return
+func (i *Interface) RemoveContact(contactId string) (successful bool) {
+	if err := i.contacts.Remove(contactId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
 }
 
-func (ohtInterface *Interface) WhisperToContact(contactId string, message string) (successful bool) {
-	return
+// WhisperToContact sends an end-to-end encrypted message to a contact, it
+// keeps being retried in the background until the contact acknowledges it.
+func (i *Interface) WhisperToContact(contactId string, message string) (successful bool) {
+	if err := i.contacts.Whisper(contactId, message); err != nil {
+		log.Println(err)
+		// Only a message that was never queued failed, delivery is retried
+		return (err != ErrNotAContact && err != ErrIdentityLocked && err != ErrContactRevoked)
+	}
+	return true
+}
+
+// TRUST
+// SafetyNumber is the number to compare with a contact in person, empty
+// when it can not be computed.
+func (i *Interface) SafetyNumber(contactId string) string {
+	safetyNumber, err := i.contacts.SafetyNumber(contactId)
+	if err != nil {
+		log.Println(err)
+	}
+	return safetyNumber
+}
+
+// VerifyContact marks a contact whose safety number matched as verified.
+func (i *Interface) VerifyContact(contactId string) (successful bool) {
+	if err := i.contacts.Verify(contactId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// VouchForContact publishes that we verified a contact in the DHT.
+func (i *Interface) VouchForContact(contactId string) (successful bool) {
+	if err := i.contacts.Vouch(contactId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func (i *Interface) UnverifyContact(contactId string) (successful bool) {
+	if err := i.contacts.Unverify(contactId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// RECOVERY
+// BackupAccount gives each of the contacts a share of the unlocked account's
+// key, any threshold of them recover it.
+func (i *Interface) BackupAccount(threshold int, contactIds []string) (successful bool) {
+	if err := i.contacts.BackupAccount(threshold, contactIds); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func (i *Interface) ListRecovery() []string {
+	lines := i.contacts.Recovery()
+	sort.Strings(lines)
+	return lines
+}
+
+// ReleaseShare returns the share we hold of a contact's account to the
+// recovery that asked for it, only after confirming it is them out of band.
+func (i *Interface) ReleaseShare(ownerId string) (successful bool) {
+	if err := i.contacts.ReleaseShare(ownerId); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func (i *Interface) RecoverAccount(ownerId string, holderIds []string, message string) (successful bool) {
+	if err := i.contacts.RecoverAccount(ownerId, holderIds, message); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
 }
 
-func (ohtInterface *Interface) ContactCast(message string) (successful bool) {
+func (i *Interface) ContactCast(message string) (successful bool) {
 	return
 }
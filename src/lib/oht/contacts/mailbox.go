@@ -0,0 +1,157 @@
+package contacts
+
+import (
+	"fmt"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/dht"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+// SetStore enables store-and-forward through the DHT and whisper sessions
+// with forward secrecy. Whispers that can not be delivered are deposited for
+// the contact, and our own mailbox is fetched whenever a peer connects or
+// the identity is unlocked. Our prekeys and profile are published and kept
+// fresh, see sessions.go and profiles.go, revocations of contacts' keys
+// are honored, see revocations.go, and attestations of them are collected,
+// see trust.go.
+func (c *Contacts) SetStore(store *dht.Store) {
+	c.mutex.Lock()
+	c.store = store
+	c.mutex.Unlock()
+	go c.refreshPrekeys()
+	go c.refreshProfile()
+	store.Watch(dht.RevocationNamespace+"/", c.revocationRecord)
+	store.Watch(dht.ProfileNamespace+"/", c.profileRecord)
+	store.Watch(dht.MailboxNamespace+"/", c.mailboxRecord)
+	if c.manager != nil {
+		onConnect := c.manager.OnConnect
+		c.manager.OnConnect = func(manager *p2p.Manager, peer *p2p.Peer) {
+			if onConnect != nil {
+				onConnect(manager, peer)
+			}
+			c.placeQueued()
+			c.FetchMailbox()
+			store.SyncRevocations()
+			c.SyncAttestations()
+		}
+	}
+}
+
+func (c *Contacts) Store() *dht.Store {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.store
+}
+
+// FetchMailbox delivers the whispers deposited for us on this node and asks
+// the connected peers for the rest, which are delivered as they arrive.
+func (c *Contacts) FetchMailbox() {
+	identity, mailbox := c.Identity(), c.Store()
+	if identity == nil || mailbox == nil {
+		return
+	}
+	for _, record := range mailbox.Mailbox(identity.Address) {
+		c.collect(record)
+	}
+	mailbox.SyncMailbox(identity.Address)
+}
+
+func (c *Contacts) mailboxRecord(key string, value []byte) {
+	identity := c.Identity()
+	if identity == nil {
+		return
+	}
+	record, err := dht.DecodeMailboxRecord(value)
+	if err != nil || record.Deleted || record.To != identity.Address {
+		return
+	}
+	c.collect(record)
+}
+
+// collect delivers a whisper from our mailbox and deletes it. Whispers that
+// can not be opened are left until they expire, they are tried again on the
+// next fetch.
+func (c *Contacts) collect(record *dht.MailboxRecord) {
+	identity, mailbox := c.Identity(), c.Store()
+	if identity == nil || mailbox == nil {
+		return
+	}
+	w, err := c.openWhisper(string(record.Sealed))
+	if err != nil {
+		return
+	}
+	// The sender is likely offline as well, acknowledging is best effort
+	go c.acknowledge(w, nil)
+	c.receive(w)
+	mailbox.Collect(record, identity)
+}
+
+// deposit stores a whisper the contact could not be reached for in their
+// mailbox, the sequence number keeps it in order once it is fetched. Until
+// a peer took the mailbox record it is only queued on this node, and handed
+// on as peers connect.
+func (c *Contacts) deposit(pending *pendingWhisper) {
+	contact, _ := c.Contact(pending.contactId)
+	mailbox := c.Store()
+	if mailbox == nil {
+		c.undelivered(pending)
+		return
+	}
+	key, placed, err := mailbox.Deposit(common.HexToAddress(pending.contactId), []byte(pending.message.Body), dht.MaxMailboxTTL)
+	if err != nil {
+		c.undelivered(pending)
+		return
+	}
+	if placed == 0 {
+		c.pendingMutex.Lock()
+		c.queued[key] = pending
+		c.pendingMutex.Unlock()
+		notify(fmt.Sprintf("Whisper: %s is offline, message %d is queued locally until a peer takes it to their mailbox", contact.Alias, pending.sequence))
+		return
+	}
+	c.deposited(pending)
+}
+
+func (c *Contacts) deposited(pending *pendingWhisper) {
+	contact, _ := c.Contact(pending.contactId)
+	notify(fmt.Sprintf("Whisper: %s is offline, message %d was left in their mailbox", contact.Alias, pending.sequence))
+}
+
+// placeQueued hands the whispers queued on this node to the peers keeping
+// their recipient's mailbox, whispers that expired meanwhile were not
+// delivered.
+func (c *Contacts) placeQueued() {
+	mailbox := c.Store()
+	if mailbox == nil {
+		return
+	}
+	c.pendingMutex.Lock()
+	queued := make(map[string]*pendingWhisper, len(c.queued))
+	for key, pending := range c.queued {
+		queued[key] = pending
+	}
+	c.pendingMutex.Unlock()
+	for key, pending := range queued {
+		_, err := mailbox.Get(key)
+		if err == nil && mailbox.Place(key) == 0 {
+			continue
+		}
+		c.pendingMutex.Lock()
+		delete(c.queued, key)
+		c.pendingMutex.Unlock()
+		if err != nil {
+			c.undelivered(pending)
+		} else {
+			c.deposited(pending)
+		}
+	}
+}
+
+// Queued returns how many whispers wait on this node for a peer to take
+// them to their recipient's mailbox.
+func (c *Contacts) Queued() int {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	return len(c.queued)
+}
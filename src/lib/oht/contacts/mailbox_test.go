@@ -0,0 +1,50 @@
+package contacts
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+func TestWhisperLeftInMailbox(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	db, _ := database.NewMemDatabase()
+	store := dht.NewStore(db, nil)
+	store.RegisterValidator(dht.MailboxNamespace, dht.MailboxValidator{})
+	alice.SetStore(store)
+
+	bobId := bob.Identity().Address.Hex()
+	// Bob is offline, the whisper is deposited instead of retried
+	if err := alice.Whisper(bobId, "while you were away"); err != nil {
+		t.Fatal(err)
+	}
+	if alice.Pending() != 0 {
+		t.Errorf("expected the whisper not to be retried, %d pending", alice.Pending())
+	}
+	if len(store.Mailbox(bob.Identity().Address)) != 1 {
+		t.Fatal("expected the whisper in bob's mailbox")
+	}
+	if alice.Queued() != 1 {
+		t.Errorf("expected the whisper to be queued until a peer takes it, %d queued", alice.Queued())
+	}
+
+	var bodies []string
+	bob.OnWhisper = func(contact Contact, body string, timestamp int64, late bool) {
+		bodies = append(bodies, body)
+	}
+	bob.SetStore(store)
+	// A whisper bob can not open yet stays in the mailbox
+	if _, _, err := store.Deposit(bob.Identity().Address, []byte("not a whisper"), dht.MaxMailboxTTL); err != nil {
+		t.Fatal(err)
+	}
+	bob.FetchMailbox()
+	if !reflect.DeepEqual(bodies, []string{"while you were away"}) {
+		t.Errorf("expected the whisper to be collected, got %v", bodies)
+	}
+	if left := store.Mailbox(bob.Identity().Address); len(left) != 1 || string(left[0].Sealed) != "not a whisper" {
+		t.Errorf("expected only the collected whisper to be deleted, got %d left", len(left))
+	}
+}
@@ -0,0 +1,78 @@
+package contacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+const onionAuthMessageType = "onion_auth"
+
+// onionAuth is the plaintext of a client authorization key for one of the
+// sender's private onion services, encrypted to the contact it was issued
+// to.
+type onionAuth struct {
+	OnionHost  string
+	PrivateKey string
+}
+
+// ClientAuthFunc hands Tor the key a contact authorized us on their private
+// onion service with.
+type ClientAuthFunc func(onionHost, privateKey string) error
+
+// SendOnionAuth gives an accepted contact the client authorization key
+// issued to them for one of our private onion services.
+func (c *Contacts) SendOnionAuth(contactId, onionHost, privateKey string) error {
+	contact, ok := c.Contact(contactId)
+	if !ok || !contact.Accepted() || contact.PublicKey == "" {
+		return ErrNotAContact
+	}
+	if contact.Revoked {
+		return ErrContactRevoked
+	}
+	message, err := c.sealOnionAuth(contact, onionHost, privateKey)
+	if err != nil {
+		return err
+	}
+	return c.send(contact.OnionHost, message)
+}
+
+func (c *Contacts) sealOnionAuth(contact Contact, onionHost, privateKey string) (p2p.Message, error) {
+	plaintext, err := json.Marshal(onionAuth{OnionHost: onionHost, PrivateKey: privateKey})
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	sealed, err := crypto.Encrypt(crypto.ToECDSAPub(common.Hex2Bytes(contact.PublicKey)), plaintext)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return c.seal(onionAuthMessageType, common.HexToAddress(contact.Id), common.Bytes2Hex(sealed), false)
+}
+
+// handleOnionAuth adds the key an accepted contact authorized us with to
+// Tor, so we reach their private onion service.
+func (c *Contacts) handleOnionAuth(manager *p2p.Manager, message p2p.Message) {
+	e, _, err := c.open(onionAuthMessageType, message.Body)
+	if err != nil {
+		return
+	}
+	contact, ok := c.Contact(e.From.Hex())
+	identity := c.Identity()
+	if !ok || !contact.Accepted() || identity == nil || c.AddClientAuth == nil {
+		return
+	}
+	plaintext, err := crypto.Decrypt(identity.PrivateKey, common.Hex2Bytes(e.Message))
+	auth := &onionAuth{}
+	if err != nil || json.Unmarshal(plaintext, auth) != nil {
+		return
+	}
+	if err := c.AddClientAuth(auth.OnionHost, auth.PrivateKey); err != nil {
+		log.Println("Contacts: Failed to add the onion service key of", contact.Id+":", err)
+		return
+	}
+	notify(fmt.Sprintf("Contacts: %s (%s) authorized you on their private onion service %s", contact.Alias, contact.Id, auth.OnionHost))
+}
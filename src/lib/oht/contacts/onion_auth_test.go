@@ -0,0 +1,44 @@
+package contacts
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOnionAuthDelivered(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	carol, carolDirectory := newTestContacts(t, "carolcarolcarolc.onion")
+	defer os.RemoveAll(carolDirectory)
+	added := make(map[string]string)
+	bob.AddClientAuth = func(onionHost, privateKey string) error {
+		added[onionHost] = privateKey
+		return nil
+	}
+	privateKey := "4CVAW3WNBPZCXU5AMKAUE7QXOUUKKMCQPBW2V2LK4ASCXWMGXSXQ"
+
+	bobContact, _ := alice.Contact(bob.Identity().Address.Hex())
+	message, err := alice.sealOnionAuth(bobContact, "channelchannelch.onion", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(message.Body, privateKey) {
+		t.Error("expected the key to be encrypted to the contact")
+	}
+	bob.handleOnionAuth(nil, message)
+	if added["channelchannelch.onion"] != privateKey {
+		t.Errorf("expected the key to be added to Tor, got %v", added)
+	}
+
+	// Someone who is not a contact can not make us add keys
+	delete(added, "channelchannelch.onion")
+	message, _ = carol.sealOnionAuth(bobContact, "channelchannelch.onion", privateKey)
+	bob.handleOnionAuth(nil, message)
+	if len(added) != 0 {
+		t.Errorf("expected the key of a stranger to be ignored, got %v", added)
+	}
+	if err := alice.SendOnionAuth(carol.Identity().Address.Hex(), "channelchannelch.onion", privateKey); err != ErrNotAContact {
+		t.Errorf("expected %v, got %v", ErrNotAContact, err)
+	}
+}
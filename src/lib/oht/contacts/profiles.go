@@ -0,0 +1,82 @@
+package contacts
+
+import (
+	"log"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+// profileRefresh is how often the profile of the unlocked account is
+// published again, well within its TTL so onion hosts stay current.
+const profileRefresh = dht.MaxProfileTTL / 4
+
+// PublishProfile publishes the profile of the unlocked account: the alias
+// as display name, the avatar hash, our onion host, the account public key
+// and the prekeys whisper sessions start from.
+func (c *Contacts) PublishProfile() error {
+	identity, store := c.Identity(), c.Store()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	if store == nil {
+		return nil
+	}
+	c.sessionMutex.Lock()
+	prekeys, err := c.accountPrekeys(identity.Address)
+	c.sessionMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	prekey := prekeys.current()
+	bundle, err := dht.NewPrekeyBundle(identity, prekeys.Identity.Public, prekey.Key.Public, prekey.Id, dht.MaxPrekeyTTL)
+	if err != nil {
+		return err
+	}
+	record := &dht.ProfileRecord{DisplayName: c.Alias, AvatarHash: c.AvatarHash, Prekeys: bundle}
+	if onionHost := c.LocalOnionHost(); onionHost != "" {
+		record.OnionHosts = []string{onionHost}
+	}
+	return store.PublishProfile(identity, record, dht.MaxProfileTTL)
+}
+
+// refreshProfile keeps the profile of the unlocked account published.
+func (c *Contacts) refreshProfile() {
+	for {
+		if err := c.PublishProfile(); err != nil && err != ErrIdentityLocked {
+			log.Println(err)
+		}
+		time.Sleep(profileRefresh)
+	}
+}
+
+// Profile finds the current profile of an account.
+func (c *Contacts) Profile(address common.Address) (*dht.ProfileRecord, error) {
+	store := c.Store()
+	if store == nil {
+		return nil, dht.ErrNotFound
+	}
+	return store.Profile(address, dht.DefaultLookupTimeout)
+}
+
+// profileRecord updates a contact from their profile, their display name
+// is shown next to the alias we gave them and their onion host follows
+// the one they publish.
+func (c *Contacts) profileRecord(key string, value []byte) {
+	record, err := dht.DecodeProfileRecord(value)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	contact := c.contacts[record.Owner.Hex()]
+	if contact == nil || record.Sequence <= contact.ProfileSequence {
+		return
+	}
+	contact.DisplayName, contact.AvatarHash, contact.ProfileSequence = record.DisplayName, record.AvatarHash, record.Sequence
+	if len(record.OnionHosts) > 0 {
+		contact.OnionHost = record.OnionHosts[0]
+	}
+	c.save()
+}
@@ -0,0 +1,495 @@
+package contacts
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/crypto/shamir"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+const (
+	recoveryShareMessageType   = "recovery_share"
+	recoveryRequestMessageType = "recovery_request"
+	recoveryReturnMessageType  = "recovery_return"
+	// maxRecoveryCombinations bounds how many subsets of the returned
+	// shares are tried when some holder returned a bad share.
+	maxRecoveryCombinations = 1024
+)
+
+var (
+	ErrRecoveryHolders   = errors.New("Recovery: Shares go to at least two accepted contacts, at least as many as the threshold")
+	ErrNoRecovery        = errors.New("Recovery: No recovery of that account was started")
+	ErrNoRecoveryRequest = errors.New("Recovery: The account did not ask for its share")
+	ErrTooFewShares      = errors.New("Recovery: Not enough contacts returned their share yet")
+	ErrRecoveryFailed    = errors.New("Recovery: The returned shares do not rebuild the account key")
+)
+
+// recoveryShare is the plaintext of a share, encrypted to the contact
+// holding it.
+type recoveryShare struct {
+	Owner     common.Address
+	Threshold int
+	Share     shamir.Share
+}
+
+// heldShare is a share we keep for a contact, still encrypted to our
+// account so it is only readable while we are unlocked.
+type heldShare struct {
+	Owner     common.Address
+	Sealed    []byte
+	Threshold int
+	Received  int64
+}
+
+// backup records which contacts hold shares of one of our accounts, so
+// recovery knows who to ask.
+type backup struct {
+	Holders   []string
+	Threshold int
+	Created   int64
+}
+
+// recoveryRequest asks a holder to return their share of Owner, encrypted to
+// RecoveryKey, to OnionHost. It can not be signed since the key is lost,
+// holders confirm it with the owner before releasing their share.
+type recoveryRequest struct {
+	Owner       common.Address
+	RecoveryKey []byte
+	OnionHost   string
+	Message     string
+	Timestamp   int64
+}
+
+// recoveryReturn is a share released by its holder.
+type recoveryReturn struct {
+	Owner     common.Address
+	Holder    common.Address
+	Sealed    []byte
+	Signature []byte
+}
+
+func (r *recoveryReturn) hash() []byte {
+	return crypto.Sha3([]byte("oht-recovery-return"), r.Owner[:], r.Holder[:], r.Sealed)
+}
+
+// recovery is a recovery this node started, collecting returned shares.
+type recovery struct {
+	key       *ecdsa.PrivateKey
+	threshold int
+	shares    map[byte]shamir.Share
+}
+
+// recoveryState is kept in recovery.json.
+type recoveryState struct {
+	Held    map[string]*heldShare `json:",omitempty"`
+	Backups map[string]*backup    `json:",omitempty"`
+}
+
+type recoveries struct {
+	path  string
+	state recoveryState
+	// requests are recovery requests for shares we hold, by owner
+	requests map[string]*recoveryRequest
+	// started are our own recoveries, by owner
+	started map[string]*recovery
+	mutex   sync.Mutex
+}
+
+func loadRecoveries(path string) (*recoveries, error) {
+	r := &recoveries{
+		path:     path,
+		requests: make(map[string]*recoveryRequest),
+		started:  make(map[string]*recovery),
+	}
+	file, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err = json.Unmarshal(file, &r.state); err != nil {
+			return nil, err
+		}
+	}
+	if r.state.Held == nil {
+		r.state.Held = make(map[string]*heldShare)
+	}
+	if r.state.Backups == nil {
+		r.state.Backups = make(map[string]*backup)
+	}
+	return r, nil
+}
+
+// save writes recovery.json, the caller holds the lock.
+func (r *recoveries) save() error {
+	file, err := json.MarshalIndent(r.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path, file, 0600)
+}
+
+// BackupAccount splits the key of the unlocked account into one share per
+// contact, any threshold of which rebuild it. Each share is encrypted to
+// its contact and kept by them until we ask for it back.
+func (c *Contacts) BackupAccount(threshold int, contactIds []string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	var holders []Contact
+	for _, contactId := range contactIds {
+		contact, ok := c.Contact(contactId)
+		if !ok || !contact.Accepted() || contact.PublicKey == "" {
+			return ErrNotAContact
+		}
+		holders = append(holders, contact)
+	}
+	messages, err := c.sealShares(identity, threshold, holders)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for i, holder := range holders {
+		if err := c.send(holder.OnionHost, messages[i]); err != nil {
+			return fmt.Errorf("Recovery: Failed to give %s their share: %v", holder.Id, err)
+		}
+		ids = append(ids, holder.Id)
+	}
+	c.recoveries.mutex.Lock()
+	defer c.recoveries.mutex.Unlock()
+	c.recoveries.state.Backups[identity.Address.Hex()] = &backup{Holders: ids, Threshold: threshold, Created: time.Now().Unix()}
+	return c.recoveries.save()
+}
+
+// sealShares splits the key of identity and seals a share to each holder.
+func (c *Contacts) sealShares(identity *crypto.Key, threshold int, holders []Contact) ([]p2p.Message, error) {
+	if len(holders) < 2 || threshold > len(holders) {
+		return nil, ErrRecoveryHolders
+	}
+	secret := make([]byte, 32)
+	identity.PrivateKey.D.FillBytes(secret)
+	shares, err := shamir.Split(secret, len(holders), threshold)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]p2p.Message, len(holders))
+	for i, holder := range holders {
+		plaintext, err := json.Marshal(recoveryShare{Owner: identity.Address, Threshold: threshold, Share: shares[i]})
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := crypto.Encrypt(crypto.ToECDSAPub(common.Hex2Bytes(holder.PublicKey)), plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if messages[i], err = c.seal(recoveryShareMessageType, common.HexToAddress(holder.Id), common.Bytes2Hex(sealed), false); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// handleRecoveryShare keeps a share an accepted contact gave us.
+func (c *Contacts) handleRecoveryShare(manager *p2p.Manager, message p2p.Message) {
+	e, _, err := c.open(recoveryShareMessageType, message.Body)
+	if err != nil {
+		return
+	}
+	contact, ok := c.Contact(e.From.Hex())
+	if !ok || !contact.Accepted() {
+		return
+	}
+	sealed := common.Hex2Bytes(e.Message)
+	share, err := c.openShare(sealed)
+	if err != nil || share.Owner != e.From {
+		return
+	}
+	c.recoveries.mutex.Lock()
+	c.recoveries.state.Held[e.From.Hex()] = &heldShare{Owner: e.From, Sealed: sealed, Threshold: share.Threshold, Received: time.Now().Unix()}
+	c.recoveries.save()
+	c.recoveries.mutex.Unlock()
+	notify(fmt.Sprintf("Recovery: Holding a share of the account of %s (%s), %d shares recover it", contact.Alias, contact.Id, share.Threshold))
+}
+
+func (c *Contacts) openShare(sealed []byte) (*recoveryShare, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return nil, ErrIdentityLocked
+	}
+	plaintext, err := crypto.Decrypt(identity.PrivateKey, sealed)
+	if err != nil {
+		return nil, err
+	}
+	share := &recoveryShare{}
+	return share, json.Unmarshal(plaintext, share)
+}
+
+// RecoverAccount asks the contacts holding shares of an account for them,
+// they are returned to a key only this recovery knows once each holder
+// confirmed with the owner. Without holderIds the contacts the account was
+// backed up to from this node are asked.
+func (c *Contacts) RecoverAccount(ownerId string, holderIds []string, message string) error {
+	if !isAddress(ownerId) {
+		return ErrInvalidContact
+	}
+	owner := common.HexToAddress(ownerId)
+	c.recoveries.mutex.Lock()
+	if backup := c.recoveries.state.Backups[owner.Hex()]; backup != nil && len(holderIds) == 0 {
+		holderIds = backup.Holders
+	}
+	c.recoveries.mutex.Unlock()
+	if len(holderIds) < 2 {
+		return ErrRecoveryHolders
+	}
+	request, err := c.startRecovery(owner, message)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for _, holderId := range holderIds {
+		_, onionHost, err := c.locate(holderId)
+		if err == nil {
+			err = c.send(onionHost, request)
+		}
+		if err != nil {
+			notify(fmt.Sprintf("Recovery: Failed to ask %s for their share: %v", holderId, err))
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return ErrRecoveryHolders
+	}
+	return nil
+}
+
+// startRecovery generates the key shares of owner are returned to and the
+// request holders are sent.
+func (c *Contacts) startRecovery(owner common.Address, message string) (p2p.Message, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	body, err := json.Marshal(recoveryRequest{
+		Owner:       owner,
+		RecoveryKey: crypto.FromECDSAPub(&key.PublicKey),
+		OnionHost:   c.LocalOnionHost(),
+		Message:     message,
+		Timestamp:   time.Now().Unix(),
+	})
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	c.recoveries.mutex.Lock()
+	c.recoveries.started[owner.Hex()] = &recovery{key: key, shares: make(map[byte]shamir.Share)}
+	c.recoveries.mutex.Unlock()
+	return p2p.NewMessage(recoveryRequestMessageType, string(body)), nil
+}
+
+// handleRecoveryRequest keeps a request for a share we hold until the user
+// releases it, after making sure the owner is the one asking.
+func (c *Contacts) handleRecoveryRequest(manager *p2p.Manager, message p2p.Message) {
+	request := &recoveryRequest{}
+	if json.Unmarshal([]byte(message.Body), request) != nil {
+		return
+	}
+	if recoveryKey := crypto.ToECDSAPub(request.RecoveryKey); recoveryKey == nil || recoveryKey.X == nil {
+		return
+	}
+	age := time.Since(time.Unix(request.Timestamp, 0))
+	if age > maxMessageAge || age < -maxMessageAge {
+		return
+	}
+	owner := request.Owner.Hex()
+	c.recoveries.mutex.Lock()
+	_, held := c.recoveries.state.Held[owner]
+	if held {
+		c.recoveries.requests[owner] = request
+	}
+	c.recoveries.mutex.Unlock()
+	if !held {
+		return
+	}
+	contact, _ := c.Contact(owner)
+	notify(fmt.Sprintf("Recovery: %s (%s) asks for their share from %s: %s\nRecovery: Confirm it is them before releasing it with /release %s", contact.Alias, owner, request.OnionHost, request.Message, owner))
+}
+
+// ReleaseShare returns the share we hold of an account to the recovery that
+// asked for it.
+func (c *Contacts) ReleaseShare(ownerId string) error {
+	request, message, err := c.sealReturn(ownerId)
+	if err != nil {
+		return err
+	}
+	if err := c.send(request.OnionHost, message); err != nil {
+		return err
+	}
+	c.recoveries.mutex.Lock()
+	delete(c.recoveries.requests, request.Owner.Hex())
+	c.recoveries.mutex.Unlock()
+	return nil
+}
+
+// sealReturn encrypts the share we hold of an account to the key of the
+// recovery that asked for it.
+func (c *Contacts) sealReturn(ownerId string) (*recoveryRequest, p2p.Message, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return nil, p2p.Message{}, ErrIdentityLocked
+	}
+	owner := normalizeId(ownerId)
+	c.recoveries.mutex.Lock()
+	held, request := c.recoveries.state.Held[owner], c.recoveries.requests[owner]
+	c.recoveries.mutex.Unlock()
+	if held == nil || request == nil {
+		return nil, p2p.Message{}, ErrNoRecoveryRequest
+	}
+	plaintext, err := crypto.Decrypt(identity.PrivateKey, held.Sealed)
+	if err != nil {
+		return nil, p2p.Message{}, err
+	}
+	r := &recoveryReturn{Owner: request.Owner, Holder: identity.Address}
+	if r.Sealed, err = crypto.Encrypt(crypto.ToECDSAPub(request.RecoveryKey), plaintext); err != nil {
+		return nil, p2p.Message{}, err
+	}
+	if r.Signature, err = crypto.Sign(r.hash(), identity.PrivateKey); err != nil {
+		return nil, p2p.Message{}, err
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, p2p.Message{}, err
+	}
+	return request, p2p.NewMessage(recoveryReturnMessageType, string(body)), nil
+}
+
+// handleRecoveryReturn collects a share returned to one of our recoveries.
+func (c *Contacts) handleRecoveryReturn(manager *p2p.Manager, message p2p.Message) {
+	r := &recoveryReturn{}
+	if json.Unmarshal([]byte(message.Body), r) != nil {
+		return
+	}
+	publicKey, err := crypto.SigToPub(r.hash(), r.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != r.Holder {
+		return
+	}
+	c.recoveries.mutex.Lock()
+	started := c.recoveries.started[r.Owner.Hex()]
+	if started == nil {
+		c.recoveries.mutex.Unlock()
+		return
+	}
+	plaintext, err := crypto.Decrypt(started.key, r.Sealed)
+	share := &recoveryShare{}
+	if err != nil || json.Unmarshal(plaintext, share) != nil || share.Owner != r.Owner {
+		c.recoveries.mutex.Unlock()
+		return
+	}
+	started.shares[share.Share.X] = share.Share
+	if started.threshold == 0 {
+		started.threshold = share.Threshold
+	}
+	received, threshold := len(started.shares), started.threshold
+	c.recoveries.mutex.Unlock()
+	notify(fmt.Sprintf("Recovery: %s returned a share of %s, %d of %d", r.Holder.Hex(), r.Owner.Hex(), received, threshold))
+}
+
+// RecoveredKey rebuilds the key of an account from the shares returned so
+// far. Subsets are tried until one gives the account's address, so a bad
+// share from one holder is outvoted by the others.
+func (c *Contacts) RecoveredKey(ownerId string) (*crypto.Key, error) {
+	owner := normalizeId(ownerId)
+	c.recoveries.mutex.Lock()
+	started := c.recoveries.started[owner]
+	var shares []shamir.Share
+	threshold := 0
+	if started != nil {
+		threshold = started.threshold
+		for _, share := range started.shares {
+			shares = append(shares, share)
+		}
+	}
+	c.recoveries.mutex.Unlock()
+	if started == nil {
+		return nil, ErrNoRecovery
+	}
+	if threshold < 2 || len(shares) < threshold {
+		return nil, ErrTooFewShares
+	}
+	var key *crypto.Key
+	tried := 0
+	combinations(len(shares), threshold, func(subset []int) bool {
+		if tried++; tried > maxRecoveryCombinations {
+			return false
+		}
+		picked := make([]shamir.Share, len(subset))
+		for i, index := range subset {
+			picked[i] = shares[index]
+		}
+		secret, err := shamir.Combine(picked)
+		if err != nil {
+			return true
+		}
+		privateKey := crypto.ToECDSA(secret)
+		if privateKey.PublicKey.X != nil && crypto.PubkeyToAddress(privateKey.PublicKey).Hex() == owner {
+			key = crypto.NewKeyFromECDSA(privateKey)
+			return false
+		}
+		return true
+	})
+	if key == nil {
+		return nil, ErrRecoveryFailed
+	}
+	c.recoveries.mutex.Lock()
+	delete(c.recoveries.started, owner)
+	c.recoveries.mutex.Unlock()
+	return key, nil
+}
+
+// combinations calls visit with every k sized subset of 0..n-1 until it
+// returns false.
+func combinations(n, k int, visit func(subset []int) bool) {
+	subset := make([]int, k)
+	var pick func(start, depth int) bool
+	pick = func(start, depth int) bool {
+		if depth == k {
+			return visit(subset)
+		}
+		for i := start; i <= n-(k-depth); i++ {
+			subset[depth] = i
+			if !pick(i+1, depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	pick(0, 0)
+}
+
+// Recovery describes our backups, the shares we hold for contacts and the
+// recoveries in progress.
+func (c *Contacts) Recovery() (lines []string) {
+	c.recoveries.mutex.Lock()
+	defer c.recoveries.mutex.Unlock()
+	for owner, backup := range c.recoveries.state.Backups {
+		lines = append(lines, fmt.Sprintf("Backup of %s: %d of %v", owner, backup.Threshold, backup.Holders))
+	}
+	for owner, held := range c.recoveries.state.Held {
+		status := ""
+		if c.recoveries.requests[owner] != nil {
+			status = " (asked for, /release " + owner + ")"
+		}
+		lines = append(lines, fmt.Sprintf("Holding share of %s, %d recover it%s", owner, held.Threshold, status))
+	}
+	for owner, started := range c.recoveries.started {
+		lines = append(lines, fmt.Sprintf("Recovering %s: %d of %d shares returned", owner, len(started.shares), started.threshold))
+	}
+	return lines
+}
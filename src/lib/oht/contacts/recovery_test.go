@@ -0,0 +1,67 @@
+package contacts
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAccountRecovery(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	carol, carolDirectory := newTestContacts(t, "carolcarolcarolc.onion")
+	defer os.RemoveAll(carolDirectory)
+	carol.Alias = "carol"
+	alice.Request(carol.Identity().Address.Hex()+"@carolcarolcarolc.onion", "")
+	request, _ := alice.seal(requestMessageType, carol.Identity().Address, "", false)
+	carol.handleRequest(nil, request)
+	carol.Accept("alice")
+	response, _ := carol.seal(responseMessageType, alice.Identity().Address, "", true)
+	alice.handleResponse(nil, response)
+
+	aliceId := alice.Identity().Address.Hex()
+	bobContact, _ := alice.Contact(bob.Identity().Address.Hex())
+	carolContact, _ := alice.Contact(carol.Identity().Address.Hex())
+	if _, err := alice.sealShares(alice.Identity(), 3, []Contact{bobContact, carolContact}); err != ErrRecoveryHolders {
+		t.Errorf("expected %v for a threshold above the holders, got %v", ErrRecoveryHolders, err)
+	}
+	shares, err := alice.sealShares(alice.Identity(), 2, []Contact{bobContact, carolContact})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.handleRecoveryShare(nil, shares[0])
+	carol.handleRecoveryShare(nil, shares[1])
+
+	// Alice lost her key and recovers it on a new node
+	recovering, recoveringDirectory := newTestContacts(t, "newnodenewnodene.onion")
+	defer os.RemoveAll(recoveringDirectory)
+	if _, _, err := bob.sealReturn(aliceId); err != ErrNoRecoveryRequest {
+		t.Errorf("expected %v releasing a share nobody asked for, got %v", ErrNoRecoveryRequest, err)
+	}
+	recoveryRequest, err := recovering.startRecovery(alice.Identity().Address, "it is me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.handleRecoveryRequest(nil, recoveryRequest)
+	carol.handleRecoveryRequest(nil, recoveryRequest)
+
+	_, bobReturn, err := bob.sealReturn(aliceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovering.handleRecoveryReturn(nil, bobReturn)
+	if _, err := recovering.RecoveredKey(aliceId); err != ErrTooFewShares {
+		t.Errorf("expected %v with one share, got %v", ErrTooFewShares, err)
+	}
+	_, carolReturn, err := carol.sealReturn(aliceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovering.handleRecoveryReturn(nil, carolReturn)
+	key, err := recovering.RecoveredKey(aliceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Address != alice.Identity().Address || key.PrivateKey.D.Cmp(alice.Identity().PrivateKey.D) != 0 {
+		t.Errorf("expected the key of %s, got %s", aliceId, key.Address.Hex())
+	}
+}
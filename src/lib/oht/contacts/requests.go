@@ -0,0 +1,276 @@
+package contacts
+
+import (
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+const (
+	requestMessageType  = "contact_request"
+	responseMessageType = "contact_response"
+	// maxMessageAge bounds the clock difference accepted on signed contact
+	// messages, so a captured message can not be replayed much later.
+	maxMessageAge = time.Hour
+)
+
+var (
+	errEnvelopeSignature = errors.New("Contacts: Invalid signature")
+	errEnvelopeRecipient = errors.New("Contacts: Message is for another account")
+	errEnvelopeAge       = errors.New("Contacts: Message is too old")
+	errEnvelopeRevoked   = errors.New("Contacts: Message is signed by a revoked key")
+)
+
+// envelope is the signed body of contact requests and responses. The
+// signature proves the sender holds the key of From, the public key
+// recovered from it is kept to encrypt messages to the contact.
+type envelope struct {
+	From      common.Address
+	To        common.Address
+	OnionHost string
+	Alias     string
+	Message   string
+	Accepted  bool
+	Timestamp int64
+	Signature []byte
+}
+
+func (e *envelope) hash(messageType string) []byte {
+	var number [8]byte
+	binary.BigEndian.PutUint64(number[:], uint64(e.Timestamp))
+	accepted := []byte{0}
+	if e.Accepted {
+		accepted[0] = 1
+	}
+	return crypto.Sha3([]byte("oht-contact"), []byte(messageType), []byte{0}, e.From[:], e.To[:],
+		[]byte(e.OnionHost), []byte{0}, []byte(e.Alias), []byte{0}, []byte(e.Message), []byte{0},
+		accepted, number[:])
+}
+
+// seal signs an envelope to the account at to with our identity.
+func (c *Contacts) seal(messageType string, to common.Address, message string, accepted bool) (p2p.Message, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return p2p.Message{}, ErrIdentityLocked
+	}
+	e := &envelope{
+		From:      identity.Address,
+		To:        to,
+		OnionHost: c.LocalOnionHost(),
+		Alias:     c.Alias,
+		Message:   message,
+		Accepted:  accepted,
+		Timestamp: time.Now().Unix(),
+	}
+	signature, err := crypto.Sign(e.hash(messageType), identity.PrivateKey)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	e.Signature = signature
+	body, err := json.Marshal(e)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.NewMessage(messageType, string(body)), nil
+}
+
+// open verifies an envelope addressed to our identity and returns it with
+// the sender's public key.
+func (c *Contacts) open(messageType, body string) (*envelope, *ecdsa.PublicKey, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return nil, nil, ErrIdentityLocked
+	}
+	e := &envelope{}
+	if err := json.Unmarshal([]byte(body), e); err != nil {
+		return nil, nil, err
+	}
+	if e.To != identity.Address {
+		return nil, nil, errEnvelopeRecipient
+	}
+	age := time.Since(time.Unix(e.Timestamp, 0))
+	if age > maxMessageAge || age < -maxMessageAge {
+		return nil, nil, errEnvelopeAge
+	}
+	publicKey, err := crypto.SigToPub(e.hash(messageType), e.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != e.From {
+		return nil, nil, errEnvelopeSignature
+	}
+	if c.revoked(e.From) {
+		return nil, nil, errEnvelopeRevoked
+	}
+	return e, publicKey, nil
+}
+
+func (c *Contacts) send(onionHost string, message p2p.Message) error {
+	if c.manager == nil {
+		return errors.New("Contacts: P2P is not available")
+	}
+	return c.manager.SendToOnionHost(onionHost, c.ListenPort, message)
+}
+
+// Request asks an account to add us to their contacts, the contact is kept
+// with a pending request until they answer.
+func (c *Contacts) Request(contactId, message string) error {
+	address, onionHost, err := c.locate(contactId)
+	if err != nil {
+		return err
+	}
+	request, err := c.seal(requestMessageType, address, message, false)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	contact, ok := c.contacts[address.Hex()]
+	if ok && contact.Accepted() {
+		c.mutex.Unlock()
+		return ErrContactExists
+	}
+	if !ok {
+		contact = &Contact{Id: address.Hex()}
+		// A contact requested by name keeps the name as alias
+		if !isAddress(contactId) && !strings.Contains(contactId, "@") {
+			contact.Alias = contactId
+		}
+		c.contacts[contact.Id] = contact
+	}
+	contact.OnionHost = onionHost
+	contact.AddRequest = &Request{Message: message, Status: RequestSent}
+	err = c.save()
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.send(onionHost, request)
+}
+
+// Accept adds an account to our contacts, answering its pending request or
+// sending one of our own when it has not asked.
+func (c *Contacts) Accept(contactId string) error {
+	c.mutex.Lock()
+	contact := c.find(contactId)
+	if contact == nil || contact.AddRequest == nil || contact.AddRequest.Status == RequestRejected {
+		c.mutex.Unlock()
+		return c.Request(contactId, "")
+	}
+	switch contact.AddRequest.Status {
+	case RequestAccepted, RequestSent:
+		c.mutex.Unlock()
+		return ErrContactExists
+	}
+	contact.AddRequest.Status = RequestAccepted
+	err := c.save()
+	accepted := *contact
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.respond(accepted, true)
+}
+
+// Remove deletes a contact, rejecting its pending request. Accepted
+// contacts are told as well so they stop messaging us.
+func (c *Contacts) Remove(contactId string) error {
+	c.mutex.Lock()
+	contact := c.find(contactId)
+	if contact == nil {
+		c.mutex.Unlock()
+		return ErrContactNotFound
+	}
+	delete(c.contacts, contact.Id)
+	err := c.save()
+	removed := *contact
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if removed.AddRequest != nil && removed.AddRequest.Status != RequestSent && removed.AddRequest.Status != RequestRejected {
+		return c.respond(removed, false)
+	}
+	return nil
+}
+
+func (c *Contacts) respond(contact Contact, accepted bool) error {
+	response, err := c.seal(responseMessageType, common.HexToAddress(contact.Id), "", accepted)
+	if err != nil {
+		return err
+	}
+	return c.send(contact.OnionHost, response)
+}
+
+func (c *Contacts) handleRequest(manager *p2p.Manager, message p2p.Message) {
+	e, publicKey, err := c.open(requestMessageType, message.Body)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	contact, ok := c.contacts[e.From.Hex()]
+	if !ok {
+		contact = &Contact{Id: e.From.Hex(), Alias: e.Alias}
+		c.contacts[contact.Id] = contact
+	}
+	// A request from an account we asked ourselves, or from a contact that
+	// lost our earlier acceptance, is accepted right away.
+	accept := contact.AddRequest != nil && (contact.AddRequest.Status == RequestSent || contact.AddRequest.Status == RequestAccepted)
+	if accept {
+		contact.AddRequest.Status = RequestAccepted
+	} else {
+		contact.AddRequest = &Request{Alias: e.Alias, Message: e.Message, Status: RequestReceived}
+	}
+	contact.OnionHost = e.OnionHost
+	contact.PublicKey = common.Bytes2Hex(crypto.FromECDSAPub(publicKey))
+	contact.LastConnection = time.Now().Unix()
+	c.save()
+	accepted := *contact
+	c.mutex.Unlock()
+	if accept {
+		c.respond(accepted, true)
+		notify(fmt.Sprintf("Contacts: %s (%s) is now a contact", e.Alias, accepted.Id))
+	} else {
+		notify(fmt.Sprintf("Contacts: Request from %s (%s): %s", e.Alias, accepted.Id, e.Message))
+	}
+}
+
+func (c *Contacts) handleResponse(manager *p2p.Manager, message p2p.Message) {
+	e, publicKey, err := c.open(responseMessageType, message.Body)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	contact, ok := c.contacts[e.From.Hex()]
+	if !ok || contact.AddRequest == nil {
+		c.mutex.Unlock()
+		return
+	}
+	status := contact.AddRequest.Status
+	if e.Accepted && status == RequestSent {
+		contact.AddRequest.Status = RequestAccepted
+	} else if !e.Accepted {
+		contact.AddRequest.Status = RequestRejected
+	}
+	contact.OnionHost = e.OnionHost
+	contact.PublicKey = common.Bytes2Hex(crypto.FromECDSAPub(publicKey))
+	contact.LastConnection = time.Now().Unix()
+	c.save()
+	changed := (contact.AddRequest.Status != status)
+	event := fmt.Sprintf("Contacts: %s (%s) %s", contact.Alias, contact.Id, contact.Status())
+	c.mutex.Unlock()
+	if changed {
+		notify(event)
+	}
+}
+
+// notify prints an event for the console user the way received chat is.
+func notify(event string) {
+	fmt.Println("")
+	fmt.Println(event)
+	fmt.Printf("oht> ")
+}
@@ -0,0 +1,48 @@
+package contacts
+
+import (
+	"fmt"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+// revoked reports whether the DHT holds a revocation of an account key,
+// messages signed by it are refused from then on.
+func (c *Contacts) revoked(address common.Address) bool {
+	store := c.Store()
+	return store != nil && store.Revoked(address)
+}
+
+// revocationRecord marks a contact whose account key was revoked. When the
+// key was rotated the contact is told to send a request to the successor,
+// who is not added without one since the old key may have been stolen.
+func (c *Contacts) revocationRecord(key string, value []byte) {
+	record, err := dht.DecodeRevocationRecord(value)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	contact := c.contacts[record.Owner.Hex()]
+	if contact == nil {
+		c.mutex.Unlock()
+		return
+	}
+	successor := ""
+	if record.Successor != nil {
+		successor = record.Successor.Hex()
+	}
+	if contact.Revoked && contact.Successor == successor {
+		c.mutex.Unlock()
+		return
+	}
+	contact.Revoked, contact.Successor = true, successor
+	c.save()
+	alias := contact.Alias
+	c.mutex.Unlock()
+	if successor == "" {
+		notify(fmt.Sprintf("Contacts: %s (%s) revoked their account key: %s", alias, record.Owner.Hex(), record.Reason))
+	} else {
+		notify(fmt.Sprintf("Contacts: %s (%s) rotated their account key to %s: %s\nContacts: Confirm it is them before adding it with /request %s", alias, record.Owner.Hex(), successor, record.Reason, successor))
+	}
+}
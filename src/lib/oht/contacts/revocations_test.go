@@ -0,0 +1,36 @@
+package contacts
+
+import (
+	"testing"
+
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+func TestRevokedContact(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	db, _ := database.NewMemDatabase()
+	store := dht.NewStore(db, nil)
+	store.RegisterValidator(dht.RevocationNamespace, dht.RevocationValidator{})
+	bob.SetStore(store)
+
+	aliceId := alice.Identity().Address.Hex()
+	request, _ := alice.seal(requestMessageType, bob.Identity().Address, "hi", false)
+	successor, _ := crypto.GenerateKey()
+	successorKey := crypto.NewKeyFromECDSA(successor)
+	if err := store.Revoke(alice.Identity(), successorKey, "new device"); err != nil {
+		t.Fatal(err)
+	}
+	contact, _ := bob.Contact(aliceId)
+	if !contact.Revoked || contact.Successor != successorKey.Address.Hex() {
+		t.Errorf("expected the contact to be marked rotated, got %+v", contact)
+	}
+	if _, _, err := bob.open(requestMessageType, request.Body); err != errEnvelopeRevoked {
+		t.Errorf("expected %v, got %v", errEnvelopeRevoked, err)
+	}
+	if err := bob.Whisper(aliceId, "still there?"); err != ErrContactRevoked {
+		t.Errorf("expected %v, got %v", ErrContactRevoked, err)
+	}
+}
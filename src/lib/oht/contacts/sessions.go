@@ -0,0 +1,397 @@
+package contacts
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/crypto/ratchet"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+const (
+	// prekeyRotation is how often a new signed prekey is generated, the one
+	// before it is kept so sessions started just before still open.
+	prekeyRotation = 7 * 24 * time.Hour
+	// prekeyRefresh is how often the prekey bundle is published again
+	prekeyRefresh = 24 * time.Hour
+	// prekeyLookupTimeout is how long a whisper waits for the prekeys of a
+	// contact before falling back to encrypting to their account key.
+	prekeyLookupTimeout = 5 * time.Second
+	// sessionExpiry is how long a session nothing was received on is kept
+	// once the contact started another.
+	sessionExpiry = dht.MaxPrekeyTTL
+	// recentWhisperTTL covers every retry of a whisper, see recentWhisper.
+	recentWhisperTTL = whisperAckTimeout * (maxWhisperAttempts + 1)
+)
+
+var (
+	errSessionNotFound = errors.New("Whisper: Unknown session")
+	errSessionPrekey   = errors.New("Whisper: Session started with an unknown prekey")
+)
+
+type signedPrekey struct {
+	Id      uint32
+	Key     *ratchet.KeyPair
+	Created int64
+}
+
+// accountPrekeys are the x25519 keys of one account. The identity key is
+// bound to the account by the signature on the published bundle.
+type accountPrekeys struct {
+	Identity *ratchet.KeyPair
+	// Prekeys holds the current signed prekey last, preceded by the one it
+	// replaced.
+	Prekeys []*signedPrekey
+}
+
+func (prekeys *accountPrekeys) current() *signedPrekey {
+	return prekeys.Prekeys[len(prekeys.Prekeys)-1]
+}
+
+func (prekeys *accountPrekeys) find(id uint32) *signedPrekey {
+	for _, prekey := range prekeys.Prekeys {
+		if prekey.Id == id {
+			return prekey
+		}
+	}
+	return nil
+}
+
+// session is a Double Ratchet session between one of our accounts and a
+// contact. Once a message key is used it is gone, so a compromised account
+// key or a stolen sessions.json does not open earlier whispers.
+type session struct {
+	Account        string
+	Contact        string
+	State          *ratchet.State
+	AssociatedData []byte
+	// Initial is sent along until the contact answers on the session, so it
+	// can be started from any of the first whispers.
+	Initial  *ratchet.Initial `json:",omitempty"`
+	Created  int64
+	Received int64 `json:",omitempty"`
+}
+
+// recentWhisper remembers whispers opened by ciphertext. A whisper is sent
+// again until it is acknowledged, and its message key is gone after the
+// first copy is opened, so later copies are recognized here and
+// acknowledged again. They are kept in sessions.json without their body,
+// which is only held in memory, so copies arriving after a restart are
+// still acknowledged.
+type recentWhisper struct {
+	From     common.Address
+	To       common.Address
+	Sequence uint64
+	Received int64
+	whisper  *whisper
+}
+
+// sessionsFile is the layout of sessions.json.
+type sessionsFile struct {
+	Sessions map[string]*session
+	Recent   map[string]*recentWhisper `json:",omitempty"`
+}
+
+func sessionId(initial *ratchet.Initial) string {
+	return common.Bytes2Hex(crypto.Sha3([]byte("oht-whisper-session"), initial.EphemeralKey)[:16])
+}
+
+func (c *Contacts) loadSessions() error {
+	file, err := ioutil.ReadFile(c.prekeysPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		if err = json.Unmarshal(file, &c.prekeys); err != nil {
+			return err
+		}
+	}
+	file, err = ioutil.ReadFile(c.sessionsPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sessions := &sessionsFile{}
+	if err = json.Unmarshal(file, sessions); err != nil {
+		return err
+	}
+	if sessions.Sessions == nil {
+		// sessions.json used to hold the sessions alone
+		return json.Unmarshal(file, &c.sessions)
+	}
+	c.sessions = sessions.Sessions
+	if sessions.Recent != nil {
+		c.recent = sessions.Recent
+	}
+	return nil
+}
+
+// saveSessions writes prekeys.json and sessions.json, the caller holds the
+// session lock.
+func (c *Contacts) saveSessions() error {
+	sessions := &sessionsFile{Sessions: c.sessions, Recent: c.recent}
+	for path, value := range map[string]interface{}{c.prekeysPath: c.prekeys, c.sessionsPath: sessions} {
+		file, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(path, file, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountPrekeys returns the prekeys of an account, generating them the
+// first time and rotating the signed prekey when it is due. The caller holds
+// the session lock.
+func (c *Contacts) accountPrekeys(account common.Address) (*accountPrekeys, error) {
+	prekeys := c.prekeys[account.Hex()]
+	if prekeys == nil {
+		identity, err := ratchet.GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		prekeys = &accountPrekeys{Identity: identity}
+	}
+	if len(prekeys.Prekeys) == 0 || time.Since(time.Unix(prekeys.current().Created, 0)) > prekeyRotation {
+		key, err := ratchet.GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		id := uint32(1)
+		if len(prekeys.Prekeys) > 0 {
+			id = prekeys.current().Id + 1
+		}
+		prekeys.Prekeys = append(prekeys.Prekeys, &signedPrekey{Id: id, Key: key, Created: time.Now().Unix()})
+		if len(prekeys.Prekeys) > 2 {
+			prekeys.Prekeys = prekeys.Prekeys[len(prekeys.Prekeys)-2:]
+		}
+		c.prekeys[account.Hex()] = prekeys
+		if err := c.saveSessions(); err != nil {
+			return nil, err
+		}
+	}
+	return prekeys, nil
+}
+
+// PublishPrekeys publishes the prekey bundle of the unlocked account, so
+// contacts can start whisper sessions with it while we are offline.
+func (c *Contacts) PublishPrekeys() error {
+	identity, store := c.Identity(), c.Store()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	if store == nil {
+		return nil
+	}
+	c.sessionMutex.Lock()
+	prekeys, err := c.accountPrekeys(identity.Address)
+	c.sessionMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	prekey := prekeys.current()
+	return store.PublishPrekeys(identity, prekeys.Identity.Public, prekey.Key.Public, prekey.Id, dht.MaxPrekeyTTL)
+}
+
+// refreshPrekeys publishes the prekey bundle again well before it expires,
+// rotating the signed prekey when it is due.
+func (c *Contacts) refreshPrekeys() {
+	for {
+		if err := c.PublishPrekeys(); err != nil && err != ErrIdentityLocked {
+			log.Println(err)
+		}
+		time.Sleep(prekeyRefresh)
+	}
+}
+
+// sendingSession returns the session to whisper to a contact on, the one
+// last received on, or starts one from the contact's prekey bundle. Without
+// a bundle it returns nil and the whisper is encrypted to the account key,
+// the lookup is tried again on the next whisper.
+func (c *Contacts) sendingSession(identity *crypto.Key, contact Contact) (string, *session) {
+	c.sessionMutex.Lock()
+	id, current := c.contactSession(identity.Address.Hex(), contact.Id)
+	c.sessionMutex.Unlock()
+	if current != nil {
+		return id, current
+	}
+	store := c.Store()
+	if store == nil {
+		return "", nil
+	}
+	bundle, err := store.Prekeys(common.HexToAddress(contact.Id), prekeyLookupTimeout)
+	if err != nil {
+		// The prekeys in the contact's profile are as good
+		if profile, profileErr := store.Profile(common.HexToAddress(contact.Id), prekeyLookupTimeout); profileErr == nil && profile.Prekeys != nil {
+			bundle, err = profile.Prekeys, nil
+		}
+	}
+	if err != nil || bundle.Owner != common.HexToAddress(contact.Id) || bundle.Verify() != nil || bundle.Expired() {
+		return "", nil
+	}
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	prekeys, err := c.accountPrekeys(identity.Address)
+	if err != nil {
+		return "", nil
+	}
+	secret, initial, err := ratchet.Initiate(prekeys.Identity, bundle.IdentityKey, bundle.SignedPrekey, bundle.PrekeyId)
+	if err != nil {
+		return "", nil
+	}
+	state, err := ratchet.NewInitiator(secret, bundle.SignedPrekey)
+	if err != nil {
+		return "", nil
+	}
+	id = sessionId(initial)
+	c.sessions[id] = &session{
+		Account:        identity.Address.Hex(),
+		Contact:        contact.Id,
+		State:          state,
+		AssociatedData: ratchet.AssociatedData(prekeys.Identity.Public, bundle.IdentityKey),
+		Initial:        initial,
+		Created:        time.Now().Unix(),
+	}
+	return id, c.sessions[id]
+}
+
+// contactSession finds the session with a contact that was last received
+// on, or the latest one we started. The caller holds the session lock.
+func (c *Contacts) contactSession(account, contactId string) (id string, found *session) {
+	for sessionId, session := range c.sessions {
+		if session.Account != account || session.Contact != contactId || session.State.SendChain == nil {
+			continue
+		}
+		if found == nil || session.Received > found.Received || (session.Received == found.Received && session.Created > found.Created) {
+			id, found = sessionId, session
+		}
+	}
+	return id, found
+}
+
+// sealSession encrypts a whisper on a session.
+func (c *Contacts) sealSession(id string, session *session, sealed *sealedWhisper, plaintext []byte) error {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	header, ciphertext, err := session.State.Encrypt(plaintext, append(common.CopyBytes(session.AssociatedData), sealed.To[:]...))
+	if err != nil {
+		return err
+	}
+	sealed.Session, sealed.Ratchet, sealed.Initial, sealed.Ciphertext = id, header, session.Initial, ciphertext
+	return c.saveSessions()
+}
+
+// openSession decrypts a whisper sent on a session. A session started by
+// the contact is returned unsaved, it is only kept once the whisper it
+// carried is verified, see bindSession.
+func (c *Contacts) openSession(identity *crypto.Key, sealed *sealedWhisper) (plaintext []byte, started *session, err error) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	current := c.sessions[sealed.Session]
+	if current == nil {
+		if sealed.Initial == nil || sessionId(sealed.Initial) != sealed.Session {
+			return nil, nil, errSessionNotFound
+		}
+		prekeys := c.prekeys[identity.Address.Hex()]
+		if prekeys == nil {
+			return nil, nil, errSessionPrekey
+		}
+		prekey := prekeys.find(sealed.Initial.PrekeyId)
+		if prekey == nil {
+			return nil, nil, errSessionPrekey
+		}
+		secret, err := ratchet.Respond(prekeys.Identity, prekey.Key, sealed.Initial)
+		if err != nil {
+			return nil, nil, err
+		}
+		started = &session{
+			Account:        identity.Address.Hex(),
+			State:          ratchet.NewResponder(secret, prekey.Key),
+			AssociatedData: ratchet.AssociatedData(sealed.Initial.IdentityKey, prekeys.Identity.Public),
+			Created:        time.Now().Unix(),
+		}
+		current = started
+	} else if current.Account != identity.Address.Hex() {
+		return nil, nil, errSessionNotFound
+	}
+	plaintext, err = current.State.Decrypt(sealed.Ratchet, sealed.Ciphertext, append(common.CopyBytes(current.AssociatedData), sealed.To[:]...))
+	if err != nil {
+		return nil, nil, err
+	}
+	if started == nil {
+		// The contact answered, the initial message is no longer needed
+		current.Initial = nil
+		current.Received = time.Now().Unix()
+		if err := c.saveSessions(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return plaintext, started, nil
+}
+
+// bindSession keeps a session the contact started once the whisper it
+// carried was verified, and forgets the contact's sessions that have been
+// idle for longer than sessionExpiry.
+func (c *Contacts) bindSession(id string, started *session, contactId string) error {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	started.Contact = contactId
+	started.Received = time.Now().Unix()
+	c.sessions[id] = started
+	for sessionId, session := range c.sessions {
+		last := session.Received
+		if last == 0 {
+			last = session.Created
+		}
+		if session.Account == started.Account && session.Contact == contactId && time.Since(time.Unix(last, 0)) > sessionExpiry {
+			delete(c.sessions, sessionId)
+		}
+	}
+	return c.saveSessions()
+}
+
+// rememberWhisper records an opened whisper by its ciphertext, dropping the
+// ones older than recentWhisperTTL.
+func (c *Contacts) rememberWhisper(ciphertext []byte, w *whisper) error {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	now := time.Now()
+	for key, recent := range c.recent {
+		if now.Sub(time.Unix(recent.Received, 0)) > recentWhisperTTL {
+			delete(c.recent, key)
+		}
+	}
+	c.recent[common.Bytes2Hex(crypto.Sha3(ciphertext))] = &recentWhisper{From: w.From, To: w.To, Sequence: w.Sequence, Received: now.Unix(), whisper: w}
+	return c.saveSessions()
+}
+
+// recentWhisper returns a whisper opened before by its ciphertext. One
+// remembered from an earlier run has no body and is only acknowledged.
+func (c *Contacts) recentWhisper(ciphertext []byte) *whisper {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	recent, ok := c.recent[common.Bytes2Hex(crypto.Sha3(ciphertext))]
+	if !ok || time.Since(time.Unix(recent.Received, 0)) > recentWhisperTTL {
+		return nil
+	}
+	if recent.whisper != nil {
+		return recent.whisper
+	}
+	return &whisper{From: recent.From, To: recent.To, Sequence: recent.Sequence, copy: true}
+}
+
+// sessionWith reports whether a session belongs to a contact.
+func (c *Contacts) sessionWith(id, contactId string) bool {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	session, ok := c.sessions[id]
+	return ok && session.Contact == contactId
+}
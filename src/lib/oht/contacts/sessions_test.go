@@ -0,0 +1,127 @@
+package contacts
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+func TestWhisperSession(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	db, _ := database.NewMemDatabase()
+	store := dht.NewStore(db, nil)
+	store.RegisterValidator(dht.MailboxNamespace, dht.MailboxValidator{})
+	store.RegisterValidator(dht.PrekeyNamespace, dht.PrekeyValidator{})
+	// Both are offline, whispers go through the mailbox
+	alice.store, bob.store = store, store
+	if err := bob.PublishPrekeys(); err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	bob.OnWhisper = func(contact Contact, body string, timestamp int64, late bool) {
+		bodies = append(bodies, body)
+	}
+
+	for _, body := range []string{"one", "two"} {
+		if err := alice.Whisper(bob.Identity().Address.Hex(), body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := store.Mailbox(bob.Identity().Address)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 whispers in bob's mailbox, got %d", len(records))
+	}
+	var first sealedWhisper
+	json.Unmarshal(records[0].Sealed, &first)
+	if first.Session == "" || first.Initial == nil {
+		t.Fatal("expected the whisper to start a session")
+	}
+	bob.FetchMailbox()
+	if !reflect.DeepEqual(bodies, []string{"one", "two"}) {
+		t.Fatalf("expected both whispers in order, got %v", bodies)
+	}
+	// A copy of a whisper is recognized although its key is gone
+	if _, err := bob.openWhisper(string(records[0].Sealed)); err != nil {
+		t.Errorf("expected a copy to be recognized, got %v", err)
+	}
+
+	var replies []string
+	alice.OnWhisper = func(contact Contact, body string, timestamp int64, late bool) {
+		replies = append(replies, body)
+	}
+	if err := bob.Whisper(alice.Identity().Address.Hex(), "three"); err != nil {
+		t.Fatal(err)
+	}
+	var reply sealedWhisper
+	json.Unmarshal(store.Mailbox(alice.Identity().Address)[0].Sealed, &reply)
+	if reply.Session != first.Session || reply.Initial != nil {
+		t.Error("expected bob to answer on the session alice started")
+	}
+	alice.FetchMailbox()
+	if !reflect.DeepEqual(replies, []string{"three"}) {
+		t.Fatalf("expected the reply, got %v", replies)
+	}
+	if session := alice.sessions[first.Session]; session == nil || session.Initial != nil {
+		t.Error("expected the session to be established once bob answered")
+	}
+
+	// Recent copies are still recognized after a restart, but not delivered
+	// again
+	restarted, err := InitializeContacts(filepath.Dir(bob.sessionsPath), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.SetIdentity(bob.Identity())
+	restarted.OnWhisper = bob.OnWhisper
+	if w, err := restarted.openWhisper(string(records[0].Sealed)); err != nil || !w.copy {
+		t.Errorf("expected a copy to be recognized after a restart, got %v", err)
+	}
+	restarted.handleWhisper(nil, p2p.NewMessage(whisperMessageType, string(records[1].Sealed)))
+	if !reflect.DeepEqual(bodies, []string{"one", "two"}) {
+		t.Errorf("expected the copy not to be delivered again, got %v", bodies)
+	}
+
+	// Once the recent copies are forgotten, bob can not open the whispers
+	// he received again
+	bob.recent = make(map[string]*recentWhisper)
+	if _, err := bob.openWhisper(string(records[0].Sealed)); err != errWhisperDecrypt {
+		t.Errorf("expected %v, got %v", errWhisperDecrypt, err)
+	}
+}
+
+func TestProfileUpdatesContact(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	db, _ := database.NewMemDatabase()
+	store := dht.NewStore(db, nil)
+	store.RegisterValidator(dht.MailboxNamespace, dht.MailboxValidator{})
+	store.RegisterValidator(dht.ProfileNamespace, dht.ProfileValidator{})
+	alice.store, bob.store = store, store
+	store.Watch(dht.ProfileNamespace+"/", bob.profileRecord)
+
+	alice.Alias = "Alice Liddell"
+	alice.LocalOnionHost = func() string { return "alicemovedalicem.onion" }
+	if err := alice.PublishProfile(); err != nil {
+		t.Fatal(err)
+	}
+	contact, _ := bob.Contact(alice.Identity().Address.Hex())
+	if contact.DisplayName != "Alice Liddell" || contact.OnionHost != "alicemovedalicem.onion" {
+		t.Errorf("expected the contact to follow alice's profile, got %+v", contact)
+	}
+
+	// The prekeys in the profile start a session
+	if err := bob.Whisper(alice.Identity().Address.Hex(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var sealed sealedWhisper
+	json.Unmarshal(store.Mailbox(alice.Identity().Address)[0].Sealed, &sealed)
+	if sealed.Session == "" {
+		t.Error("expected the whisper to start a session from the profile prekeys")
+	}
+}
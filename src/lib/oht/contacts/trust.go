@@ -0,0 +1,216 @@
+package contacts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+// Trust levels of a contact, shown in ListContacts.
+const (
+	TrustUnverified = iota
+	// TrustVouched contacts were vouched for in the DHT by contacts we
+	// verified ourselves.
+	TrustVouched
+	// TrustVerified contacts had their safety number compared with ours.
+	TrustVerified
+)
+
+// safetyIterations slows down finding a key whose safety number collides
+// with another's.
+const safetyIterations = 5200
+
+var (
+	ErrNotVerified = errors.New("Contacts: Compare safety numbers and verify the contact first")
+	errNoStore     = errors.New("Contacts: The DHT is not available")
+)
+
+var trustLevels = map[int]string{
+	TrustUnverified: "unverified",
+	TrustVouched:    "vouched",
+	TrustVerified:   "verified",
+}
+
+// fingerprint is the half of a safety number for one account key, 30
+// digits in groups of 5.
+func fingerprint(publicKey []byte) []string {
+	hash := crypto.Sha3([]byte("oht-safety-number"), publicKey)
+	for i := 0; i < safetyIterations; i++ {
+		hash = crypto.Sha3(hash, publicKey)
+	}
+	var groups []string
+	for i := 0; i < 30; i += 5 {
+		var chunk [8]byte
+		copy(chunk[3:], hash[i:i+5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000))
+	}
+	return groups
+}
+
+// SafetyNumber is 60 digits derived from our account key and the contact's.
+// Both sides see the same number, when it matches what the contact reads
+// out in person no one is in the middle.
+func SafetyNumber(ours, theirs []byte) string {
+	if bytes.Compare(ours, theirs) > 0 {
+		ours, theirs = theirs, ours
+	}
+	return strings.Join(append(fingerprint(ours), fingerprint(theirs)...), " ")
+}
+
+// verifiedBy reports whether our identity verified the contact, the
+// attestation is only ours if it was made as the unlocked account.
+func (contact *Contact) verifiedBy(identity *crypto.Key) bool {
+	return identity != nil && contact.Attestation != nil && contact.Attestation.Attester == identity.Address && !contact.Attestation.Expired()
+}
+
+// SafetyNumber returns the safety number to compare with a contact.
+func (c *Contacts) SafetyNumber(contactId string) (string, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return "", ErrIdentityLocked
+	}
+	contact, ok := c.Contact(contactId)
+	if !ok || contact.PublicKey == "" {
+		return "", ErrNotAContact
+	}
+	return SafetyNumber(crypto.FromECDSAPub(&identity.PrivateKey.PublicKey), common.Hex2Bytes(contact.PublicKey)), nil
+}
+
+// Verify records that the safety number of a contact was compared, as an
+// attestation signed by our account that is kept until it is published
+// with Vouch.
+func (c *Contacts) Verify(contactId string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	contact, ok := c.Contact(contactId)
+	if !ok || !contact.Accepted() || contact.PublicKey == "" {
+		return ErrNotAContact
+	}
+	if contact.Revoked {
+		return ErrContactRevoked
+	}
+	attestation, err := dht.NewAttestation(identity, common.HexToAddress(contact.Id), dht.MaxAttestationTTL, false)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if saved := c.contacts[contact.Id]; saved != nil {
+		saved.Attestation, saved.Vouched = attestation, false
+	}
+	return c.save()
+}
+
+// Vouch publishes our attestation of a verified contact in the DHT, so our
+// contacts who verified us trust them too.
+func (c *Contacts) Vouch(contactId string) error {
+	identity, store := c.Identity(), c.Store()
+	if store == nil {
+		return errNoStore
+	}
+	contact, ok := c.Contact(contactId)
+	if !ok {
+		return ErrNotAContact
+	}
+	if !contact.verifiedBy(identity) {
+		return ErrNotVerified
+	}
+	if err := store.PublishAttestation(contact.Attestation); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if saved := c.contacts[contact.Id]; saved != nil {
+		saved.Vouched = true
+	}
+	return c.save()
+}
+
+// Unverify forgets that a contact was verified, an attestation that was
+// published is withdrawn.
+func (c *Contacts) Unverify(contactId string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	contact, ok := c.Contact(contactId)
+	if !ok {
+		return ErrNotAContact
+	}
+	if contact.Vouched && contact.verifiedBy(identity) {
+		store := c.Store()
+		if store == nil {
+			return errNoStore
+		}
+		withdrawn, err := dht.NewAttestation(identity, common.HexToAddress(contact.Id), dht.MaxAttestationTTL, true)
+		if err != nil {
+			return err
+		}
+		if err := store.PublishAttestation(withdrawn); err != nil {
+			return err
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if saved := c.contacts[contact.Id]; saved != nil {
+		saved.Attestation, saved.Vouched = nil, false
+	}
+	return c.save()
+}
+
+// Trust returns the trust level of a contact and the aliases of the
+// verified contacts who vouched for them.
+func (c *Contacts) Trust(contactId string) (level int, vouchers []string) {
+	identity, store := c.Identity(), c.Store()
+	contact, ok := c.Contact(contactId)
+	if !ok || contact.Revoked {
+		return TrustUnverified, nil
+	}
+	if contact.verifiedBy(identity) {
+		return TrustVerified, nil
+	}
+	if store == nil {
+		return TrustUnverified, nil
+	}
+	for _, attestation := range store.Attestations(common.HexToAddress(contact.Id)) {
+		attester, ok := c.Contact(attestation.Attester.Hex())
+		if ok && !attester.Revoked && attester.verifiedBy(identity) {
+			vouchers = append(vouchers, attester.Alias)
+		}
+	}
+	if len(vouchers) == 0 {
+		return TrustUnverified, nil
+	}
+	sort.Strings(vouchers)
+	return TrustVouched, vouchers
+}
+
+// TrustStatus describes the trust level of a contact.
+func (c *Contacts) TrustStatus(contactId string) string {
+	level, vouchers := c.Trust(contactId)
+	if level == TrustVouched {
+		return trustLevels[level] + " by " + strings.Join(vouchers, ", ")
+	}
+	return trustLevels[level]
+}
+
+// SyncAttestations asks the connected peers for the attestations of our
+// contacts.
+func (c *Contacts) SyncAttestations() {
+	store := c.Store()
+	if store == nil {
+		return
+	}
+	for _, contact := range c.List() {
+		store.SyncAttestations(common.HexToAddress(contact.Id))
+	}
+}
@@ -0,0 +1,78 @@
+package contacts
+
+import (
+	"os"
+	"testing"
+
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	forBob, err := alice.SafetyNumber(bob.Identity().Address.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forAlice, _ := bob.SafetyNumber("alice")
+	if forBob != forAlice || len(forBob) != 71 {
+		t.Errorf("expected both sides to see the same 60 digits, got %q and %q", forBob, forAlice)
+	}
+	carol, carolDirectory := newTestContacts(t, "carolcarolcarolc.onion")
+	defer os.RemoveAll(carolDirectory)
+	if _, err := carol.SafetyNumber(bob.Identity().Address.Hex()); err != ErrNotAContact {
+		t.Errorf("expected %v, got %v", ErrNotAContact, err)
+	}
+}
+
+func TestVouchedContact(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	carol, carolDirectory := newTestContacts(t, "carolcarolcarolc.onion")
+	defer os.RemoveAll(carolDirectory)
+	carol.Alias = "carol"
+	// Carol is a contact of both alice and bob
+	for _, c := range []*Contacts{alice, bob} {
+		request, _ := carol.seal(requestMessageType, c.Identity().Address, "", false)
+		c.handleRequest(nil, request)
+		c.Accept("carol")
+	}
+	db, _ := database.NewMemDatabase()
+	store := dht.NewStore(db, nil)
+	store.RegisterValidator(dht.AttestationNamespace, dht.AttestationValidator{})
+	alice.SetStore(store)
+	bob.SetStore(store)
+
+	carolId := carol.Identity().Address.Hex()
+	if level, _ := bob.Trust(carolId); level != TrustUnverified {
+		t.Errorf("expected carol to be unverified, got %d", level)
+	}
+	if err := alice.Vouch("carol"); err != ErrNotVerified {
+		t.Errorf("expected %v vouching for an unverified contact, got %v", ErrNotVerified, err)
+	}
+	if err := alice.Verify("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Vouch("carol"); err != nil {
+		t.Fatal(err)
+	}
+	// Alice's word only counts for bob once he verified her
+	if level, _ := bob.Trust(carolId); level != TrustUnverified {
+		t.Errorf("expected carol to stay unverified, got %d", level)
+	}
+	bob.Verify("alice")
+	if status := bob.TrustStatus(carolId); status != "vouched by alice" {
+		t.Errorf("expected carol to be vouched by alice, got %q", status)
+	}
+	if level, _ := alice.Trust(carolId); level != TrustVerified {
+		t.Errorf("expected carol to be verified by alice, got %d", level)
+	}
+
+	if err := alice.Unverify("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if level, _ := bob.Trust(carolId); level != TrustUnverified {
+		t.Errorf("expected the withdrawn attestation to no longer count, got %d", level)
+	}
+}
@@ -0,0 +1,466 @@
+package contacts
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/crypto/ratchet"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+const (
+	whisperMessageType    = "whisper"
+	whisperAckMessageType = "whisper_ack"
+	// whisperAckTimeout is how long a whisper waits for its acknowledgement
+	// before it is sent again, up to maxWhisperAttempts times.
+	whisperAckTimeout  = 30 * time.Second
+	maxWhisperAttempts = 5
+	// reorderTimeout is how long whispers received ahead of a missing one
+	// are held back before the gap is skipped.
+	reorderTimeout = 2 * time.Minute
+	// maxSkippedWhispers bounds how many skipped sequence numbers of a
+	// contact are remembered to deliver late.
+	maxSkippedWhispers = 256
+)
+
+var (
+	ErrNotAContact     = errors.New("Whisper: Account is not an accepted contact")
+	ErrContactRevoked  = errors.New("Whisper: The contact revoked their account key")
+	errWhisperDecrypt  = errors.New("Whisper: Failed to decrypt")
+	errWhisperSequence = errors.New("Whisper: Invalid sequence")
+)
+
+// WhisperFunc is called with every whisper received from a contact, in the
+// order they were sent. Whispers that arrive after the gap they left was
+// skipped are late, and delivered out of order.
+type WhisperFunc func(contact Contact, body string, timestamp int64, late bool)
+
+// sealedWhisper is what travels over p2p, only the recipient can read who
+// sent it. Whispers are encrypted on a session with the contact when they
+// published prekeys, otherwise to their account key.
+type sealedWhisper struct {
+	To         common.Address
+	Session    string           `json:",omitempty"`
+	Ratchet    *ratchet.Header  `json:",omitempty"`
+	Initial    *ratchet.Initial `json:",omitempty"`
+	Ciphertext []byte
+}
+
+// whisper is the plaintext of a sealedWhisper, signed by the sender so the
+// recipient knows which contact it is from.
+type whisper struct {
+	From      common.Address
+	To        common.Address
+	Sequence  uint64
+	Timestamp int64
+	Body      string
+	Signature []byte
+	// copy is set on a whisper recognized from an earlier run, which is
+	// acknowledged again but not delivered
+	copy bool
+}
+
+func (w *whisper) hash() []byte {
+	var numbers [16]byte
+	binary.BigEndian.PutUint64(numbers[:8], w.Sequence)
+	binary.BigEndian.PutUint64(numbers[8:], uint64(w.Timestamp))
+	return crypto.Sha3([]byte("oht-whisper"), w.From[:], w.To[:], numbers[:], []byte(w.Body))
+}
+
+type whisperAck struct {
+	From      common.Address
+	To        common.Address
+	Sequence  uint64
+	Signature []byte
+}
+
+func (a *whisperAck) hash() []byte {
+	var number [8]byte
+	binary.BigEndian.PutUint64(number[:], a.Sequence)
+	return crypto.Sha3([]byte("oht-whisper-ack"), a.From[:], a.To[:], number[:])
+}
+
+type pendingWhisper struct {
+	contactId string
+	sequence  uint64
+	message   p2p.Message
+	attempts  int
+}
+
+// received holds whispers from one contact that arrived ahead of a missing
+// sequence number.
+type received struct {
+	whispers map[uint64]*whisper
+}
+
+func pendingKey(contactId string, sequence uint64) string {
+	return fmt.Sprintf("%s/%d", contactId, sequence)
+}
+
+// Whisper sends an end-to-end encrypted message to an accepted contact. It
+// is sent again until the contact acknowledges it, an error only means the
+// first attempt failed.
+func (c *Contacts) Whisper(contactId, body string) error {
+	identity := c.Identity()
+	if identity == nil {
+		return ErrIdentityLocked
+	}
+	c.mutex.Lock()
+	contact := c.find(contactId)
+	if contact == nil || !contact.Accepted() || contact.PublicKey == "" {
+		c.mutex.Unlock()
+		return ErrNotAContact
+	}
+	if contact.Revoked {
+		c.mutex.Unlock()
+		return ErrContactRevoked
+	}
+	contact.SentSequence++
+	w := &whisper{
+		From:      identity.Address,
+		To:        common.HexToAddress(contact.Id),
+		Sequence:  contact.SentSequence,
+		Timestamp: time.Now().Unix(),
+		Body:      body,
+	}
+	err := c.save()
+	to := *contact
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if w.Signature, err = crypto.Sign(w.hash(), identity.PrivateKey); err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	envelope := sealedWhisper{To: w.To}
+	if id, session := c.sendingSession(identity, to); session != nil {
+		err = c.sealSession(id, session, &envelope, plaintext)
+	} else {
+		// No session is kept for the contact, so the next whisper looks up
+		// their prekeys again
+		notify(fmt.Sprintf("Whisper: No prekeys of %s (%s) were found, message %d is encrypted to their account key without forward secrecy", to.Alias, to.Id, w.Sequence))
+		envelope.Ciphertext, err = crypto.Encrypt(crypto.ToECDSAPub(common.Hex2Bytes(to.PublicKey)), plaintext)
+	}
+	if err != nil {
+		return err
+	}
+	sealed, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	pending := &pendingWhisper{contactId: to.Id, sequence: w.Sequence, message: p2p.NewMessage(whisperMessageType, string(sealed))}
+	c.pendingMutex.Lock()
+	c.pending[pendingKey(to.Id, w.Sequence)] = pending
+	c.pendingMutex.Unlock()
+	return c.attemptWhisper(pending)
+}
+
+func (c *Contacts) attemptWhisper(pending *pendingWhisper) error {
+	c.pendingMutex.Lock()
+	if _, ok := c.pending[pendingKey(pending.contactId, pending.sequence)]; !ok {
+		c.pendingMutex.Unlock()
+		return nil
+	}
+	pending.attempts++
+	if pending.attempts > maxWhisperAttempts {
+		delete(c.pending, pendingKey(pending.contactId, pending.sequence))
+		c.pendingMutex.Unlock()
+		c.deposit(pending)
+		return nil
+	}
+	c.pendingMutex.Unlock()
+	contact, ok := c.Contact(pending.contactId)
+	if !ok {
+		return ErrNotAContact
+	}
+	err := c.send(contact.OnionHost, pending.message)
+	if err != nil && c.Store() != nil {
+		// The contact is offline, retrying would not reach them either
+		c.pendingMutex.Lock()
+		delete(c.pending, pendingKey(pending.contactId, pending.sequence))
+		c.pendingMutex.Unlock()
+		c.deposit(pending)
+		return nil
+	}
+	time.AfterFunc(whisperAckTimeout, func() { c.attemptWhisper(pending) })
+	return err
+}
+
+// undelivered is called with whispers that were never acknowledged.
+func (c *Contacts) undelivered(pending *pendingWhisper) {
+	contact, _ := c.Contact(pending.contactId)
+	notify(fmt.Sprintf("Whisper: Message %d to %s (%s) was not delivered", pending.sequence, contact.Alias, pending.contactId))
+}
+
+// Pending returns how many whispers are waiting for an acknowledgement.
+func (c *Contacts) Pending() int {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	return len(c.pending)
+}
+
+// openWhisper decrypts a whisper to our identity and checks it was signed
+// by an accepted contact.
+func (c *Contacts) openWhisper(body string) (*whisper, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return nil, ErrIdentityLocked
+	}
+	var sealed sealedWhisper
+	if err := json.Unmarshal([]byte(body), &sealed); err != nil {
+		return nil, err
+	}
+	if sealed.To != identity.Address {
+		return nil, errEnvelopeRecipient
+	}
+	var plaintext []byte
+	var started *session
+	var err error
+	if sealed.Session != "" {
+		plaintext, started, err = c.openSession(identity, &sealed)
+	} else {
+		plaintext, err = crypto.Decrypt(identity.PrivateKey, sealed.Ciphertext)
+	}
+	if err != nil {
+		if w := c.recentWhisper(sealed.Ciphertext); w != nil {
+			return w, nil
+		}
+		return nil, errWhisperDecrypt
+	}
+	w := &whisper{}
+	if err := json.Unmarshal(plaintext, w); err != nil {
+		return nil, err
+	}
+	publicKey, err := crypto.SigToPub(w.hash(), w.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != w.From || w.To != identity.Address {
+		return nil, errEnvelopeSignature
+	}
+	if c.revoked(w.From) {
+		return nil, errEnvelopeRevoked
+	}
+	if contact, ok := c.Contact(w.From.Hex()); !ok || !contact.Accepted() {
+		return nil, ErrNotAContact
+	}
+	if w.Sequence == 0 {
+		return nil, errWhisperSequence
+	}
+	if sealed.Session != "" {
+		// The whisper signature is what ties a session to a contact
+		if started != nil {
+			if err := c.bindSession(sealed.Session, started, w.From.Hex()); err != nil {
+				return nil, err
+			}
+		} else if !c.sessionWith(sealed.Session, w.From.Hex()) {
+			return nil, errEnvelopeSignature
+		}
+		if err := c.rememberWhisper(sealed.Ciphertext, w); err != nil {
+			log.Println("Whisper: Failed to save sessions.json:", err)
+		}
+	}
+	return w, nil
+}
+
+func (c *Contacts) handleWhisper(manager *p2p.Manager, message p2p.Message) {
+	w, err := c.openWhisper(message.Body)
+	if err != nil {
+		return
+	}
+	// Duplicates are acknowledged again, the first acknowledgement may have
+	// been lost.
+	c.acknowledge(w, message.From)
+	c.receive(w)
+}
+
+// receive passes whispers on in sequence order, holding back any that
+// arrive ahead of a missing one. A whisper whose gap was skipped already is
+// delivered late, any other older whisper is a duplicate.
+func (c *Contacts) receive(w *whisper) {
+	if w.copy {
+		return
+	}
+	id := w.From.Hex()
+	c.mutex.Lock()
+	contact := c.contacts[id]
+	if contact == nil {
+		c.mutex.Unlock()
+		return
+	}
+	if w.Sequence <= contact.ReceivedSequence {
+		late := contact.unskip(w.Sequence)
+		if late {
+			c.save()
+		}
+		delivered := *contact
+		c.mutex.Unlock()
+		if late {
+			c.OnWhisper(delivered, w.Body, w.Timestamp, true)
+		}
+		return
+	}
+	buffer, ok := c.received[id]
+	if !ok {
+		buffer = &received{whispers: make(map[uint64]*whisper)}
+		c.received[id] = buffer
+	}
+	buffer.whispers[w.Sequence] = w
+	ready := c.ready(contact, buffer, false)
+	if len(buffer.whispers) == 0 {
+		delete(c.received, id)
+	} else if !ok {
+		time.AfterFunc(reorderTimeout, func() { c.flushReceived(id) })
+	}
+	c.save()
+	delivered := *contact
+	c.mutex.Unlock()
+	for _, w := range ready {
+		c.OnWhisper(delivered, w.Body, w.Timestamp, false)
+	}
+}
+
+// flushReceived skips the gap in front of whispers that waited longer than
+// reorderTimeout for it to be filled.
+func (c *Contacts) flushReceived(id string) {
+	c.mutex.Lock()
+	contact, buffer := c.contacts[id], c.received[id]
+	if contact == nil || buffer == nil {
+		c.mutex.Unlock()
+		return
+	}
+	ready := c.ready(contact, buffer, true)
+	delete(c.received, id)
+	c.save()
+	delivered := *contact
+	c.mutex.Unlock()
+	for _, w := range ready {
+		c.OnWhisper(delivered, w.Body, w.Timestamp, false)
+	}
+}
+
+// ready removes the whispers that can be delivered from buffer, in order,
+// and advances the contact's received sequence. With skipGaps every
+// buffered whisper is delivered. The caller holds the lock.
+func (c *Contacts) ready(contact *Contact, buffer *received, skipGaps bool) (ready []*whisper) {
+	for len(buffer.whispers) > 0 {
+		next := contact.ReceivedSequence + 1
+		if _, ok := buffer.whispers[next]; !ok {
+			if !skipGaps {
+				break
+			}
+			for sequence := range buffer.whispers {
+				if next == contact.ReceivedSequence+1 || sequence < next {
+					next = sequence
+				}
+			}
+		}
+		contact.skip(contact.ReceivedSequence+1, next)
+		ready = append(ready, buffer.whispers[next])
+		delete(buffer.whispers, next)
+		contact.ReceivedSequence = next
+	}
+	return ready
+}
+
+// skip remembers the sequence numbers from first up to next as skipped,
+// keeping the most recent maxSkippedWhispers.
+func (contact *Contact) skip(first, next uint64) {
+	if next-first > maxSkippedWhispers {
+		first = next - maxSkippedWhispers
+	}
+	for sequence := first; sequence < next; sequence++ {
+		contact.Skipped = append(contact.Skipped, sequence)
+	}
+	if len(contact.Skipped) > maxSkippedWhispers {
+		contact.Skipped = contact.Skipped[len(contact.Skipped)-maxSkippedWhispers:]
+	}
+}
+
+// unskip reports whether sequence was skipped and forgets it, so a late
+// whisper is delivered once.
+func (contact *Contact) unskip(sequence uint64) bool {
+	for i, skipped := range contact.Skipped {
+		if skipped == sequence {
+			contact.Skipped = append(append([]uint64{}, contact.Skipped[:i]...), contact.Skipped[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Contacts) acknowledge(w *whisper, from *p2p.Peer) {
+	contact, ok := c.Contact(w.From.Hex())
+	if !ok {
+		return
+	}
+	message, err := c.sealAck(w)
+	if err != nil {
+		return
+	}
+	if from != nil && c.manager != nil {
+		c.manager.SendTo(from, message)
+		return
+	}
+	c.send(contact.OnionHost, message)
+}
+
+func (c *Contacts) sealAck(w *whisper) (p2p.Message, error) {
+	identity := c.Identity()
+	if identity == nil {
+		return p2p.Message{}, ErrIdentityLocked
+	}
+	ack := &whisperAck{From: identity.Address, To: w.From, Sequence: w.Sequence}
+	signature, err := crypto.Sign(ack.hash(), identity.PrivateKey)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	ack.Signature = signature
+	body, err := json.Marshal(ack)
+	if err != nil {
+		return p2p.Message{}, err
+	}
+	return p2p.NewMessage(whisperAckMessageType, string(body)), nil
+}
+
+func (c *Contacts) handleWhisperAck(manager *p2p.Manager, message p2p.Message) {
+	identity := c.Identity()
+	ack := &whisperAck{}
+	if identity == nil || json.Unmarshal([]byte(message.Body), ack) != nil || ack.To != identity.Address {
+		return
+	}
+	publicKey, err := crypto.SigToPub(ack.hash(), ack.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != ack.From {
+		return
+	}
+	key := pendingKey(ack.From.Hex(), ack.Sequence)
+	c.pendingMutex.Lock()
+	_, ok := c.pending[key]
+	delete(c.pending, key)
+	c.pendingMutex.Unlock()
+	if ok {
+		c.Seen(ack.From.Hex())
+		contact, _ := c.Contact(ack.From.Hex())
+		notify(fmt.Sprintf("Whisper: Message %d delivered to %s", ack.Sequence, contact.Alias))
+	}
+}
+
+// printWhisper is the default OnWhisper, printing to the console.
+func printWhisper(contact Contact, body string, timestamp int64, late bool) {
+	name := contact.Alias
+	if name == "" {
+		name = contact.Id
+	}
+	kind := "whisper"
+	if late {
+		kind = "late whisper"
+	}
+	notify(fmt.Sprintf("[ %d ] %s (%s) : %s", timestamp, name, kind, body))
+}
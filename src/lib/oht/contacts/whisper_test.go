@@ -0,0 +1,111 @@
+package contacts
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// acceptedContacts returns alice and bob with each other as accepted
+// contacts.
+func acceptedContacts(t *testing.T) (alice, bob *Contacts, cleanup func()) {
+	alice, aliceDirectory := newTestContacts(t, "alicealicealicea.onion")
+	bob, bobDirectory := newTestContacts(t, "bobbobbobbobbobb.onion")
+	alice.Alias, bob.Alias = "alice", "bob"
+	alice.Request(bob.Identity().Address.Hex()+"@bobbobbobbobbobb.onion", "")
+	request, _ := alice.seal(requestMessageType, bob.Identity().Address, "", false)
+	bob.handleRequest(nil, request)
+	bob.Accept("alice")
+	response, _ := bob.seal(responseMessageType, alice.Identity().Address, "", true)
+	alice.handleResponse(nil, response)
+	return alice, bob, func() {
+		os.RemoveAll(aliceDirectory)
+		os.RemoveAll(bobDirectory)
+	}
+}
+
+func TestWhisperOrderingAndAcknowledgement(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	var bodies []string
+	bob.OnWhisper = func(contact Contact, body string, timestamp int64, late bool) {
+		if contact.Id != alice.Identity().Address.Hex() {
+			t.Errorf("whisper attributed to %s", contact.Id)
+		}
+		bodies = append(bodies, body)
+	}
+	bobId := bob.Identity().Address.Hex()
+	for _, body := range []string{"one", "two", "three"} {
+		// Delivery fails without p2p, the whisper stays pending
+		alice.Whisper(bobId, body)
+	}
+	if alice.Pending() != 3 {
+		t.Fatalf("expected 3 pending whispers, got %d", alice.Pending())
+	}
+	pending := func(sequence uint64) *pendingWhisper {
+		return alice.pending[pendingKey(bobId, sequence)]
+	}
+	for _, sequence := range []uint64{3, 1, 1, 2} {
+		bob.handleWhisper(nil, pending(sequence).message)
+	}
+	if !reflect.DeepEqual(bodies, []string{"one", "two", "three"}) {
+		t.Errorf("expected whispers in order without duplicates, got %v", bodies)
+	}
+
+	if _, err := alice.openWhisper(pending(1).message.Body); err != errEnvelopeRecipient {
+		t.Errorf("expected %v opening a whisper to another account, got %v", errEnvelopeRecipient, err)
+	}
+
+	w, err := bob.openWhisper(pending(2).message.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := bob.sealAck(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.handleWhisperAck(nil, ack)
+	if alice.Pending() != 2 || pending(2) != nil {
+		t.Errorf("expected the acknowledged whisper to be removed, %d pending", alice.Pending())
+	}
+}
+
+func TestWhisperGapSkipped(t *testing.T) {
+	alice, bob, cleanup := acceptedContacts(t)
+	defer cleanup()
+	var bodies []string
+	bob.OnWhisper = func(contact Contact, body string, timestamp int64, late bool) {
+		if late {
+			body += " (late)"
+		}
+		bodies = append(bodies, body)
+	}
+	bobId := bob.Identity().Address.Hex()
+	for _, body := range []string{"lost", "two", "three"} {
+		alice.Whisper(bobId, body)
+	}
+	bob.handleWhisper(nil, alice.pending[pendingKey(bobId, 3)].message)
+	bob.handleWhisper(nil, alice.pending[pendingKey(bobId, 2)].message)
+	if len(bodies) != 0 {
+		t.Fatalf("expected whispers to wait for the first, got %v", bodies)
+	}
+	bob.flushReceived(alice.Identity().Address.Hex())
+	if !reflect.DeepEqual(bodies, []string{"two", "three"}) {
+		t.Errorf("expected the gap to be skipped, got %v", bodies)
+	}
+	// The late whisper was acknowledged, so it has to be delivered once
+	bob.handleWhisper(nil, alice.pending[pendingKey(bobId, 1)].message)
+	bob.handleWhisper(nil, alice.pending[pendingKey(bobId, 1)].message)
+	bob.handleWhisper(nil, alice.pending[pendingKey(bobId, 2)].message)
+	if !reflect.DeepEqual(bodies, []string{"two", "three", "lost (late)"}) {
+		t.Errorf("expected the whisper arriving after the gap was skipped to be delivered late, got %v", bodies)
+	}
+}
+
+func TestWhisperRequiresContact(t *testing.T) {
+	alice, aliceDirectory := newTestContacts(t, "alicealicealicea.onion")
+	defer os.RemoveAll(aliceDirectory)
+	if err := alice.Whisper("0x0000000000000000000000000000000000000001", "hi"); err != ErrNotAContact {
+		t.Errorf("expected %v, got %v", ErrNotAContact, err)
+	}
+}
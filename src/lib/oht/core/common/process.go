@@ -15,15 +15,26 @@ type Process struct {
 	StartTime time.Time
 	EndTime   time.Time
 	cmd       *exec.Cmd        `json:"-"`
+	Stdout    *os.File         `json:"-"`
 	ExitState *os.ProcessState `json:"-"`
 	WaitCh    chan struct{}    `json:"-"`
 }
 
 func StartProcess(label string, execPath string, args []string) (*Process, error) {
 	cmd := exec.Command(execPath, args...)
+	// Stdout is handed to the child as a plain pipe instead of cmd.StdoutPipe()
+	// so that Wait() does not close it while the caller is still reading.
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = stdoutWriter
 	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
 		return nil, err
 	}
+	stdoutWriter.Close()
 	proc := &Process{
 		Label:     label,
 		ExecPath:  execPath,
@@ -31,6 +42,7 @@ func StartProcess(label string, execPath string, args []string) (*Process, error
 		Pid:       cmd.Process.Pid,
 		StartTime: time.Now(),
 		cmd:       cmd,
+		Stdout:    stdout,
 		ExitState: nil,
 		WaitCh:    make(chan struct{}),
 	}
@@ -58,3 +70,21 @@ func (proc *Process) StopProcess(kill bool) error {
 		return proc.cmd.Process.Signal(os.Interrupt)
 	}
 }
+
+// Exited reports whether the process has terminated.
+func (proc *Process) Exited() bool {
+	select {
+	case <-proc.WaitCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Uptime returns how long the process ran, or has been running so far.
+func (proc *Process) Uptime() time.Duration {
+	if proc.Exited() {
+		return proc.EndTime.Sub(proc.StartTime)
+	}
+	return time.Since(proc.StartTime)
+}
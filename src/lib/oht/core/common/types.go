@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/hex"
 	"fmt"
 	"math/big"
 	"math/rand"
@@ -76,6 +77,16 @@ func StringToAddress(s string) Address { return BytesToAddress([]byte(s)) }
 func BigToAddress(b *big.Int) Address  { return BytesToAddress(b.Bytes()) }
 func HexToAddress(s string) Address    { return BytesToAddress(FromHex(s)) }
 
+// IsHexAddress reports whether s is a hex encoded address, with or without
+// the 0x prefix.
+func IsHexAddress(s string) bool {
+	if HasHexPrefix(s) {
+		s = s[2:]
+	}
+	_, err := hex.DecodeString(s)
+	return len(s) == 2*addressLength && err == nil
+}
+
 // Get the string representation of the underlying address
 func (a Address) Str() string   { return string(a[:]) }
 func (a Address) Bytes() []byte { return a[:] }
@@ -27,10 +27,13 @@ type P2PConfig struct {
 }
 
 type TorConfig struct {
-	ListenPort  string
-	SocksPort   string
-	ControlPort string
-	WebUIPort   string
+	ListenPort       string
+	SocksPort        string
+	ControlPort      string
+	WebUIPort        string
+	NameProxyPort    string
+	Bridges          []string `json:",omitempty"`
+	TransportPlugins []string `json:",omitempty"`
 }
 
 type Config struct {
@@ -48,6 +51,7 @@ type Config struct {
 	GenesisFile        string `json:",omitempty"`
 	PrivateKeyFile     string
 	PrivateKey         *ecdsa.PrivateKey
+	KeyDerivation      string
 	LogFile            string
 	LogVerbosity       int
 	Custom             map[string]string
@@ -67,10 +71,11 @@ func InitializeConfig(torListenPort, torSocksPort, torControlPort, torWebUIPort
 		MaxPeers:        8,
 		MaxPendingPeers: 8,
 		TorConfig: &TorConfig{
-			ListenPort:  "9042",
-			SocksPort:   "9142",
-			ControlPort: "9555",
-			WebUIPort:   "8080",
+			ListenPort:    "9042",
+			SocksPort:     "9142",
+			ControlPort:   "9555",
+			WebUIPort:     "8080",
+			NameProxyPort: "9242",
 		},
 		Locale:         "en",
 		IPCName:        "oht",
@@ -78,6 +83,7 @@ func InitializeConfig(torListenPort, torSocksPort, torControlPort, torWebUIPort
 		LogFile:        "log.json",
 		DataDirectory:  common.DefaultDataDir("oht"),
 		PrivateKeyFile: (common.DefaultDataDir("oht") + "node_key"),
+		KeyDerivation:  crypto.KDFScrypt,
 		LogVerbosity:   1,
 		Custom:         make(map[string]string),
 	}
@@ -104,9 +110,19 @@ func InitializeConfig(torListenPort, torSocksPort, torControlPort, torWebUIPort
 	if torWebUIPort != "" {
 		config.TorConfig.WebUIPort = torWebUIPort
 	}
+	config.validateKeyDerivation()
 	return config
 }
 
+// validateKeyDerivation falls back to scrypt when KeyDerivation does not
+// name a function new keys can be encrypted with.
+func (config *Config) validateKeyDerivation() {
+	if !crypto.ValidKDF(config.KeyDerivation) {
+		log.Printf("Config: Unknown KeyDerivation %q, falling back to %s", config.KeyDerivation, crypto.KDFScrypt)
+		config.KeyDerivation = crypto.KDFScrypt
+	}
+}
+
 func (config *Config) saveConfiguration() bool {
 	jsonFile, err := json.Marshal(config)
 	if err = ioutil.WriteFile(common.AbsolutePath(config.DataDirectory, "config.json"), jsonFile, 0644); err != nil {
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"testing"
+
+	"../crypto"
+)
+
+func TestValidateKeyDerivation(t *testing.T) {
+	tests := map[string]string{
+		crypto.KDFScrypt:   crypto.KDFScrypt,
+		crypto.KDFArgon2id: crypto.KDFArgon2id,
+		"":                 crypto.KDFScrypt,
+		"bcrypt":           crypto.KDFScrypt,
+	}
+	for kdf, expected := range tests {
+		config := &Config{KeyDerivation: kdf}
+		config.validateKeyDerivation()
+		if config.KeyDerivation != expected {
+			t.Errorf("%q: expected %s, got %s", kdf, expected, config.KeyDerivation)
+		}
+	}
+}
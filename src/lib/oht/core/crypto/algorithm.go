@@ -0,0 +1,232 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"lib/oht/core/common"
+
+	"github.com/pborman/uuid"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Key algorithms, keys stored before keys were tagged have no algorithm and
+// are secp256k1.
+const (
+	AlgorithmSecp256k1 = "secp256k1"
+	AlgorithmEd25519   = "ed25519"
+	AlgorithmX25519    = "x25519"
+)
+
+// ed25519SignatureLength is an ed25519 public key followed by a signature,
+// secp256k1 signatures are 65 bytes.
+const ed25519SignatureLength = ed25519.PublicKeySize + ed25519.SignatureSize
+
+var (
+	ErrUnknownAlgorithm = errors.New("Crypto: Unknown key algorithm")
+	ErrCannotSign       = errors.New("Crypto: Key algorithm does not sign")
+	ErrCannotEncrypt    = errors.New("Crypto: Key algorithm does not encrypt")
+	ErrInvalidSignature = errors.New("Crypto: Invalid signature")
+	ErrInvalidSecret    = errors.New("Crypto: Private key has the wrong length")
+	ErrSealedBox        = errors.New("Crypto: Sealed box could not be opened")
+)
+
+// ValidAlgorithm reports whether keys of algorithm can be created and
+// stored, the empty algorithm is secp256k1.
+func ValidAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case "", AlgorithmSecp256k1, AlgorithmEd25519, AlgorithmX25519:
+		return true
+	}
+	return false
+}
+
+// NewKeyOfAlgorithm generates a key of any algorithm.
+func NewKeyOfAlgorithm(algorithm string, rand io.Reader) (*Key, error) {
+	switch algorithm {
+	case "", AlgorithmSecp256k1:
+		privateKey, err := ecdsa.GenerateKey(S256(), rand)
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyFromECDSA(privateKey), nil
+	case AlgorithmEd25519, AlgorithmX25519:
+		secret := make([]byte, 32)
+		if _, err := io.ReadFull(rand, secret); err != nil {
+			return nil, err
+		}
+		return NewKeyFromSecret(algorithm, secret)
+	}
+	return nil, ErrUnknownAlgorithm
+}
+
+// NewKeyFromSecret makes a key from the private key bytes kept in key files,
+// the scalar of secp256k1 keys, the seed of ed25519 keys and the scalar of
+// x25519 keys.
+func NewKeyFromSecret(algorithm string, secret []byte) (*Key, error) {
+	key := &Key{Id: uuid.NewRandom(), Algorithm: algorithm}
+	switch algorithm {
+	case "", AlgorithmSecp256k1:
+		key.PrivateKey = ToECDSA(secret)
+		if key.PrivateKey == nil {
+			return nil, ErrInvalidSecret
+		}
+		key.Address = PubkeyToAddress(key.PrivateKey.PublicKey)
+		return key, nil
+	case AlgorithmEd25519, AlgorithmX25519:
+		if len(secret) != 32 {
+			return nil, ErrInvalidSecret
+		}
+		key.Secret = common.CopyBytes(secret)
+		key.Address = AlgorithmAddress(algorithm, key.Public())
+		return key, nil
+	}
+	return nil, ErrUnknownAlgorithm
+}
+
+// AlgorithmAddress is the address of an ed25519 or x25519 public key, the
+// algorithm is hashed in so one public key never has two addresses.
+func AlgorithmAddress(algorithm string, public []byte) common.Address {
+	return common.BytesToAddress(Sha3([]byte(algorithm), public)[12:])
+}
+
+// KeyAlgorithm is the algorithm of a key, secp256k1 when untagged.
+func (k *Key) KeyAlgorithm() string {
+	if k.Algorithm == "" {
+		return AlgorithmSecp256k1
+	}
+	return k.Algorithm
+}
+
+// secret is what a key file keeps of the key.
+func (k *Key) secret() []byte {
+	if k.KeyAlgorithm() == AlgorithmSecp256k1 {
+		return FromECDSA(k.PrivateKey)
+	}
+	return k.Secret
+}
+
+// Public returns the public key, uncompressed for secp256k1 keys.
+func (k *Key) Public() []byte {
+	switch k.KeyAlgorithm() {
+	case AlgorithmSecp256k1:
+		return FromECDSAPub(&k.PrivateKey.PublicKey)
+	case AlgorithmEd25519:
+		return ed25519.NewKeyFromSeed(k.Secret).Public().(ed25519.PublicKey)
+	case AlgorithmX25519:
+		public, _ := curve25519.X25519(k.Secret, curve25519.Basepoint)
+		return public
+	}
+	return nil
+}
+
+// Sign signs a 32 byte hash. Ed25519 signatures are prefixed with the public
+// key so SignatureAddress finds their signer like it recovers the signer of
+// a secp256k1 signature.
+func (k *Key) Sign(hash []byte) ([]byte, error) {
+	switch k.KeyAlgorithm() {
+	case AlgorithmSecp256k1:
+		return Sign(hash, k.PrivateKey)
+	case AlgorithmEd25519:
+		privateKey := ed25519.NewKeyFromSeed(k.Secret)
+		defer zeroBytes(privateKey)
+		public := privateKey.Public().(ed25519.PublicKey)
+		return append(common.CopyBytes(public), ed25519.Sign(privateKey, hash)...), nil
+	}
+	return nil, ErrCannotSign
+}
+
+// SignatureAddress returns the address of whoever signed hash, for
+// secp256k1 and ed25519 signatures alike.
+func SignatureAddress(hash, signature []byte) (common.Address, error) {
+	if len(signature) == ed25519SignatureLength {
+		public := ed25519.PublicKey(signature[:ed25519.PublicKeySize])
+		if !ed25519.Verify(public, hash, signature[ed25519.PublicKeySize:]) {
+			return common.Address{}, ErrInvalidSignature
+		}
+		return AlgorithmAddress(AlgorithmEd25519, public), nil
+	}
+	publicKey, err := SigToPub(hash, signature)
+	if err != nil || publicKey.X == nil {
+		return common.Address{}, ErrInvalidSignature
+	}
+	return PubkeyToAddress(*publicKey), nil
+}
+
+// Encrypt encrypts a message to the key itself, ECIES for secp256k1 keys
+// and a sealed box for x25519 keys.
+func (k *Key) Encrypt(message []byte) ([]byte, error) {
+	return EncryptTo(k.KeyAlgorithm(), k.Public(), message)
+}
+
+// EncryptTo encrypts a message to a public key of algorithm.
+func EncryptTo(algorithm string, public, message []byte) ([]byte, error) {
+	switch algorithm {
+	case "", AlgorithmSecp256k1:
+		publicKey := ToECDSAPub(public)
+		if publicKey == nil || publicKey.X == nil {
+			return nil, ErrCannotEncrypt
+		}
+		return Encrypt(publicKey, message)
+	case AlgorithmX25519:
+		return SealBox(public, message)
+	}
+	return nil, ErrCannotEncrypt
+}
+
+// Decrypt opens a message encrypted to the key.
+func (k *Key) Decrypt(ciphertext []byte) ([]byte, error) {
+	switch k.KeyAlgorithm() {
+	case AlgorithmSecp256k1:
+		return Decrypt(k.PrivateKey, ciphertext)
+	case AlgorithmX25519:
+		return OpenBox(k.Secret, ciphertext)
+	}
+	return nil, ErrCannotEncrypt
+}
+
+// SealBox encrypts a message to an x25519 public key with a key pair used
+// once, compatible with libsodium's crypto_box_seal.
+func SealBox(public, message []byte) ([]byte, error) {
+	if len(public) != 32 {
+		return nil, ErrCannotEncrypt
+	}
+	var recipient [32]byte
+	copy(recipient[:], public)
+	return box.SealAnonymous(nil, message, &recipient, rand.Reader)
+}
+
+// OpenBox opens a sealed box with the x25519 secret of its recipient.
+func OpenBox(secret, sealed []byte) ([]byte, error) {
+	if len(secret) != 32 {
+		return nil, ErrInvalidSecret
+	}
+	var privateKey, publicKey [32]byte
+	copy(privateKey[:], secret)
+	defer zeroBytes(privateKey[:])
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(publicKey[:], public)
+	message, ok := box.OpenAnonymous(nil, sealed, &publicKey, &privateKey)
+	if !ok {
+		return nil, ErrSealedBox
+	}
+	return message, nil
+}
+
+// Zero zeroes the private key in memory.
+func (k *Key) Zero() {
+	if k.PrivateKey != nil {
+		b := k.PrivateKey.D.Bits()
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	zeroBytes(k.Secret)
+}
@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEd25519Signature(t *testing.T) {
+	key, err := NewKeyOfAlgorithm(AlgorithmEd25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := Sha3([]byte("message"))
+	signature, err := key.Sign(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address, err := SignatureAddress(hash, signature); err != nil || address != key.Address {
+		t.Errorf("expected %s to have signed, got %s %v", key.Address.Hex(), address.Hex(), err)
+	}
+	if _, err := SignatureAddress(Sha3([]byte("other")), signature); err != ErrInvalidSignature {
+		t.Errorf("expected %v for another message, got %v", ErrInvalidSignature, err)
+	}
+	if _, err := key.Encrypt([]byte("message")); err != ErrCannotEncrypt {
+		t.Errorf("expected %v, got %v", ErrCannotEncrypt, err)
+	}
+
+	secp256k1Key, _ := NewKeyOfAlgorithm("", rand.Reader)
+	signature, _ = secp256k1Key.Sign(hash)
+	if address, err := SignatureAddress(hash, signature); err != nil || address != secp256k1Key.Address {
+		t.Errorf("expected %s to have signed, got %s %v", secp256k1Key.Address.Hex(), address.Hex(), err)
+	}
+}
+
+func TestX25519SealedBox(t *testing.T) {
+	key, err := NewKeyOfAlgorithm(AlgorithmX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := EncryptTo(AlgorithmX25519, key.Public(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message, err := key.Decrypt(sealed); err != nil || string(message) != "secret" {
+		t.Errorf("expected the message, got %q %v", message, err)
+	}
+	other, _ := NewKeyOfAlgorithm(AlgorithmX25519, rand.Reader)
+	if _, err := other.Decrypt(sealed); err != ErrSealedBox {
+		t.Errorf("expected %v opening a box sealed to another key, got %v", ErrSealedBox, err)
+	}
+	if _, err := key.Sign(Sha3([]byte("message"))); err != ErrCannotSign {
+		t.Errorf("expected %v, got %v", ErrCannotSign, err)
+	}
+}
+
+func TestKeyStoreAlgorithms(t *testing.T) {
+	directory, err := ioutil.TempDir("", "oht-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ks := NewKeyStorePassphrase(directory, KDFLight)
+	for _, algorithm := range []string{"", AlgorithmEd25519, AlgorithmX25519} {
+		key, _ := NewKeyOfAlgorithm(algorithm, rand.Reader)
+		if err := ks.StoreKey(key, "secret"); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ks.GetKey(key.Address, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.KeyAlgorithm() != key.KeyAlgorithm() || !bytes.Equal(stored.Public(), key.Public()) {
+			t.Errorf("expected the %s key back, got a %s key", key.KeyAlgorithm(), stored.KeyAlgorithm())
+		}
+
+		plain, _ := json.Marshal(key)
+		unmarshaled := new(Key)
+		if err := json.Unmarshal(plain, unmarshaled); err != nil || !bytes.Equal(unmarshaled.Public(), key.Public()) {
+			t.Errorf("expected the %s key to survive JSON, %v", key.KeyAlgorithm(), err)
+		}
+	}
+}
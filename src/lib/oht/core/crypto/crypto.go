@@ -159,7 +159,7 @@ func ValidateSignatureValues(v byte, r, s *big.Int) bool {
 }
 
 func SigToPub(hash, sig []byte) (*ecdsa.PublicKey, error) {
-	s, err := secp256k1.RecoverPubkey(sig, hash)
+	s, err := secp256k1.RecoverPubkey(hash, sig)
 	if err != nil {
 		return nil, err
 	}
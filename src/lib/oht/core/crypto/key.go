@@ -6,38 +6,81 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"io"
-	"strings"
+	"time"
 
 	"lib/oht/core/common"
 
 	"github.com/pborman/uuid"
 )
 
+// Key files written by oht are tagged with keyFormat and count their
+// version from there. Untagged files are Ethereum keystore v3 files, which
+// oht wrote before and migrates the first time they are unlocked.
 const (
-	version = 3
+	keyFormat = "oht"
+	version   = 1
+	v3Version = 3
 )
 
+// Purposes kept in the metadata of key files.
+const (
+	PurposeAccount    = "account"
+	PurposeSigning    = "signing"
+	PurposeEncryption = "encryption"
+)
+
+// KeyMetadata describes a key, it is kept in the clear next to the
+// encrypted key so accounts can be listed while they are locked.
+type KeyMetadata struct {
+	Label string `json:"label,omitempty"`
+	// Created is when the key was first stored in unix seconds
+	Created int64  `json:"created"`
+	Purpose string `json:"purpose,omitempty"`
+}
+
 type Key struct {
 	Id uuid.UUID // Version 4 "random" for unique id not derived from key data
+	// Algorithm is one of the Algorithm constants, empty for secp256k1
+	Algorithm string
 	// to simplify lookups we also store the address
 	Address common.Address
 	// we only store privkey as pubkey/address can be derived from it
 	// privkey in this struct is always in plaintext
 	PrivateKey *ecdsa.PrivateKey
+	// Secret is the private key of ed25519 and x25519 keys
+	Secret   []byte
+	Metadata KeyMetadata
 }
 
 type plainKeyJSON struct {
-	Address    string `json:"address"`
-	PrivateKey string `json:"privatekey"`
-	Id         string `json:"id"`
-	Version    int    `json:"version"`
+	Format     string       `json:"format,omitempty"`
+	Version    int          `json:"version"`
+	Address    string       `json:"address"`
+	Algorithm  string       `json:"algorithm,omitempty"`
+	Metadata   *KeyMetadata `json:"metadata,omitempty"`
+	PrivateKey string       `json:"privatekey"`
+	Id         string       `json:"id"`
 }
 
+// encryptedKeyJSON reads both oht key files and keystore v3 files, which
+// have no format, algorithm or metadata.
 type encryptedKeyJSON struct {
-	Address string `json:"address"`
-	Crypto  cryptoJSON
-	Id      string `json:"id"`
-	Version int    `json:"version"`
+	Format    string       `json:"format,omitempty"`
+	Version   int          `json:"version"`
+	Address   string       `json:"address"`
+	Algorithm string       `json:"algorithm,omitempty"`
+	Metadata  *KeyMetadata `json:"metadata,omitempty"`
+	Crypto    cryptoJSON   `json:"crypto"`
+	Id        string       `json:"id"`
+}
+
+// legacy reports whether the key file is a keystore v3 file to migrate.
+func (k *encryptedKeyJSON) legacy() bool {
+	return k.Format == "" && k.Version == v3Version
+}
+
+func (k *encryptedKeyJSON) supported() bool {
+	return k.legacy() || (k.Format == keyFormat && k.Version == version)
 }
 
 type cryptoJSON struct {
@@ -61,12 +104,35 @@ type scryptParamsJSON struct {
 	Salt  string `json:"salt"`
 }
 
+// metadata is the metadata of the key with the creation time and purpose
+// filled in when they were not set.
+func (k *Key) metadata() *KeyMetadata {
+	metadata := k.Metadata
+	if metadata.Created == 0 {
+		metadata.Created = time.Now().Unix()
+	}
+	if metadata.Purpose == "" {
+		switch k.KeyAlgorithm() {
+		case AlgorithmEd25519:
+			metadata.Purpose = PurposeSigning
+		case AlgorithmX25519:
+			metadata.Purpose = PurposeEncryption
+		default:
+			metadata.Purpose = PurposeAccount
+		}
+	}
+	return &metadata
+}
+
 func (k *Key) MarshalJSON() (j []byte, err error) {
 	jStruct := plainKeyJSON{
-		hex.EncodeToString(k.Address[:]),
-		hex.EncodeToString(FromECDSA(k.PrivateKey)),
-		k.Id.String(),
-		version,
+		Format:     keyFormat,
+		Version:    version,
+		Address:    hex.EncodeToString(k.Address[:]),
+		Algorithm:  k.KeyAlgorithm(),
+		Metadata:   k.metadata(),
+		PrivateKey: hex.EncodeToString(k.secret()),
+		Id:         k.Id.String(),
 	}
 	j, err = json.Marshal(jStruct)
 	return j, err
@@ -92,8 +158,16 @@ func (k *Key) UnmarshalJSON(j []byte) (err error) {
 		return err
 	}
 
+	key, err := NewKeyFromSecret(keyJSON.Algorithm, privkey)
+	if err != nil {
+		return err
+	}
+	k.Algorithm = keyJSON.Algorithm
 	k.Address = common.BytesToAddress(addr)
-	k.PrivateKey = ToECDSA(privkey)
+	k.PrivateKey, k.Secret = key.PrivateKey, key.Secret
+	if keyJSON.Metadata != nil {
+		k.Metadata = *keyJSON.Metadata
+	}
 
 	return nil
 }
@@ -122,24 +196,3 @@ func NewKey(rand io.Reader) *Key {
 
 	return NewKeyFromECDSA(privateKeyECDSA)
 }
-
-// generate key whose address fits into < 155 bits so it can fit into
-// the Direct ICAP spec. for simplicity and easier compatibility with
-// other libs, we retry until the first byte is 0.
-func NewKeyForDirectICAP(rand io.Reader) *Key {
-	randBytes := make([]byte, 64)
-	_, err := rand.Read(randBytes)
-	if err != nil {
-		panic("key generation: could not read from random source: " + err.Error())
-	}
-	reader := bytes.NewReader(randBytes)
-	privateKeyECDSA, err := ecdsa.GenerateKey(S256(), reader)
-	if err != nil {
-		panic("key generation: ecdsa.GenerateKey failed: " + err.Error())
-	}
-	key := NewKeyFromECDSA(privateKeyECDSA)
-	if !strings.HasPrefix(key.Address.Hex(), "0x00") {
-		return NewKeyForDirectICAP(rand)
-	}
-	return key
-}
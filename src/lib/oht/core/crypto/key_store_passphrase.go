@@ -9,11 +9,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 
 	"lib/oht/core/common"
 	"lib/oht/core/crypto/randentropy"
 
 	"github.com/pborman/uuid"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/scrypt"
 )
@@ -35,20 +38,54 @@ const (
 	scryptDKLen = 32
 )
 
+// Key derivation functions key files are encrypted with.
+const (
+	KDFScrypt   = "scrypt"
+	KDFArgon2id = "argon2id"
+
+	// t,m,p = 3, 64MB, 4 are the parameters RFC 9106 recommends when memory
+	// is constrained.
+	stdArgon2T = 3
+	stdArgon2M = 64 << 10
+
+	// t,m,p = 1, 4MB, 4 takes a fraction of the time.
+	lightArgon2T = 1
+	lightArgon2M = 4 << 10
+
+	argon2P = 4
+
+	// Key files asking for more are refused rather than unlocked, t,m = 16,
+	// 4GB is far beyond what new keys are encrypted with.
+	maxArgon2T = 16
+	maxArgon2M = 4 << 20
+)
+
+var (
+	ErrUnknownKDF = errors.New("Crypto: Unknown key derivation function")
+	ErrKeyVersion = errors.New("Crypto: Key file version not supported")
+	ErrKDFParams  = errors.New("Crypto: Malformed key derivation parameters")
+)
+
 type keyStorePassphrase struct {
 	keysDirPath string
-	scryptN     int
-	scryptP     int
-	scryptR     int
-	scryptDKLen int
+	kdf         string
+	safety      int
 }
 
+// NewKeyStorePassphrase keeps keys encrypted with scrypt.
 func NewKeyStorePassphrase(path string, safety int) KeyStore {
-	if safety == KDFStandard {
-		return &keyStorePassphrase{path, stdScryptN, stdScryptP, scryptR, scryptDKLen}
-	} else {
-		return &keyStorePassphrase{path, lightScryptN, lightScryptP, scryptR, scryptDKLen}
-	}
+	return NewKeyStorePassphraseKDF(path, KDFScrypt, safety)
+}
+
+// NewKeyStorePassphraseKDF keeps keys encrypted with a key derived by kdf,
+// one of the KDF constants. Keys encrypted with any of them are read.
+func NewKeyStorePassphraseKDF(path, kdf string, safety int) KeyStore {
+	return &keyStorePassphrase{path, kdf, safety}
+}
+
+// ValidKDF reports whether new keys can be encrypted with kdf.
+func ValidKDF(kdf string) bool {
+	return kdf == KDFScrypt || kdf == KDFArgon2id
 }
 
 func (ks keyStorePassphrase) GenerateNewKey(rand io.Reader, auth string) (key *Key, err error) {
@@ -56,15 +93,55 @@ func (ks keyStorePassphrase) GenerateNewKey(rand io.Reader, auth string) (key *K
 }
 
 func (ks keyStorePassphrase) GetKey(keyAddr common.Address, auth string) (key *Key, err error) {
-	keyBytes, keyId, err := decryptKeyFromFile(ks.keysDirPath, keyAddr, auth)
-	if err == nil {
-		key = &Key{
-			Id:         uuid.UUID(keyId),
-			Address:    keyAddr,
-			PrivateKey: ToECDSA(keyBytes),
-		}
+	keyProtected, keyBytes, keyId, err := decryptKeyFromFile(ks.keysDirPath, keyAddr, auth)
+	if err != nil {
+		return nil, err
+	}
+	if key, err = NewKeyFromSecret(keyProtected.Algorithm, keyBytes); err != nil {
+		return nil, err
+	}
+	key.Id, key.Address = uuid.UUID(keyId), keyAddr
+	if keyProtected.Metadata != nil {
+		key.Metadata = *keyProtected.Metadata
+	}
+	if keyProtected.legacy() {
+		// A key file that can not be rewritten still unlocks, migrating is
+		// tried again the next time
+		ks.migrate(key, auth)
+	}
+	return key, nil
+}
+
+// migrate rewrites a keystore v3 file as an oht key file, created when the
+// old file was last written, and deletes the old file.
+func (ks keyStorePassphrase) migrate(key *Key, auth string) error {
+	path, err := getKeyFilePath(ks.keysDirPath, key.Address)
+	if err != nil {
+		return err
 	}
-	return
+	if info, err := os.Stat(path); err == nil {
+		key.Metadata.Created = info.ModTime().Unix()
+	}
+	if err := ks.StoreKey(key, auth); err != nil {
+		return err
+	}
+	migrated, err := getKeyFilePath(ks.keysDirPath, key.Address)
+	if err != nil {
+		return err
+	}
+	if migrated == path {
+		// The v3 file was written within the same second and is replaced
+		return nil
+	}
+	addrHex := hex.EncodeToString(key.Address[:])
+	if path == filepath.Join(ks.keysDirPath, addrHex, addrHex) {
+		return os.RemoveAll(filepath.Dir(path))
+	}
+	return os.Remove(path)
+}
+
+func (ks keyStorePassphrase) GetKeyMetadata(keyAddr common.Address) (KeyMetadata, error) {
+	return getKeyMetadata(ks.keysDirPath, keyAddr)
 }
 
 func (ks keyStorePassphrase) Cleanup(keyAddr common.Address) (err error) {
@@ -76,61 +153,109 @@ func (ks keyStorePassphrase) GetKeyAddresses() (addresses []common.Address, err
 }
 
 func (ks keyStorePassphrase) StoreKey(key *Key, auth string) (err error) {
-	authArray := []byte(auth)
-	salt := randentropy.GetEntropyCSPRNG(32)
-	//now := time.Now()
-	derivedKey, err := scrypt.Key(authArray, salt, ks.scryptN, ks.scryptR, ks.scryptP, ks.scryptDKLen)
+	cryptoStruct, err := encryptData(key.secret(), auth, ks.kdf, ks.safety)
+	if err != nil {
+		return err
+	}
+	encryptedKeyJSON := encryptedKeyJSON{
+		Format:    keyFormat,
+		Version:   version,
+		Address:   hex.EncodeToString(key.Address[:]),
+		Algorithm: key.KeyAlgorithm(),
+		Metadata:  key.metadata(),
+		Crypto:    cryptoStruct,
+		Id:        key.Id.String(),
+	}
+	keyJSON, err := json.Marshal(encryptedKeyJSON)
 	if err != nil {
 		return err
 	}
-	//fmt.Println("took: ", time.Since(now))
+
+	return writeKeyFile(key.Address, ks.keysDirPath, keyJSON)
+}
+
+// EncryptData seals data with a key derived from auth by kdf the same way
+// account keys are stored, for other secrets kept next to them. It returns
+// the crypto section of a key file.
+func EncryptData(data []byte, auth, kdf string, safety int) ([]byte, error) {
+	cryptoStruct, err := encryptData(data, auth, kdf, safety)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cryptoStruct)
+}
+
+// DecryptData opens data sealed by EncryptData.
+func DecryptData(sealed []byte, auth string) ([]byte, error) {
+	var cryptoStruct cryptoJSON
+	if err := json.Unmarshal(sealed, &cryptoStruct); err != nil {
+		return nil, err
+	}
+	return decryptData(cryptoStruct, auth)
+}
+
+// kdfParams are the parameters of kdf at a safety level.
+func kdfParams(kdf string, safety int, salt []byte) (map[string]interface{}, error) {
+	params := make(map[string]interface{}, 5)
+	params["dklen"] = scryptDKLen
+	params["salt"] = hex.EncodeToString(salt)
+	switch kdf {
+	case "", KDFScrypt:
+		params["n"], params["r"], params["p"] = stdScryptN, scryptR, stdScryptP
+		if safety != KDFStandard {
+			params["n"], params["p"] = lightScryptN, lightScryptP
+		}
+	case KDFArgon2id:
+		params["t"], params["m"], params["p"] = stdArgon2T, stdArgon2M, argon2P
+		if safety != KDFStandard {
+			params["t"], params["m"] = lightArgon2T, lightArgon2M
+		}
+	default:
+		return nil, ErrUnknownKDF
+	}
+	return params, nil
+}
+
+func encryptData(data []byte, auth string, kdf string, safety int) (cryptoJSON, error) {
+	if kdf == "" {
+		kdf = KDFScrypt
+	}
+	salt := randentropy.GetEntropyCSPRNG(32)
+	params, err := kdfParams(kdf, safety, salt)
+	if err != nil {
+		return cryptoJSON{}, err
+	}
+	derivedKey, err := getKDFKey(cryptoJSON{KDF: kdf, KDFParams: params}, auth)
+	if err != nil {
+		return cryptoJSON{}, err
+	}
 	encryptKey := derivedKey[:16]
-	keyBytes := FromECDSA(key.PrivateKey)
 
 	iv := randentropy.GetEntropyCSPRNG(aes.BlockSize) // 16
-	cipherText, err := aesCTRXOR(encryptKey, keyBytes, iv)
+	cipherText, err := aesCTRXOR(encryptKey, data, iv)
 	if err != nil {
-		return err
+		return cryptoJSON{}, err
 	}
 
 	mac := Sha3(derivedKey[16:32], cipherText)
 
-	scryptParamsJSON := make(map[string]interface{}, 5)
-	scryptParamsJSON["n"] = ks.scryptN
-	scryptParamsJSON["r"] = ks.scryptR
-	scryptParamsJSON["p"] = ks.scryptP
-	scryptParamsJSON["dklen"] = ks.scryptDKLen
-	scryptParamsJSON["salt"] = hex.EncodeToString(salt)
-
 	cipherParamsJSON := cipherparamsJSON{
 		IV: hex.EncodeToString(iv),
 	}
 
-	cryptoStruct := cryptoJSON{
+	return cryptoJSON{
 		Cipher:       "aes-128-ctr",
 		CipherText:   hex.EncodeToString(cipherText),
 		CipherParams: cipherParamsJSON,
-		KDF:          "scrypt",
-		KDFParams:    scryptParamsJSON,
+		KDF:          kdf,
+		KDFParams:    params,
 		MAC:          hex.EncodeToString(mac),
-	}
-	encryptedKeyJSON := encryptedKeyJSON{
-		hex.EncodeToString(key.Address[:]),
-		cryptoStruct,
-		key.Id.String(),
-		version,
-	}
-	keyJSON, err := json.Marshal(encryptedKeyJSON)
-	if err != nil {
-		return err
-	}
-
-	return writeKeyFile(key.Address, ks.keysDirPath, keyJSON)
+	}, nil
 }
 
 func (ks keyStorePassphrase) DeleteKey(keyAddr common.Address, auth string) (err error) {
 	// only delete if correct passphrase is given
-	_, _, err = decryptKeyFromFile(ks.keysDirPath, keyAddr, auth)
+	_, _, _, err = decryptKeyFromFile(ks.keysDirPath, keyAddr, auth)
 	if err != nil {
 		return err
 	}
@@ -138,62 +263,63 @@ func (ks keyStorePassphrase) DeleteKey(keyAddr common.Address, auth string) (err
 	return deleteKey(ks.keysDirPath, keyAddr)
 }
 
-func decryptKeyFromFile(keysDirPath string, keyAddr common.Address, auth string) (keyBytes []byte, keyId []byte, err error) {
-	m := make(map[string]interface{})
-	err = getKey(keysDirPath, keyAddr, &m)
+func decryptKeyFromFile(keysDirPath string, keyAddr common.Address, auth string) (keyProtected *encryptedKeyJSON, keyBytes []byte, keyId []byte, err error) {
+	keyProtected = new(encryptedKeyJSON)
+	err = getKey(keysDirPath, keyAddr, keyProtected)
 	if err != nil {
-		return
+		return nil, nil, nil, err
 	}
-
-	//v := reflect.ValueOf(m["version"])
-	k := new(encryptedKeyJSON)
-	err = getKey(keysDirPath, keyAddr, &k)
-	if err != nil {
-		return
+	if !ValidAlgorithm(keyProtected.Algorithm) {
+		return nil, nil, nil, ErrUnknownAlgorithm
 	}
-	return decryptKey(k, auth)
+	keyBytes, keyId, err = decryptKey(keyProtected, auth)
+	return keyProtected, keyBytes, keyId, err
 }
 
 func decryptKey(keyProtected *encryptedKeyJSON, auth string) (keyBytes []byte, keyId []byte, err error) {
-	if keyProtected.Version != version {
-		return nil, nil, fmt.Errorf("Version not supported: %v", keyProtected.Version)
-	}
-
-	if keyProtected.Crypto.Cipher != "aes-128-ctr" {
-		return nil, nil, fmt.Errorf("Cipher not supported: %v", keyProtected.Crypto.Cipher)
+	if !keyProtected.supported() {
+		return nil, nil, ErrKeyVersion
 	}
 
 	keyId = uuid.Parse(keyProtected.Id)
-	mac, err := hex.DecodeString(keyProtected.Crypto.MAC)
+	plainText, err := decryptData(keyProtected.Crypto, auth)
 	if err != nil {
 		return nil, nil, err
 	}
+	return plainText, keyId, err
+}
 
-	iv, err := hex.DecodeString(keyProtected.Crypto.CipherParams.IV)
+func decryptData(cryptoStruct cryptoJSON, auth string) ([]byte, error) {
+	if cryptoStruct.Cipher != "aes-128-ctr" {
+		return nil, fmt.Errorf("Cipher not supported: %v", cryptoStruct.Cipher)
+	}
+
+	mac, err := hex.DecodeString(cryptoStruct.MAC)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	cipherText, err := hex.DecodeString(keyProtected.Crypto.CipherText)
+	iv, err := hex.DecodeString(cryptoStruct.CipherParams.IV)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	derivedKey, err := getKDFKey(keyProtected.Crypto, auth)
+	cipherText, err := hex.DecodeString(cryptoStruct.CipherText)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	derivedKey, err := getKDFKey(cryptoStruct, auth)
+	if err != nil {
+		return nil, err
 	}
 
 	calculatedMAC := Sha3(derivedKey[16:32], cipherText)
 	if !bytes.Equal(calculatedMAC, mac) {
-		return nil, nil, errors.New("Decryption failed: MAC mismatch")
+		return nil, errors.New("Decryption failed: MAC mismatch")
 	}
 
-	plainText, err := aesCTRXOR(derivedKey[:16], cipherText, iv)
-	if err != nil {
-		return nil, nil, err
-	}
-	return plainText, keyId, err
+	return aesCTRXOR(derivedKey[:16], cipherText, iv)
 }
 
 func getKDFKey(cryptoJSON cryptoJSON, auth string) ([]byte, error) {
@@ -218,6 +344,15 @@ func getKDFKey(cryptoJSON cryptoJSON, auth string) ([]byte, error) {
 		}
 		key := pbkdf2.Key(authArray, salt, c, dkLen, sha256.New)
 		return key, nil
+
+	} else if cryptoJSON.KDF == KDFArgon2id {
+		t := ensureInt(cryptoJSON.KDFParams["t"])
+		m := ensureInt(cryptoJSON.KDFParams["m"])
+		p := ensureInt(cryptoJSON.KDFParams["p"])
+		if t < 1 || t > maxArgon2T || m < 8*p || m > maxArgon2M || p < 1 || p > 255 || dkLen < 32 {
+			return nil, ErrKDFParams
+		}
+		return argon2.IDKey(authArray, salt, uint32(t), uint32(m), uint8(p), uint32(dkLen)), nil
 	}
 
 	return nil, fmt.Errorf("Unsupported KDF: ", cryptoJSON.KDF)
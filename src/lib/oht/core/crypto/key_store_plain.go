@@ -16,10 +16,11 @@ import (
 type KeyStore interface {
 	// create new key using io.Reader entropy source and optionally using auth string
 	GenerateNewKey(io.Reader, string) (*Key, error)
-	GetKey(common.Address, string) (*Key, error) // get key from addr and auth string
-	GetKeyAddresses() ([]common.Address, error)  // get all addresses
-	StoreKey(*Key, string) error                 // store key optionally using auth string
-	DeleteKey(common.Address, string) error      // delete key by addr and auth string
+	GetKey(common.Address, string) (*Key, error)        // get key from addr and auth string
+	GetKeyAddresses() ([]common.Address, error)         // get all addresses
+	GetKeyMetadata(common.Address) (KeyMetadata, error) // get metadata kept in the clear
+	StoreKey(*Key, string) error                        // store key optionally using auth string
+	DeleteKey(common.Address, string) error             // delete key by addr and auth string
 	Cleanup(keyAddr common.Address) (err error)
 }
 
@@ -64,6 +65,25 @@ func (ks keyStorePlain) GetKeyAddresses() (addresses []common.Address, err error
 	return getKeyAddresses(ks.keysDirPath)
 }
 
+func (ks keyStorePlain) GetKeyMetadata(keyAddr common.Address) (KeyMetadata, error) {
+	return getKeyMetadata(ks.keysDirPath, keyAddr)
+}
+
+// getKeyMetadata reads the metadata of a key file without decrypting it,
+// keystore v3 files have none until they are migrated.
+func getKeyMetadata(keysDirPath string, keyAddr common.Address) (KeyMetadata, error) {
+	var keyJSON struct {
+		Metadata *KeyMetadata `json:"metadata"`
+	}
+	if err := getKey(keysDirPath, keyAddr, &keyJSON); err != nil {
+		return KeyMetadata{}, err
+	}
+	if keyJSON.Metadata == nil {
+		return KeyMetadata{}, nil
+	}
+	return *keyJSON.Metadata, nil
+}
+
 func (ks keyStorePlain) Cleanup(keyAddr common.Address) (err error) {
 	return cleanup(ks.keysDirPath, keyAddr)
 }
@@ -0,0 +1,163 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readKeyFile(t *testing.T, directory string, key *Key) *encryptedKeyJSON {
+	files, _ := ioutil.ReadDir(directory)
+	if len(files) != 1 {
+		t.Fatalf("expected one key file, got %d", len(files))
+	}
+	keyJSON := new(encryptedKeyJSON)
+	if err := getKey(directory, key.Address, keyJSON); err != nil {
+		t.Fatal(err)
+	}
+	return keyJSON
+}
+
+func TestKeyStoreV3Migration(t *testing.T) {
+	directory, err := ioutil.TempDir("", "oht-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	key, _ := NewKeyOfAlgorithm("", rand.Reader)
+	cryptoStruct, _ := encryptData(key.secret(), "secret", KDFScrypt, KDFLight)
+	v3, _ := json.Marshal(map[string]interface{}{
+		"address": hex.EncodeToString(key.Address[:]),
+		"crypto":  cryptoStruct,
+		"id":      key.Id.String(),
+		"version": v3Version,
+	})
+	if err := writeKeyFile(key.Address, directory, v3); err != nil {
+		t.Fatal(err)
+	}
+	ks := NewKeyStorePassphraseKDF(directory, KDFArgon2id, KDFLight)
+	if metadata, err := ks.GetKeyMetadata(key.Address); err != nil || metadata.Created != 0 {
+		t.Errorf("expected a v3 file to have no metadata, got %+v %v", metadata, err)
+	}
+	if _, err := ks.GetKey(key.Address, "wrong"); err == nil {
+		t.Fatal("expected the wrong passphrase to fail")
+	}
+	if keyJSON := readKeyFile(t, directory, key); !keyJSON.legacy() {
+		t.Error("expected a failed unlock to leave the v3 file alone")
+	}
+
+	unlocked, err := ks.GetKey(key.Address, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked.Address != key.Address || unlocked.Id.String() != key.Id.String() {
+		t.Errorf("expected the v3 key back, got %s", unlocked.Address.Hex())
+	}
+	keyJSON := readKeyFile(t, directory, key)
+	if keyJSON.Format != keyFormat || keyJSON.Version != version || keyJSON.Algorithm != AlgorithmSecp256k1 || keyJSON.Crypto.KDF != KDFArgon2id {
+		t.Errorf("expected the key file to be migrated, got %+v", keyJSON)
+	}
+	if keyJSON.Metadata == nil || keyJSON.Metadata.Purpose != PurposeAccount || keyJSON.Metadata.Created == 0 {
+		t.Errorf("expected metadata in the migrated file, got %+v", keyJSON.Metadata)
+	}
+	if _, err := ks.GetKey(key.Address, "secret"); err != nil {
+		t.Errorf("expected the migrated key to unlock, got %v", err)
+	}
+}
+
+func TestKeyStoreV3DirectoryMigration(t *testing.T) {
+	directory, err := ioutil.TempDir("", "oht-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	// The old directory of an address starting with a letter sorts after
+	// the migrated UTC-- file
+	key, _ := NewKeyOfAlgorithm("", rand.Reader)
+	for hex.EncodeToString(key.Address[:])[0] < 'a' {
+		key, _ = NewKeyOfAlgorithm("", rand.Reader)
+	}
+	cryptoStruct, _ := encryptData(key.secret(), "secret", KDFScrypt, KDFLight)
+	v3, _ := json.Marshal(map[string]interface{}{
+		"address": hex.EncodeToString(key.Address[:]),
+		"crypto":  cryptoStruct,
+		"id":      key.Id.String(),
+		"version": v3Version,
+	})
+	addrHex := hex.EncodeToString(key.Address[:])
+	os.Mkdir(filepath.Join(directory, addrHex), 0700)
+	if err := ioutil.WriteFile(filepath.Join(directory, addrHex, addrHex), v3, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks := NewKeyStorePassphraseKDF(directory, KDFArgon2id, KDFLight)
+	if _, err := ks.GetKey(key.Address, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if keyJSON := readKeyFile(t, directory, key); keyJSON.legacy() {
+		t.Error("expected the old directory to be replaced by the migrated file")
+	}
+}
+
+func TestKeyStoreArgon2id(t *testing.T) {
+	directory, err := ioutil.TempDir("", "oht-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ks := NewKeyStorePassphraseKDF(directory, KDFArgon2id, KDFLight)
+	key, _ := NewKeyOfAlgorithm(AlgorithmEd25519, rand.Reader)
+	key.Metadata.Label = "laptop"
+	if err := ks.StoreKey(key, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := ks.GetKeyMetadata(key.Address)
+	if err != nil || metadata.Label != "laptop" || metadata.Purpose != PurposeSigning || metadata.Created == 0 {
+		t.Errorf("expected the metadata to be readable while locked, got %+v %v", metadata, err)
+	}
+	stored, err := ks.GetKey(key.Address, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Metadata != metadata {
+		t.Errorf("expected the metadata with the key, got %+v", stored.Metadata)
+	}
+	if _, err := ks.GetKey(key.Address, "wrong"); err == nil {
+		t.Error("expected the wrong passphrase to fail")
+	}
+
+	unknown := NewKeyStorePassphraseKDF(directory, "bcrypt", KDFLight)
+	if err := unknown.StoreKey(key, "secret"); err != ErrUnknownKDF {
+		t.Errorf("expected %v, got %v", ErrUnknownKDF, err)
+	}
+}
+
+func TestEncryptDataKDF(t *testing.T) {
+	for _, kdf := range []string{KDFScrypt, KDFArgon2id} {
+		sealed, err := EncryptData([]byte("seed phrase"), "secret", kdf, KDFLight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cryptoStruct cryptoJSON
+		if err := json.Unmarshal(sealed, &cryptoStruct); err != nil || cryptoStruct.KDF != kdf {
+			t.Errorf("expected the data sealed with %s, got %q %v", kdf, cryptoStruct.KDF, err)
+		}
+		if data, err := DecryptData(sealed, "secret"); err != nil || string(data) != "seed phrase" {
+			t.Errorf("%s: expected the data back, got %q %v", kdf, data, err)
+		}
+	}
+	sealed, _ := EncryptData([]byte("seed phrase"), "secret", KDFArgon2id, KDFLight)
+	var cryptoStruct cryptoJSON
+	json.Unmarshal(sealed, &cryptoStruct)
+	cryptoStruct.KDFParams["m"] = maxArgon2M + 1
+	sealed, _ = json.Marshal(cryptoStruct)
+	if _, err := DecryptData(sealed, "secret"); err != ErrKDFParams {
+		t.Errorf("expected %v for more memory than allowed, got %v", ErrKDFParams, err)
+	}
+	if _, err := EncryptData([]byte("seed phrase"), "secret", "bcrypt", KDFLight); err != ErrUnknownKDF {
+		t.Errorf("expected %v, got %v", ErrUnknownKDF, err)
+	}
+}
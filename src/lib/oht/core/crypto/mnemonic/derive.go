@@ -0,0 +1,138 @@
+package mnemonic
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"lib/oht/core/crypto"
+)
+
+// Hardened marks a child index whose key can only be derived with the
+// private key of its parent.
+const Hardened uint32 = 1 << 31
+
+// Accounts follow the BIP44 layout wallets use for secp256k1 accounts with
+// keccak addresses, so a seed restores the same accounts elsewhere. The node
+// key lives under an account of its own.
+const (
+	AccountPath = "m/44'/60'/0'/0/%d"
+	NodeKeyPath = "m/44'/60'/1'/0/0"
+)
+
+var (
+	ErrInvalidPath = errors.New("Mnemonic: Derivation paths look like m/44'/60'/0'/0/0")
+	ErrInvalidKey  = errors.New("Mnemonic: Derived key is invalid, use the next index")
+)
+
+// ExtendedKey is a private key with the chain code its children are
+// derived with.
+type ExtendedKey struct {
+	Key       []byte
+	ChainCode []byte
+}
+
+// MasterKey derives the root of the key tree from a seed.
+func MasterKey(seed []byte) (*ExtendedKey, error) {
+	return newExtendedKey([]byte("Bitcoin seed"), seed, nil)
+}
+
+// newExtendedKey splits the HMAC-SHA512 of data into a key, added to
+// parent when there is one, and a chain code.
+func newExtendedKey(hmacKey, data []byte, parent []byte) (*ExtendedKey, error) {
+	mac := hmac.New(sha512.New, hmacKey)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	n := crypto.S256().Params().N
+	key := new(big.Int).SetBytes(sum[:32])
+	if key.Cmp(n) >= 0 {
+		return nil, ErrInvalidKey
+	}
+	if parent != nil {
+		key.Add(key, new(big.Int).SetBytes(parent))
+		key.Mod(key, n)
+	}
+	if key.Sign() == 0 {
+		return nil, ErrInvalidKey
+	}
+	extended := &ExtendedKey{Key: make([]byte, 32), ChainCode: sum[32:]}
+	key.FillBytes(extended.Key)
+	return extended, nil
+}
+
+// Child derives the child key at index, hardened when index has the
+// Hardened bit set.
+func (parent *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	var data []byte
+	if index >= Hardened {
+		data = append([]byte{0}, parent.Key...)
+	} else {
+		data = parent.compressedPublicKey()
+	}
+	var number [4]byte
+	binary.BigEndian.PutUint32(number[:], index)
+	return newExtendedKey(parent.ChainCode, append(data, number[:]...), parent.Key)
+}
+
+func (parent *ExtendedKey) compressedPublicKey() []byte {
+	x, y := crypto.S256().ScalarBaseMult(parent.Key)
+	publicKey := make([]byte, 33)
+	publicKey[0] = byte(2 + y.Bit(0))
+	x.FillBytes(publicKey[1:])
+	return publicKey
+}
+
+// Derive follows a path such as m/44'/60'/0'/0/0 from the key, which must
+// be the master key.
+func (key *ExtendedKey) Derive(path string) (*ExtendedKey, error) {
+	levels := strings.Split(path, "/")
+	if levels[0] != "m" {
+		return nil, ErrInvalidPath
+	}
+	for _, level := range levels[1:] {
+		var offset uint32
+		if strings.HasSuffix(level, "'") {
+			level, offset = strings.TrimSuffix(level, "'"), Hardened
+		}
+		index, err := strconv.ParseUint(level, 10, 31)
+		if err != nil {
+			return nil, ErrInvalidPath
+		}
+		if key, err = key.Child(uint32(index) + offset); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (key *ExtendedKey) ECDSA() *ecdsa.PrivateKey {
+	return crypto.ToECDSA(key.Key)
+}
+
+// AccountKey derives the account key at index of the seed.
+func AccountKey(seed []byte, index int) (*ecdsa.PrivateKey, error) {
+	return derive(seed, fmt.Sprintf(AccountPath, index))
+}
+
+// NodeKey derives the node key of the seed.
+func NodeKey(seed []byte) (*ecdsa.PrivateKey, error) {
+	return derive(seed, NodeKeyPath)
+}
+
+func derive(seed []byte, path string) (*ecdsa.PrivateKey, error) {
+	master, err := MasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	key, err := master.Derive(path)
+	if err != nil {
+		return nil, err
+	}
+	return key.ECDSA(), nil
+}
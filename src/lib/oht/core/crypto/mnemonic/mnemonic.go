@@ -0,0 +1,118 @@
+// Package mnemonic implements BIP39 seed phrases and BIP32 derivation of
+// secp256k1 keys from them, so every key of a user can be restored from a
+// list of words, see
+// https://github.com/bitcoin/bips/blob/master/bip-0039.mediawiki and
+// https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki.
+package mnemonic
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// DefaultEntropyBits gives a 24 word mnemonic.
+	DefaultEntropyBits = 256
+	seedIterations     = 2048
+)
+
+var (
+	ErrEntropyLength = errors.New("Mnemonic: Entropy must be 128 to 256 bits in steps of 32")
+	ErrWordCount     = errors.New("Mnemonic: A mnemonic has 12, 15, 18, 21 or 24 words")
+	ErrUnknownWord   = errors.New("Mnemonic: Word is not in the word list")
+	ErrChecksum      = errors.New("Mnemonic: Checksum does not match, a word was mistyped")
+	wordIndex        = make(map[string]int, len(English))
+)
+
+func init() {
+	for index, word := range English {
+		wordIndex[word] = index
+	}
+}
+
+// NewEntropy reads entropy for a new mnemonic from the system random source.
+func NewEntropy(bits int) ([]byte, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return nil, ErrEntropyLength
+	}
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return nil, err
+	}
+	return entropy, nil
+}
+
+// NewMnemonic encodes entropy as words, every word holds 11 bits of the
+// entropy followed by the first bits of its sha256 as a checksum.
+func NewMnemonic(entropy []byte) (string, error) {
+	bits := len(entropy) * 8
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", ErrEntropyLength
+	}
+	checksumBits := uint(bits / 32)
+	hash := sha256.Sum256(entropy)
+	data := new(big.Int).SetBytes(entropy)
+	data.Lsh(data, checksumBits)
+	data.Or(data, big.NewInt(int64(hash[0]>>(8-checksumBits))))
+
+	words := make([]string, (bits+int(checksumBits))/11)
+	mask := big.NewInt(2047)
+	for i := len(words) - 1; i >= 0; i-- {
+		words[i] = English[new(big.Int).And(data, mask).Int64()]
+		data.Rsh(data, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// Entropy decodes a mnemonic back into its entropy, verifying its checksum.
+func Entropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, ErrWordCount
+	}
+	data := new(big.Int)
+	for _, word := range words {
+		index, ok := wordIndex[word]
+		if !ok {
+			return nil, ErrUnknownWord
+		}
+		data.Lsh(data, 11)
+		data.Or(data, big.NewInt(int64(index)))
+	}
+	checksumBits := uint(len(words) * 11 / 33)
+	checksum := new(big.Int).And(data, big.NewInt(int64(1<<checksumBits-1)))
+	data.Rsh(data, checksumBits)
+
+	entropy := make([]byte, (len(words)*11-int(checksumBits))/8)
+	data.FillBytes(entropy)
+	hash := sha256.Sum256(entropy)
+	if checksum.Int64() != int64(hash[0]>>(8-checksumBits)) {
+		return nil, ErrChecksum
+	}
+	return entropy, nil
+}
+
+// Valid reports whether the mnemonic decodes with a correct checksum.
+func Valid(mnemonic string) bool {
+	_, err := Entropy(mnemonic)
+	return err == nil
+}
+
+// Normalize lowercases a mnemonic and separates its words by single
+// spaces, the form the seed is computed from.
+func Normalize(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+// Seed stretches a mnemonic and an optional passphrase into the seed keys
+// are derived from. Any passphrase gives a valid seed, a different one
+// gives different keys.
+func Seed(mnemonic, passphrase string) []byte {
+	return pbkdf2.Key([]byte(Normalize(mnemonic)), []byte("mnemonic"+passphrase), seedIterations, 64, sha512.New)
+}
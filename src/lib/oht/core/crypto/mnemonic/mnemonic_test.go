@@ -0,0 +1,79 @@
+package mnemonic
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"lib/oht/core/crypto"
+)
+
+func TestMnemonicVectors(t *testing.T) {
+	// Vectors from https://github.com/trezor/python-mnemonic/blob/master/vectors.json
+	vectors := []struct{ entropy, mnemonic, seed string }{
+		{
+			"00000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+			"legal winner thank year wave sausage worth useful legal winner thank yellow",
+			"2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607",
+		},
+	}
+	for _, vector := range vectors {
+		entropy, _ := hex.DecodeString(vector.entropy)
+		mnemonic, err := NewMnemonic(entropy)
+		if err != nil || mnemonic != vector.mnemonic {
+			t.Errorf("expected %q, got %q %v", vector.mnemonic, mnemonic, err)
+		}
+		if decoded, err := Entropy(strings.ToUpper(vector.mnemonic)); err != nil || hex.EncodeToString(decoded) != vector.entropy {
+			t.Errorf("expected entropy %s, got %x %v", vector.entropy, decoded, err)
+		}
+		if seed := hex.EncodeToString(Seed(vector.mnemonic, "TREZOR")); seed != vector.seed {
+			t.Errorf("expected seed %s, got %s", vector.seed, seed)
+		}
+	}
+
+	if _, err := Entropy("legal winner thank year wave sausage worth useful legal winner thank thank"); err != ErrChecksum {
+		t.Errorf("expected %v, got %v", ErrChecksum, err)
+	}
+	if _, err := Entropy("legal winner thank year wave sausage worth useful legal winner thank yellowish"); err != ErrUnknownWord {
+		t.Errorf("expected %v, got %v", ErrUnknownWord, err)
+	}
+
+	entropy, _ := NewEntropy(DefaultEntropyBits)
+	mnemonic, _ := NewMnemonic(entropy)
+	if words := strings.Fields(mnemonic); len(words) != 24 || !Valid(mnemonic) {
+		t.Errorf("expected a valid 24 word mnemonic, got %q", mnemonic)
+	}
+}
+
+func TestDerive(t *testing.T) {
+	// Test vector 1 of BIP32
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, err := MasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := master.Derive("m/0'/1/2'/2/1000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(key.Key) != "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8" {
+		t.Errorf("unexpected key %x", key.Key)
+	}
+	if _, err := master.Derive("44'/60'"); err != ErrInvalidPath {
+		t.Errorf("expected %v, got %v", ErrInvalidPath, err)
+	}
+
+	// Wallets restore the same first account from the seed phrase
+	account, err := AccountKey(Seed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", ""), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := crypto.PubkeyToAddress(account.PublicKey).Hex(); !strings.EqualFold(address, "0x9858EfFD232B4033E47d90003D41EC34EcaEda94") {
+		t.Errorf("unexpected first account %s", address)
+	}
+}
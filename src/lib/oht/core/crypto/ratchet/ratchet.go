@@ -0,0 +1,274 @@
+package ratchet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxSkip bounds how many messages of a chain are skipped at once, and how
+// many keys of skipped messages are kept in total. Once there are more the
+// oldest are dropped, their messages are the least likely to still arrive.
+const maxSkip = 1000
+
+var (
+	ErrTooManySkipped = errors.New("Ratchet: Too many skipped messages")
+	ErrDecrypt        = errors.New("Ratchet: Message could not be decrypted")
+	ErrNoSendingChain = errors.New("Ratchet: No sending chain, a message must be received first")
+)
+
+// Header is sent in the clear with each message, it is authenticated as
+// associated data.
+type Header struct {
+	PublicKey     []byte
+	PreviousChain uint32
+	Number        uint32
+}
+
+func (header *Header) encode() []byte {
+	encoded := make([]byte, len(header.PublicKey), len(header.PublicKey)+8)
+	copy(encoded, header.PublicKey)
+	encoded = binary.BigEndian.AppendUint32(encoded, header.PreviousChain)
+	return binary.BigEndian.AppendUint32(encoded, header.Number)
+}
+
+// State is one side of a session. It is exported field by field so sessions
+// can be saved as JSON between restarts.
+type State struct {
+	DHs          *KeyPair
+	DHr          []byte
+	RootKey      []byte
+	SendChain    []byte
+	ReceiveChain []byte
+	Ns           uint32
+	Nr           uint32
+	PN           uint32
+	// Skipped holds the keys of messages skipped in a receiving chain, by
+	// hex ratchet key and message number, SkippedOrder their indexes from the
+	// oldest on.
+	Skipped      map[string][]byte
+	SkippedOrder []string `json:",omitempty"`
+}
+
+// NewInitiator starts a session from an X3DH secret and the signed prekey
+// of the responder, which serves as its first ratchet key.
+func NewInitiator(secret, remotePrekey []byte) (*State, error) {
+	dhs, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	output, err := dh(dhs.Private, remotePrekey)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, sendChain, err := kdfRoot(secret, output)
+	if err != nil {
+		return nil, err
+	}
+	return &State{
+		DHs:       dhs,
+		DHr:       remotePrekey,
+		RootKey:   rootKey,
+		SendChain: sendChain,
+		Skipped:   make(map[string][]byte),
+	}, nil
+}
+
+// NewResponder starts a session from an X3DH secret and the signed prekey
+// the initiator used. The responder can only send once it has received.
+func NewResponder(secret []byte, prekey *KeyPair) *State {
+	return &State{
+		DHs:     &KeyPair{Private: append([]byte{}, prekey.Private...), Public: append([]byte{}, prekey.Public...)},
+		RootKey: secret,
+		Skipped: make(map[string][]byte),
+	}
+}
+
+// Encrypt advances the sending chain and seals plaintext under the next
+// message key.
+func (state *State) Encrypt(plaintext, associatedData []byte) (*Header, []byte, error) {
+	if state.SendChain == nil {
+		return nil, nil, ErrNoSendingChain
+	}
+	chain, messageKey := kdfChain(state.SendChain)
+	header := &Header{PublicKey: state.DHs.Public, PreviousChain: state.PN, Number: state.Ns}
+	ciphertext, err := seal(messageKey, plaintext, append(append([]byte{}, associatedData...), header.encode()...))
+	if err != nil {
+		return nil, nil, err
+	}
+	state.SendChain = chain
+	state.Ns++
+	return header, ciphertext, nil
+}
+
+// Decrypt opens a message, ratcheting forward as its header requires. The
+// state is only changed when the message authenticates, so forged messages
+// can not desynchronize a session.
+func (state *State) Decrypt(header *Header, ciphertext, associatedData []byte) ([]byte, error) {
+	if header == nil || len(header.PublicKey) != KeySize {
+		return nil, ErrDecrypt
+	}
+	associatedData = append(append([]byte{}, associatedData...), header.encode()...)
+	skippedKey := skippedIndex(header.PublicKey, header.Number)
+	if messageKey, ok := state.Skipped[skippedKey]; ok {
+		plaintext, err := open(messageKey, ciphertext, associatedData)
+		if err != nil {
+			return nil, err
+		}
+		state.unskip(skippedKey)
+		return plaintext, nil
+	}
+	next := state.clone()
+	if !hmac.Equal(header.PublicKey, next.DHr) {
+		if err := next.skip(header.PreviousChain); err != nil {
+			return nil, err
+		}
+		if err := next.step(header.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := next.skip(header.Number); err != nil {
+		return nil, err
+	}
+	chain, messageKey := kdfChain(next.ReceiveChain)
+	plaintext, err := open(messageKey, ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	next.ReceiveChain = chain
+	next.Nr++
+	*state = *next
+	return plaintext, nil
+}
+
+// skip stores the message keys of the current receiving chain up to until.
+func (state *State) skip(until uint32) error {
+	if state.ReceiveChain == nil || until <= state.Nr {
+		return nil
+	}
+	if until-state.Nr > maxSkip {
+		return ErrTooManySkipped
+	}
+	for state.Nr < until {
+		chain, messageKey := kdfChain(state.ReceiveChain)
+		index := skippedIndex(state.DHr, state.Nr)
+		state.Skipped[index] = messageKey
+		state.SkippedOrder = append(state.SkippedOrder, index)
+		state.ReceiveChain = chain
+		state.Nr++
+	}
+	for len(state.SkippedOrder) > maxSkip {
+		delete(state.Skipped, state.SkippedOrder[0])
+		state.SkippedOrder = state.SkippedOrder[1:]
+	}
+	return nil
+}
+
+// unskip forgets the key of a skipped message once it arrived.
+func (state *State) unskip(index string) {
+	delete(state.Skipped, index)
+	for i, skipped := range state.SkippedOrder {
+		if skipped == index {
+			state.SkippedOrder = append(state.SkippedOrder[:i:i], state.SkippedOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// step performs a DH ratchet step on a new ratchet key of the other side.
+func (state *State) step(remote []byte) (err error) {
+	state.PN, state.Ns, state.Nr = state.Ns, 0, 0
+	state.DHr = append([]byte{}, remote...)
+	output, err := dh(state.DHs.Private, state.DHr)
+	if err != nil {
+		return err
+	}
+	if state.RootKey, state.ReceiveChain, err = kdfRoot(state.RootKey, output); err != nil {
+		return err
+	}
+	if state.DHs, err = GenerateKeyPair(); err != nil {
+		return err
+	}
+	if output, err = dh(state.DHs.Private, state.DHr); err != nil {
+		return err
+	}
+	state.RootKey, state.SendChain, err = kdfRoot(state.RootKey, output)
+	return err
+}
+
+func (state *State) clone() *State {
+	next := *state
+	next.Skipped = make(map[string][]byte, len(state.Skipped))
+	for key, value := range state.Skipped {
+		next.Skipped[key] = value
+	}
+	next.SkippedOrder = append([]string(nil), state.SkippedOrder...)
+	return &next
+}
+
+func skippedIndex(publicKey []byte, number uint32) string {
+	return fmt.Sprintf("%s/%d", hex.EncodeToString(publicKey), number)
+}
+
+func kdfRoot(rootKey, output []byte) ([]byte, []byte, error) {
+	keys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, output, rootKey, []byte("oht-ratchet")), keys); err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	return next, mac.Sum(nil)
+}
+
+// messageCipher expands a message key into an AES-256-GCM key and nonce.
+// Each message key is used once, so a derived nonce is safe.
+func messageCipher(messageKey []byte) (cipher.AEAD, []byte, error) {
+	material := make([]byte, 32+12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, messageKey, nil, []byte("oht-ratchet-message")), material); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(material[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, material[32:], nil
+}
+
+func seal(messageKey, plaintext, associatedData []byte) ([]byte, error) {
+	gcm, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, nonce, plaintext, associatedData), nil
+}
+
+func open(messageKey, ciphertext, associatedData []byte) ([]byte, error) {
+	gcm, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
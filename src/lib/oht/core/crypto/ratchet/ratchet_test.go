@@ -0,0 +1,116 @@
+package ratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+type sealed struct {
+	header     *Header
+	ciphertext []byte
+}
+
+// newSessions runs X3DH between alice and bob's prekeys and starts both
+// sides of a session.
+func newSessions(t *testing.T) (alice, bob *State, ad []byte) {
+	aliceIdentity, _ := GenerateKeyPair()
+	bobIdentity, _ := GenerateKeyPair()
+	bobPrekey, _ := GenerateKeyPair()
+	secret, initial, err := Initiate(aliceIdentity, bobIdentity.Public, bobPrekey.Public, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderSecret, err := Respond(bobIdentity, bobPrekey, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, responderSecret) {
+		t.Fatal("expected both sides to agree on the secret")
+	}
+	if alice, err = NewInitiator(secret, bobPrekey.Public); err != nil {
+		t.Fatal(err)
+	}
+	return alice, NewResponder(responderSecret, bobPrekey), AssociatedData(aliceIdentity.Public, bobIdentity.Public)
+}
+
+func encrypt(t *testing.T, state *State, plaintext string, ad []byte) sealed {
+	header, ciphertext, err := state.Encrypt([]byte(plaintext), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed{header, ciphertext}
+}
+
+func expectPlaintext(t *testing.T, state *State, message sealed, ad []byte, expected string) {
+	plaintext, err := state.Decrypt(message.header, message.ciphertext, ad)
+	if err != nil {
+		t.Fatalf("decrypting %q: %v", expected, err)
+	}
+	if string(plaintext) != expected {
+		t.Errorf("expected %q, got %q", expected, plaintext)
+	}
+}
+
+func TestRatchetConversation(t *testing.T) {
+	alice, bob, ad := newSessions(t)
+	if _, _, err := bob.Encrypt([]byte("too early"), ad); err != ErrNoSendingChain {
+		t.Errorf("expected %v before the responder received, got %v", ErrNoSendingChain, err)
+	}
+	expectPlaintext(t, bob, encrypt(t, alice, "hello", ad), ad, "hello")
+	expectPlaintext(t, alice, encrypt(t, bob, "hi", ad), ad, "hi")
+	first := encrypt(t, alice, "first", ad)
+	expectPlaintext(t, bob, encrypt(t, alice, "second", ad), ad, "second")
+	expectPlaintext(t, bob, first, ad, "first")
+
+	// A message key is only used once
+	if _, err := bob.Decrypt(first.header, first.ciphertext, ad); err == nil {
+		t.Error("expected a replayed message not to decrypt")
+	}
+	if _, err := bob.Decrypt(first.header, first.ciphertext, append(ad, 0)); err == nil {
+		t.Error("expected other associated data not to decrypt")
+	}
+}
+
+func TestRatchetForgeryLeavesStateIntact(t *testing.T) {
+	alice, bob, ad := newSessions(t)
+	message := encrypt(t, alice, "hello", ad)
+	forged := *message.header
+	forged.Number = 500
+	if _, err := bob.Decrypt(&forged, message.ciphertext, ad); err == nil {
+		t.Fatal("expected a forged header not to decrypt")
+	}
+	if len(bob.Skipped) != 0 || bob.ReceiveChain != nil {
+		t.Error("expected a forged message not to change the state")
+	}
+	expectPlaintext(t, bob, message, ad, "hello")
+
+	skipped := *message.header
+	skipped.Number = maxSkip + 2
+	if _, err := bob.Decrypt(&skipped, message.ciphertext, ad); err != ErrTooManySkipped {
+		t.Errorf("expected %v, got %v", ErrTooManySkipped, err)
+	}
+}
+
+func TestRatchetSkippedKeysEvicted(t *testing.T) {
+	alice, bob, ad := newSessions(t)
+	expectPlaintext(t, bob, encrypt(t, alice, "hello", ad), ad, "hello")
+	var lost []sealed
+	for i := 0; i < maxSkip+maxSkip/2; i++ {
+		lost = append(lost, encrypt(t, alice, "lost", ad))
+		// No gap of a single chain is too long
+		if i == maxSkip-1 {
+			expectPlaintext(t, bob, encrypt(t, alice, "after the first gap", ad), ad, "after the first gap")
+		}
+	}
+	expectPlaintext(t, bob, encrypt(t, alice, "after the second gap", ad), ad, "after the second gap")
+	if len(bob.Skipped) != maxSkip || len(bob.SkippedOrder) != maxSkip {
+		t.Errorf("expected %d skipped keys, got %d", maxSkip, len(bob.Skipped))
+	}
+	if _, err := bob.Decrypt(lost[0].header, lost[0].ciphertext, ad); err == nil {
+		t.Error("expected the key of the oldest skipped message to be dropped")
+	}
+	expectPlaintext(t, bob, lost[len(lost)-1], ad, "lost")
+	if len(bob.Skipped) != maxSkip-1 || len(bob.SkippedOrder) != maxSkip-1 {
+		t.Errorf("expected the used key to be forgotten, got %d", len(bob.Skipped))
+	}
+}
@@ -0,0 +1,120 @@
+// Package ratchet implements the X3DH key agreement and the Double Ratchet
+// used to encrypt messages between two accounts with forward secrecy, see
+// https://signal.org/docs/specifications/x3dh/ and
+// https://signal.org/docs/specifications/doubleratchet/.
+//
+// All keys are x25519. Accounts bind their x25519 identity key to their
+// secp256k1 account key by signing their published prekey bundle with it.
+package ratchet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const KeySize = 32
+
+var ErrInvalidKey = errors.New("Ratchet: Invalid x25519 key")
+
+type KeyPair struct {
+	Private []byte
+	Public  []byte
+}
+
+func GenerateKeyPair() (*KeyPair, error) {
+	private := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Private: private, Public: public}, nil
+}
+
+func dh(private, public []byte) ([]byte, error) {
+	if len(private) != KeySize || len(public) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return curve25519.X25519(private, public)
+}
+
+// Initial is sent with the messages of a session until the responder
+// answers, so the responder can run the same agreement.
+type Initial struct {
+	IdentityKey  []byte
+	EphemeralKey []byte
+	PrekeyId     uint32
+}
+
+// agreement derives the shared secret from the three X3DH DH outputs. One
+// time prekeys are not used, a DHT record can not be consumed by a single
+// initiator.
+func agreement(dh1, dh2, dh3 []byte) ([]byte, error) {
+	// F is 32 0xFF bytes for x25519, see "Cryptographic notation" in X3DH
+	input := make([]byte, KeySize, KeySize*4)
+	for index := range input {
+		input[index] = 0xFF
+	}
+	input = append(append(append(input, dh1...), dh2...), dh3...)
+	secret := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, input, make([]byte, KeySize), []byte("oht-x3dh")), secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Initiate runs X3DH against the identity and signed prekey of a responder.
+// It returns the shared secret and the initial message to send along.
+func Initiate(identity *KeyPair, remoteIdentity, remotePrekey []byte, prekeyId uint32) ([]byte, *Initial, error) {
+	ephemeral, err := GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	dh1, err := dh(identity.Private, remotePrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh2, err := dh(ephemeral.Private, remoteIdentity)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh3, err := dh(ephemeral.Private, remotePrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := agreement(dh1, dh2, dh3)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, &Initial{IdentityKey: identity.Public, EphemeralKey: ephemeral.Public, PrekeyId: prekeyId}, nil
+}
+
+// Respond runs X3DH for an initial message received with the signed prekey
+// it names.
+func Respond(identity, prekey *KeyPair, initial *Initial) ([]byte, error) {
+	dh1, err := dh(prekey.Private, initial.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(identity.Private, initial.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(prekey.Private, initial.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	return agreement(dh1, dh2, dh3)
+}
+
+// AssociatedData binds the messages of a session to both identity keys.
+func AssociatedData(initiatorIdentity, responderIdentity []byte) []byte {
+	return append(append([]byte{}, initiatorIdentity...), responderIdentity...)
+}
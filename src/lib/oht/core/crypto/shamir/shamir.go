@@ -0,0 +1,125 @@
+// Package shamir splits a secret into shares so any threshold of them
+// rebuild it while fewer reveal nothing about it, see
+// https://en.wikipedia.org/wiki/Shamir%27s_Secret_Sharing. Every byte of the
+// secret is the constant term of its own random polynomial over GF(256).
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+const MaxShares = 255
+
+var (
+	ErrThreshold     = errors.New("Shamir: Threshold must be at least 2 and at most the number of shares")
+	ErrShareCount    = errors.New("Shamir: At most 255 shares")
+	ErrEmptySecret   = errors.New("Shamir: Secret is empty")
+	ErrTooFewShares  = errors.New("Shamir: At least two shares are needed")
+	ErrShareMismatch = errors.New("Shamir: Shares differ in length or repeat an index")
+)
+
+// Share is the value of the polynomials at X, which is never zero.
+type Share struct {
+	X byte
+	Y []byte
+}
+
+var expTable, logTable [256]byte
+
+func init() {
+	// 3 generates the multiplicative group of GF(256) with the AES
+	// polynomial x^8 + x^4 + x^3 + x + 1
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		x ^= x<<1 ^ reduce(x)
+	}
+	expTable[255] = expTable[0]
+}
+
+// reduce is what x<<1 has to be xored with to stay in the field.
+func reduce(x byte) byte {
+	if x&0x80 != 0 {
+		return 0x1b
+	}
+	return 0
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+// Split splits secret into shares of which threshold rebuild it.
+func Split(secret []byte, shares, threshold int) ([]Share, error) {
+	if len(secret) == 0 {
+		return nil, ErrEmptySecret
+	}
+	if shares > MaxShares {
+		return nil, ErrShareCount
+	}
+	if threshold < 2 || threshold > shares {
+		return nil, ErrThreshold
+	}
+	coefficients := make([]byte, threshold-1)
+	result := make([]Share, shares)
+	for i := range result {
+		result[i] = Share{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	for position, value := range secret {
+		if _, err := rand.Read(coefficients); err != nil {
+			return nil, err
+		}
+		for i := range result {
+			// Horner's rule, from the highest coefficient down
+			y := byte(0)
+			for c := len(coefficients) - 1; c >= 0; c-- {
+				y = mul(y, result[i].X) ^ coefficients[c]
+			}
+			result[i].Y[position] = mul(y, result[i].X) ^ value
+		}
+	}
+	return result, nil
+}
+
+// Combine rebuilds the secret from threshold shares. More shares than the
+// threshold still rebuild it, fewer give a wrong secret that can not be
+// told apart from the right one.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrTooFewShares
+	}
+	length := len(shares[0].Y)
+	seen := make(map[byte]bool, len(shares))
+	for _, share := range shares {
+		if share.X == 0 || seen[share.X] || len(share.Y) != length {
+			return nil, ErrShareMismatch
+		}
+		seen[share.X] = true
+	}
+	secret := make([]byte, length)
+	for i, share := range shares {
+		// Lagrange basis polynomial of the share evaluated at zero
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = mul(basis, div(other.X, other.X^share.X))
+			}
+		}
+		for position := range secret {
+			secret[position] ^= mul(basis, share.Y[position])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,43 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("a 32 byte account private key!!!")
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked []Share
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		combined, err := Combine(picked)
+		if err != nil || !bytes.Equal(combined, secret) {
+			t.Errorf("shares %v: expected the secret, got %q %v", subset, combined, err)
+		}
+	}
+	if combined, _ := Combine(shares[:2]); bytes.Equal(combined, secret) {
+		t.Error("expected fewer shares than the threshold not to rebuild the secret")
+	}
+	if _, err := Combine([]Share{shares[0], shares[0], shares[1]}); err != ErrShareMismatch {
+		t.Errorf("expected %v for a repeated share, got %v", ErrShareMismatch, err)
+	}
+	if _, err := Split(secret, 3, 4); err != ErrThreshold {
+		t.Errorf("expected %v, got %v", ErrThreshold, err)
+	}
+}
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if div(mul(byte(a), byte(b)), byte(b)) != byte(a) {
+				t.Fatalf("%d * %d / %d != %d", a, b, b, a)
+			}
+		}
+	}
+}
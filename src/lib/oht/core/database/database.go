@@ -1,19 +1,100 @@
 package database
 
 import (
-	"log"
+	"errors"
 
 	"github.com/boltdb/bolt"
 
 	"github.com/multiverse-os/libs/oht/core/common"
 )
 
-func InitializeDatabase() {
-	db, err := bolt.Open(common.AbsolutePath(common.DefaultDataDir(), "oht.db"), 0600, nil)
+var (
+	ErrNotFound   = errors.New("Database: Not found")
+	defaultBucket = []byte("oht")
+)
+
+// BoltDatabase is the persistent Database, every key lives in a single
+// bucket of the bolt file.
+type BoltDatabase struct {
+	db *bolt.DB
+}
+
+func InitializeDatabase(path string) (*BoltDatabase, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(defaultBucket)
+		return err
+	})
 	if err != nil {
-		log.Fatal(err)
+		db.Close()
+		return nil, err
 	}
-	log.Println("Database initialized")
-	defer db.Close()
+	return &BoltDatabase{db: db}, nil
+}
+
+func (db *BoltDatabase) Put(key []byte, value []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(defaultBucket).Put(key, value)
+	})
+}
+
+func (db *BoltDatabase) Get(key []byte) (value []byte, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		// Values returned by bolt are only valid inside the transaction
+		if entry := tx.Bucket(defaultBucket).Get(key); entry != nil {
+			value = common.CopyBytes(entry)
+			return nil
+		}
+		return ErrNotFound
+	})
+	return value, err
+}
+
+func (db *BoltDatabase) Delete(key []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(defaultBucket).Delete(key)
+	})
+}
+
+func (db *BoltDatabase) Keys() (keys [][]byte) {
+	db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(defaultBucket).ForEach(func(key, _ []byte) error {
+			keys = append(keys, common.CopyBytes(key))
+			return nil
+		})
+	})
+	return keys
+}
+
+func (db *BoltDatabase) Close() {
+	db.db.Close()
+}
+
+func (db *BoltDatabase) NewBatch() Batch {
+	return &boltBatch{db: db}
+}
+
+type boltBatch struct {
+	db     *BoltDatabase
+	writes []kv
+}
+
+func (b *boltBatch) Put(key, value []byte) error {
+	b.writes = append(b.writes, kv{common.CopyBytes(key), common.CopyBytes(value)})
+	return nil
+}
 
+func (b *boltBatch) Write() error {
+	return b.db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(defaultBucket)
+		for _, kv := range b.writes {
+			if err := bucket.Put(kv.k, kv.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
@@ -4,6 +4,7 @@ type Database interface {
 	Put(key []byte, value []byte) error
 	Get(key []byte) ([]byte, error)
 	Delete(key []byte) error
+	Keys() [][]byte
 	Close()
 	NewBatch() Batch
 }
@@ -0,0 +1,188 @@
+package dht
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+const (
+	AttestationNamespace = "attestation"
+	// MaxAttestationTTL bounds how long an attestation counts before the
+	// attester has to vouch again.
+	MaxAttestationTTL  = 365 * 24 * time.Hour
+	maxAttestationSize = 2 << 10
+)
+
+var (
+	ErrAttestationRecordFormat = errors.New("Attestation: Malformed record")
+	ErrAttestationSignature    = errors.New("Attestation: Record must be signed by the attester")
+	ErrAttestationSequence     = errors.New("Attestation: Must be newer than the attestation it replaces")
+	ErrAttestationExpiry       = errors.New("Attestation: Expiry must be in the future and within the maximum TTL")
+)
+
+// AttestationRecord is an account vouching that the key of Subject belongs
+// to who it claims to be, usually after comparing safety numbers in
+// person. An account address is the hash of its key, so vouching for the
+// address vouches for the key. Attesters withdraw an attestation by
+// replacing it with a newer one that is Withdrawn.
+type AttestationRecord struct {
+	Attester  common.Address
+	Subject   common.Address
+	Created   int64
+	Expires   int64
+	Withdrawn bool `json:",omitempty"`
+	Signature []byte
+}
+
+func AttestationPrefix(subject common.Address) string {
+	return AttestationNamespace + "/" + subject.Hex() + "/"
+}
+
+func AttestationKey(subject, attester common.Address) string {
+	return AttestationPrefix(subject) + attester.Hex()
+}
+
+func (record *AttestationRecord) Expired() bool {
+	return time.Now().Unix() >= record.Expires
+}
+
+func (record *AttestationRecord) hash() []byte {
+	var numbers [17]byte
+	binary.BigEndian.PutUint64(numbers[:8], uint64(record.Created))
+	binary.BigEndian.PutUint64(numbers[8:16], uint64(record.Expires))
+	if record.Withdrawn {
+		numbers[16] = 1
+	}
+	return crypto.Sha3([]byte("oht-attestation"), record.Attester[:], record.Subject[:], numbers[:])
+}
+
+// Sign signs the record with the attester's account key.
+func (record *AttestationRecord) Sign(attester *crypto.Key) (err error) {
+	record.Attester = attester.Address
+	record.Signature, err = attester.Sign(record.hash())
+	return err
+}
+
+// Verify checks the record was signed by its attester.
+func (record *AttestationRecord) Verify() error {
+	if record.Attester == record.Subject {
+		return ErrAttestationRecordFormat
+	}
+	if signer, err := crypto.SignatureAddress(record.hash(), record.Signature); err != nil || signer != record.Attester {
+		return ErrAttestationSignature
+	}
+	return nil
+}
+
+func DecodeAttestationRecord(value []byte) (*AttestationRecord, error) {
+	record := &AttestationRecord{}
+	if len(value) > maxAttestationSize || json.Unmarshal(value, record) != nil {
+		return nil, ErrAttestationRecordFormat
+	}
+	return record, nil
+}
+
+// AttestationValidator accepts attestations signed by their attester, each
+// replacing the last the attester made for the subject. Attestations are
+// placed on the peers responsible for their subject.
+type AttestationValidator struct{}
+
+func (AttestationValidator) Validate(key string, existing, value []byte) error {
+	record, err := DecodeAttestationRecord(value)
+	if err != nil {
+		return err
+	}
+	if key != AttestationKey(record.Subject, record.Attester) {
+		return ErrAttestationRecordFormat
+	}
+	if err := record.Verify(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if record.Expires <= now.Unix() || record.Expires > now.Add(MaxAttestationTTL).Unix() {
+		return ErrAttestationExpiry
+	}
+	if existing != nil {
+		if current, err := DecodeAttestationRecord(existing); err == nil && record.Created <= current.Created {
+			return ErrAttestationSequence
+		}
+	}
+	return nil
+}
+
+func (AttestationValidator) Signer(value []byte) (common.Address, error) {
+	record, err := DecodeAttestationRecord(value)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return record.Attester, nil
+}
+
+func (AttestationValidator) Expired(value []byte) bool {
+	record, err := DecodeAttestationRecord(value)
+	return err != nil || record.Expired()
+}
+
+// Responsible places the attestations of a subject on the same peers.
+func (AttestationValidator) Responsible(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 2 {
+		return key
+	}
+	return parts[1]
+}
+
+// NewAttestation signs an attestation of attester for subject valid for
+// ttl, one that is withdrawn when withdrawn is set.
+func NewAttestation(attester *crypto.Key, subject common.Address, ttl time.Duration, withdrawn bool) (*AttestationRecord, error) {
+	if ttl > MaxAttestationTTL {
+		ttl = MaxAttestationTTL
+	}
+	now := time.Now()
+	record := &AttestationRecord{
+		Subject:   subject,
+		Created:   now.UnixNano(),
+		Expires:   now.Add(ttl).Unix(),
+		Withdrawn: withdrawn,
+	}
+	if err := record.Sign(attester); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// PublishAttestation stores a signed attestation.
+func (store *Store) PublishAttestation(record *AttestationRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return store.Put(AttestationKey(record.Subject, record.Attester), value)
+}
+
+// Attestations returns the attestations for subject stored on this node
+// that are not withdrawn.
+func (store *Store) Attestations(subject common.Address) (records []*AttestationRecord) {
+	for _, key := range store.Keys(AttestationPrefix(subject)) {
+		value, err := store.Get(key)
+		if err != nil {
+			continue
+		}
+		if record, err := DecodeAttestationRecord(value); err == nil && !record.Withdrawn && !record.Expired() {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// SyncAttestations asks the connected peers for the attestations of
+// subject.
+func (store *Store) SyncAttestations(subject common.Address) {
+	store.Sync(AttestationPrefix(subject))
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAttestationRecords(t *testing.T) {
+	alice, bob, mallory := newTestKey(t), newTestKey(t), newTestKey(t)
+	store := newTestStore(t, RevocationNamespace, NameNamespace, ProfileNamespace, AttestationNamespace)
+
+	older, _ := NewAttestation(alice, bob.Address, time.Hour, false)
+	attestation, err := NewAttestation(alice, bob.Address, MaxAttestationTTL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *attestation
+	forged.Attester = mallory.Address
+	value, _ := json.Marshal(&forged)
+	if err := store.Put(AttestationKey(bob.Address, mallory.Address), value); err != ErrAttestationSignature {
+		t.Errorf("expected %v vouching in another account's name, got %v", ErrAttestationSignature, err)
+	}
+	if err := store.PublishAttestation(attestation); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PublishAttestation(older); err != ErrAttestationSequence {
+		t.Errorf("expected %v replaying an older attestation, got %v", ErrAttestationSequence, err)
+	}
+	if attestations := store.Attestations(bob.Address); len(attestations) != 1 || attestations[0].Attester != alice.Address {
+		t.Errorf("expected alice's attestation, got %+v", attestations)
+	}
+	self, _ := NewAttestation(bob, bob.Address, time.Hour, false)
+	if err := store.PublishAttestation(self); err != ErrAttestationRecordFormat {
+		t.Errorf("expected %v vouching for yourself, got %v", ErrAttestationRecordFormat, err)
+	}
+
+	withdrawn, _ := NewAttestation(alice, bob.Address, time.Hour, true)
+	if err := store.PublishAttestation(withdrawn); err != nil {
+		t.Fatal(err)
+	}
+	if attestations := store.Attestations(bob.Address); len(attestations) != 0 {
+		t.Errorf("expected the attestation to be withdrawn, got %+v", attestations)
+	}
+
+	// Attestations of a revoked key no longer count
+	renewed, _ := NewAttestation(alice, bob.Address, time.Hour, false)
+	store.PublishAttestation(renewed)
+	if err := store.Revoke(alice, nil, "lost"); err != nil {
+		t.Fatal(err)
+	}
+	if attestations := store.Attestations(bob.Address); len(attestations) != 0 {
+		t.Errorf("expected attestations of a revoked key to be ignored, got %+v", attestations)
+	}
+}
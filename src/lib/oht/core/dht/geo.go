@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	GeoNamespace = "geo"
+	// MaxGeoTTL bounds how long a node is listed in an area without
+	// refreshing its record.
+	MaxGeoTTL = time.Hour
+	// MaxGeohashPrecision keeps areas at least about 1.2km by 0.6km wide, so
+	// no record narrows a node down further than that.
+	MaxGeohashPrecision = 6
+)
+
+var (
+	ErrGeoRecordFormat = errors.New("Geo: Malformed record")
+	ErrGeoExpiry       = errors.New("Geo: Expiry must be later than the current one and within the maximum TTL")
+)
+
+var (
+	geohashPattern = regexp.MustCompile(`^[0-9b-hjkmnp-z]{1,6}$`)
+	geoTagPattern  = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// GeoRecord lists a node as present in the area of a geohash. The node is
+// only known by a random tag it picks when joining the area, not by its
+// account or onion host.
+type GeoRecord struct {
+	Geohash string
+	Tag     string
+	Expires int64
+}
+
+func GeoPrefix(geohash string) string {
+	return GeoNamespace + "/" + geohash
+}
+
+func GeoKey(geohash, tag string) string {
+	return GeoPrefix(geohash) + "/" + tag
+}
+
+func ValidGeohash(geohash string) bool {
+	return geohashPattern.MatchString(geohash)
+}
+
+func (record *GeoRecord) Expired() bool {
+	return time.Now().Unix() >= record.Expires
+}
+
+func DecodeGeoRecord(value []byte) (*GeoRecord, error) {
+	record := &GeoRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, ErrGeoRecordFormat
+	}
+	return record, nil
+}
+
+// GeoValidator accepts area records of up to MaxGeohashPrecision that only
+// ever move their expiry forward.
+type GeoValidator struct{}
+
+func (GeoValidator) Validate(key string, existing, value []byte) error {
+	record, err := DecodeGeoRecord(value)
+	if err != nil {
+		return err
+	}
+	if !ValidGeohash(record.Geohash) || !geoTagPattern.MatchString(record.Tag) || key != GeoKey(record.Geohash, record.Tag) {
+		return ErrGeoRecordFormat
+	}
+	now := time.Now()
+	if record.Expires <= now.Unix() || record.Expires > now.Add(MaxGeoTTL).Unix() {
+		return ErrGeoExpiry
+	}
+	if existing != nil {
+		if current, err := DecodeGeoRecord(existing); err == nil && record.Expires <= current.Expires {
+			return ErrGeoExpiry
+		}
+	}
+	return nil
+}
+
+func (GeoValidator) Expired(value []byte) bool {
+	record, err := DecodeGeoRecord(value)
+	return err != nil || record.Expired()
+}
+
+// AnnounceArea lists this node in the area of geohash under tag for ttl.
+func (store *Store) AnnounceArea(geohash, tag string, ttl time.Duration) error {
+	if ttl > MaxGeoTTL {
+		ttl = MaxGeoTTL
+	}
+	value, err := json.Marshal(&GeoRecord{Geohash: geohash, Tag: tag, Expires: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return err
+	}
+	return store.Put(GeoKey(geohash, tag), value)
+}
+
+// Areas counts the nodes known to be present in each area within geohash.
+// Call SyncAreas first to learn of areas from the connected peers.
+func (store *Store) Areas(geohash string) map[string]int {
+	areas := make(map[string]int)
+	for _, key := range store.Keys(GeoPrefix(geohash)) {
+		value, err := store.Get(key)
+		if err != nil {
+			continue
+		}
+		if record, err := DecodeGeoRecord(value); err == nil && strings.HasPrefix(record.Geohash, geohash) {
+			areas[record.Geohash]++
+		}
+	}
+	return areas
+}
+
+// SyncAreas asks the connected peers for the area records within geohash.
+func (store *Store) SyncAreas(geohash string) {
+	store.Sync(GeoPrefix(geohash))
+}
@@ -0,0 +1,31 @@
+package dht
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGeoRecords(t *testing.T) {
+	store := newTestStore(t, GeoNamespace)
+	tag := "0123456789abcdef0123456789abcdef"
+	if err := store.AnnounceArea("u4pruy", tag, 2*MaxGeoTTL); err != nil {
+		t.Fatal(err)
+	}
+	store.AnnounceArea("u4pruv", "fedcba9876543210fedcba9876543210", time.Minute)
+	store.AnnounceArea("ezs42", "00000000000000000000000000000000", time.Minute)
+	if areas := store.Areas("u4"); len(areas) != 2 || areas["u4pruy"] != 1 {
+		t.Errorf("expected the two areas within u4, got %v", areas)
+	}
+
+	// Records never move their expiry back
+	older, _ := json.Marshal(&GeoRecord{Geohash: "u4pruy", Tag: tag, Expires: time.Now().Add(time.Minute).Unix()})
+	if err := store.Put(GeoKey("u4pruy", tag), older); err != ErrGeoExpiry {
+		t.Errorf("expected %v, got %v", ErrGeoExpiry, err)
+	}
+	// Nor narrow a node down further than MaxGeohashPrecision
+	precise, _ := json.Marshal(&GeoRecord{Geohash: "u4pruydq", Tag: tag, Expires: time.Now().Add(time.Minute).Unix()})
+	if err := store.Put(GeoKey("u4pruydq", tag), precise); err != ErrGeoRecordFormat {
+		t.Errorf("expected %v, got %v", ErrGeoRecordFormat, err)
+	}
+}
@@ -0,0 +1,189 @@
+package dht
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+const (
+	MailboxNamespace = "mailbox"
+	// MaxMailboxTTL bounds how long a message waits for its recipient
+	MaxMailboxTTL  = 7 * 24 * time.Hour
+	maxMailboxSize = 64 << 10
+)
+
+var (
+	ErrMailboxRecordFormat = errors.New("Mailbox: Malformed record")
+	ErrMailboxExists       = errors.New("Mailbox: Message is already stored")
+	ErrMailboxSignature    = errors.New("Mailbox: Only the recipient can delete a message")
+	ErrMailboxExpiry       = errors.New("Mailbox: Expiry must be in the future and within the maximum TTL")
+)
+
+// MailboxRecord holds a message for an offline recipient. The message is
+// sealed to the recipient by the sender and deposited without a signature,
+// so the nodes keeping it do not learn who sent it. Once collected the
+// recipient replaces it with a signed tombstone, which is kept until the
+// original expiry so copies on other nodes are not accepted again.
+type MailboxRecord struct {
+	To        common.Address
+	Id        string
+	Expires   int64
+	Sealed    []byte `json:",omitempty"`
+	Deleted   bool   `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+}
+
+func MailboxPrefix(to common.Address) string {
+	return MailboxNamespace + "/" + to.Hex() + "/"
+}
+
+func MailboxKey(to common.Address, id string) string {
+	return MailboxPrefix(to) + id
+}
+
+func (record *MailboxRecord) Expired() bool {
+	return time.Now().Unix() >= record.Expires
+}
+
+func (record *MailboxRecord) hash() []byte {
+	var number [8]byte
+	binary.BigEndian.PutUint64(number[:], uint64(record.Expires))
+	return crypto.Sha3([]byte("oht-mailbox-delete"), record.To[:], []byte(record.Id), []byte{0}, number[:])
+}
+
+func DecodeMailboxRecord(value []byte) (*MailboxRecord, error) {
+	record := &MailboxRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, ErrMailboxRecordFormat
+	}
+	return record, nil
+}
+
+// MailboxValidator keeps deposited messages immutable and lets only their
+// recipient delete them. Mailbox records are placed on the peers
+// responsible for the recipient instead of being gossiped to everyone.
+type MailboxValidator struct{}
+
+func (MailboxValidator) Validate(key string, existing, value []byte) error {
+	if len(value) > maxMailboxSize {
+		return ErrMailboxRecordFormat
+	}
+	record, err := DecodeMailboxRecord(value)
+	if err != nil {
+		return err
+	}
+	if record.Id == "" || strings.Contains(record.Id, "/") || key != MailboxKey(record.To, record.Id) {
+		return ErrMailboxRecordFormat
+	}
+	now := time.Now()
+	if record.Expires <= now.Unix() || record.Expires > now.Add(MaxMailboxTTL).Unix() {
+		return ErrMailboxExpiry
+	}
+	if !record.Deleted {
+		if len(record.Sealed) == 0 {
+			return ErrMailboxRecordFormat
+		}
+		if existing != nil {
+			return ErrMailboxExists
+		}
+		return nil
+	}
+	if len(record.Sealed) != 0 {
+		return ErrMailboxRecordFormat
+	}
+	publicKey, err := crypto.SigToPub(record.hash(), record.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != record.To {
+		return ErrMailboxSignature
+	}
+	return nil
+}
+
+func (MailboxValidator) Expired(value []byte) bool {
+	record, err := DecodeMailboxRecord(value)
+	return err != nil || record.Expired()
+}
+
+// Responsible places the messages of a recipient on the same peers.
+func (MailboxValidator) Responsible(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 2 {
+		return key
+	}
+	return parts[1]
+}
+
+// Syncable only allows the mailbox of a single recipient to be synced, a
+// node never hands out every mailbox it keeps.
+func (MailboxValidator) Syncable(prefix string) bool {
+	parts := strings.Split(prefix, "/")
+	return len(parts) == 3 && common.IsHexAddress(parts[1]) && prefix == MailboxPrefix(common.HexToAddress(parts[1]))
+}
+
+// Deposit stores a sealed message for an offline recipient and hands it to
+// the peers responsible for them, placed counts the peers it was handed
+// to. A message no peer took is only kept on this node until Place
+// succeeds.
+func (store *Store) Deposit(to common.Address, sealed []byte, ttl time.Duration) (key string, placed int, err error) {
+	if ttl > MaxMailboxTTL {
+		ttl = MaxMailboxTTL
+	}
+	record := &MailboxRecord{
+		To:      to,
+		Id:      uuid.New(),
+		Expires: time.Now().Add(ttl).Unix(),
+		Sealed:  sealed,
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return "", 0, err
+	}
+	key = MailboxKey(to, record.Id)
+	if err := store.put(key, value); err != nil {
+		return "", 0, err
+	}
+	store.notifyWatchers(key, value)
+	return key, store.Place(key), nil
+}
+
+// Mailbox returns the messages for to stored on this node.
+func (store *Store) Mailbox(to common.Address) (records []*MailboxRecord) {
+	for _, key := range store.Keys(MailboxPrefix(to)) {
+		value, err := store.Get(key)
+		if err != nil {
+			continue
+		}
+		if record, err := DecodeMailboxRecord(value); err == nil && !record.Deleted {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// SyncMailbox asks the connected peers for the messages waiting for to.
+func (store *Store) SyncMailbox(to common.Address) {
+	store.Sync(MailboxPrefix(to))
+}
+
+// Collect deletes a message from the mailbox of its recipient, owner, on
+// this node and the peers responsible for it.
+func (store *Store) Collect(record *MailboxRecord, owner *crypto.Key) error {
+	tombstone := &MailboxRecord{To: record.To, Id: record.Id, Expires: record.Expires, Deleted: true}
+	signature, err := crypto.Sign(tombstone.hash(), owner.PrivateKey)
+	if err != nil {
+		return err
+	}
+	tombstone.Signature = signature
+	value, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+	return store.Put(MailboxKey(record.To, record.Id), value)
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMailboxCollect(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	store := newTestStore(t, MailboxNamespace)
+	if _, placed, err := store.Deposit(bob.Address, []byte("sealed"), 30*24*time.Hour); err != nil || placed != 0 {
+		t.Fatalf("expected the message to stay on this node without peers, placed with %d: %v", placed, err)
+	}
+	records := store.Mailbox(bob.Address)
+	if len(records) != 1 || string(records[0].Sealed) != "sealed" {
+		t.Fatalf("expected one message for bob, got %+v", records)
+	}
+	if records[0].Expires > time.Now().Add(MaxMailboxTTL).Unix() {
+		t.Error("expected the TTL to be capped")
+	}
+	if len(store.Mailbox(alice.Address)) != 0 {
+		t.Error("expected no messages for alice")
+	}
+	record := records[0]
+	key := MailboxKey(bob.Address, record.Id)
+
+	// Deposited messages can not be replaced
+	replaced := *record
+	replaced.Sealed = []byte("replaced")
+	value, _ := json.Marshal(replaced)
+	if err := store.Put(key, value); err != ErrMailboxExists {
+		t.Errorf("expected %v, got %v", ErrMailboxExists, err)
+	}
+
+	// Nor deleted by anyone but the recipient
+	if err := store.Collect(record, alice); err != ErrMailboxSignature {
+		t.Errorf("expected %v, got %v", ErrMailboxSignature, err)
+	}
+	unsigned, _ := json.Marshal(&MailboxRecord{To: bob.Address, Id: record.Id, Expires: record.Expires, Deleted: true})
+	if err := store.Put(key, unsigned); err != ErrMailboxSignature {
+		t.Errorf("expected %v, got %v", ErrMailboxSignature, err)
+	}
+
+	if err := store.Collect(record, bob); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Mailbox(bob.Address)) != 0 {
+		t.Error("expected the message to be collected")
+	}
+	// A copy arriving from another node does not bring the message back
+	if value, _ := json.Marshal(record); store.put(key, value) != ErrMailboxExists {
+		t.Error("expected the tombstone to keep the message deleted")
+	}
+}
+
+func TestMailboxPlacement(t *testing.T) {
+	bob := newTestKey(t)
+	key := MailboxKey(bob.Address, "message")
+	if responsible := (MailboxValidator{}).Responsible(key); responsible != bob.Address.Hex() {
+		t.Errorf("expected messages to be placed by recipient, got %s", responsible)
+	}
+}
+
+func TestMailboxSyncable(t *testing.T) {
+	bob := newTestKey(t)
+	tests := []struct {
+		prefix   string
+		syncable bool
+	}{
+		{MailboxPrefix(bob.Address), true},
+		{MailboxNamespace + "/", false},
+		{MailboxNamespace + "/0x", false},
+		{MailboxKey(bob.Address, "message"), false},
+		{MailboxNamespace + "/not-an-address/", false},
+	}
+	for _, test := range tests {
+		if syncable := (MailboxValidator{}).Syncable(test.prefix); syncable != test.syncable {
+			t.Errorf("%q: expected syncable %v, got %v", test.prefix, test.syncable, syncable)
+		}
+	}
+}
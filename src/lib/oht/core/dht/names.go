@@ -0,0 +1,166 @@
+package dht
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+const (
+	NameNamespace = "name"
+	// MaxNameTTL bounds how far in the future a name record may expire,
+	// names that are not renewed become free again.
+	MaxNameTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidName      = errors.New("Name: Names are 1-63 lowercase letters, digits and dashes")
+	ErrNameTaken        = errors.New("Name: Already registered to another account")
+	ErrNameSignature    = errors.New("Name: Invalid signature")
+	ErrNameSequence     = errors.New("Name: Sequence must increase on every update")
+	ErrNameExpiry       = errors.New("Name: Expiry must be in the future and within the maximum TTL")
+	ErrNameRecordFormat = errors.New("Name: Malformed record")
+	validName           = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+)
+
+// NameRecord binds a name to an onion host. The first account to publish a
+// record for a free name owns it until the record expires. Only the owner
+// can renew it or transfer it to another account, by signing a record with
+// a higher Sequence. A transfer names the owner that signed it in
+// PreviousOwner, so nodes that never saw the earlier record accept it.
+type NameRecord struct {
+	Name          string
+	OnionHost     string
+	Owner         common.Address
+	PreviousOwner *common.Address `json:",omitempty"`
+	Sequence      uint64
+	Expires       int64
+	Signature     []byte
+}
+
+func NameKey(name string) string {
+	return NameNamespace + "/" + strings.ToLower(name)
+}
+
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+func (record *NameRecord) Expired() bool {
+	return time.Now().Unix() >= record.Expires
+}
+
+// hash is what the signature covers, every field but the signature in a
+// fixed encoding.
+func (record *NameRecord) hash() []byte {
+	var number [8]byte
+	data := [][]byte{[]byte("oht-name"), []byte(record.Name), {0}, []byte(record.OnionHost), {0}, record.Owner[:]}
+	binary.BigEndian.PutUint64(number[:], record.Sequence)
+	data = append(data, common.CopyBytes(number[:]))
+	binary.BigEndian.PutUint64(number[:], uint64(record.Expires))
+	data = append(data, common.CopyBytes(number[:]))
+	if record.PreviousOwner != nil {
+		data = append(data, record.PreviousOwner[:])
+	}
+	return crypto.Sha3(data...)
+}
+
+// Sign signs the record with the key of signer, which is the current owner
+// when renewing or transferring and the new owner when registering.
+func (record *NameRecord) Sign(signer *crypto.Key) (err error) {
+	record.Signature, err = crypto.Sign(record.hash(), signer.PrivateKey)
+	return err
+}
+
+func (record *NameRecord) Signer() (common.Address, error) {
+	publicKey, err := crypto.SigToPub(record.hash(), record.Signature)
+	if err != nil {
+		return common.Address{}, ErrNameSignature
+	}
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
+
+func DecodeNameRecord(value []byte) (*NameRecord, error) {
+	record := &NameRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, ErrNameRecordFormat
+	}
+	return record, nil
+}
+
+// NameValidator enforces first-come ownership of the "name/" namespace.
+// With Rotations the successor of an owner's rotated key takes over its
+// names.
+type NameValidator struct {
+	Rotations Rotations
+}
+
+func (validator NameValidator) Validate(key string, existing, value []byte) error {
+	record, err := DecodeNameRecord(value)
+	if err != nil {
+		return err
+	}
+	if !ValidName(record.Name) || key != NameKey(record.Name) {
+		return ErrInvalidName
+	}
+	if !strings.HasSuffix(record.OnionHost, ".onion") {
+		return ErrNameRecordFormat
+	}
+	now := time.Now()
+	if record.Expires <= now.Unix() || record.Expires > now.Add(MaxNameTTL).Unix() {
+		return ErrNameExpiry
+	}
+	signer, err := record.Signer()
+	if err != nil {
+		return err
+	}
+	if record.PreviousOwner != nil && *record.PreviousOwner != signer {
+		return ErrNameSignature
+	}
+	if existing == nil {
+		// A free name can only be claimed for the signing account, unless
+		// the signer transferred it to the owner
+		if signer != record.Owner && record.PreviousOwner == nil {
+			return ErrNameSignature
+		}
+		return nil
+	}
+	current, err := DecodeNameRecord(existing)
+	if err != nil {
+		return err
+	}
+	if signer != current.Owner && !validator.rotatedTo(current.Owner, signer) {
+		return ErrNameTaken
+	}
+	if record.Sequence <= current.Sequence {
+		return ErrNameSequence
+	}
+	return nil
+}
+
+func (validator NameValidator) rotatedTo(owner, signer common.Address) bool {
+	if validator.Rotations == nil {
+		return false
+	}
+	successor, ok := validator.Rotations.Successor(owner)
+	return ok && successor == signer
+}
+
+func (NameValidator) Signer(value []byte) (common.Address, error) {
+	record, err := DecodeNameRecord(value)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return record.Signer()
+}
+
+func (NameValidator) Expired(value []byte) bool {
+	record, err := DecodeNameRecord(value)
+	return err != nil || record.Expired()
+}
@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/database"
+)
+
+func newTestKey(t *testing.T) *crypto.Key {
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &crypto.Key{
+		Id:         uuid.NewRandom(),
+		Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+		PrivateKey: privateKey,
+	}
+}
+
+func signedName(t *testing.T, signer *crypto.Key, name string, owner common.Address, sequence uint64, expires time.Time) []byte {
+	record := &NameRecord{
+		Name:      name,
+		OnionHost: "abcdefghijklmnop.onion",
+		Owner:     owner,
+		Sequence:  sequence,
+		Expires:   expires.Unix(),
+	}
+	if err := record.Sign(signer); err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// newTestStore returns a store in memory that validates the namespaces
+// given like a node does.
+func newTestStore(t *testing.T, namespaces ...string) *Store {
+	db, err := database.NewMemDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(db, nil)
+	validators := map[string]Validator{
+		RevocationNamespace:  RevocationValidator{},
+		NameNamespace:        NameValidator{Rotations: store},
+		MailboxNamespace:     MailboxValidator{},
+		GeoNamespace:         GeoValidator{},
+		PrekeyNamespace:      PrekeyValidator{},
+		ProfileNamespace:     ProfileValidator{},
+		AttestationNamespace: AttestationValidator{},
+	}
+	for _, namespace := range namespaces {
+		store.RegisterValidator(namespace, validators[namespace])
+	}
+	return store
+}
+
+func TestNameOwnership(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	expires := time.Now().Add(time.Hour)
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		err   error
+	}{
+		{"register", NameKey("alice"), signedName(t, alice, "alice", alice.Address, 0, expires), nil},
+		{"identical record", NameKey("alice"), signedName(t, alice, "alice", alice.Address, 0, expires), ErrRecordUnchanged},
+		{"claimed by another account", NameKey("alice"), signedName(t, bob, "alice", bob.Address, 5, expires), ErrNameTaken},
+		{"renewal without new sequence", NameKey("alice"), signedName(t, alice, "alice", alice.Address, 0, expires.Add(time.Hour)), ErrNameSequence},
+		{"renewal", NameKey("alice"), signedName(t, alice, "alice", alice.Address, 1, expires.Add(time.Hour)), nil},
+		{"transfer", NameKey("alice"), signedName(t, alice, "alice", bob.Address, 2, expires), nil},
+		{"previous owner after transfer", NameKey("alice"), signedName(t, alice, "alice", alice.Address, 3, expires), ErrNameTaken},
+		{"renewal by new owner", NameKey("alice"), signedName(t, bob, "alice", bob.Address, 3, expires), nil},
+		{"register for another account", NameKey("carol"), signedName(t, alice, "carol", bob.Address, 0, expires), ErrNameSignature},
+		{"key does not match name", NameKey("dave"), signedName(t, alice, "carol", alice.Address, 0, expires), ErrInvalidName},
+		{"invalid name", NameKey("Not_Valid"), signedName(t, alice, "Not_Valid", alice.Address, 0, expires), ErrInvalidName},
+		{"already expired", NameKey("erin"), signedName(t, alice, "erin", alice.Address, 0, time.Now().Add(-time.Minute)), ErrNameExpiry},
+		{"expiry beyond maximum TTL", NameKey("erin"), signedName(t, alice, "erin", alice.Address, 0, time.Now().Add(2*MaxNameTTL)), ErrNameExpiry},
+	}
+	store := newTestStore(t, NameNamespace)
+	for _, test := range tests {
+		if err := store.Put(test.key, test.value); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+	value, err := store.Get(NameKey("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ := DecodeNameRecord(value)
+	if record.Owner != bob.Address || record.Sequence != 3 {
+		t.Errorf("expected alice to be owned by bob at sequence 3, got %x at %d", record.Owner, record.Sequence)
+	}
+}
+
+func TestExpiredNameIsFree(t *testing.T) {
+	alice, bob := newTestKey(t), newTestKey(t)
+	store := newTestStore(t, NameNamespace)
+	// Stored directly, the validator would not accept an expiry this close
+	expired := signedName(t, alice, "alice", alice.Address, 7, time.Now().Add(-time.Second))
+	store.db.Put([]byte(NameKey("alice")), expired)
+	if _, err := store.Get(NameKey("alice")); err != ErrNotFound {
+		t.Errorf("expected expired record to be hidden, got %v", err)
+	}
+	if err := store.Put(NameKey("alice"), signedName(t, bob, "alice", bob.Address, 0, time.Now().Add(time.Hour))); err != nil {
+		t.Errorf("expected expired name to be claimable, got %v", err)
+	}
+	store.db.Put([]byte(NameKey("carol")), expired)
+	if removed := store.Expire(); removed != 1 {
+		t.Errorf("expected 1 expired record to be removed, got %d", removed)
+	}
+}
+
+func signedTransfer(t *testing.T, owner *crypto.Key, name string, newOwner common.Address, sequence uint64, expires time.Time) []byte {
+	record := &NameRecord{
+		Name:          name,
+		OnionHost:     "abcdefghijklmnop.onion",
+		Owner:         newOwner,
+		PreviousOwner: &owner.Address,
+		Sequence:      sequence,
+		Expires:       expires.Unix(),
+	}
+	if err := record.Sign(owner); err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestNameTransferOnFreshStore(t *testing.T) {
+	alice, bob, mallory := newTestKey(t), newTestKey(t), newTestKey(t)
+	expires := time.Now().Add(time.Hour)
+	origin, fresh := newTestStore(t, NameNamespace), newTestStore(t, NameNamespace)
+	if err := origin.Put(NameKey("alice"), signedName(t, alice, "alice", alice.Address, 0, expires)); err != nil {
+		t.Fatal(err)
+	}
+	transfer := signedTransfer(t, alice, "alice", bob.Address, 1, expires)
+	if err := origin.Put(NameKey("alice"), transfer); err != nil {
+		t.Fatal(err)
+	}
+	// The fresh store never saw alice's registration
+	if err := fresh.Put(NameKey("alice"), transfer); err != nil {
+		t.Fatalf("expected the transfer to be accepted without the original, got %v", err)
+	}
+	if err := fresh.Put(NameKey("alice"), signedName(t, bob, "alice", bob.Address, 2, expires)); err != nil {
+		t.Errorf("expected the new owner to renew, got %v", err)
+	}
+	if err := fresh.Put(NameKey("alice"), signedTransfer(t, alice, "alice", alice.Address, 3, expires)); err != ErrNameTaken {
+		t.Errorf("expected %v transferring back without owning it, got %v", ErrNameTaken, err)
+	}
+
+	forged := &NameRecord{Name: "carol", OnionHost: "abcdefghijklmnop.onion", Owner: bob.Address, PreviousOwner: &alice.Address, Expires: expires.Unix()}
+	forged.Sign(mallory)
+	forgedValue, _ := json.Marshal(forged)
+	if err := fresh.Put(NameKey("carol"), forgedValue); err != ErrNameSignature {
+		t.Errorf("expected %v for a transfer not signed by the previous owner, got %v", ErrNameSignature, err)
+	}
+}
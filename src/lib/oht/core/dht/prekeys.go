@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+const (
+	PrekeyNamespace = "prekey"
+	// MaxPrekeyTTL bounds how long a bundle is used after its owner stopped
+	// renewing it.
+	MaxPrekeyTTL  = 30 * 24 * time.Hour
+	x25519KeySize = 32
+)
+
+var (
+	ErrPrekeyRecordFormat = errors.New("Prekey: Malformed bundle")
+	ErrPrekeySignature    = errors.New("Prekey: Bundle must be signed by its owner")
+	ErrPrekeyExpiry       = errors.New("Prekey: Expiry must be later than the current one and within the maximum TTL")
+)
+
+// PrekeyBundle publishes the x25519 keys other accounts start a whisper
+// session with, see core/crypto/ratchet. The signed prekey is rotated by its
+// owner, the identity key stays the same. There are no one-time prekeys, a
+// record in the DHT can not be handed to a single initiator.
+type PrekeyBundle struct {
+	Owner        common.Address
+	IdentityKey  []byte
+	SignedPrekey []byte
+	PrekeyId     uint32
+	Expires      int64
+	Signature    []byte
+}
+
+func PrekeyKey(owner common.Address) string {
+	return PrekeyNamespace + "/" + owner.Hex()
+}
+
+func (bundle *PrekeyBundle) Expired() bool {
+	return time.Now().Unix() >= bundle.Expires
+}
+
+func (bundle *PrekeyBundle) hash() []byte {
+	var numbers [12]byte
+	binary.BigEndian.PutUint32(numbers[:4], bundle.PrekeyId)
+	binary.BigEndian.PutUint64(numbers[4:], uint64(bundle.Expires))
+	return crypto.Sha3([]byte("oht-prekey"), bundle.Owner[:], bundle.IdentityKey, bundle.SignedPrekey, numbers[:])
+}
+
+// Sign signs the bundle with the owner's account key, binding the x25519
+// keys to the account.
+func (bundle *PrekeyBundle) Sign(owner *crypto.Key) (err error) {
+	bundle.Owner = owner.Address
+	bundle.Signature, err = crypto.Sign(bundle.hash(), owner.PrivateKey)
+	return err
+}
+
+// Verify checks the bundle was signed by its owner.
+func (bundle *PrekeyBundle) Verify() error {
+	if len(bundle.IdentityKey) != x25519KeySize || len(bundle.SignedPrekey) != x25519KeySize {
+		return ErrPrekeyRecordFormat
+	}
+	publicKey, err := crypto.SigToPub(bundle.hash(), bundle.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != bundle.Owner {
+		return ErrPrekeySignature
+	}
+	return nil
+}
+
+func DecodePrekeyBundle(value []byte) (*PrekeyBundle, error) {
+	bundle := &PrekeyBundle{}
+	if err := json.Unmarshal(value, bundle); err != nil {
+		return nil, ErrPrekeyRecordFormat
+	}
+	return bundle, nil
+}
+
+// PrekeyValidator accepts bundles signed by the account they are stored
+// under, each replacing the last with a later expiry.
+type PrekeyValidator struct{}
+
+func (PrekeyValidator) Validate(key string, existing, value []byte) error {
+	bundle, err := DecodePrekeyBundle(value)
+	if err != nil {
+		return err
+	}
+	if key != PrekeyKey(bundle.Owner) {
+		return ErrPrekeyRecordFormat
+	}
+	if err := bundle.Verify(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if bundle.Expires <= now.Unix() || bundle.Expires > now.Add(MaxPrekeyTTL).Unix() {
+		return ErrPrekeyExpiry
+	}
+	if existing != nil {
+		if current, err := DecodePrekeyBundle(existing); err == nil && bundle.Expires <= current.Expires {
+			return ErrPrekeyExpiry
+		}
+	}
+	return nil
+}
+
+func (PrekeyValidator) Signer(value []byte) (common.Address, error) {
+	bundle, err := DecodePrekeyBundle(value)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return bundle.Owner, nil
+}
+
+func (PrekeyValidator) Expired(value []byte) bool {
+	bundle, err := DecodePrekeyBundle(value)
+	return err != nil || bundle.Expired()
+}
+
+// NewPrekeyBundle signs a bundle of owner valid for ttl.
+func NewPrekeyBundle(owner *crypto.Key, identityKey, signedPrekey []byte, prekeyId uint32, ttl time.Duration) (*PrekeyBundle, error) {
+	if ttl > MaxPrekeyTTL {
+		ttl = MaxPrekeyTTL
+	}
+	bundle := &PrekeyBundle{
+		IdentityKey:  identityKey,
+		SignedPrekey: signedPrekey,
+		PrekeyId:     prekeyId,
+		Expires:      time.Now().Add(ttl).Unix(),
+	}
+	if err := bundle.Sign(owner); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// PublishPrekeys signs and stores the bundle of owner for ttl.
+func (store *Store) PublishPrekeys(owner *crypto.Key, identityKey, signedPrekey []byte, prekeyId uint32, ttl time.Duration) error {
+	bundle, err := NewPrekeyBundle(owner, identityKey, signedPrekey, prekeyId, ttl)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	return store.Put(PrekeyKey(owner.Address), value)
+}
+
+// Prekeys finds the bundle of an account, asking the connected peers when
+// this node has none.
+func (store *Store) Prekeys(owner common.Address, timeout time.Duration) (*PrekeyBundle, error) {
+	value, err := store.Lookup(PrekeyKey(owner), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePrekeyBundle(value)
+}
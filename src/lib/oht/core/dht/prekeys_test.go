@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPrekeyBundle(t *testing.T) {
+	alice, mallory := newTestKey(t), newTestKey(t)
+	store := newTestStore(t, PrekeyNamespace)
+	identityKey, prekey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	if err := store.PublishPrekeys(alice, identityKey, prekey, 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := store.Prekeys(alice.Address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.PrekeyId != 1 || !bytes.Equal(bundle.SignedPrekey, prekey) {
+		t.Errorf("unexpected bundle %+v", bundle)
+	}
+
+	// Only alice can replace her bundle
+	forged := *bundle
+	forged.SignedPrekey = bytes.Repeat([]byte{3}, 32)
+	forged.Expires++
+	forged.Sign(mallory)
+	forged.Owner = alice.Address
+	value, _ := json.Marshal(forged)
+	if err := store.Put(PrekeyKey(alice.Address), value); err != ErrPrekeySignature {
+		t.Errorf("expected %v, got %v", ErrPrekeySignature, err)
+	}
+
+	// Nor roll it back to an earlier one
+	earlier := *bundle
+	earlier.Expires--
+	earlier.Sign(alice)
+	value, _ = json.Marshal(earlier)
+	if err := store.Put(PrekeyKey(alice.Address), value); err != ErrPrekeyExpiry {
+		t.Errorf("expected %v, got %v", ErrPrekeyExpiry, err)
+	}
+
+	if err := store.PublishPrekeys(alice, identityKey, forged.SignedPrekey, 2, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if bundle, _ = store.Prekeys(alice.Address, time.Second); bundle.PrekeyId != 2 {
+		t.Error("expected the rotated prekey to replace the bundle")
+	}
+}
@@ -0,0 +1,184 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+const (
+	ProfileNamespace = "profile"
+	// MaxProfileTTL bounds how long a profile is used after its owner
+	// stopped refreshing it, onion hosts go stale quickly.
+	MaxProfileTTL    = 24 * time.Hour
+	maxDisplayName   = 64
+	maxProfileOnions = 8
+	maxProfileSize   = 8 << 10
+)
+
+var (
+	ErrProfileRecordFormat = errors.New("Profile: Malformed record")
+	ErrProfileSignature    = errors.New("Profile: Record must be signed by its owner")
+	ErrProfileSequence     = errors.New("Profile: Sequence must increase on every update")
+	ErrProfileExpiry       = errors.New("Profile: Expiry must be in the future and within the maximum TTL")
+	avatarHashPattern      = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// ProfileRecord describes an account: what it is called, where it can be
+// reached and the keys to encrypt to it. Publishers use the time in
+// nanoseconds as Sequence, so every update replaces the last.
+type ProfileRecord struct {
+	Owner       common.Address
+	DisplayName string `json:",omitempty"`
+	// AvatarHash is the hex sha3 of the avatar image, which is exchanged
+	// separately.
+	AvatarHash string `json:",omitempty"`
+	OnionHosts []string
+	// PublicKey is the account public key whispers and account messages are
+	// encrypted to.
+	PublicKey []byte
+	Prekeys   *PrekeyBundle `json:",omitempty"`
+	Sequence  uint64
+	Expires   int64
+	Signature []byte
+}
+
+func ProfileKey(owner common.Address) string {
+	return ProfileNamespace + "/" + owner.Hex()
+}
+
+func (record *ProfileRecord) Expired() bool {
+	return time.Now().Unix() >= record.Expires
+}
+
+func (record *ProfileRecord) hash() []byte {
+	var numbers [16]byte
+	binary.BigEndian.PutUint64(numbers[:8], record.Sequence)
+	binary.BigEndian.PutUint64(numbers[8:], uint64(record.Expires))
+	data := [][]byte{[]byte("oht-profile"), record.Owner[:], []byte(record.DisplayName), {0}, []byte(record.AvatarHash), {0}}
+	for _, onionHost := range record.OnionHosts {
+		data = append(data, []byte(onionHost), []byte{0})
+	}
+	data = append(data, record.PublicKey, numbers[:])
+	if record.Prekeys != nil {
+		data = append(data, record.Prekeys.hash())
+	}
+	return crypto.Sha3(data...)
+}
+
+// Sign signs the record with the owner's account key, setting its owner and
+// public key.
+func (record *ProfileRecord) Sign(owner *crypto.Key) (err error) {
+	record.Owner = owner.Address
+	record.PublicKey = crypto.FromECDSAPub(&owner.PrivateKey.PublicKey)
+	record.Signature, err = crypto.Sign(record.hash(), owner.PrivateKey)
+	return err
+}
+
+// Verify checks the record and the prekeys in it were signed by its owner.
+func (record *ProfileRecord) Verify() error {
+	if len([]rune(record.DisplayName)) > maxDisplayName || len(record.OnionHosts) > maxProfileOnions {
+		return ErrProfileRecordFormat
+	}
+	if record.AvatarHash != "" && !avatarHashPattern.MatchString(record.AvatarHash) {
+		return ErrProfileRecordFormat
+	}
+	for _, onionHost := range record.OnionHosts {
+		if !strings.HasSuffix(onionHost, ".onion") {
+			return ErrProfileRecordFormat
+		}
+	}
+	publicKey, err := crypto.SigToPub(record.hash(), record.Signature)
+	if err != nil || crypto.PubkeyToAddress(*publicKey) != record.Owner || !bytes.Equal(crypto.FromECDSAPub(publicKey), record.PublicKey) {
+		return ErrProfileSignature
+	}
+	if record.Prekeys != nil {
+		if record.Prekeys.Owner != record.Owner {
+			return ErrProfileRecordFormat
+		}
+		return record.Prekeys.Verify()
+	}
+	return nil
+}
+
+func DecodeProfileRecord(value []byte) (*ProfileRecord, error) {
+	record := &ProfileRecord{}
+	if len(value) > maxProfileSize || json.Unmarshal(value, record) != nil {
+		return nil, ErrProfileRecordFormat
+	}
+	return record, nil
+}
+
+// ProfileValidator accepts profiles signed by the account they are stored
+// under, each replacing the last with a higher sequence.
+type ProfileValidator struct{}
+
+func (ProfileValidator) Validate(key string, existing, value []byte) error {
+	record, err := DecodeProfileRecord(value)
+	if err != nil {
+		return err
+	}
+	if key != ProfileKey(record.Owner) {
+		return ErrProfileRecordFormat
+	}
+	if err := record.Verify(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if record.Expires <= now.Unix() || record.Expires > now.Add(MaxProfileTTL).Unix() {
+		return ErrProfileExpiry
+	}
+	if existing != nil {
+		if current, err := DecodeProfileRecord(existing); err == nil && record.Sequence <= current.Sequence {
+			return ErrProfileSequence
+		}
+	}
+	return nil
+}
+
+func (ProfileValidator) Signer(value []byte) (common.Address, error) {
+	record, err := DecodeProfileRecord(value)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return record.Owner, nil
+}
+
+func (ProfileValidator) Expired(value []byte) bool {
+	record, err := DecodeProfileRecord(value)
+	return err != nil || record.Expired()
+}
+
+// PublishProfile signs and stores the profile of owner for ttl.
+func (store *Store) PublishProfile(owner *crypto.Key, record *ProfileRecord, ttl time.Duration) error {
+	if ttl > MaxProfileTTL {
+		ttl = MaxProfileTTL
+	}
+	record.Sequence = uint64(time.Now().UnixNano())
+	record.Expires = time.Now().Add(ttl).Unix()
+	if err := record.Sign(owner); err != nil {
+		return err
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return store.Put(ProfileKey(owner.Address), value)
+}
+
+// Profile finds the profile of an account, asking the connected peers when
+// this node has none.
+func (store *Store) Profile(owner common.Address, timeout time.Duration) (*ProfileRecord, error) {
+	value, err := store.Lookup(ProfileKey(owner), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeProfileRecord(value)
+}
@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestProfileRecord(t *testing.T) {
+	alice, mallory := newTestKey(t), newTestKey(t)
+	store := newTestStore(t, ProfileNamespace)
+
+	record := &ProfileRecord{DisplayName: "Alice", OnionHosts: []string{"alicealicealicea.onion"}}
+	if err := store.PublishProfile(alice, record, 48*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := store.Profile(alice.Address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.DisplayName != "Alice" || profile.OnionHosts[0] != "alicealicealicea.onion" || profile.Owner != alice.Address {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+	if profile.Expires > time.Now().Add(MaxProfileTTL).Unix() {
+		t.Error("expected the TTL to be capped")
+	}
+
+	// Mallory can not point alice's profile at her own onion host
+	forged := *profile
+	forged.OnionHosts = []string{"mallorymallorymal.onion"}
+	forged.Sign(mallory)
+	forged.Owner = alice.Address
+	value, _ := json.Marshal(forged)
+	if err := store.Put(ProfileKey(alice.Address), value); err != ErrProfileSignature {
+		t.Errorf("expected %v, got %v", ErrProfileSignature, err)
+	}
+
+	// Nor replay an earlier profile of alice's
+	earlier := &ProfileRecord{DisplayName: "Old"}
+	earlier.Sequence, earlier.Expires = profile.Sequence-1, profile.Expires
+	earlier.Sign(alice)
+	value, _ = json.Marshal(earlier)
+	if err := store.Put(ProfileKey(alice.Address), value); err != ErrProfileSequence {
+		t.Errorf("expected %v, got %v", ErrProfileSequence, err)
+	}
+
+	invalid := &ProfileRecord{OnionHosts: []string{"example.com"}}
+	if err := store.PublishProfile(alice, invalid, time.Hour); err != ErrProfileRecordFormat {
+		t.Errorf("expected %v for a host that is not an onion, got %v", ErrProfileRecordFormat, err)
+	}
+}
@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+const (
+	RevocationNamespace = "revocation"
+	maxRevocationReason = 256
+	maxRevocationSize   = 4 << 10
+	// maxRevocationSkew is how far in the future a revocation may be dated
+	maxRevocationSkew = time.Hour
+)
+
+var (
+	ErrRevocationRecordFormat = errors.New("Revocation: Malformed record")
+	ErrRevocationSignature    = errors.New("Revocation: Must be signed by the revoked key, and by the successor for a rotation")
+	ErrRevocationExists       = errors.New("Revocation: The key is revoked already")
+	ErrRevoked                = errors.New("DHT: Record is signed by a revoked key")
+)
+
+// RevocationRecord says an account key is not to be trusted anymore. It is
+// signed by the key itself, so whoever holds the key can revoke it. With a
+// Successor it is a rotation statement: the old key endorses the new one,
+// which signs too so nobody is named successor without holding its key.
+// Revocations never expire. A rotation can still be replaced by a plain
+// revocation, in case the key that signed it was stolen and the thief
+// rotated it to a key of their own.
+type RevocationRecord struct {
+	Owner              common.Address
+	Successor          *common.Address `json:",omitempty"`
+	Reason             string          `json:",omitempty"`
+	Created            int64
+	Signature          []byte
+	SuccessorSignature []byte `json:",omitempty"`
+}
+
+func RevocationKey(owner common.Address) string {
+	return RevocationNamespace + "/" + owner.Hex()
+}
+
+func (record *RevocationRecord) hash() []byte {
+	var number [8]byte
+	binary.BigEndian.PutUint64(number[:], uint64(record.Created))
+	successor := []byte{}
+	if record.Successor != nil {
+		successor = record.Successor[:]
+	}
+	return crypto.Sha3([]byte("oht-revocation"), record.Owner[:], successor, []byte(record.Reason), []byte{0}, number[:])
+}
+
+// Sign signs the record with the revoked key and, for a rotation, with the
+// key of the successor.
+func (record *RevocationRecord) Sign(owner, successor *crypto.Key) (err error) {
+	record.Owner = owner.Address
+	record.Successor = nil
+	if successor != nil {
+		record.Successor = &successor.Address
+	}
+	if record.Signature, err = owner.Sign(record.hash()); err != nil {
+		return err
+	}
+	if successor != nil {
+		record.SuccessorSignature, err = successor.Sign(record.hash())
+	}
+	return err
+}
+
+// Verify checks the record was signed by the revoked key and its successor.
+func (record *RevocationRecord) Verify() error {
+	if len(record.Reason) > maxRevocationReason {
+		return ErrRevocationRecordFormat
+	}
+	if signer, err := crypto.SignatureAddress(record.hash(), record.Signature); err != nil || signer != record.Owner {
+		return ErrRevocationSignature
+	}
+	if record.Successor != nil {
+		if *record.Successor == record.Owner {
+			return ErrRevocationRecordFormat
+		}
+		if signer, err := crypto.SignatureAddress(record.hash(), record.SuccessorSignature); err != nil || signer != *record.Successor {
+			return ErrRevocationSignature
+		}
+	}
+	return nil
+}
+
+func DecodeRevocationRecord(value []byte) (*RevocationRecord, error) {
+	record := &RevocationRecord{}
+	if len(value) > maxRevocationSize || json.Unmarshal(value, record) != nil {
+		return nil, ErrRevocationRecordFormat
+	}
+	return record, nil
+}
+
+// RevocationValidator accepts revocations signed by the key they revoke.
+// Only a plain revocation replaces a rotation, nothing replaces a plain
+// revocation.
+type RevocationValidator struct{}
+
+func (RevocationValidator) Validate(key string, existing, value []byte) error {
+	record, err := DecodeRevocationRecord(value)
+	if err != nil {
+		return err
+	}
+	if key != RevocationKey(record.Owner) {
+		return ErrRevocationRecordFormat
+	}
+	if err := record.Verify(); err != nil {
+		return err
+	}
+	if record.Created > time.Now().Add(maxRevocationSkew).Unix() {
+		return ErrRevocationRecordFormat
+	}
+	if existing != nil {
+		current, err := DecodeRevocationRecord(existing)
+		if err == nil && (current.Successor == nil || record.Successor != nil) {
+			return ErrRevocationExists
+		}
+	}
+	return nil
+}
+
+func (RevocationValidator) Expired(value []byte) bool {
+	_, err := DecodeRevocationRecord(value)
+	return err != nil
+}
+
+// Rotations finds the key an account key was rotated to.
+type Rotations interface {
+	Successor(owner common.Address) (common.Address, bool)
+}
+
+// revocation reads the revocation of owner stored on this node. It does not
+// take the store's mutex, so validators may call it.
+func (store *Store) revocation(owner common.Address) *RevocationRecord {
+	value, err := store.db.Get([]byte(RevocationKey(owner)))
+	if err != nil {
+		return nil
+	}
+	record, err := DecodeRevocationRecord(value)
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+// Revocation returns the revocation of an account key this node knows of,
+// ErrNotFound when the key was not revoked.
+func (store *Store) Revocation(owner common.Address) (*RevocationRecord, error) {
+	if record := store.revocation(owner); record != nil {
+		return record, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Revoked reports whether an account key was revoked or rotated.
+func (store *Store) Revoked(owner common.Address) bool {
+	return store.revocation(owner) != nil
+}
+
+// Successor returns the key an account key was rotated to.
+func (store *Store) Successor(owner common.Address) (common.Address, bool) {
+	record := store.revocation(owner)
+	if record == nil || record.Successor == nil {
+		return common.Address{}, false
+	}
+	return *record.Successor, true
+}
+
+// Revoke publishes a revocation of owner, or when successor is not nil a
+// rotation statement endorsing it.
+func (store *Store) Revoke(owner, successor *crypto.Key, reason string) error {
+	record := &RevocationRecord{Reason: reason, Created: time.Now().Unix()}
+	if err := record.Sign(owner, successor); err != nil {
+		return err
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return store.Put(RevocationKey(owner.Address), value)
+}
+
+// SyncRevocations asks the connected peers for the revocations they know.
+func (store *Store) SyncRevocations() {
+	store.Sync(RevocationNamespace + "/")
+}
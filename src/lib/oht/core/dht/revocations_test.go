@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/crypto"
+)
+
+func signedRevocation(t *testing.T, owner, successor *crypto.Key, reason string) []byte {
+	record := &RevocationRecord{Reason: reason, Created: time.Now().Unix()}
+	if err := record.Sign(owner, successor); err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestRevocationRecords(t *testing.T) {
+	alice, bob, thief := newTestKey(t), newTestKey(t), newTestKey(t)
+	store := newTestStore(t, RevocationNamespace, NameNamespace, ProfileNamespace)
+	forged := &RevocationRecord{Created: time.Now().Unix()}
+	forged.Sign(thief, nil)
+	forged.Owner = alice.Address
+	forgedValue, _ := json.Marshal(forged)
+	if err := store.Put(RevocationKey(alice.Address), forgedValue); err != ErrRevocationSignature {
+		t.Errorf("expected %v revoking another account's key, got %v", ErrRevocationSignature, err)
+	}
+	unendorsed := &RevocationRecord{Created: time.Now().Unix()}
+	unendorsed.Sign(alice, nil)
+	unendorsed.Successor = &bob.Address
+	unendorsedValue, _ := json.Marshal(unendorsed)
+	if err := store.Put(RevocationKey(alice.Address), unendorsedValue); err != ErrRevocationSignature {
+		t.Errorf("expected %v naming a successor that did not sign, got %v", ErrRevocationSignature, err)
+	}
+
+	// A thief with alice's key rotates it to their own, alice revokes it
+	if err := store.Put(RevocationKey(alice.Address), signedRevocation(t, alice, thief, "")); err != nil {
+		t.Fatal(err)
+	}
+	if successor, ok := store.Successor(alice.Address); !ok || successor != thief.Address {
+		t.Errorf("expected the rotation to %s, got %s", thief.Address.Hex(), successor.Hex())
+	}
+	if err := store.Put(RevocationKey(alice.Address), signedRevocation(t, alice, bob, "")); err != ErrRevocationExists {
+		t.Errorf("expected %v replacing a rotation with another, got %v", ErrRevocationExists, err)
+	}
+	if err := store.Put(RevocationKey(alice.Address), signedRevocation(t, alice, nil, "compromised")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Successor(alice.Address); ok || !store.Revoked(alice.Address) {
+		t.Error("expected the key to be revoked without successor")
+	}
+	if err := store.Put(RevocationKey(alice.Address), signedRevocation(t, alice, thief, "")); err != ErrRevocationExists {
+		t.Errorf("expected %v replacing a revocation, got %v", ErrRevocationExists, err)
+	}
+
+	ed25519Key, _ := crypto.NewKeyOfAlgorithm(crypto.AlgorithmEd25519, rand.Reader)
+	if err := store.Put(RevocationKey(ed25519Key.Address), signedRevocation(t, ed25519Key, nil, "")); err != nil {
+		t.Errorf("expected ed25519 keys to be revocable, got %v", err)
+	}
+}
+
+func TestRevokedKeySignaturesRefused(t *testing.T) {
+	alice, successor, mallory := newTestKey(t), newTestKey(t), newTestKey(t)
+	store := newTestStore(t, RevocationNamespace, NameNamespace, ProfileNamespace)
+	expires := time.Now().Add(time.Hour)
+	if err := store.Put(NameKey("alice"), signedName(t, alice, "alice", alice.Address, 0, expires)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PublishProfile(alice, &ProfileRecord{}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Revoke(alice, successor, "new device"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(ProfileKey(alice.Address)); err != ErrNotFound {
+		t.Errorf("expected the profile signed by the revoked key to be hidden, got %v", err)
+	}
+	if err := store.PublishProfile(alice, &ProfileRecord{}, time.Hour); err != ErrRevoked {
+		t.Errorf("expected %v for a profile signed by the revoked key, got %v", ErrRevoked, err)
+	}
+	if err := store.Put(NameKey("alice"), signedName(t, alice, "alice", alice.Address, 1, expires)); err != ErrRevoked {
+		t.Errorf("expected %v renewing with the revoked key, got %v", ErrRevoked, err)
+	}
+	if err := store.Put(NameKey("alice"), signedName(t, mallory, "alice", mallory.Address, 1, expires)); err != ErrNameTaken {
+		t.Errorf("expected %v claiming the name of a revoked key, got %v", ErrNameTaken, err)
+	}
+	if err := store.Put(NameKey("alice"), signedName(t, successor, "alice", successor.Address, 1, expires)); err != nil {
+		t.Errorf("expected the successor to take over the name, got %v", err)
+	}
+	if _, err := store.Get(NameKey("alice")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,411 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/database"
+	p2p "github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+const (
+	storeMessageType  = "dht_store"
+	lookupMessageType = "dht_lookup"
+	syncMessageType   = "dht_sync"
+	// replicas is how many peers keep a record of a placed namespace
+	replicas = 3
+	// maxSyncRecords bounds the records sent in answer to one sync request
+	maxSyncRecords = 256
+	// DefaultLookupTimeout is how long Lookup waits for peers to answer
+	// when a key is not stored locally.
+	DefaultLookupTimeout = 10 * time.Second
+)
+
+var (
+	ErrNotFound         = errors.New("DHT: Not found")
+	ErrRecordUnchanged  = errors.New("DHT: Record is already stored")
+	ErrUnknownNamespace = errors.New("DHT: No validator for key namespace")
+)
+
+// Validator guards the records of a key namespace, the part of the key
+// before the first "/". Records are accepted from any peer, so everything a
+// namespace relies on, such as ownership, has to be checked here.
+type Validator interface {
+	// Validate returns nil when value may replace existing, existing is nil
+	// for keys that are not stored yet.
+	Validate(key string, existing, value []byte) error
+	// Expired reports whether a stored value can be dropped.
+	Expired(value []byte) bool
+}
+
+// Placement is implemented by validators of namespaces whose records are
+// not gossiped to every peer but sent to the peers responsible for them,
+// picked by consistent hashing of Responsible over the connected peers.
+type Placement interface {
+	Responsible(key string) string
+}
+
+// Signed is implemented by validators of namespaces whose records are
+// signed by an account, records signed by a key revoked on this node are
+// refused. Signer is only called for records that passed Validate.
+type Signed interface {
+	Signer(value []byte) (common.Address, error)
+}
+
+// Syncable is implemented by validators of namespaces whose records may not
+// all be handed out at once, only prefixes it allows are answered in sync.
+type Syncable interface {
+	Syncable(prefix string) bool
+}
+
+// WatchFunc is called with every record stored under the watched prefix.
+type WatchFunc func(key string, value []byte)
+
+type watcher struct {
+	prefix string
+	watch  WatchFunc
+}
+
+type storeRecord struct {
+	Key   string
+	Value []byte
+}
+
+// Store keeps the DHT records this node knows of. Every record is gossiped
+// to all peers, each of which validates it before storing and forwarding it,
+// so a record only spreads as far as it is valid.
+type Store struct {
+	db         database.Database
+	manager    *p2p.Manager
+	validators map[string]Validator
+	lookups    map[string][]chan []byte
+	watchers   []watcher
+	mutex      sync.Mutex
+}
+
+func NewStore(db database.Database, manager *p2p.Manager) *Store {
+	store := &Store{
+		db:         db,
+		manager:    manager,
+		validators: make(map[string]Validator),
+		lookups:    make(map[string][]chan []byte),
+	}
+	if manager != nil {
+		manager.Handle(storeMessageType, store.handleStore)
+		manager.Handle(lookupMessageType, store.handleLookup)
+		manager.Handle(syncMessageType, store.handleSync)
+	}
+	return store
+}
+
+func (store *Store) RegisterValidator(namespace string, validator Validator) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.validators[namespace] = validator
+}
+
+// Watch calls watch with every record stored under prefix from now on,
+// whether it was put locally or received from a peer.
+func (store *Store) Watch(prefix string, watch WatchFunc) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.watchers = append(store.watchers, watcher{prefix: prefix, watch: watch})
+}
+
+func (store *Store) notifyWatchers(key string, value []byte) {
+	store.mutex.Lock()
+	watchers := store.watchers
+	store.mutex.Unlock()
+	for _, w := range watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			w.watch(key, value)
+		}
+	}
+}
+
+func (store *Store) validator(key string) (Validator, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	namespace := strings.SplitN(key, "/", 2)[0]
+	if validator, ok := store.validators[namespace]; ok {
+		return validator, nil
+	}
+	return nil, ErrUnknownNamespace
+}
+
+// Put validates and stores a record, then publishes it to all peers.
+func (store *Store) Put(key string, value []byte) error {
+	if err := store.put(key, value); err != nil {
+		return err
+	}
+	store.publish(p2p.Message{}, key, value)
+	store.notifyWatchers(key, value)
+	return nil
+}
+
+func (store *Store) put(key string, value []byte) error {
+	validator, err := store.validator(key)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	existing, err := store.db.Get([]byte(key))
+	if err != nil || validator.Expired(existing) {
+		existing = nil
+	}
+	if existing != nil && bytes.Equal(existing, value) {
+		return ErrRecordUnchanged
+	}
+	if err := validator.Validate(key, existing, value); err != nil {
+		return err
+	}
+	if signed, ok := validator.(Signed); ok {
+		if signer, err := signed.Signer(value); err != nil || store.revocation(signer) != nil {
+			return ErrRevoked
+		}
+	}
+	return store.db.Put([]byte(key), value)
+}
+
+// Get returns a record stored on this node, records signed by a key that
+// was revoked since they were stored are not returned.
+func (store *Store) Get(key string) ([]byte, error) {
+	validator, err := store.validator(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := store.db.Get([]byte(key))
+	if err != nil || validator.Expired(value) {
+		return nil, ErrNotFound
+	}
+	if signed, ok := validator.(Signed); ok {
+		if signer, err := signed.Signer(value); err != nil || store.revocation(signer) != nil {
+			return nil, ErrNotFound
+		}
+	}
+	return value, nil
+}
+
+// Lookup returns a record, asking the connected peers for it when it is not
+// stored on this node. Answers are validated like any other record.
+func (store *Store) Lookup(key string, timeout time.Duration) ([]byte, error) {
+	if value, err := store.Get(key); err == nil || store.manager == nil {
+		return value, err
+	}
+	found := make(chan []byte, 1)
+	store.mutex.Lock()
+	store.lookups[key] = append(store.lookups[key], found)
+	store.mutex.Unlock()
+	defer store.cancelLookup(key, found)
+	store.manager.Broadcast <- p2p.NewMessage(lookupMessageType, key)
+	select {
+	case value := <-found:
+		return value, nil
+	case <-time.After(timeout):
+		return nil, ErrNotFound
+	}
+}
+
+func (store *Store) cancelLookup(key string, found chan []byte) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	lookups := store.lookups[key]
+	for index, lookup := range lookups {
+		if lookup == found {
+			lookups = append(lookups[:index], lookups[index+1:]...)
+			break
+		}
+	}
+	if len(lookups) == 0 {
+		delete(store.lookups, key)
+	} else {
+		store.lookups[key] = lookups
+	}
+}
+
+// Delete removes a record from this node only, peers keep their copy until
+// it expires or is replaced.
+func (store *Store) Delete(key string) error {
+	return store.db.Delete([]byte(key))
+}
+
+// Keys lists the stored keys with the given prefix.
+func (store *Store) Keys(prefix string) (keys []string) {
+	for _, key := range store.db.Keys() {
+		if strings.HasPrefix(string(key), prefix) {
+			keys = append(keys, string(key))
+		}
+	}
+	return keys
+}
+
+// Expire drops every expired record and returns how many were removed.
+func (store *Store) Expire() (removed int) {
+	for _, key := range store.Keys("") {
+		validator, err := store.validator(key)
+		if err != nil {
+			continue
+		}
+		value, err := store.db.Get([]byte(key))
+		if err == nil && validator.Expired(value) {
+			if store.db.Delete([]byte(key)) == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// publish sends a record to every peer but the one it was received from,
+// or for placed namespaces to the peers responsible for it.
+func (store *Store) publish(received p2p.Message, key string, value []byte) {
+	if store.manager == nil {
+		return
+	}
+	body, err := json.Marshal(storeRecord{Key: key, Value: value})
+	if err != nil {
+		return
+	}
+	message := p2p.NewMessage(storeMessageType, string(body))
+	validator, _ := store.validator(key)
+	if placement, ok := validator.(Placement); ok {
+		// Placed records are only sent on by the node that put them
+		if received.From == nil {
+			for _, onionHost := range store.responsible(placement.Responsible(key)) {
+				go store.manager.SendToOnionHost(onionHost, store.manager.Config.ListenPort, message)
+			}
+		}
+		return
+	}
+	message.From = received.From
+	store.manager.Relay(message)
+}
+
+// Place sends a stored record of a placed namespace to the peers
+// responsible for it and returns how many it was handed to.
+func (store *Store) Place(key string) (placed int) {
+	validator, err := store.validator(key)
+	if err != nil || store.manager == nil {
+		return 0
+	}
+	placement, ok := validator.(Placement)
+	if !ok {
+		return 0
+	}
+	value, err := store.Get(key)
+	if err != nil {
+		return 0
+	}
+	body, err := json.Marshal(storeRecord{Key: key, Value: value})
+	if err != nil {
+		return 0
+	}
+	message := p2p.NewMessage(storeMessageType, string(body))
+	var wait sync.WaitGroup
+	var mutex sync.Mutex
+	for _, onionHost := range store.responsible(placement.Responsible(key)) {
+		wait.Add(1)
+		go func(onionHost string) {
+			defer wait.Done()
+			if store.manager.SendToOnionHost(onionHost, store.manager.Config.ListenPort, message) == nil {
+				mutex.Lock()
+				placed++
+				mutex.Unlock()
+			}
+		}(onionHost)
+	}
+	wait.Wait()
+	return placed
+}
+
+// responsible picks the connected peers that keep the records of id.
+func (store *Store) responsible(id string) []string {
+	ring := common.New()
+	ring.Set(store.manager.OnionHosts())
+	onionHosts, err := ring.GetN(id, replicas)
+	if err != nil {
+		return nil
+	}
+	return onionHosts
+}
+
+// Sync asks the connected peers for every record they store under prefix.
+// The records arrive like any other and are passed to the watchers.
+func (store *Store) Sync(prefix string) {
+	if store.manager != nil {
+		store.manager.Broadcast <- p2p.NewMessage(syncMessageType, prefix)
+	}
+}
+
+func (store *Store) handleStore(manager *p2p.Manager, message p2p.Message) {
+	var record storeRecord
+	if err := json.Unmarshal([]byte(message.Body), &record); err != nil {
+		return
+	}
+	err := store.put(record.Key, record.Value)
+	if err != nil && err != ErrRecordUnchanged {
+		return
+	}
+	store.mutex.Lock()
+	lookups := store.lookups[record.Key]
+	delete(store.lookups, record.Key)
+	store.mutex.Unlock()
+	for _, found := range lookups {
+		select {
+		case found <- record.Value:
+		default:
+		}
+	}
+	// Only records that changed are forwarded, which ends the gossip once
+	// every peer has the record.
+	if err == nil {
+		store.publish(message, record.Key, record.Value)
+		store.notifyWatchers(record.Key, record.Value)
+	}
+}
+
+func (store *Store) handleSync(manager *p2p.Manager, message p2p.Message) {
+	// A prefix has to name a namespace, the whole store is never sent
+	if message.From == nil || !strings.Contains(message.Body, "/") {
+		return
+	}
+	validator, err := store.validator(message.Body)
+	if err != nil {
+		return
+	}
+	if syncable, ok := validator.(Syncable); ok && !syncable.Syncable(message.Body) {
+		return
+	}
+	for index, key := range store.Keys(message.Body) {
+		if index == maxSyncRecords {
+			break
+		}
+		value, err := store.Get(key)
+		if err != nil {
+			continue
+		}
+		body, err := json.Marshal(storeRecord{Key: key, Value: value})
+		if err != nil {
+			continue
+		}
+		manager.SendTo(message.From, p2p.NewMessage(storeMessageType, string(body)))
+	}
+}
+
+func (store *Store) handleLookup(manager *p2p.Manager, message p2p.Message) {
+	value, err := store.Get(message.Body)
+	if err != nil || message.From == nil {
+		return
+	}
+	body, err := json.Marshal(storeRecord{Key: message.Body, Value: value})
+	if err != nil {
+		return
+	}
+	manager.SendTo(message.From, p2p.NewMessage(storeMessageType, string(body)))
+}
@@ -0,0 +1,315 @@
+package oht
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/multiverse-os/libs/oht/accounts"
+	"github.com/multiverse-os/libs/oht/channels"
+	"github.com/multiverse-os/libs/oht/contacts"
+	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
+	"github.com/multiverse-os/libs/oht/core/network"
+	"github.com/multiverse-os/libs/oht/core/network/p2p"
+)
+
+// DefaultIdentity is the identity of the node's own onion service, it
+// makes contacts as whichever account is unlocked.
+const DefaultIdentity = "default"
+
+var (
+	ErrIdentityExists      = errors.New("Identity: An identity with this name already exists")
+	ErrUnknownIdentity     = errors.New("Identity: No identity with this name")
+	ErrInvalidIdentityName = errors.New("Identity: Names are 1 to 32 lowercase letters, digits and dashes")
+	ErrIdentityAccount     = errors.New("Identity: The identity belongs to another account")
+	ErrIdentityAlgorithm   = errors.New("Identity: Contacts, channels and names need a secp256k1 account")
+	identityNamePattern    = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+)
+
+// Identity is an account the node hosts next to the others without them
+// being linkable: it has its own onion service, its own peers dialed over
+// circuits no other identity uses, its own DHT store, contacts and
+// channels.
+type Identity struct {
+	Name         string
+	Account      string
+	OnionService *network.OnionServiceConfig
+	p2p          *p2p.Manager
+	db           *database.BoltDatabase
+	dht          *dht.Store
+	contacts     *contacts.Contacts
+	channels     *channels.Channels
+	// listening is set once startIdentity accepts its peers.
+	listening bool
+}
+
+// onionHost is where peers reach the identity, empty until Tor has
+// published its onion service.
+func (identity *Identity) onionHost() string {
+	return identity.OnionService.OnionHost
+}
+
+// onionHost is where peers reach an identity, the default identity uses
+// the node's onion service.
+func (i *Interface) onionHost(identity *Identity) string {
+	if identity.OnionService == nil {
+		return i.tor.OnionHost
+	}
+	return identity.onionHost()
+}
+
+func registerValidators(store *dht.Store) {
+	store.RegisterValidator(dht.RevocationNamespace, dht.RevocationValidator{})
+	store.RegisterValidator(dht.NameNamespace, dht.NameValidator{Rotations: store})
+	store.RegisterValidator(dht.MailboxNamespace, dht.MailboxValidator{})
+	store.RegisterValidator(dht.GeoNamespace, dht.GeoValidator{})
+	store.RegisterValidator(dht.PrekeyNamespace, dht.PrekeyValidator{})
+	store.RegisterValidator(dht.ProfileNamespace, dht.ProfileValidator{})
+	store.RegisterValidator(dht.AttestationNamespace, dht.AttestationValidator{})
+}
+
+// initializeIdentity opens the network stack and data of an identity, kept
+// in identities/<name> of the data directory so nothing is shared with the
+// other identities.
+func (i *Interface) initializeIdentity(identity *Identity) (err error) {
+	directory := common.AbsolutePath(i.config.DataDirectory, ("identities/" + identity.Name))
+	common.CreatePathUnlessExist(directory, 0700)
+	identity.p2p = p2p.InitializeP2PManager(&p2p.P2PConfig{
+		MaxPeers:        i.config.MaxPeers,
+		MaxPendingPeers: i.config.MaxPendingPeers,
+		MaxQueueSize:    i.config.P2PConfig.MaxQueueSize,
+		SocksPort:       i.config.TorConfig.SocksPort,
+		ListenPort:      identity.OnionService.RemoteListenPort,
+		Isolation:       p2p.IsolateAccount,
+		Account:         identity.Account,
+	})
+	if identity.db, err = database.InitializeDatabase(common.AbsolutePath(directory, "oht.db")); err != nil {
+		return err
+	}
+	identity.dht = dht.NewStore(identity.db, identity.p2p)
+	registerValidators(identity.dht)
+	if identity.contacts, err = contacts.InitializeContacts(directory, identity.p2p); err != nil {
+		return err
+	}
+	if identity.channels, err = channels.InitializeChannels(directory, identity.db, identity.p2p); err != nil {
+		return err
+	}
+	identity.contacts.LocalOnionHost = identity.onionHost
+	identity.contacts.AddClientAuth = i.tor.AddClientAuth
+	identity.contacts.ListenPort = identity.OnionService.RemoteListenPort
+	identity.contacts.Locate = func(contactId string) (common.Address, string, error) {
+		return i.locateContact(identity.dht, contactId)
+	}
+	identity.contacts.SetStore(identity.dht)
+	identity.channels.SetDirectory(identity.dht)
+	return nil
+}
+
+// loadIdentities opens the identities listed in identities.json next to
+// the default one.
+func (i *Interface) loadIdentities() error {
+	file, err := ioutil.ReadFile(common.AbsolutePath(i.config.DataDirectory, "identities.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var identities []*Identity
+	if err = json.Unmarshal(file, &identities); err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		if err = i.tor.AddOnionService(identity.OnionService); err != nil {
+			return err
+		}
+		if err = i.initializeIdentity(identity); err != nil {
+			return err
+		}
+		i.addIdentity(identity)
+	}
+	return nil
+}
+
+// saveIdentities writes identities.json, the default identity is never
+// listed.
+func (i *Interface) saveIdentities() error {
+	var identities []*Identity
+	for _, identity := range i.identityList() {
+		if identity.Name != DefaultIdentity {
+			identities = append(identities, identity)
+		}
+	}
+	data, err := json.MarshalIndent(identities, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(common.AbsolutePath(i.config.DataDirectory, "identities.json"), data, 0600)
+}
+
+// identityList is a snapshot of the identities sorted by name, identities
+// are added from the console while the node is running.
+func (i *Interface) identityList() (identities []*Identity) {
+	i.identitiesMutex.RLock()
+	defer i.identitiesMutex.RUnlock()
+	for _, identity := range i.identities {
+		identities = append(identities, identity)
+	}
+	sort.Slice(identities, func(a, b int) bool { return identities[a].Name < identities[b].Name })
+	return identities
+}
+
+func (i *Interface) addIdentity(identity *Identity) {
+	i.identitiesMutex.Lock()
+	defer i.identitiesMutex.Unlock()
+	i.identities[identity.Name] = identity
+}
+
+func (i *Interface) lookupIdentity(name string) *Identity {
+	i.identitiesMutex.RLock()
+	defer i.identitiesMutex.RUnlock()
+	return i.identities[name]
+}
+
+// freeListenPort picks the first local port after the node's listen port
+// that no onion service uses yet.
+func (i *Interface) freeListenPort() string {
+	used := make(map[string]bool)
+	for _, onionService := range i.tor.OnionServices() {
+		used[onionService.LocalListenPort] = true
+	}
+	port, _ := strconv.Atoi(i.config.TorConfig.ListenPort)
+	for port++; used[strconv.Itoa(port)]; port++ {
+	}
+	return strconv.Itoa(port)
+}
+
+// IDENTITIES INTERFACE
+// ListIdentities lists the identities the node hosts with their account
+// and onion host, marking the one commands act as.
+func (i *Interface) ListIdentities() (identities []string) {
+	active := i.active()
+	for _, identity := range i.identityList() {
+		account, onionHost := identity.Account, i.tor.OnionHost
+		if identity.OnionService != nil {
+			onionHost = identity.onionHost()
+		}
+		if account == "" {
+			account = "any account"
+		}
+		if onionHost == "" {
+			onionHost = "not published"
+		}
+		line := fmt.Sprintf("%s %s %s", identity.Name, account, onionHost)
+		if identity == active {
+			line += " (active)"
+		}
+		identities = append(identities, line)
+	}
+	return identities
+}
+
+// CreateIdentity adds an identity for an account with an onion service of
+// its own. Tor is restarted to publish the service when it is running,
+// otherwise the identity starts with Tor's next start.
+func (i *Interface) CreateIdentity(name, account string) error {
+	if !identityNamePattern.MatchString(name) {
+		return ErrInvalidIdentityName
+	}
+	if i.lookupIdentity(name) != nil {
+		return ErrIdentityExists
+	}
+	if !common.IsHexAddress(account) || !i.accounts.Interface.Manager.HasAccount(common.HexToAddress(account)) {
+		return accounts.ErrUnknownAccount
+	}
+	identity := &Identity{
+		Name:    name,
+		Account: common.HexToAddress(account).Hex(),
+		OnionService: &network.OnionServiceConfig{
+			DirectoryName:    ("identity-" + name),
+			RemoteListenPort: i.config.TorConfig.ListenPort,
+			LocalListenPort:  i.freeListenPort(),
+		},
+	}
+	if err := i.tor.AddOnionService(identity.OnionService); err != nil {
+		return err
+	}
+	if err := i.initializeIdentity(identity); err != nil {
+		return err
+	}
+	i.addIdentity(identity)
+	if err := i.saveIdentities(); err != nil {
+		return err
+	}
+	if i.tor.Online && i.tor.Restart() {
+		for _, other := range i.identityList() {
+			other.p2p.RequestReconnect()
+		}
+		return i.startIdentity(identity)
+	}
+	return nil
+}
+
+// startIdentity accepts the peers of an identity on the local end of its
+// onion service, an identity that was started already is left alone.
+func (i *Interface) startIdentity(identity *Identity) error {
+	i.identitiesMutex.Lock()
+	defer i.identitiesMutex.Unlock()
+	if identity.listening {
+		return nil
+	}
+	if err := identity.p2p.Listen("127.0.0.1:" + identity.OnionService.LocalListenPort); err != nil {
+		return err
+	}
+	identity.listening = true
+	go identity.p2p.Start()
+	return nil
+}
+
+// startIdentities starts the identities that are not running yet, it is
+// called whenever Tor has started and published their onion services.
+func (i *Interface) startIdentities() {
+	for _, identity := range i.identityList() {
+		if identity.OnionService == nil {
+			continue
+		}
+		if err := i.startIdentity(identity); err != nil {
+			log.Println("P2P: Failed to listen for peers of identity", identity.Name+":", err)
+		}
+	}
+}
+
+// UseIdentity makes the contacts, channels, names and DHT commands act as
+// another identity. Identities keep running in the background, their
+// whispers and channel messages are still received.
+func (i *Interface) UseIdentity(name string) error {
+	identity := i.lookupIdentity(name)
+	if identity == nil {
+		return ErrUnknownIdentity
+	}
+	i.identitiesMutex.Lock()
+	defer i.identitiesMutex.Unlock()
+	i.identity = identity
+	return nil
+}
+
+// active is the identity commands act as.
+func (i *Interface) active() *Identity {
+	i.identitiesMutex.RLock()
+	defer i.identitiesMutex.RUnlock()
+	return i.identity
+}
+
+// ActiveIdentity is the name of the identity commands act as.
+func (i *Interface) ActiveIdentity() string { return i.active().Name }
+
+// IdentityAccount is the account the active identity is bound to, empty
+// for the default identity which takes any account.
+func (i *Interface) IdentityAccount() string { return i.active().Account }
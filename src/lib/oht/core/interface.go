@@ -1,10 +1,22 @@
 package oht
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/accounts"
+	"github.com/multiverse-os/libs/oht/channels"
+	"github.com/multiverse-os/libs/oht/contacts"
 
 	"github.com/multiverse-os/libs/oht/core/common"
 	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/dht"
 	"github.com/multiverse-os/libs/oht/core/network"
 	"github.com/multiverse-os/libs/oht/core/network/p2p"
 	"github.com/multiverse-os/libs/oht/core/network/webui"
@@ -12,18 +24,30 @@ import (
 )
 
 type Interface struct {
-	config *Config
-	tor    *network.TorProcess
-	webUI  *webui.WebUI
-	p2p    *p2p.Manager
+	config    *Config
+	tor       *network.TorProcess
+	webUI     *webui.WebUI
+	nameProxy *network.SocksServer
+	names     network.StaticResolver
+	accounts  *accounts.Accounts
+	// identity is the identity contacts, channels, names and DHT commands act
+	// as, it is read with active as UseIdentity switches it.
+	identity        *Identity
+	identities      map[string]*Identity
+	identitiesMutex sync.RWMutex
 }
 
-func NewInterface(c *Config, t *network.TorProcess, w *webui.WebUI, p *p2p.Manager) (i *Interface) {
+func NewInterface(c *Config, t *network.TorProcess, w *webui.WebUI, p *p2p.Manager, s *network.SocksServer, n network.StaticResolver, d *dht.Store, k *contacts.Contacts, h *channels.Channels, a *accounts.Accounts) (i *Interface) {
+	identity := &Identity{Name: DefaultIdentity, p2p: p, dht: d, contacts: k, channels: h}
 	return &Interface{
-		config: c,
-		tor:    t,
-		webUI:  w,
-		p2p:    p,
+		config:     c,
+		tor:        t,
+		webUI:      w,
+		nameProxy:  s,
+		names:      n,
+		accounts:   a,
+		identity:   identity,
+		identities: map[string]*Identity{DefaultIdentity: identity},
 	}
 }
 
@@ -48,7 +72,161 @@ func (i *Interface) NewUnecryptedKeyStore() crypto.KeyStore {
 	return crypto.NewKeyStorePlain(common.DefaultDataDir() + "/keys")
 }
 func (i *Interface) NewEncryptedKeyStore() crypto.KeyStore {
-	return crypto.NewKeyStorePassphrase(common.DefaultDataDir()+"/keys", crypto.KDFStandard)
+	return crypto.NewKeyStorePassphraseKDF(common.DefaultDataDir()+"/keys", i.config.KeyDerivation, crypto.KDFStandard)
+}
+
+// IDENTITY
+// UnlockIdentity unlocks the account this node makes contacts and posts to
+// channels, and receives requests and messages, as. Until then incoming
+// contact and channel messages are dropped. Identities other than the
+// default one only unlock with their own account.
+func (i *Interface) UnlockIdentity(account, passphrase string) error {
+	identity := i.active()
+	if identity.Account != "" && common.HexToAddress(account).Hex() != identity.Account {
+		return ErrIdentityAccount
+	}
+	key, err := i.identityKey(account, passphrase)
+	if err != nil {
+		return err
+	}
+	identity.contacts.SetIdentity(key)
+	identity.channels.SetIdentity(key)
+	return nil
+}
+
+// identityKey decrypts the key of an account that can be an identity, whose
+// signatures and envelopes are secp256k1.
+func (i *Interface) identityKey(account, passphrase string) (*crypto.Key, error) {
+	key, err := i.NewEncryptedKeyStore().GetKey(common.HexToAddress(account), passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if key.PrivateKey == nil {
+		return nil, ErrIdentityAlgorithm
+	}
+	return key, nil
+}
+
+func (i *Interface) IdentityUnlocked() bool {
+	return (i.active().contacts.Identity() != nil)
+}
+func (i *Interface) SetUsername(username string) {
+	identity := i.active()
+	identity.contacts.Alias = username
+	identity.channels.Alias = username
+}
+
+// SetAvatar publishes the sha3 of an avatar image in our profile.
+func (i *Interface) SetAvatar(path string) error {
+	image, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	contacts := i.active().contacts
+	contacts.AvatarHash = common.Bytes2Hex(crypto.Sha3(image))
+	if contacts.Identity() != nil {
+		return contacts.PublishProfile()
+	}
+	return nil
+}
+
+// CONTACTS INTERFACE
+func (i *Interface) Contacts() *contacts.Interface {
+	return i.active().contacts.Interface
+}
+
+// locateContact finds the onion host of an account from its profile, or
+// the owner and onion host of a registered name, so
+// contacts can be requested by name. Each identity looks them up in its
+// own store.
+func (i *Interface) locateContact(store *dht.Store, contactId string) (common.Address, string, error) {
+	if common.IsHexAddress(contactId) {
+		address := common.HexToAddress(contactId)
+		onionHost := profileOnionHost(store, address)
+		if onionHost == "" {
+			return common.Address{}, "", dht.ErrNotFound
+		}
+		return address, onionHost, nil
+	}
+	record, err := lookupName(store, contactId)
+	if err != nil {
+		return common.Address{}, "", err
+	}
+	return record.Owner, record.OnionHost, nil
+}
+
+// CHANNELS INTERFACE
+func (i *Interface) Channels() *channels.Interface {
+	return i.active().channels.Interface
+}
+
+// ACCOUNTS INTERFACE
+func (i *Interface) Accounts() *accounts.Interface {
+	return i.accounts.Interface
+}
+
+// RestoreNodeKey writes the node key derived from the seed phrase to the
+// node key file, so a restored node keeps its node identity.
+func (i *Interface) RestoreNodeKey(passphrase string) error {
+	key, err := i.accounts.Interface.Manager.NodeKey(passphrase)
+	if err != nil {
+		return err
+	}
+	return crypto.SaveECDSA(i.config.PrivateKeyFile, key)
+}
+
+// RestoreAccount stores the account key rebuilt from the shares contacts
+// returned under a new passphrase.
+func (i *Interface) RestoreAccount(ownerId, passphrase string) error {
+	key, err := i.active().contacts.RecoveredKey(ownerId)
+	if err != nil {
+		return err
+	}
+	_, err = i.accounts.Interface.Manager.ImportKey(key.PrivateKey, passphrase)
+	return err
+}
+
+// RevokeAccount publishes a revocation of an account key, contacts and the
+// DHT refuse what it signs from then on.
+func (i *Interface) RevokeAccount(account, passphrase, reason string) error {
+	key, err := i.NewEncryptedKeyStore().GetKey(common.HexToAddress(account), passphrase)
+	if err != nil {
+		return err
+	}
+	defer key.Zero()
+	return i.revoke(key, nil, reason)
+}
+
+// RotateAccount publishes a rotation statement in which an account key
+// endorses its successor, contacts are asked to add the successor.
+func (i *Interface) RotateAccount(account, passphrase, successor, successorPassphrase, reason string) error {
+	keyStore := i.NewEncryptedKeyStore()
+	key, err := keyStore.GetKey(common.HexToAddress(account), passphrase)
+	if err != nil {
+		return err
+	}
+	defer key.Zero()
+	successorKey, err := keyStore.GetKey(common.HexToAddress(successor), successorPassphrase)
+	if err != nil {
+		return err
+	}
+	defer successorKey.Zero()
+	return i.revoke(key, successorKey, reason)
+}
+
+// revoke publishes the revocation in the DHT of the active identity and of
+// the identities bound to the account, the others are not linked to it.
+func (i *Interface) revoke(key, successor *crypto.Key, reason string) error {
+	active := i.active()
+	if err := active.dht.Revoke(key, successor, reason); err != nil {
+		return err
+	}
+	for _, identity := range i.identityList() {
+		if identity.dht != nil && identity != active && identity.Account == key.Address.Hex() {
+			identity.dht.Revoke(key, successor, reason)
+		}
+	}
+	return nil
 }
 
 // CONFIG INTERFACE
@@ -73,16 +251,103 @@ func (i *Interface) TorStart() bool {
 	return i.tor.Start()
 }
 func (i *Interface) TorStop() bool {
-	return i.tor.Stop()
+	return i.tor.Stop(false)
 }
 func (i *Interface) TorCycleIdentity() bool {
 	i.tor.Cycle()
 	return true
 }
 func (i *Interface) TorCycleOnionAddresses() bool {
-	i.tor.Stop()
+	i.tor.Stop(false)
 	i.tor.DeleteOnionFiles()
-	return i.tor.Start()
+	started := i.tor.Start()
+	if started {
+		// Contacts find the new onion hosts through our profiles
+		for _, identity := range i.identityList() {
+			if identity.contacts.Identity() != nil {
+				go identity.contacts.PublishProfile()
+			}
+		}
+	}
+	return started
+}
+
+// TorAddPrivateService adds an onion service only the clients authorized
+// on it reach, for local services such as a channel's.
+func (i *Interface) TorAddPrivateService(directoryName, port string) (onionHost string, err error) {
+	return i.tor.AddPrivateService(directoryName, port, port)
+}
+
+// TorAuthorizeClient issues a client authorization key for one of the
+// node's private onion services. The private key is handed to the client,
+// usually a contact, see AuthorizeContact.
+func (i *Interface) TorAuthorizeClient(directoryName, clientName string) (privateKey string, err error) {
+	key, err := i.tor.AuthorizeClient(directoryName, clientName)
+	if err != nil {
+		return "", err
+	}
+	return key.PrivateKeyBase32(), nil
+}
+func (i *Interface) TorRevokeClient(directoryName, clientName string) error {
+	return i.tor.RevokeClient(directoryName, clientName)
+}
+
+// TorPrivateServices lists the private onion services with their onion host
+// and the clients authorized on them.
+func (i *Interface) TorPrivateServices() (onionServices []string) {
+	for _, onionService := range i.tor.PrivateServices() {
+		var clients []string
+		for clientName := range onionService.AuthorizedClients {
+			clients = append(clients, clientName)
+		}
+		sort.Strings(clients)
+		if len(clients) == 0 {
+			clients = []string{"no clients"}
+		}
+		onionServices = append(onionServices, fmt.Sprintf("%s %s:%s %s", onionService.DirectoryName, onionService.OnionHost, onionService.RemoteListenPort, strings.Join(clients, ", ")))
+	}
+	return onionServices
+}
+
+// AuthorizeContact authorizes a contact on one of the node's private onion
+// services and sends them the key, their node adds it to Tor so they can
+// reach the service.
+func (i *Interface) AuthorizeContact(directoryName, contactId string) error {
+	contactList := i.active().contacts
+	contact, ok := contactList.Contact(contactId)
+	if !ok || !contact.Accepted() {
+		return contacts.ErrNotAContact
+	}
+	key, err := i.tor.AuthorizeClient(directoryName, contact.Id)
+	if err != nil {
+		return err
+	}
+	for _, onionService := range i.tor.PrivateServices() {
+		if onionService.DirectoryName != directoryName {
+			continue
+		}
+		if err = contactList.SendOnionAuth(contact.Id, onionService.OnionHost, key.PrivateKeyBase32()); err != nil {
+			// A key that never reached the contact is not left authorized
+			i.tor.RevokeClient(directoryName, contact.Id)
+		}
+	}
+	return err
+}
+
+// DeauthorizeContact revokes the key of a contact on a private onion
+// service, they no longer reach it.
+func (i *Interface) DeauthorizeContact(directoryName, contactId string) error {
+	contact, ok := i.active().contacts.Contact(contactId)
+	if !ok {
+		return contacts.ErrNotAContact
+	}
+	return i.tor.RevokeClient(directoryName, contact.Id)
+}
+func (i *Interface) TorAddClientAuth(onionHost, privateKey string) error {
+	return i.tor.AddClientAuth(onionHost, privateKey)
+}
+func (i *Interface) TorRemoveClientAuth(onionHost string) error {
+	return i.tor.RemoveClientAuth(onionHost)
 }
 
 // NETWORK INTERFACE
@@ -93,32 +358,148 @@ func (i *Interface) PeerFTable() (peers []string)   { return }
 func (i *Interface) NewRing() (ringData string)     { return }
 func (i *Interface) ConnectToPeer(peerAddress string) bool {
 	if i.tor.Online {
-		go i.p2p.ConnectToPeer(peerAddress, i.tor.ListenPort)
+		go i.active().p2p.ConnectToPeer(peerAddress, i.tor.ListenPort)
 		return true
 	} else {
 		return false
 	}
 }
-func (in *Interface) RingLookupPeerById(peerId string) string { return "" }
-func (in *Interface) RingPing(onionAddress string) bool       { return false }
+
+// RingLookupPeerById finds the current onion host of an account from the
+// profile it publishes in the DHT.
+func (i *Interface) RingLookupPeerById(peerId string) string {
+	if !common.IsHexAddress(peerId) {
+		return ""
+	}
+	return profileOnionHost(i.active().dht, common.HexToAddress(peerId))
+}
+
+func profileOnionHost(store *dht.Store, address common.Address) string {
+	profile, err := store.Profile(address, dht.DefaultLookupTimeout)
+	if err != nil || profile.Verify() != nil || len(profile.OnionHosts) == 0 {
+		return ""
+	}
+	return profile.OnionHosts[0]
+}
+func (in *Interface) RingPing(onionAddress string) bool { return false }
 func (i *Interface) RingCast(username, body string) bool {
 	message := types.NewMessage(username, body)
 	if body != "" {
 		log.Println("[", message.Timestamp, "] ", message.Username, " : ", message.Body)
-		i.p2p.Broadcast <- message
+		i.active().p2p.Broadcast <- message
 	}
 	return true
 }
 
 // DHT INTERFACE
-func (ohtInterface *Interface) Put(key string, value string) (successful bool) {
-	return
+func (i *Interface) Put(key string, value string) (successful bool) {
+	return (i.active().dht.Put(key, []byte(value)) == nil)
+}
+func (i *Interface) Get(key string) (value string) {
+	result, err := i.active().dht.Lookup(key, dht.DefaultLookupTimeout)
+	if err != nil {
+		return ""
+	}
+	return string(result)
+}
+func (i *Interface) Delete(key string) (value string) {
+	value = i.Get(key)
+	i.active().dht.Delete(key)
+	return value
+}
+
+// NAME INTERFACE
+// ResolveName finds the onion host registered for an oht name, names the
+// user set in names.json take precedence over names registered in the DHT.
+func (i *Interface) ResolveName(name string) (onionHost string, err error) {
+	if onionHost, err = i.names.ResolveName(name); err == nil {
+		return onionHost, nil
+	}
+	record, err := lookupName(i.active().dht, name)
+	if err != nil {
+		return "", err
+	}
+	return record.OnionHost, nil
+}
+
+// RegisterName claims a free name for an account, pointing it at this
+// node's onion host. Registering a name the account already owns renews it.
+func (i *Interface) RegisterName(account, passphrase, name string) error {
+	return i.publishName(account, passphrase, name, false, nil)
+}
+
+// RenewName extends the expiry of a name the account owns and updates its
+// onion host.
+func (i *Interface) RenewName(account, passphrase, name string) error {
+	return i.publishName(account, passphrase, name, true, nil)
+}
+
+// TransferName hands a name the account owns to newOwner, who renews it
+// from then on.
+func (i *Interface) TransferName(account, passphrase, name, newOwner string) error {
+	owner := common.HexToAddress(newOwner)
+	return i.publishName(account, passphrase, name, true, &owner)
+}
+
+func lookupName(store *dht.Store, name string) (*dht.NameRecord, error) {
+	if !dht.ValidName(name) {
+		return nil, dht.ErrInvalidName
+	}
+	value, err := store.Lookup(dht.NameKey(name), dht.DefaultLookupTimeout)
+	if err != nil {
+		return nil, network.ErrNameNotFound
+	}
+	return dht.DecodeNameRecord(value)
+}
+
+func (i *Interface) publishName(account, passphrase, name string, registered bool, newOwner *common.Address) error {
+	if !dht.ValidName(name) {
+		return dht.ErrInvalidName
+	}
+	key, err := i.identityKey(account, passphrase)
+	if err != nil {
+		return err
+	}
+	identity := i.active()
+	record := &dht.NameRecord{Name: name, Owner: key.Address}
+	if current, err := lookupName(identity.dht, name); err == nil {
+		if current.Owner != key.Address {
+			return dht.ErrNameTaken
+		}
+		record.Sequence = current.Sequence + 1
+	} else if registered {
+		return network.ErrNameNotFound
+	}
+	if newOwner != nil {
+		record.Owner, record.PreviousOwner = *newOwner, &key.Address
+	}
+	record.OnionHost = i.onionHost(identity)
+	record.Expires = time.Now().Add(dht.MaxNameTTL).Unix()
+	if err := record.Sign(key); err != nil {
+		return err
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return identity.dht.Put(dht.NameKey(name), value)
+}
+func (i *Interface) NameProxyOnline() bool {
+	return i.nameProxy.Online
+}
+func (i *Interface) NameProxyStart() bool {
+	if i.tor.Online {
+		err := i.nameProxy.Start()
+		return (err == nil)
+	} else {
+		return false
+	}
 }
-func (ohtInterface *Interface) Get(key string) (value string) {
-	return
+func (i *Interface) NameProxyStop() bool {
+	return i.nameProxy.Stop()
 }
-func (ohtInterface *Interface) Delete(key string) (value string) {
-	return
+func (i *Interface) NameProxyPort() string {
+	return i.config.TorConfig.NameProxyPort
 }
 
 // WEB UI INTERFACE
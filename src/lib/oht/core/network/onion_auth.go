@@ -0,0 +1,369 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Onion service v3 client authorization, see "CLIENT AUTHORIZATION" in
+// tor(1). The service side lists the x25519 public key of every client
+// allowed to fetch its descriptor, the client holds the private key.
+
+var (
+	errOnionAuthKey        = errors.New("Tor: Invalid onion client authorization key")
+	errOnionAuthClientName = errors.New("Tor: Invalid onion client authorization name")
+	errOnionServicePublic  = errors.New("Tor: Clients are only authorized on private onion services, peers reach the node's own services without a key")
+	onionAuthClientName    = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+	onionAuthEncoding      = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type OnionAuthKey struct {
+	PublicKey  [32]byte
+	PrivateKey [32]byte
+}
+
+func GenerateOnionAuthKey(random io.Reader) (*OnionAuthKey, error) {
+	key := &OnionAuthKey{}
+	if _, err := io.ReadFull(random, key.PrivateKey[:]); err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(key.PrivateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(key.PublicKey[:], publicKey)
+	return key, nil
+}
+
+func (key *OnionAuthKey) PublicKeyBase32() string {
+	return onionAuthEncoding.EncodeToString(key.PublicKey[:])
+}
+
+func (key *OnionAuthKey) PrivateKeyBase32() string {
+	return onionAuthEncoding.EncodeToString(key.PrivateKey[:])
+}
+
+func decodeOnionAuthKey(encoded string) ([]byte, error) {
+	key, err := onionAuthEncoding.DecodeString(strings.ToUpper(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errOnionAuthKey
+	}
+	return key, nil
+}
+
+func onionServiceId(onionHost string) string {
+	return strings.TrimSuffix(strings.ToLower(onionHost), ".onion")
+}
+
+// privateServicesFile keeps the private onion services with their keys and
+// authorized clients, Tor forgets them whenever it stops.
+const privateServicesFile = "private_services.json"
+
+// AddPrivateService adds an onion service only authorized clients can
+// reach. Unlike the node's own services, which peers reach without a key,
+// it is added over the control port so clients are authorized and revoked
+// without restarting Tor. Tor generates its key while running, the service
+// is only published once it has a client.
+func (tor *TorProcess) AddPrivateService(directoryName, remotePort, localPort string) (onionHost string, err error) {
+	if !onionAuthClientName.MatchString(directoryName) {
+		return "", fmt.Errorf("Tor: Invalid onion service name %q", directoryName)
+	}
+	if err = validatePort(remotePort); err != nil {
+		return "", err
+	}
+	if err = validatePort(localPort); err != nil {
+		return "", err
+	}
+	tor.mutex.Lock()
+	err = tor.privateServiceUnused(directoryName, localPort)
+	tor.mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+	// The key is requested with a client no one holds, and the service taken
+	// down again right away, so it is never reachable without a key
+	placeholder, err := GenerateOnionAuthKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	onionHost, serviceKey, err := tor.AddOnion("", remotePort, localPort, []string{placeholder.PublicKeyBase32()})
+	if err != nil {
+		return "", err
+	}
+	if err = tor.DeleteOnion(onionHost); err != nil {
+		return "", err
+	}
+	tor.mutex.Lock()
+	defer tor.mutex.Unlock()
+	if err = tor.privateServiceUnused(directoryName, localPort); err != nil {
+		return "", err
+	}
+	tor.privateServices = append(tor.privateServices, &OnionServiceConfig{
+		DirectoryName:    directoryName,
+		OnionHost:        onionHost,
+		RemoteListenPort: remotePort,
+		LocalListenPort:  localPort,
+		Private:          true,
+		ServiceKey:       serviceKey,
+	})
+	return onionHost, tor.savePrivateServices()
+}
+
+// privateServiceUnused checks that neither the name nor the local port of a
+// new private service are taken. The caller must hold tor.mutex.
+func (tor *TorProcess) privateServiceUnused(directoryName, localPort string) error {
+	if tor.onionServiceConfig(directoryName) != nil || tor.privateService(directoryName) != nil {
+		return fmt.Errorf("Tor: Onion service %s already exists", directoryName)
+	}
+	for _, onionServices := range [][]*OnionServiceConfig{tor.OnionServiceConfigs, tor.privateServices} {
+		for _, onionService := range onionServices {
+			if onionService.LocalListenPort == localPort {
+				return fmt.Errorf("%v: %q", errTorDuplicatePort, localPort)
+			}
+		}
+	}
+	return nil
+}
+
+// PrivateServices is a snapshot of the private onion services.
+func (tor *TorProcess) PrivateServices() (onionServices []OnionServiceConfig) {
+	tor.mutex.Lock()
+	defer tor.mutex.Unlock()
+	for _, onionService := range tor.privateServices {
+		snapshot := *onionService
+		snapshot.AuthorizedClients = make(map[string]string, len(onionService.AuthorizedClients))
+		for clientName, publicKey := range onionService.AuthorizedClients {
+			snapshot.AuthorizedClients[clientName] = publicKey
+		}
+		onionServices = append(onionServices, snapshot)
+	}
+	return onionServices
+}
+
+// AuthorizeClient adds a client to a private onion service. The returned
+// private key is what the client needs in its ClientOnionAuthDir, and is
+// not stored by the service. The node's own services are refused, peers
+// without a key could no longer reach them.
+func (tor *TorProcess) AuthorizeClient(directoryName, clientName string) (*OnionAuthKey, error) {
+	if !onionAuthClientName.MatchString(clientName) {
+		return nil, errOnionAuthClientName
+	}
+	tor.mutex.Lock()
+	onionService, err := tor.authorizableService(directoryName)
+	if err != nil {
+		tor.mutex.Unlock()
+		return nil, err
+	}
+	key, err := GenerateOnionAuthKey(rand.Reader)
+	if err != nil {
+		tor.mutex.Unlock()
+		return nil, err
+	}
+	if onionService.AuthorizedClients == nil {
+		onionService.AuthorizedClients = make(map[string]string)
+	}
+	onionService.AuthorizedClients[clientName] = key.PublicKeyBase32()
+	err = tor.savePrivateServices()
+	tor.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return key, tor.publishPrivateService(onionService)
+}
+
+// RevokeClient removes a client from a private onion service, it can no
+// longer fetch the service descriptor from then on.
+func (tor *TorProcess) RevokeClient(directoryName, clientName string) error {
+	tor.mutex.Lock()
+	onionService, err := tor.authorizableService(directoryName)
+	if err != nil {
+		tor.mutex.Unlock()
+		return err
+	}
+	delete(onionService.AuthorizedClients, clientName)
+	err = tor.savePrivateServices()
+	tor.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return tor.publishPrivateService(onionService)
+}
+
+// authorizableService finds the private onion service clients are
+// authorized on. The caller must hold tor.mutex.
+func (tor *TorProcess) authorizableService(directoryName string) (*OnionServiceConfig, error) {
+	if onionService := tor.privateService(directoryName); onionService != nil {
+		return onionService, nil
+	}
+	if tor.onionServiceConfig(directoryName) != nil {
+		return nil, errOnionServicePublic
+	}
+	return nil, fmt.Errorf("Tor: No onion service with directory %q", directoryName)
+}
+
+func (tor *TorProcess) onionServiceConfig(directoryName string) *OnionServiceConfig {
+	for _, onionService := range tor.OnionServiceConfigs {
+		if onionService.DirectoryName == directoryName {
+			return onionService
+		}
+	}
+	return nil
+}
+
+func (tor *TorProcess) privateService(directoryName string) *OnionServiceConfig {
+	for _, onionService := range tor.privateServices {
+		if onionService.DirectoryName == directoryName {
+			return onionService
+		}
+	}
+	return nil
+}
+
+// publishPrivateService adds a private onion service again with its current
+// clients, Tor can not change the clients of a service it runs. A service
+// left without clients stays down. While Tor is offline nothing is done,
+// the service is published once Tor is running again.
+func (tor *TorProcess) publishPrivateService(onionService *OnionServiceConfig) error {
+	tor.publishMutex.Lock()
+	defer tor.publishMutex.Unlock()
+	tor.mutex.Lock()
+	serviceKey, onionHost := onionService.ServiceKey, onionService.OnionHost
+	remotePort, localPort := onionService.RemoteListenPort, onionService.LocalListenPort
+	var authorizedClients []string
+	for _, publicKey := range onionService.AuthorizedClients {
+		authorizedClients = append(authorizedClients, publicKey)
+	}
+	tor.mutex.Unlock()
+	// Fails after a restart of Tor, which drops what the control port added
+	tor.DeleteOnion(onionHost)
+	if len(authorizedClients) == 0 {
+		return nil
+	}
+	_, _, err := tor.AddOnion(serviceKey, remotePort, localPort, authorizedClients)
+	if err != errTorControlOffline {
+		return err
+	}
+	return nil
+}
+
+// publishPrivateServices publishes the private onion services once Tor has
+// started.
+func (tor *TorProcess) publishPrivateServices() {
+	tor.mutex.Lock()
+	onionServices := append([]*OnionServiceConfig(nil), tor.privateServices...)
+	tor.mutex.Unlock()
+	for _, onionService := range onionServices {
+		if err := tor.publishPrivateService(onionService); err != nil {
+			log.Println("Tor: Failed to publish private onion service", onionService.DirectoryName+":", err)
+		}
+	}
+}
+
+// loadPrivateServices reads the private onion services added in an earlier
+// run.
+func (tor *TorProcess) loadPrivateServices() error {
+	data, err := ioutil.ReadFile(common.AbsolutePath(tor.torRC.directory, privateServicesFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &tor.privateServices)
+}
+
+// savePrivateServices writes private_services.json, the caller must hold
+// tor.mutex.
+func (tor *TorProcess) savePrivateServices() error {
+	data, err := json.MarshalIndent(tor.privateServices, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(common.AbsolutePath(tor.torRC.directory, privateServicesFile), data, 0600)
+}
+
+// AddClientAuth stores the private key a remote service issued to us so Tor
+// can fetch its descriptor. It is written to ClientOnionAuthDir, which Tor
+// rereads whenever it needs the key, and registered over the control port
+// when Tor is already running.
+func (tor *TorProcess) AddClientAuth(onionHost, privateKey string) error {
+	serviceId := onionServiceId(onionHost)
+	if _, err := decodeOnionAuthKey(privateKey); err != nil {
+		return err
+	}
+	auth := fmt.Sprintf("%s:descriptor:x25519:%s\n", serviceId, strings.ToUpper(privateKey))
+	path := filepath.Join(tor.torRC.clientOnionAuthDirectory, (serviceId + ".auth_private"))
+	if err := ioutil.WriteFile(path, []byte(auth), 0600); err != nil {
+		return err
+	}
+	// Tor reads the file itself when it is started later
+	if _, err := tor.controlRequest(fmt.Sprintf("ONION_CLIENT_AUTH_ADD %s x25519:%s", serviceId, strings.ToUpper(privateKey))); err != errTorControlOffline {
+		return err
+	}
+	return nil
+}
+
+func (tor *TorProcess) RemoveClientAuth(onionHost string) error {
+	serviceId := onionServiceId(onionHost)
+	err := os.Remove(filepath.Join(tor.torRC.clientOnionAuthDirectory, (serviceId + ".auth_private")))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := tor.controlRequest("ONION_CLIENT_AUTH_REMOVE " + serviceId); err != errTorControlOffline {
+		return err
+	}
+	return nil
+}
+
+// AddOnion creates an ephemeral onion service over the control port that
+// lives as long as the Tor process. When authorizedClients holds base32
+// x25519 public keys only those clients can connect. An empty privateKey
+// lets Tor generate a new ED25519-V3 key, which is returned so the address
+// can be kept across restarts.
+func (tor *TorProcess) AddOnion(privateKey, remotePort, localPort string, authorizedClients []string) (onionHost, onionPrivateKey string, err error) {
+	if err = validatePort(remotePort); err != nil {
+		return "", "", err
+	}
+	if err = validatePort(localPort); err != nil {
+		return "", "", err
+	}
+	keyArgument := "NEW:ED25519-V3"
+	if privateKey != "" {
+		keyArgument = privateKey
+	}
+	// Detach keeps the service once the control connection is closed
+	command := fmt.Sprintf("ADD_ONION %s Flags=Detach Port=%s,127.0.0.1:%s", keyArgument, remotePort, localPort)
+	for _, publicKey := range authorizedClients {
+		if _, err = decodeOnionAuthKey(publicKey); err != nil {
+			return "", "", err
+		}
+		command += " ClientAuthV3=" + strings.ToUpper(publicKey)
+	}
+	reply, err := tor.controlRequest(command)
+	if err != nil {
+		return "", "", err
+	}
+	onionPrivateKey = controlReplyValue(reply, "PrivateKey")
+	if onionPrivateKey == "" {
+		onionPrivateKey = privateKey
+	}
+	return (controlReplyValue(reply, "ServiceID") + ".onion"), onionPrivateKey, nil
+}
+
+func (tor *TorProcess) DeleteOnion(onionHost string) error {
+	_, err := tor.controlRequest("DEL_ONION " + onionServiceId(onionHost))
+	return err
+}
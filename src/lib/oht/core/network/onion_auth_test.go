@@ -0,0 +1,129 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testServiceId = "abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz234567"
+
+// fakeControlPort answers the control port commands of tor like Tor does,
+// and returns what it was sent besides authenticating.
+func fakeControlPort(t *testing.T, tor *TorProcess) (sent func() []string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	var mutex sync.Mutex
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				command := scanner.Text()
+				switch {
+				case strings.HasPrefix(command, "AUTHENTICATE"):
+					fmt.Fprintf(conn, "250 OK\r\n")
+				case command == "QUIT":
+					fmt.Fprintf(conn, "250 closing connection\r\n")
+					conn.Close()
+				case strings.HasPrefix(command, "ADD_ONION"):
+					fmt.Fprintf(conn, "250-ServiceID=%s\r\n250-PrivateKey=ED25519-V3:c2VydmljZWtleQ==\r\n250 OK\r\n", testServiceId)
+				default:
+					fmt.Fprintf(conn, "250 OK\r\n")
+				}
+				if !strings.HasPrefix(command, "AUTHENTICATE") && command != "QUIT" {
+					mutex.Lock()
+					commands = append(commands, command)
+					mutex.Unlock()
+				}
+			}
+		}
+	}()
+	tor.mutex.Lock()
+	tor.Online, tor.authCookie = true, "cookie"
+	tor.torRC.ControlPort = strings.TrimPrefix(listener.Addr().String(), "127.0.0.1:")
+	tor.mutex.Unlock()
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent := commands
+		commands = nil
+		return sent
+	}, func() { listener.Close() }
+}
+
+func TestPrivateServiceClients(t *testing.T) {
+	onionService := func() *OnionServiceConfig {
+		return &OnionServiceConfig{DirectoryName: "onion_service", RemoteListenPort: "9042", LocalListenPort: "9043"}
+	}
+	tor, directory := newTestTor(t, &InitializeConfig{OnionServiceConfigs: []*OnionServiceConfig{onionService()}})
+	defer os.RemoveAll(directory)
+	if _, err := tor.AddPrivateService("channel", "80", "9044"); err != errTorControlOffline {
+		t.Errorf("expected %v while Tor is offline, got %v", errTorControlOffline, err)
+	}
+	sent, stop := fakeControlPort(t, tor)
+	defer stop()
+
+	// Peers reach the node's own service without a key
+	if _, err := tor.AuthorizeClient("onion_service", "alice"); err != errOnionServicePublic {
+		t.Errorf("expected %v, got %v", errOnionServicePublic, err)
+	}
+	onionHost, err := tor.AddPrivateService("channel", "80", "9044")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onionHost != testServiceId+".onion" {
+		t.Errorf("expected the onion host Tor generated, got %q", onionHost)
+	}
+	commands := sent()
+	if len(commands) != 2 || !strings.HasPrefix(commands[0], "ADD_ONION NEW:ED25519-V3 Flags=Detach Port=80,127.0.0.1:9044 ClientAuthV3=") || commands[1] != "DEL_ONION "+testServiceId {
+		t.Errorf("expected the service to be created and taken down, got %q", commands)
+	}
+	if _, err := tor.AddPrivateService("other", "80", "9043"); err == nil {
+		t.Error("expected the local port of the node's service to be refused")
+	}
+
+	key, err := tor.AuthorizeClient("channel", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"DEL_ONION " + testServiceId, "ADD_ONION ED25519-V3:c2VydmljZWtleQ== Flags=Detach Port=80,127.0.0.1:9044 ClientAuthV3=" + strings.ToUpper(key.PublicKeyBase32())}
+	if commands := sent(); fmt.Sprint(commands) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, commands)
+	}
+	if err := tor.RevokeClient("channel", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if commands := sent(); len(commands) != 1 || commands[0] != "DEL_ONION "+testServiceId {
+		t.Errorf("expected the service without clients to stay down, got %q", commands)
+	}
+	bob, err := tor.AuthorizeClient("channel", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new process starts without the private services
+	restarted := InitializeTor(&InitializeConfig{
+		Directory:           directory,
+		SocksPort:           "9142",
+		ControlPort:         "9555",
+		OnionServiceConfigs: []*OnionServiceConfig{onionService()},
+	})
+	privateServices := restarted.PrivateServices()
+	if len(privateServices) != 1 {
+		t.Fatalf("expected the private service to be loaded, got %+v", privateServices)
+	}
+	if channel := privateServices[0]; channel.OnionHost != onionHost || channel.ServiceKey != "ED25519-V3:c2VydmljZWtleQ==" || len(channel.AuthorizedClients) != 1 || channel.AuthorizedClients["bob"] != bob.PublicKeyBase32() {
+		t.Errorf("expected the service with its key and clients, got %+v", channel)
+	}
+}
@@ -0,0 +1,41 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	proxy "github.com/multiverse-os/libs/oht/core/network"
+)
+
+// Isolation decides which outbound connections may share a Tor circuit.
+// Streams are tagged with SOCKS credentials derived from the isolation scope,
+// Tor keeps streams with different credentials on different circuits.
+type Isolation int
+
+const (
+	IsolateNone Isolation = iota
+	IsolatePeer
+	IsolateChannel
+	IsolateAccount
+)
+
+var isolationScopes = map[Isolation]string{
+	IsolatePeer:    "peer",
+	IsolateChannel: "channel",
+	IsolateAccount: "account",
+}
+
+// IsolationAuth returns the SOCKS credentials that isolate the circuits used
+// for id, a peer onion host, a channel id or an account address depending on
+// the scope. The id is hashed so it never reaches the proxy in the clear.
+func IsolationAuth(isolation Isolation, id string) *proxy.ProxyAuth {
+	scope, ok := isolationScopes[isolation]
+	if !ok || id == "" {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(scope + ":" + id))
+	return &proxy.ProxyAuth{
+		Username: ("oht-" + scope),
+		Password: hex.EncodeToString(hash[:]),
+	}
+}
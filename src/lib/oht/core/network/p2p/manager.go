@@ -4,13 +4,29 @@ import (
 	"crypto/ecdsa"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"sync"
 	"time"
+
+	"github.com/gorilla/websocket"
+
+	proxy "github.com/multiverse-os/libs/oht/core/network"
 )
 
 type P2PConfig struct {
 	MaxPeers        int
 	MaxPendingPeers int
 	MaxQueueSize    int
+	SocksPort       string
+	// ListenPort is the port onion services accept peer connections on
+	ListenPort string
+	// Isolation is applied to connections made with ConnectToPeer, callers
+	// that need channel or account isolation use ConnectToPeerIsolated.
+	Isolation Isolation
+	// Account scopes every connection of the manager to an account, so the
+	// circuits of accounts sharing a Tor process are never shared.
+	Account string `json:",omitempty"`
 }
 
 type Server struct {
@@ -34,9 +50,15 @@ type Manager struct {
 	Receive         chan Message
 	Register        chan *Peer
 	Unregister      chan *Peer
+	Reconnect       chan bool
 	OnConnect       EventFunc
 	OnClose         EventFunc
 	LastActivity    time.Time
+	handlers        map[string]MessageHandler
+	handlersMutex   sync.RWMutex
+	// onionPeers indexes the connected peers that were dialed by onion host
+	onionPeers map[string]*Peer
+	peersMutex sync.RWMutex
 }
 
 func InitializeP2PManager(config *P2PConfig) *Manager {
@@ -49,10 +71,13 @@ func InitializeP2PManager(config *P2PConfig) *Manager {
 		Receive:         make(chan Message, config.MaxQueueSize),
 		Register:        make(chan *Peer, config.MaxQueueSize),
 		Unregister:      make(chan *Peer, config.MaxQueueSize),
+		Reconnect:       make(chan bool, 1),
 		Peers:           make(map[*Peer]bool, config.MaxQueueSize),
 		OnConnect:       nil,
 		OnClose:         nil,
 		LastActivity:    time.Now(),
+		handlers:        make(map[string]MessageHandler),
+		onionPeers:      make(map[string]*Peer),
 	}
 }
 
@@ -61,6 +86,7 @@ func (manager *Manager) Start() {
 		select {
 		case p := <-manager.Register:
 			manager.Peers[p] = true
+			manager.indexPeer(p)
 			log.Println("P2P: Peer connection established: ", p.Config.OnionHost)
 			fmt.Printf("oht> ")
 			if manager.OnConnect != nil {
@@ -69,6 +95,7 @@ func (manager *Manager) Start() {
 		case p := <-manager.Unregister:
 			if _, ok := manager.Peers[p]; ok {
 				delete(manager.Peers, p)
+				manager.unindexPeer(p)
 				close(p.Send)
 				if manager.OnClose != nil {
 					go manager.OnClose(manager, p)
@@ -77,14 +104,38 @@ func (manager *Manager) Start() {
 			}
 		case m := <-manager.Broadcast:
 			for p := range manager.Peers {
+				if (m.To != nil && p != m.To) || p == m.From {
+					continue
+				}
 				select {
 				case p.Send <- m:
 				default:
 					close(p.Send)
 					delete(manager.Peers, p)
+					manager.unindexPeer(p)
+				}
+			}
+		case <-manager.Reconnect:
+			// Existing connections were routed through a Tor process that is
+			// gone, drop them and dial every peer again.
+			for p := range manager.Peers {
+				delete(manager.Peers, p)
+				manager.unindexPeer(p)
+				close(p.Send)
+				p.WebSocket.Close()
+				if p.Config.OnionHost != "" {
+					go manager.ConnectToPeerIsolated(p.Config.OnionHost, p.Config.ListenPort, p.Isolation)
 				}
 			}
 		case m := <-manager.Receive:
+			manager.LastActivity = time.Now()
+			manager.handlersMutex.RLock()
+			handler, ok := manager.handlers[m.Type]
+			manager.handlersMutex.RUnlock()
+			if ok {
+				go handler(manager, m)
+				continue
+			}
 			fmt.Println("")
 			fmt.Println("[", m.Timestamp, "] ", m.Username, " : ", m.Body)
 			fmt.Printf("oht> ")
@@ -95,6 +146,168 @@ func (manager *Manager) Start() {
 func (manager *Manager) Stop() {
 }
 
+// Handle registers the handler for messages of messageType. Messages without
+// a handler are printed to the console as chat.
+func (manager *Manager) Handle(messageType string, handler MessageHandler) {
+	manager.handlersMutex.Lock()
+	defer manager.handlersMutex.Unlock()
+	manager.handlers[messageType] = handler
+}
+
+// Relay forwards a received message to every connected peer except the one
+// it came from.
+func (manager *Manager) Relay(message Message) {
+	message.To = nil
+	manager.Broadcast <- message
+}
+
+// SendTo queues a message for a single peer, it is dropped when the peer is
+// no longer connected.
+func (manager *Manager) SendTo(p *Peer, message Message) {
+	message.To = p
+	manager.Broadcast <- message
+}
+
+func (manager *Manager) ConnectToPeer(onionHost, port string) bool {
+	return manager.ConnectToPeerIsolated(onionHost, port, manager.isolationAuth(onionHost))
+}
+
+// ConnectToPeerIsolated connects to a peer over a circuit selected by auth,
+// see IsolationAuth. A nil auth shares circuits with other anonymous streams.
+func (manager *Manager) ConnectToPeerIsolated(onionHost, port string, auth *proxy.ProxyAuth) bool {
+	_, err := manager.connect(onionHost, port, auth)
+	return (err == nil)
+}
+
+// SendToOnionHost delivers a message to the peer at onionHost, connecting
+// to it first when it is not connected yet.
+func (manager *Manager) SendToOnionHost(onionHost, port string, message Message) error {
+	manager.peersMutex.RLock()
+	p, ok := manager.onionPeers[onionHost]
+	manager.peersMutex.RUnlock()
+	if ok {
+		manager.SendTo(p, message)
+		return nil
+	}
+	_, err := manager.connect(onionHost, port, manager.isolationAuth(onionHost), message)
+	return err
+}
+
+// OnionHosts lists the onion hosts of the connected peers this node dialed.
+func (manager *Manager) OnionHosts() (onionHosts []string) {
+	manager.peersMutex.RLock()
+	defer manager.peersMutex.RUnlock()
+	for onionHost := range manager.onionPeers {
+		onionHosts = append(onionHosts, onionHost)
+	}
+	return onionHosts
+}
+
+func (manager *Manager) isolationAuth(onionHost string) *proxy.ProxyAuth {
+	if manager.Config.Isolation == IsolatePeer {
+		return IsolationAuth(IsolatePeer, onionHost)
+	}
+	return nil
+}
+
+// accountAuth scopes auth to the account of the manager. Without an auth
+// the connection still gets the circuits of the account, with one it gets
+// circuits that are isolated within the account as well.
+func (manager *Manager) accountAuth(auth *proxy.ProxyAuth) *proxy.ProxyAuth {
+	if manager.Config.Account == "" {
+		return auth
+	}
+	if auth == nil {
+		return IsolationAuth(IsolateAccount, manager.Config.Account)
+	}
+	return IsolationAuth(IsolateAccount, (manager.Config.Account + ":" + auth.Username + ":" + auth.Password))
+}
+
+// connect dials a peer and registers it. The queued messages are sent as
+// soon as the connection is up, before anything broadcast afterwards.
+func (manager *Manager) connect(onionHost, port string, auth *proxy.ProxyAuth, queued ...Message) (*Peer, error) {
+	d := websocket.Dialer{
+		NetDial:          proxy.DialProxyIsolated(("127.0.0.1:" + manager.Config.SocksPort), manager.accountAuth(auth)),
+		HandshakeTimeout: 15 * time.Second,
+	}
+	ws, _, err := d.Dial(("ws://" + onionHost + ":" + port + "/"), nil)
+	if err != nil {
+		log.Println("P2P: Failed to connect to peer: ", onionHost, err)
+		return nil, err
+	}
+	p := &Peer{
+		Config:    &OnionServiceConfig{OnionHost: onionHost, ListenPort: port},
+		Connected: 1,
+		WebSocket: ws,
+		Manager:   manager,
+		Send:      make(chan Message, (manager.MaxQueueSize + len(queued))),
+		Isolation: auth,
+	}
+	for _, message := range queued {
+		p.Send <- message
+	}
+	manager.Register <- p
+	go p.writeMessages()
+	go p.readMessages()
+	return p, nil
+}
+
+// Listen accepts connections from peers on host, the local end of the
+// node's onion service.
+func (manager *Manager) Listen(host string) error {
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		return err
+	}
+	go http.Serve(listener, http.HandlerFunc(manager.acceptPeer))
+	return nil
+}
+
+func (manager *Manager) acceptPeer(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	// Inbound peers are anonymous, their onion host is only known from
+	// what they send.
+	p := &Peer{
+		Config:    &OnionServiceConfig{},
+		Connected: 1,
+		WebSocket: ws,
+		Manager:   manager,
+		Send:      make(chan Message, manager.MaxQueueSize),
+	}
+	manager.Register <- p
+	go p.writeMessages()
+	go p.readMessages()
+}
+
+func (manager *Manager) indexPeer(p *Peer) {
+	if p.Config.OnionHost == "" {
+		return
+	}
+	manager.peersMutex.Lock()
+	defer manager.peersMutex.Unlock()
+	manager.onionPeers[p.Config.OnionHost] = p
+}
+
+func (manager *Manager) unindexPeer(p *Peer) {
+	manager.peersMutex.Lock()
+	defer manager.peersMutex.Unlock()
+	if manager.onionPeers[p.Config.OnionHost] == p {
+		delete(manager.onionPeers, p.Config.OnionHost)
+	}
+}
+
+// RequestReconnect asks the manager to re-dial all peers, it never blocks
+// and coalesces repeated requests.
+func (manager *Manager) RequestReconnect() {
+	select {
+	case manager.Reconnect <- true:
+	default:
+	}
+}
+
 //func (manager *Manager) DumpPeers() {
 //	for p := range manager.Peers {
 //		log.Println("Active Peers")
@@ -3,13 +3,21 @@ package network
 import (
 	"net/url"
 	"time"
+
+	"github.com/pborman/uuid"
 )
 
 const (
-	pongWait   = 60 * time.Second
-	pingPeriod = (pongWait * 9) / 10
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxMessageSize = 1 << 20
 )
 
+// MessageHandler processes a received message of the type it was
+// registered for with Manager.Handle.
+type MessageHandler func(manager *Manager, message Message)
+
 type Message struct {
 	SubProtocol string
 	Id          string
@@ -18,4 +26,18 @@ type Message struct {
 	Timestamp   int64  `json:",omitempty"`
 	Username    string `json:",omitempty"`
 	Body        string `json:",omitempty"`
+	// From is the peer the message was received from, nil for messages
+	// created locally.
+	From *Peer `json:"-"`
+	// To limits a message passed to Manager.Broadcast to a single peer.
+	To *Peer `json:"-"`
+}
+
+func NewMessage(messageType, body string) Message {
+	return Message{
+		Id:        uuid.New(),
+		Type:      messageType,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Body:      body,
+	}
 }
@@ -1,7 +1,11 @@
 package network
 
 import (
+	"time"
+
 	"github.com/gorilla/websocket"
+
+	proxy "github.com/multiverse-os/libs/oht/core/network"
 )
 
 type OnionServiceConfig struct {
@@ -19,6 +23,9 @@ type Peer struct {
 	Manager   *Manager
 	Send      chan Message
 	Data      interface{}
+	// Isolation is the SOCKS auth the connection was dialed with, it is
+	// reused when the peer is dialed again.
+	Isolation *proxy.ProxyAuth
 }
 
 var upgrader = websocket.Upgrader{
@@ -27,15 +34,54 @@ var upgrader = websocket.Upgrader{
 }
 
 func (p *Peer) readMessages() {
+	defer func() {
+		p.Manager.Unregister <- p
+	}()
+	p.WebSocket.SetReadLimit(maxMessageSize)
+	p.WebSocket.SetReadDeadline(time.Now().Add(pongWait))
+	p.WebSocket.SetPongHandler(func(string) error {
+		p.WebSocket.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		var message Message
+		if err := p.WebSocket.ReadJSON(&message); err != nil {
+			break
+		}
+		message.From = p
+		p.Manager.Receive <- message
+	}
 }
 
 func (p *Peer) writeMessage(message Message) error {
-	return nil
+	p.WebSocket.SetWriteDeadline(time.Now().Add(writeWait))
+	return p.WebSocket.WriteJSON(message)
 }
 
 func (p *Peer) writeControl(messageType int) error {
-	return nil
+	return p.WebSocket.WriteControl(messageType, []byte{}, time.Now().Add(writeWait))
 }
 
 func (p *Peer) writeMessages() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		p.WebSocket.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-p.Send:
+			if !ok {
+				p.writeControl(websocket.CloseMessage)
+				return
+			}
+			if err := p.writeMessage(message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := p.writeControl(websocket.PingMessage); err != nil {
+				return
+			}
+		}
+	}
 }
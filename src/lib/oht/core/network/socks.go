@@ -5,8 +5,13 @@
 package network
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"time"
 )
 
 const (
@@ -15,124 +20,364 @@ const (
 	SOCKS5
 )
 
+// Used when the caller supplies no context deadline, long enough for Tor to
+// build a circuit to an onion service.
+const defaultSocksTimeout = 2 * time.Minute
+
+const (
+	socks5Version      = 5
+	socks5Connect      = 1
+	socks5AddressIPv4  = 1
+	socks5AddressName  = 3
+	socks5AddressIPv6  = 4
+	socks5NoAuth       = 0
+	socks5PasswordAuth = 2
+	socks5NoMethod     = 0xff
+)
+
+// SocksReply is the REP field of a SOCKS5 reply. Codes from 0xF0 are Tor
+// extensions, only sent when the SOCKSPort has the ExtendedErrors flag.
+type SocksReply byte
+
+const (
+	SocksSucceeded               SocksReply = 0x00
+	SocksGeneralFailure          SocksReply = 0x01
+	SocksNotAllowed              SocksReply = 0x02
+	SocksNetworkUnreachable      SocksReply = 0x03
+	SocksHostUnreachable         SocksReply = 0x04
+	SocksConnectionRefused       SocksReply = 0x05
+	SocksTTLExpired              SocksReply = 0x06
+	SocksCommandNotSupported     SocksReply = 0x07
+	SocksAddressNotSupported     SocksReply = 0x08
+	SocksOnionDescriptorNotFound SocksReply = 0xF0
+	SocksOnionDescriptorInvalid  SocksReply = 0xF1
+	SocksOnionIntroFailed        SocksReply = 0xF2
+	SocksOnionRendezvousFailed   SocksReply = 0xF3
+	SocksOnionMissingClientAuth  SocksReply = 0xF4
+	SocksOnionWrongClientAuth    SocksReply = 0xF5
+	SocksOnionBadAddress         SocksReply = 0xF6
+	SocksOnionIntroTimedOut      SocksReply = 0xF7
+)
+
+var socksReplyMessages = map[SocksReply]string{
+	SocksGeneralFailure:          "general SOCKS server failure",
+	SocksNotAllowed:              "connection not allowed by ruleset",
+	SocksNetworkUnreachable:      "network unreachable",
+	SocksHostUnreachable:         "host unreachable",
+	SocksConnectionRefused:       "connection refused",
+	SocksTTLExpired:              "TTL expired",
+	SocksCommandNotSupported:     "command not supported",
+	SocksAddressNotSupported:     "address type not supported",
+	SocksOnionDescriptorNotFound: "onion service descriptor can not be found",
+	SocksOnionDescriptorInvalid:  "onion service descriptor is invalid",
+	SocksOnionIntroFailed:        "onion service introduction failed",
+	SocksOnionRendezvousFailed:   "onion service rendezvous failed",
+	SocksOnionMissingClientAuth:  "onion service client authorization missing",
+	SocksOnionWrongClientAuth:    "onion service client authorization wrong",
+	SocksOnionBadAddress:         "onion service address is invalid",
+	SocksOnionIntroTimedOut:      "onion service introduction timed out",
+}
+
+// SocksError is returned when the proxy refuses a CONNECT request.
+type SocksError struct {
+	Reply SocksReply
+}
+
+func (e *SocksError) Error() string {
+	if message, ok := socksReplyMessages[e.Reply]; ok {
+		return "Proxy: " + message
+	}
+	return fmt.Sprintf("Proxy: Unknown SOCKS5 reply 0x%02x", byte(e.Reply))
+}
+
+// OnionServiceError reports whether the failure was specific to reaching an
+// onion service, as opposed to the proxy or the Tor network.
+func (e *SocksError) OnionServiceError() bool {
+	return e.Reply >= SocksOnionDescriptorNotFound && e.Reply <= SocksOnionIntroTimedOut
+}
+
+var (
+	errSocksBadVersion    = errors.New("Proxy: Server does not support Socks 5.")
+	errSocksNoMethod      = errors.New("Proxy: Negotiation failed.")
+	errSocksAuthFailed    = errors.New("Proxy: Authentication failed.")
+	errSocksBadReply      = errors.New("Proxy: Server did not respond correctly.")
+	errSocksHostTooLong   = errors.New("Proxy: Host name is longer than 255 bytes.")
+	errSocksAuthTooLong   = errors.New("Proxy: Username and password must be 1 to 255 bytes.")
+	errSocks4Unsupported  = errors.New("Proxy: SOCKS4 only supports IPv4 destinations.")
+	errSocksUnknownSocks4 = errors.New("Proxy: Socks connection request failed, unknown error.")
+)
+
+// ProxyAuth holds SOCKS5 username/password credentials (RFC 1929). Tor does
+// not check them, but with IsolateSOCKSAuth it never shares a circuit
+// between streams that used different credentials, which makes them an
+// isolation key.
+type ProxyAuth struct {
+	Username string
+	Password string
+}
+
 func DialProxy(socksType int, proxy string) func(string, string) (net.Conn, error) {
 	if socksType == SOCKS5 {
-		return func(_, targetAddr string) (conn net.Conn, err error) {
-			return dialSocks5(proxy, targetAddr)
-		}
+		return DialProxyIsolated(proxy, nil)
 	}
 	return func(_, targetAddr string) (conn net.Conn, err error) {
-		return dialSocks4(socksType, proxy, targetAddr)
+		ctx, cancel := context.WithTimeout(context.Background(), defaultSocksTimeout)
+		defer cancel()
+		return dialSocks4(ctx, socksType, proxy, targetAddr)
 	}
 }
 
-func dialSocks5(proxy, targetAddr string) (conn net.Conn, err error) {
-	conn, err = net.Dial("tcp", proxy)
+// DialProxyIsolated dials through a SOCKS5 proxy authenticating with auth,
+// a nil auth connects anonymously.
+func DialProxyIsolated(proxy string, auth *ProxyAuth) func(string, string) (net.Conn, error) {
+	dial := DialProxyContext(proxy, auth)
+	return func(network, targetAddr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultSocksTimeout)
+		defer cancel()
+		return dial(ctx, network, targetAddr)
+	}
+}
+
+// DialProxyContext returns a SOCKS5 dial function whose connection setup,
+// including the handshake with the proxy, is bounded by the context.
+func DialProxyContext(proxy string, auth *ProxyAuth) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, _, targetAddr string) (net.Conn, error) {
+		return dialSocks5(ctx, proxy, targetAddr, auth)
+	}
+}
+
+// dialProxyConn connects to the proxy and arranges for the connection
+// deadline to follow the context until the returned done func is called.
+func dialProxyConn(ctx context.Context, proxy string) (conn net.Conn, done func(), err error) {
+	var dialer net.Dialer
+	conn, err = dialer.DialContext(ctx, "tcp", proxy)
 	if err != nil {
-		return
+		return nil, nil, err
 	}
-	// version identifier/method selection request
-	req := []byte{
-		5, // version number
-		1, // number of methods
-		0, // method 0: no authentication (only anonymous access supported for now)
+	// The deadline is only moved once the context is done, rather than set
+	// from ctx.Deadline(), so ctx.Err() is always set when it expires.
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			// Unblock any read or write still in progress
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	done = func() {
+		close(stop)
+		<-finished
+	}
+	return conn, done, nil
+}
+
+func dialSocks5(ctx context.Context, proxy, targetAddr string, auth *ProxyAuth) (conn net.Conn, err error) {
+	host, port, err := splitHostPort(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, done, err := dialProxyConn(ctx, proxy)
+	if err != nil {
+		return nil, err
+	}
+	err = socks5Handshake(conn, host, port, auth)
+	done()
+	if ctx.Err() != nil {
+		err = ctx.Err()
 	}
-	resp, err := sendReceive(conn, req)
 	if err != nil {
-		return
-	} else if len(resp) != 2 {
-		err = errors.New("Proxy: Server did not respond correctly.")
-		return
-	} else if resp[0] != 5 {
-		err = errors.New("Proxy: Server does not support Socks 5.")
-		return
-	} else if resp[1] != 0 { // no auth
-		err = errors.New("Proxy: Negotiation failed.")
-		return
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, host string, port uint16, auth *ProxyAuth) (err error) {
+	// version identifier/method selection request
+	method := byte(socks5NoAuth)
+	if auth != nil {
+		method = socks5PasswordAuth
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return err
+	} else if resp[0] != socks5Version {
+		return errSocksBadVersion
+	} else if resp[1] == socks5NoMethod || resp[1] != method {
+		return errSocksNoMethod
+	}
+	if auth != nil {
+		if err = socks5Authenticate(conn, auth); err != nil {
+			return err
+		}
 	}
 	// detail request
-	host, port, err := splitHostPort(targetAddr)
-	req = []byte{
-		5,               // version number
-		1,               // connect command
-		0,               // reserved, must be zero
-		3,               // address type, 3 means domain name
-		byte(len(host)), // address length
-	}
-	req = append(req, []byte(host)...)
+	req := []byte{
+		socks5Version,
+		socks5Connect,
+		0, // reserved, must be zero
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errSocksHostTooLong
+		}
+		req = append(req, socks5AddressName, byte(len(host)))
+		req = append(req, []byte(host)...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddressIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddressIPv6)
+		req = append(req, ip.To16()...)
+	}
 	req = append(req, []byte{
 		byte(port >> 8), // higher byte of destination port
 		byte(port),      // lower byte of destination port (big endian)
 	}...)
-	resp, err = sendReceive(conn, req)
-	if err != nil {
-		return
-	} else if len(resp) != 10 {
-		err = errors.New("Proxy: Server did not respond correctly.")
-	} else if resp[1] != 0 {
-		err = errors.New("Proxy: Can't complete SOCKS5 connection.")
+	if _, err = conn.Write(req); err != nil {
+		return err
 	}
+	_, err = readSocks5Reply(conn)
+	return err
+}
 
-	return
+func socks5Authenticate(conn net.Conn, auth *ProxyAuth) error {
+	if len(auth.Username) == 0 || len(auth.Username) > 255 || len(auth.Password) > 255 {
+		return errSocksAuthTooLong
+	}
+	req := []byte{1, byte(len(auth.Username))} // subnegotiation version 1
+	req = append(req, []byte(auth.Username)...)
+	req = append(req, byte(len(auth.Password)))
+	req = append(req, []byte(auth.Password)...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	} else if resp[0] != 1 {
+		return errSocksBadReply
+	} else if resp[1] != 0 {
+		return errSocksAuthFailed
+	}
+	return nil
 }
 
-func dialSocks4(socksType int, proxy, targetAddr string) (conn net.Conn, err error) {
-	conn, err = net.Dial("tcp", proxy)
-	if err != nil {
-		return
+// readSocks5Reply reads a complete CONNECT reply, whatever the type of the
+// bound address, and returns that address.
+func readSocks5Reply(conn net.Conn) (boundAddr string, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", errSocksBadReply
+	}
+	// Tor closes the connection after an error reply, so only the header is
+	// guaranteed to be there.
+	if reply := SocksReply(header[1]); reply != SocksSucceeded {
+		return "", &SocksError{Reply: reply}
 	}
+	var host string
+	switch header[3] {
+	case socks5AddressIPv4, socks5AddressIPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == socks5AddressIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddressName:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err = io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errSocksBadReply
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
 
+func dialSocks4(ctx context.Context, socksType int, proxy, targetAddr string) (conn net.Conn, err error) {
 	host, port, err := splitHostPort(targetAddr)
 	if err != nil {
-		return
+		return nil, err
+	}
+	ip := net.IPv4(0, 0, 0, 1).To4() // special invalid IP address to indicate the host name is provided
+	if socksType == SOCKS4 {
+		if ip = net.ParseIP(host).To4(); ip == nil {
+			return nil, errSocks4Unsupported
+		}
 	}
-	ip := net.IPv4(0, 0, 0, 1).To4()
 	req := []byte{
 		4,                          // version number
 		1,                          // command CONNECT
 		byte(port >> 8),            // higher byte of destination port
 		byte(port),                 // lower byte of destination port (big endian)
-		ip[0], ip[1], ip[2], ip[3], // special invalid IP address to indicate the host name is provided
+		ip[0], ip[1], ip[2], ip[3], // destination address
 		0, // user id is empty, anonymous proxy only
 	}
 	if socksType == SOCKS4A {
 		req = append(req, []byte(host+"\x00")...)
 	}
-
-	resp, err := sendReceive(conn, req)
+	conn, done, err := dialProxyConn(ctx, proxy)
 	if err != nil {
-		return
-	} else if len(resp) != 8 {
-		err = errors.New("Proxy: Server did not respond correctly.")
-		return
-	}
-	switch resp[1] {
-	case 90:
-		// request granted
-	case 91:
-		err = errors.New("Proxy: Socks connection request rejected or failed.")
-	case 92:
-		err = errors.New("Proxy: Socks connection request rejected becasue SOCKS server cannot connect to identd on the client.")
-	case 93:
-		err = errors.New("Proxy: Socks connection request rejected because the client program and identd report different user-ids.")
-	default:
-		err = errors.New("Proxy: Socks connection request failed, unknown error.")
+		return nil, err
+	}
+	resp := make([]byte, 8)
+	if _, err = conn.Write(req); err == nil {
+		_, err = io.ReadFull(conn, resp)
+	}
+	done()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if err == nil {
+		switch resp[1] {
+		case 90:
+			// request granted
+		case 91:
+			err = errors.New("Proxy: Socks connection request rejected or failed.")
+		case 92:
+			err = errors.New("Proxy: Socks connection request rejected becasue SOCKS server cannot connect to identd on the client.")
+		case 93:
+			err = errors.New("Proxy: Socks connection request rejected because the client program and identd report different user-ids.")
+		default:
+			err = errSocksUnknownSocks4
+		}
 	}
-	return
-}
-
-func sendReceive(conn net.Conn, req []byte) (resp []byte, err error) {
-	_, err = conn.Write(req)
 	if err != nil {
-		return
+		conn.Close()
+		return nil, err
 	}
-	resp, err = readAll(conn)
-	return
+	return conn, nil
 }
 
-func readAll(conn net.Conn) (resp []byte, err error) {
-	resp = make([]byte, 1024)
-	n, err := conn.Read(resp)
-	resp = resp[:n]
+func splitHostPort(addr string) (host string, port uint16, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	portInt, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	port = uint16(portInt)
 	return
 }
@@ -0,0 +1,294 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NameSuffix is the pseudo top level domain of names resolved by oht.
+const NameSuffix = ".oht"
+
+var (
+	ErrNameNotFound      = errors.New("Name: Not found")
+	errSocksServerOnline = errors.New("Proxy: SOCKS server is already online")
+)
+
+// NameResolver maps an oht name, without the NameSuffix, to an onion host.
+type NameResolver interface {
+	ResolveName(name string) (onionHost string, err error)
+}
+
+// StaticResolver resolves names from a fixed map, such as the user's own
+// names file.
+type StaticResolver map[string]string
+
+func (r StaticResolver) ResolveName(name string) (string, error) {
+	if onionHost, ok := r[strings.ToLower(name)]; ok {
+		return onionHost, nil
+	}
+	return "", ErrNameNotFound
+}
+
+// LoadStaticResolver reads a JSON object of name to onion host, a missing
+// file is an empty resolver.
+func LoadStaticResolver(path string) (StaticResolver, error) {
+	resolver := make(StaticResolver)
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return resolver, nil
+		}
+		return nil, err
+	}
+	var names map[string]string
+	if err := json.Unmarshal(file, &names); err != nil {
+		return nil, err
+	}
+	for name, onionHost := range names {
+		resolver[strings.ToLower(name)] = onionHost
+	}
+	return resolver, nil
+}
+
+// SocksServer is a SOCKS5 server for other applications. Connections to
+// "name.oht" are resolved to the registered onion host and connections to
+// ".onion" hosts are passed through, both are forwarded over Tor. Anything
+// else is refused so the server can not be used to reach the clearnet.
+type SocksServer struct {
+	Online   bool
+	Host     string
+	TorProxy string
+	Resolver NameResolver
+	listener net.Listener
+	mutex    sync.Mutex
+}
+
+func InitializeSocksServer(host, torProxy string, resolver NameResolver) *SocksServer {
+	return &SocksServer{
+		Online:   false,
+		Host:     host,
+		TorProxy: torProxy,
+		Resolver: resolver,
+	}
+}
+
+func (server *SocksServer) Start() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.Online {
+		return errSocksServerOnline
+	}
+	listener, err := net.Listen("tcp", server.Host)
+	if err != nil {
+		return err
+	}
+	server.listener = listener
+	server.Online = true
+	go server.serve(listener)
+	return nil
+}
+
+func (server *SocksServer) Stop() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.Online {
+		server.listener.Close()
+		server.Online = false
+	}
+	return !server.Online
+}
+
+func (server *SocksServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *SocksServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(defaultSocksTimeout))
+	auth, err := acceptSocks5Greeting(conn)
+	if err != nil {
+		return
+	}
+	host, port, err := readSocks5Request(conn)
+	if err != nil {
+		if socksErr, ok := err.(*SocksError); ok {
+			writeSocks5Reply(conn, socksErr.Reply)
+		}
+		return
+	}
+	target, reply := server.resolve(host)
+	if reply != SocksSucceeded {
+		writeSocks5Reply(conn, reply)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSocksTimeout)
+	// The client's credentials are passed on so its own stream isolation
+	// still applies through oht.
+	upstream, err := dialSocks5(ctx, server.TorProxy, net.JoinHostPort(target, strconv.Itoa(int(port))), auth)
+	cancel()
+	if err != nil {
+		if socksErr, ok := err.(*SocksError); ok {
+			writeSocks5Reply(conn, socksErr.Reply)
+		} else {
+			writeSocks5Reply(conn, SocksGeneralFailure)
+		}
+		return
+	}
+	defer upstream.Close()
+	if err := writeSocks5Reply(conn, SocksSucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// resolve turns the requested host into an onion host, or the reply to
+// refuse the request with.
+func (server *SocksServer) resolve(host string) (onionHost string, reply SocksReply) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case strings.HasSuffix(host, ".onion"):
+		return host, SocksSucceeded
+	case strings.HasSuffix(host, NameSuffix) && server.Resolver != nil:
+		onionHost, err := server.Resolver.ResolveName(strings.TrimSuffix(host, NameSuffix))
+		if err != nil {
+			log.Println("Proxy: Failed to resolve", host, err)
+			return "", SocksHostUnreachable
+		}
+		return onionHost, SocksSucceeded
+	default:
+		return "", SocksNotAllowed
+	}
+}
+
+// acceptSocks5Greeting reads the method selection request, preferring
+// username/password so that the credentials can be forwarded to Tor.
+func acceptSocks5Greeting(conn net.Conn) (auth *ProxyAuth, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, errSocksBadVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	selected := byte(socks5NoMethod)
+	for _, method := range methods {
+		if method == socks5PasswordAuth {
+			selected = socks5PasswordAuth
+			break
+		} else if method == socks5NoAuth {
+			selected = socks5NoAuth
+		}
+	}
+	if _, err = conn.Write([]byte{socks5Version, selected}); err != nil {
+		return nil, err
+	}
+	switch selected {
+	case socks5NoMethod:
+		return nil, errSocksNoMethod
+	case socks5PasswordAuth:
+		return readSocks5Auth(conn)
+	}
+	return nil, nil
+}
+
+func readSocks5Auth(conn net.Conn) (*ProxyAuth, error) {
+	readField := func() (string, error) {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		field := make([]byte, length[0])
+		_, err := io.ReadFull(conn, field)
+		return string(field), err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return nil, err
+	}
+	username, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	password, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	if version[0] != 1 || username == "" {
+		conn.Write([]byte{1, 1})
+		return nil, errSocksAuthFailed
+	}
+	if _, err := conn.Write([]byte{1, 0}); err != nil {
+		return nil, err
+	}
+	return &ProxyAuth{Username: username, Password: password}, nil
+}
+
+// readSocks5Request reads a CONNECT request. Other commands, and requests
+// for IP addresses which could only be reached through an exit, are
+// answered with a *SocksError.
+func readSocks5Request(conn net.Conn) (host string, port uint16, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socks5Version {
+		return "", 0, errSocksBadVersion
+	}
+	if header[1] != socks5Connect {
+		return "", 0, &SocksError{Reply: SocksCommandNotSupported}
+	}
+	if header[3] != socks5AddressName {
+		return "", 0, &SocksError{Reply: SocksAddressNotSupported}
+	}
+	length := make([]byte, 1)
+	if _, err = io.ReadFull(conn, length); err != nil {
+		return "", 0, err
+	}
+	address := make([]byte, int(length[0])+2)
+	if _, err = io.ReadFull(conn, address); err != nil {
+		return "", 0, err
+	}
+	host = string(address[:length[0]])
+	port = uint16(address[length[0]])<<8 | uint16(address[length[0]+1])
+	return host, port, nil
+}
+
+func writeSocks5Reply(conn net.Conn, reply SocksReply) error {
+	// The bound address is not meaningful through Tor, report 0.0.0.0:0
+	_, err := conn.Write([]byte{socks5Version, byte(reply), 0, socks5AddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
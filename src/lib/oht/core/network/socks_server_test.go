@@ -0,0 +1,64 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSocksServerResolvesNames(t *testing.T) {
+	onionRequest := append([]byte{5, 1, 0, 3, 22}, append([]byte("abcdefghijklmnop.onion"), 0x00, 0x50)...)
+	tests := []struct {
+		name   string
+		target string
+		script []exchange
+		reply  SocksReply
+	}{
+		{
+			name:   "registered name",
+			target: "alice.oht:80",
+			script: []exchange{{[]byte{5, 1, 0}, [][]byte{{5, 0}}}, {onionRequest, [][]byte{{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}}}},
+		},
+		{
+			name:   "onion passthrough",
+			target: "abcdefghijklmnop.onion:80",
+			script: []exchange{{[]byte{5, 1, 0}, [][]byte{{5, 0}}}, {onionRequest, [][]byte{{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}}}},
+		},
+		{
+			name:   "upstream onion error",
+			target: "alice.oht:80",
+			script: []exchange{{[]byte{5, 1, 0}, [][]byte{{5, 0}}}, {onionRequest, [][]byte{{5, 0xf2, 0, 1}}}},
+			reply:  SocksOnionIntroFailed,
+		},
+		{
+			name:   "unknown name",
+			target: "bob.oht:80",
+			reply:  SocksHostUnreachable,
+		},
+		{
+			name:   "clearnet refused",
+			target: "example.com:80",
+			reply:  SocksNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		tor, _ := fakeProxy(t, test.script)
+		server := InitializeSocksServer("127.0.0.1:0", tor, StaticResolver{"alice": "abcdefghijklmnop.onion"})
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := DialProxyContext(server.listener.Addr().String(), nil)(ctx, "tcp", test.target)
+		cancel()
+		if test.reply == SocksSucceeded {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			} else {
+				conn.Close()
+			}
+		} else if socksErr, ok := err.(*SocksError); !ok || socksErr.Reply != test.reply {
+			t.Errorf("%s: expected reply 0x%02x, got %v", test.name, byte(test.reply), err)
+		}
+		server.Stop()
+	}
+}
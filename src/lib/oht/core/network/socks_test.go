@@ -0,0 +1,190 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// exchange is one step of a scripted SOCKS conversation, the fake proxy
+// reads a message of the length of request and answers with replies, one
+// write per reply so split reads are exercised.
+type exchange struct {
+	request []byte
+	replies [][]byte
+}
+
+// fakeProxy accepts a single connection and plays the script, sending what
+// it received for every step on the returned channel.
+func fakeProxy(t *testing.T, script []exchange) (addr string, received chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = make(chan []byte, len(script))
+	go func() {
+		defer listener.Close()
+		defer close(received)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, step := range script {
+			request := make([]byte, len(step.request))
+			n, _ := io.ReadFull(conn, request)
+			received <- request[:n]
+			for _, reply := range step.replies {
+				conn.Write(reply)
+				time.Sleep(time.Millisecond)
+			}
+		}
+		// Hold the connection open until the client is done with it
+		io.Copy(ioutil.Discard, conn)
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestDialSocks5(t *testing.T) {
+	greeting := []byte{5, 1, 0}
+	authGreeting := []byte{5, 1, 2}
+	auth := []byte{1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}
+	onionRequest := append([]byte{5, 1, 0, 3, 22}, append([]byte("abcdefghijklmnop.onion"), 0x23, 0x52)...)
+	ipv4Request := []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}
+	ipv6Request := append(append([]byte{5, 1, 0, 4}, net.ParseIP("2001:db8::1").To16()...), 0, 80)
+	ipv4Bound := []byte{5, 0, 0, 1, 127, 0, 0, 1, 0x1f, 0x90}
+	ipv6Bound := append(append([]byte{5, 0, 0, 4}, net.ParseIP("::1").To16()...), 0x1f, 0x90)
+	nameBound := append([]byte{5, 0, 0, 3, 9}, append([]byte("localhost"), 0x1f, 0x90)...)
+	tests := []struct {
+		name   string
+		target string
+		auth   *ProxyAuth
+		script []exchange
+		reply  SocksReply
+		err    error
+	}{
+		{
+			name:   "onion ipv4 bound",
+			target: "abcdefghijklmnop.onion:9042",
+			script: []exchange{{greeting, [][]byte{{5, 0}}}, {onionRequest, [][]byte{ipv4Bound}}},
+		},
+		{
+			name:   "ipv4 target ipv6 bound",
+			target: "10.0.0.1:80",
+			script: []exchange{{greeting, [][]byte{{5, 0}}}, {ipv4Request, [][]byte{ipv6Bound}}},
+		},
+		{
+			name:   "ipv6 target name bound",
+			target: "[2001:db8::1]:80",
+			script: []exchange{{greeting, [][]byte{{5, 0}}}, {ipv6Request, [][]byte{nameBound}}},
+		},
+		{
+			name:   "reply split across reads",
+			target: "10.0.0.1:80",
+			script: []exchange{{greeting, [][]byte{{5}, {0}}}, {ipv4Request, [][]byte{ipv4Bound[:3], ipv4Bound[3:7], ipv4Bound[7:]}}},
+		},
+		{
+			name:   "username password",
+			target: "abcdefghijklmnop.onion:9042",
+			auth:   &ProxyAuth{Username: "user", Password: "pass"},
+			script: []exchange{{authGreeting, [][]byte{{5, 2}}}, {auth, [][]byte{{1, 0}}}, {onionRequest, [][]byte{ipv4Bound}}},
+		},
+		{
+			name:   "authentication rejected",
+			target: "abcdefghijklmnop.onion:9042",
+			auth:   &ProxyAuth{Username: "user", Password: "pass"},
+			script: []exchange{{authGreeting, [][]byte{{5, 2}}}, {auth, [][]byte{{1, 1}}}},
+			err:    errSocksAuthFailed,
+		},
+		{
+			name:   "no acceptable method",
+			target: "abcdefghijklmnop.onion:9042",
+			script: []exchange{{greeting, [][]byte{{5, 0xff}}}},
+			err:    errSocksNoMethod,
+		},
+		{
+			name:   "not socks5",
+			target: "abcdefghijklmnop.onion:9042",
+			script: []exchange{{greeting, [][]byte{{4, 0}}}},
+			err:    errSocksBadVersion,
+		},
+		{
+			name:   "connection refused",
+			target: "10.0.0.1:80",
+			script: []exchange{{greeting, [][]byte{{5, 0}}}, {ipv4Request, [][]byte{{5, 5, 0, 1}}}},
+			reply:  SocksConnectionRefused,
+		},
+		{
+			name:   "onion descriptor not found",
+			target: "abcdefghijklmnop.onion:9042",
+			script: []exchange{{greeting, [][]byte{{5, 0}}}, {onionRequest, [][]byte{{5, 0xf0, 0, 1, 0, 0, 0, 0, 0, 0}}}},
+			reply:  SocksOnionDescriptorNotFound,
+		},
+		{
+			name:   "missing client authorization",
+			target: "abcdefghijklmnop.onion:9042",
+			script: []exchange{{greeting, [][]byte{{5, 0}}}, {onionRequest, [][]byte{{5, 0xf4, 0, 1}}}},
+			reply:  SocksOnionMissingClientAuth,
+		},
+		{
+			name:   "unknown address type",
+			target: "10.0.0.1:80",
+			script: []exchange{{greeting, [][]byte{{5, 0}}}, {ipv4Request, [][]byte{{5, 0, 0, 9}}}},
+			err:    errSocksBadReply,
+		},
+	}
+	for _, test := range tests {
+		proxy, received := fakeProxy(t, test.script)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := DialProxyContext(proxy, test.auth)(ctx, "tcp", test.target)
+		cancel()
+		switch {
+		case test.reply != SocksSucceeded:
+			if socksErr, ok := err.(*SocksError); !ok || socksErr.Reply != test.reply {
+				t.Errorf("%s: expected reply 0x%02x, got %v", test.name, byte(test.reply), err)
+			}
+		case test.err != nil:
+			if err != test.err {
+				t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		for _, step := range test.script {
+			if request := <-received; !bytes.Equal(request, step.request) {
+				t.Errorf("%s: proxy received %v, expected %v", test.name, request, step.request)
+			}
+		}
+	}
+}
+
+func TestDialSocks5ContextDeadline(t *testing.T) {
+	// The proxy accepts but never answers the greeting
+	proxy, _ := fakeProxy(t, []exchange{{[]byte{5, 1, 0}, nil}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := DialProxyContext(proxy, nil)(ctx, "tcp", "abcdefghijklmnop.onion:9042")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial returned after %v, deadline was not applied", elapsed)
+	}
+}
+
+func TestSocksErrorOnionService(t *testing.T) {
+	if !(&SocksError{Reply: SocksOnionWrongClientAuth}).OnionServiceError() {
+		t.Error("0xF5 should be an onion service error")
+	}
+	if (&SocksError{Reply: SocksHostUnreachable}).OnionServiceError() {
+		t.Error("0x04 should not be an onion service error")
+	}
+}
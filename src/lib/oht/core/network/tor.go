@@ -2,15 +2,17 @@ package network
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
-	"os/exec"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/multiverse-os/libs/oht/core/common"
 )
@@ -27,7 +29,14 @@ type InitializeConfig struct {
 	Directory           string
 	SocksPort           string
 	ControlPort         string
+	DNSPort             string
 	OnionServiceConfigs []*OnionServiceConfig
+	// Bridges are torrc Bridge lines without the leading keyword, for
+	// example "obfs4 192.0.2.3:443 <fingerprint> cert=... iat-mode=0".
+	Bridges []string
+	// TransportPlugins are ClientTransportPlugin lines without the leading
+	// keyword, for example "obfs4 exec /usr/bin/obfs4proxy".
+	TransportPlugins []string
 }
 
 type OnionServiceConfig struct {
@@ -35,29 +44,39 @@ type OnionServiceConfig struct {
 	OnionHost        string
 	RemoteListenPort string
 	LocalListenPort  string
+	// Private services are added over the control port with ServiceKey and
+	// only reachable by AuthorizedClients, which maps a client name to its
+	// base32 x25519 public key. See onion_auth.go
+	Private           bool              `json:",omitempty"`
+	ServiceKey        string            `json:",omitempty"`
+	AuthorizedClients map[string]string `json:",omitempty"`
 }
 
 type TorRuntimeConfig struct {
-	OnionServiceConfigs    []*OnionServiceConfig
-	SocksPort              string
-	ControlPort            string
-	DNSPort                string
-	oRPort                 []string
-	extORPort              []string
-	dataDirectory          string
-	debugLogFile           string
-	serverTransportPlugin  []string
-	virtualAddrNetworkIPv4 []string
-	transPort              []string
-	exitPolicy             []string
-	dnsPort                []string
-	socksPolicy            []string
-	runAsDaemon            int
-	avoidDiskWrites        int
-	hardwareAcceleration   int
-	cookieAuthentication   int
-	automapHostsOnResolve  int
-	bridgeRelay            int
+	OnionServiceConfigs      []*OnionServiceConfig
+	SocksPort                string
+	ControlPort              string
+	DNSPort                  string
+	Bridges                  []string
+	ClientTransportPlugin    []string
+	oRPort                   []string
+	extORPort                []string
+	directory                string
+	dataDirectory            string
+	debugLogFile             string
+	overrideFile             string
+	clientOnionAuthDirectory string
+	serverTransportPlugin    []string
+	virtualAddrNetworkIPv4   []string
+	transPort                []string
+	exitPolicy               []string
+	socksPolicy              []string
+	runAsDaemon              int
+	avoidDiskWrites          int
+	hardwareAcceleration     int
+	cookieAuthentication     int
+	automapHostsOnResolve    int
+	bridgeRelay              int
 }
 
 type TorProcess struct {
@@ -67,30 +86,59 @@ type TorProcess struct {
 	configFile          string
 	pidFile             string
 	OnionServiceConfigs []*OnionServiceConfig
-	process             *common.Process
-	torRC               *TorRuntimeConfig
+	privateServices     []*OnionServiceConfig
+	// OnRestart is called after the supervisor has brought Tor back up
+	// following an unexpected exit, once the onion hosts have been re-read.
+	OnRestart  func(tor *TorProcess)
+	Restarts   int
+	process    *common.Process
+	torRC      *TorRuntimeConfig
+	supervisor *torSupervisor
+	// starting is set while Start waits for Tor to bootstrap, generation
+	// counts the calls to Stop so a start that raced one is undone.
+	starting   bool
+	generation int
+	mutex      sync.Mutex
+	// publishMutex keeps private onion services from being re-added twice
+	// at once, see publishPrivateService.
+	publishMutex sync.Mutex
 }
 
 func InitializeTor(config *InitializeConfig) (tor *TorProcess) {
-	common.CreatePathUnlessExist("/tor", 0700)
-	// Iterate for each onion service and initialize folders
-	for i := 0; i < len(tor.OnionServiceConfigs); i++ {
-		common.CreatePathUnlessExist(("/tor/" + tor.OnionServiceConfigs[i].DirectoryName), 0700)
-	}
 	tor = &TorProcess{
-		Online:     false,
-		configFile: common.AbsolutePath(config.Directory, "tor/torrc"),
-		pidFile:    common.AbsolutePath(config.Directory, "tor/tor.pid"),
+		Online:              false,
+		configFile:          common.AbsolutePath(config.Directory, "tor/torrc"),
+		pidFile:             common.AbsolutePath(config.Directory, "tor/tor.pid"),
+		OnionServiceConfigs: config.OnionServiceConfigs,
 		torRC: &TorRuntimeConfig{
-			SocksPort:            config.SocksPort,
-			ControlPort:          config.ControlPort,
-			dataDirectory:        common.AbsolutePath(config.Directory, "tor/data"),
-			avoidDiskWrites:      0,
-			hardwareAcceleration: 1,
-			debugLogFile:         common.AbsolutePath(config.Directory, "tor/debug.log"),
-			cookieAuthentication: 1,
+			OnionServiceConfigs:      config.OnionServiceConfigs,
+			SocksPort:                config.SocksPort,
+			ControlPort:              config.ControlPort,
+			DNSPort:                  config.DNSPort,
+			Bridges:                  config.Bridges,
+			ClientTransportPlugin:    config.TransportPlugins,
+			directory:                common.AbsolutePath(config.Directory, "tor"),
+			dataDirectory:            common.AbsolutePath(config.Directory, "tor/data"),
+			debugLogFile:             common.AbsolutePath(config.Directory, "tor/debug.log"),
+			overrideFile:             common.AbsolutePath(config.Directory, "tor/torrc.override"),
+			clientOnionAuthDirectory: common.AbsolutePath(config.Directory, "tor/onion_auth"),
+			socksPolicy:              []string{"accept 127.0.0.1", "reject *"},
+			exitPolicy:               []string{"reject *:*"},
+			avoidDiskWrites:          0,
+			hardwareAcceleration:     1,
+			cookieAuthentication:     1,
 		},
 	}
+	common.CreatePathUnlessExist(tor.torRC.directory, 0700)
+	common.CreatePathUnlessExist(tor.torRC.dataDirectory, 0700)
+	common.CreatePathUnlessExist(tor.torRC.clientOnionAuthDirectory, 0700)
+	// Iterate for each onion service and initialize folders
+	for i := 0; i < len(tor.OnionServiceConfigs); i++ {
+		common.CreatePathUnlessExist(tor.onionServiceDirectory(tor.OnionServiceConfigs[i].DirectoryName), 0700)
+	}
+	if err := tor.loadPrivateServices(); err != nil {
+		log.Println("Tor: Failed to load private onion services:", err)
+	}
 	if runtime.GOOS == "darwin" {
 		tor.binaryFile = common.AbsolutePath((config.BinaryPath + "/osx/"), "tor")
 	} else if runtime.GOOS == "windows" {
@@ -98,111 +146,175 @@ func InitializeTor(config *InitializeConfig) (tor *TorProcess) {
 	} else {
 		tor.binaryFile = common.AbsolutePath((config.BinaryPath + "/linux/64/"), "tor")
 	}
-	if !common.FileExist(tor.configFile) {
-		err := tor.initializeConfig()
-		if err != nil {
-			log.Fatal("Tor: Failed to write configuration: %s", err)
-		}
-	}
 	return tor
 
 }
 func (tor *TorProcess) Start() bool {
-	tor.process.cmd = exec.Command(tor.binaryFile, "-f", tor.configFile)
-	stdout, _ := tor.cmd.StdoutPipe()
-	err := tor.cmd.Start()
+	tor.mutex.Lock()
+	// A supervisor without Tor online is restarting it already
+	if tor.Online || tor.starting || tor.supervisor != nil {
+		tor.mutex.Unlock()
+		return tor.Online
+	}
+	// torrc is regenerated on every start so it always reflects the current
+	// configuration, local changes belong in the override file.
+	if err := tor.writeConfig(); err != nil {
+		tor.mutex.Unlock()
+		log.Println("Tor: Failed to write configuration:", err)
+		return false
+	}
+	tor.starting = true
+	generation, onionServices := tor.generation, tor.OnionServiceConfigs
+	tor.mutex.Unlock()
+
+	process, err := tor.bootstrap()
+	tor.mutex.Lock()
+	defer tor.mutex.Unlock()
+	tor.starting = false
+	if err != nil {
+		log.Println("Tor: Failed to start:", err)
+		return false
+	}
+	// Stop was called while Tor was bootstrapping
+	if tor.generation != generation || tor.Online {
+		process.StopProcess(false)
+		return tor.Online
+	}
+	tor.launched(process, onionServices)
+	tor.supervisor = newTorSupervisor()
+	go tor.supervise(tor.supervisor, tor.process)
+	return tor.Online
+}
+
+// bootstrap starts the Tor binary and blocks until it has finished
+// bootstrapping. It leaves the state of tor alone, so callers do not hold
+// tor.mutex while waiting and Stop is not held up.
+func (tor *TorProcess) bootstrap() (*common.Process, error) {
+	process, err := common.StartProcess("tor", tor.binaryFile, []string{"-f", tor.configFile})
 	if err != nil {
-		log.Fatal("Tor: Failed to start: %s", err)
+		return nil, err
 	}
-	scanner := bufio.NewScanner(stdout)
+	bootstrapped := false
+	scanner := bufio.NewScanner(process.Stdout)
 	for scanner.Scan() {
 		line := scanner.Text()
 		//log.Println(line)
 		if match, _ := regexp.Match("(100%|Is Tor already running?)", []byte(line)); match {
-			tor.Online = true
+			bootstrapped = true
 			break
 		}
 	}
-	tor.process = tor.cmd.Process
-	tor.Pid = fmt.Sprintf("%d", tor.cmd.Process.Pid)
-	for i := 0; i < len(tor.OnionServerConfigs); i++ {
-		tor.OnionServerConfigs[i].OnionHost = tor.readOnionHost(tor.OnionServerConfigs[i].DirectoryName)
+	// Tor blocks once the pipe fills up, so keep draining what is left
+	go io.Copy(ioutil.Discard, process.Stdout)
+	if !bootstrapped {
+		process.StopProcess(true)
+		return nil, errors.New("Tor: Exited before bootstrapping completed")
+	}
+	return process, nil
+}
+
+// launched records a bootstrapped Tor process and refreshes the onion hosts
+// of the services it was started with and the control cookie, then adds the
+// private services. The caller must hold tor.mutex.
+func (tor *TorProcess) launched(process *common.Process, onionServices []*OnionServiceConfig) {
+	tor.Online = true
+	tor.process = process
+	ioutil.WriteFile(tor.pidFile, []byte(strconv.Itoa(process.Pid)), 0600)
+	for _, onionService := range onionServices {
+		onionHost, err := tor.readOnionHost(onionService.DirectoryName)
+		if err != nil {
+			log.Println("Tor: Onion service", onionService.DirectoryName, "was not published:", err)
+		}
+		onionService.OnionHost = onionHost
 	}
 	tor.authCookie = tor.readAuthCookie()
-	return tor.Online
+	// The control port is used once the caller released tor.mutex
+	go tor.publishPrivateServices()
 }
 
 func (tor *TorProcess) Stop(kill bool) bool {
-	if tor.Online {
-		if kill {
-			tor.cmd.Process.Kill()
-		} else {
-			tor.cmd.Process.Signal(os.Interrupt)
-		}
+	tor.mutex.Lock()
+	defer tor.mutex.Unlock()
+	tor.generation++
+	if tor.supervisor != nil {
+		tor.supervisor.halt()
+		tor.supervisor = nil
+	}
+	if tor.Online && tor.process != nil {
+		tor.process.StopProcess(kill)
+		<-tor.process.WaitCh
 	}
+	os.Remove(tor.pidFile)
 	tor.Online = false
 	return tor.Online
 }
 
+// AddOnionService adds an onion service to the node, Tor publishes it from
+// the next start on. Its onion host is read once Tor has bootstrapped.
+func (tor *TorProcess) AddOnionService(onionService *OnionServiceConfig) error {
+	tor.mutex.Lock()
+	defer tor.mutex.Unlock()
+	if tor.onionServiceConfig(onionService.DirectoryName) != nil || tor.privateService(onionService.DirectoryName) != nil {
+		return fmt.Errorf("Tor: Onion service %s already exists", onionService.DirectoryName)
+	}
+	onionServices := append(tor.OnionServiceConfigs, onionService)
+	rc := *tor.torRC
+	rc.OnionServiceConfigs = onionServices
+	if err := rc.validate(); err != nil {
+		return err
+	}
+	tor.OnionServiceConfigs, tor.torRC.OnionServiceConfigs = onionServices, onionServices
+	common.CreatePathUnlessExist(tor.onionServiceDirectory(onionService.DirectoryName), 0700)
+	return nil
+}
+
+// OnionServices is a snapshot of the onion services Tor publishes.
+func (tor *TorProcess) OnionServices() []*OnionServiceConfig {
+	tor.mutex.Lock()
+	defer tor.mutex.Unlock()
+	return append([]*OnionServiceConfig(nil), tor.OnionServiceConfigs...)
+}
+
+// Restart stops and starts Tor so changes to the onion services take
+// effect.
+func (tor *TorProcess) Restart() bool {
+	tor.Stop(false)
+	return tor.Start()
+}
+
 func (tor *TorProcess) DeleteOnionFiles() bool {
-	for i := 0; i < len(tor.OnionServerConfigs); i++ {
-		os.RemoveAll(tor.OnionServerConfigs[i].DirectoryName)
+	for i := 0; i < len(tor.OnionServiceConfigs); i++ {
+		os.RemoveAll(tor.onionServiceDirectory(tor.OnionServiceConfigs[i].DirectoryName))
 	}
 	return true
 }
 
-// CONFIGURATION
-func (tor *TorProcess) initializeConfig() error {
-	config := ""
-	config += fmt.Sprintf("SOCKSPort 127.0.0.1:%s\n", tor.torRC.SocksPort)
-	config += fmt.Sprintf("ControlPort 127.0.0.1:%s\n", tor.torRC.ControlPort)
-	config += fmt.Sprintf("DataDirectory %s\n", tor.torRC.dataDirectory)
-	config += fmt.Sprintf("HardwareAccel %d\n", tor.torRC.hardwareAcceleration)
-	config += fmt.Sprintf("RunAsDaemon %d\n", tor.torRC.runAsDaemon)
-	for i := 0; i < len(tor.torRC.OnionServiceConfigs); i++ {
-		config += fmt.Sprintf("HiddenServiceDir %s\n", tor.torRC.OnionServiceConfigs.DirectoryName)
-		config += fmt.Sprintf("HiddenServicePort %s 127.0.0.1:%s\n", tor.torRC.OnionServerConfigs[i].RemoteListenPort, tor.torRC.OnionServerConfigs[i].LocalListenPort)
-	}
-	config += fmt.Sprintf("AvoidDiskWrites %d\n", tor.torRC.avoidDiskWrites)
-	config += fmt.Sprintf("AutomapHostsOnResolve %d\n", tor.torRC.automapHostsOnResolve)
-	config += fmt.Sprintf("CookieAuthentication %d\n", tor.torRC.cookieAuthentication)
-	// Should restrict socks access
-	//config += fmt.Sprintf("SocksPolicy accept 192.168.0.0/16\n")
-	// This does not work because we are using the hacky method of watching stdout
-	//config += fmt.Sprintf("Log debug file %s\n", tor.debugLog)
-	err := ioutil.WriteFile(tor.configFile, []byte(config), 0644)
-	if err != nil {
-		return err
-	} else {
-		return nil
-	}
+func (tor *TorProcess) onionServiceDirectory(directoryName string) string {
+	return common.AbsolutePath(tor.torRC.directory, directoryName)
 }
 
-func (tor *TorProcess) readOnionHost(directoryName string) string {
-	directory := tor.dataDirectory + "/" + directoryName + "/hostname"
-	onion, err := ioutil.ReadFile(directory)
+func (tor *TorProcess) readOnionHost(directoryName string) (string, error) {
+	onion, err := ioutil.ReadFile(common.AbsolutePath(tor.onionServiceDirectory(directoryName), "hostname"))
 	if err != nil {
-		log.Fatal("Tor: Failed reading onion hostname file: %v", err)
+		return "", err
 	}
-	return strings.Replace(string(onion), "\n", "", -1)
+	return strings.Replace(string(onion), "\n", "", -1), nil
 }
 
 // TOR CONTROL
 func (tor *TorProcess) readAuthCookie() string {
-	cookie, err := ioutil.ReadFile(tor.dataDirectory + "/control_auth_cookie")
+	// The cookie is 32 raw bytes, it is hex encoded when authenticating
+	cookie, err := ioutil.ReadFile(common.AbsolutePath(tor.torRC.dataDirectory, "control_auth_cookie"))
 	if err != nil {
-		log.Fatal("Tor: Failed to read authorization cookie: %s", err)
+		log.Fatalf("Tor: Failed to read authorization cookie: %s", err)
 	}
-	return strings.Replace(string(cookie), "\n", "", -1)
+	return string(cookie)
 }
 
 func (tor *TorProcess) controlCommand(command string) {
-	conn, err := net.Dial("tcp", "127.0.0.1:"+tor.ControlPort)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := tor.controlRequest(command); err != nil {
+		log.Println(err)
 	}
-	fmt.Fprintf(conn, "AUTHENTICATE\r\n")
-	fmt.Fprintf(conn, "%s\fmtr\n", command)
 }
 
 func (tor *TorProcess) Cycle() {
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const torControlTimeout = 30 * time.Second
+
+var errTorControlOffline = errors.New("Tor: Control port is not available while Tor is offline")
+
+// controlRequest opens an authenticated control connection, sends a single
+// command and returns the reply lines without their status prefix.
+func (tor *TorProcess) controlRequest(command string) (reply []string, err error) {
+	// The supervisor replaces the cookie when it restarts Tor
+	tor.mutex.Lock()
+	online, authCookie, controlPort := tor.Online, tor.authCookie, tor.torRC.ControlPort
+	tor.mutex.Unlock()
+	if !online {
+		return nil, errTorControlOffline
+	}
+	conn, err := net.DialTimeout("tcp", ("127.0.0.1:" + controlPort), torControlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(torControlTimeout))
+	control := textproto.NewReader(bufio.NewReader(conn))
+	fmt.Fprintf(conn, "AUTHENTICATE %s\r\n", hex.EncodeToString([]byte(authCookie)))
+	if _, err = readControlReply(control); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(conn, "%s\r\n", command)
+	reply, err = readControlReply(control)
+	fmt.Fprintf(conn, "QUIT\r\n")
+	return reply, err
+}
+
+// readControlReply reads one, possibly multi-line, reply from the control
+// port. Any status other than 250 is returned as an error.
+func readControlReply(control *textproto.Reader) (lines []string, err error) {
+	for {
+		line, err := control.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("Tor: Malformed control reply: %q", line)
+		}
+		status, separator, text := line[:3], line[3], line[4:]
+		if status != "250" {
+			return nil, fmt.Errorf("Tor: Control command failed: %s %s", status, text)
+		}
+		lines = append(lines, text)
+		if separator == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+// controlReplyValue finds "key=value" in a reply returned by controlRequest.
+func controlReplyValue(reply []string, key string) string {
+	for _, line := range reply {
+		if strings.HasPrefix(line, (key + "=")) {
+			return line[len(key)+1:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"log"
+	"time"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+)
+
+const (
+	torRestartMinBackoff = 1 * time.Second
+	torRestartMaxBackoff = 5 * time.Minute
+	// A Tor process that stayed up this long is considered healthy again and
+	// the backoff starts over from torRestartMinBackoff on its next crash.
+	torRestartStableUptime = 10 * time.Minute
+)
+
+type torSupervisor struct {
+	stop    chan struct{}
+	backoff time.Duration
+}
+
+func newTorSupervisor() *torSupervisor {
+	return &torSupervisor{
+		stop:    make(chan struct{}),
+		backoff: torRestartMinBackoff,
+	}
+}
+
+func (s *torSupervisor) halt() {
+	close(s.stop)
+}
+
+func (s *torSupervisor) nextBackoff(uptime time.Duration) time.Duration {
+	if uptime >= torRestartStableUptime {
+		s.backoff = torRestartMinBackoff
+	}
+	backoff := s.backoff
+	s.backoff *= 2
+	if s.backoff > torRestartMaxBackoff {
+		s.backoff = torRestartMaxBackoff
+	}
+	return backoff
+}
+
+// supervise watches the Tor process and restarts it when it exits without
+// Stop having been called. Each failed attempt doubles the wait before the
+// next one, up to torRestartMaxBackoff.
+func (tor *TorProcess) supervise(s *torSupervisor, process *common.Process) {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-process.WaitCh:
+		}
+		tor.mutex.Lock()
+		if tor.supervisor != s {
+			tor.mutex.Unlock()
+			return
+		}
+		tor.Online = false
+		tor.mutex.Unlock()
+		uptime := process.Uptime()
+		log.Printf("Tor: Process %d exited unexpectedly (%v) after %v\n", process.Pid, process.ExitState, uptime)
+		for {
+			backoff := s.nextBackoff(uptime)
+			log.Printf("Tor: Restarting in %v\n", backoff)
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(backoff):
+			}
+			tor.mutex.Lock()
+			if tor.supervisor != s {
+				tor.mutex.Unlock()
+				return
+			}
+			// Onion services added while Tor was down are published too
+			onionServices := tor.OnionServiceConfigs
+			err := tor.writeConfig()
+			tor.mutex.Unlock()
+			var restarted *common.Process
+			if err == nil {
+				// Stop and AddOnionService are not held up while Tor bootstraps
+				restarted, err = tor.bootstrap()
+			}
+			tor.mutex.Lock()
+			if tor.supervisor != s || tor.Online {
+				tor.mutex.Unlock()
+				if err == nil {
+					restarted.StopProcess(false)
+				}
+				return
+			}
+			if err == nil {
+				tor.launched(restarted, onionServices)
+				tor.Restarts++
+				process = restarted
+			}
+			tor.mutex.Unlock()
+			if err == nil {
+				break
+			}
+			log.Println("Tor: Restart failed:", err)
+			uptime = 0
+		}
+		log.Println("Tor: Restarted, onion services republished")
+		if tor.OnRestart != nil {
+			go tor.OnRestart(tor)
+		}
+	}
+}
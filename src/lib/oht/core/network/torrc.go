@@ -0,0 +1,201 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/multiverse-os/libs/oht/core/common"
+)
+
+var (
+	errTorInvalidPort      = errors.New("Tor: Invalid port")
+	errTorDuplicatePort    = errors.New("Tor: Port is used more than once")
+	errTorRelativePath     = errors.New("Tor: Path must be absolute")
+	errTorMissingTransport = errors.New("Tor: Bridge uses a transport without a ClientTransportPlugin")
+)
+
+// torrcOption is a single "Keyword value" line of a torrc file.
+type torrcOption struct {
+	Keyword string
+	Value   string
+}
+
+func (tor *TorProcess) writeConfig() error {
+	if err := tor.torRC.validate(); err != nil {
+		return err
+	}
+	options := tor.torRC.options()
+	if common.FileExist(tor.torRC.overrideFile) {
+		overrides, err := readTorrc(tor.torRC.overrideFile)
+		if err != nil {
+			return err
+		}
+		options = mergeTorrc(options, overrides)
+	}
+	var config bytes.Buffer
+	config.WriteString("# Generated by oht on every start, changes belong in torrc.override\n")
+	for _, option := range options {
+		fmt.Fprintf(&config, "%s %s\n", option.Keyword, option.Value)
+	}
+	return ioutil.WriteFile(tor.configFile, config.Bytes(), 0600)
+}
+
+// options renders the runtime configuration into torrc lines, in the order
+// they will be written.
+func (rc *TorRuntimeConfig) options() (options []torrcOption) {
+	add := func(keyword string, values ...string) {
+		for _, value := range values {
+			options = append(options, torrcOption{Keyword: keyword, Value: value})
+		}
+	}
+	// IsolateSOCKSAuth is Tor's default, it is spelled out because p2p relies
+	// on it to keep circuits of different peers, channels and accounts apart.
+	// ExtendedErrors makes Tor report why an onion service was unreachable.
+	add("SOCKSPort", ("127.0.0.1:" + rc.SocksPort + " IsolateSOCKSAuth ExtendedErrors"))
+	add("ControlPort", ("127.0.0.1:" + rc.ControlPort))
+	if rc.DNSPort != "" {
+		add("DNSPort", ("127.0.0.1:" + rc.DNSPort))
+	}
+	add("DataDirectory", rc.dataDirectory)
+	add("HardwareAccel", strconv.Itoa(rc.hardwareAcceleration))
+	add("RunAsDaemon", strconv.Itoa(rc.runAsDaemon))
+	add("AvoidDiskWrites", strconv.Itoa(rc.avoidDiskWrites))
+	add("AutomapHostsOnResolve", strconv.Itoa(rc.automapHostsOnResolve))
+	add("CookieAuthentication", strconv.Itoa(rc.cookieAuthentication))
+	add("ClientOnionAuthDir", rc.clientOnionAuthDirectory)
+	add("SocksPolicy", rc.socksPolicy...)
+	add("TransPort", rc.transPort...)
+	add("VirtualAddrNetworkIPv4", rc.virtualAddrNetworkIPv4...)
+	if len(rc.Bridges) > 0 {
+		add("UseBridges", "1")
+		add("ClientTransportPlugin", rc.ClientTransportPlugin...)
+		add("Bridge", rc.Bridges...)
+	}
+	add("ORPort", rc.oRPort...)
+	add("ExtORPort", rc.extORPort...)
+	add("ServerTransportPlugin", rc.serverTransportPlugin...)
+	add("ExitPolicy", rc.exitPolicy...)
+	if rc.bridgeRelay != 0 {
+		add("BridgeRelay", strconv.Itoa(rc.bridgeRelay))
+	}
+	// This does not work because we are using the hacky method of watching stdout
+	//add("Log", ("debug file " + rc.debugLogFile))
+	for _, onionService := range rc.OnionServiceConfigs {
+		add("HiddenServiceDir", common.AbsolutePath(rc.directory, onionService.DirectoryName))
+		add("HiddenServicePort", (onionService.RemoteListenPort + " 127.0.0.1:" + onionService.LocalListenPort))
+	}
+	return options
+}
+
+func (rc *TorRuntimeConfig) validate() error {
+	ports := []string{rc.SocksPort, rc.ControlPort}
+	if rc.DNSPort != "" {
+		ports = append(ports, rc.DNSPort)
+	}
+	for _, onionService := range rc.OnionServiceConfigs {
+		if err := validatePort(onionService.RemoteListenPort); err != nil {
+			return fmt.Errorf("%v: HiddenServicePort %q", err, onionService.RemoteListenPort)
+		}
+		if onionService.DirectoryName == "" || strings.ContainsAny(onionService.DirectoryName, "/\\") {
+			return fmt.Errorf("Tor: Invalid onion service directory name %q", onionService.DirectoryName)
+		}
+		ports = append(ports, onionService.LocalListenPort)
+	}
+	seen := make(map[string]bool, len(ports))
+	for _, port := range ports {
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("%v: %q", err, port)
+		}
+		if seen[port] {
+			return fmt.Errorf("%v: %q", errTorDuplicatePort, port)
+		}
+		seen[port] = true
+	}
+	for _, path := range []string{rc.directory, rc.dataDirectory, rc.overrideFile, rc.clientOnionAuthDirectory} {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("%v: %q", errTorRelativePath, path)
+		}
+	}
+	transports := make(map[string]bool)
+	for _, plugin := range rc.ClientTransportPlugin {
+		fields := strings.Fields(plugin)
+		if len(fields) < 3 || (fields[1] != "exec" && fields[1] != "socks4" && fields[1] != "socks5") {
+			return fmt.Errorf("Tor: Invalid ClientTransportPlugin %q", plugin)
+		}
+		if fields[1] == "exec" && !common.FileExist(fields[2]) {
+			return fmt.Errorf("Tor: Transport plugin binary does not exist: %q", fields[2])
+		}
+		for _, transport := range strings.Split(fields[0], ",") {
+			transports[transport] = true
+		}
+	}
+	for _, bridge := range rc.Bridges {
+		fields := strings.Fields(bridge)
+		if len(fields) == 0 {
+			return errors.New("Tor: Empty bridge line")
+		}
+		// A bridge line either starts with its address or with the name of
+		// the pluggable transport that reaches it.
+		if _, _, err := splitHostPort(fields[0]); err != nil && !transports[fields[0]] {
+			return fmt.Errorf("%v: %q", errTorMissingTransport, bridge)
+		}
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	if port == "auto" {
+		return nil
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return errTorInvalidPort
+	}
+	return nil
+}
+
+// readTorrc parses a torrc style file, ignoring blank lines and comments.
+func readTorrc(path string) (options []torrcOption, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		option := torrcOption{Keyword: parts[0]}
+		if len(parts) == 2 {
+			option.Value = strings.TrimSpace(parts[1])
+		}
+		options = append(options, option)
+	}
+	return options, scanner.Err()
+}
+
+// mergeTorrc replaces every generated line whose keyword appears in the
+// overrides, so a keyword given in the override file wins entirely, then
+// appends the overrides. Keywords are case insensitive like in Tor.
+func mergeTorrc(generated, overrides []torrcOption) (merged []torrcOption) {
+	overridden := make(map[string]bool, len(overrides))
+	for _, option := range overrides {
+		overridden[strings.ToLower(option.Keyword)] = true
+	}
+	for _, option := range generated {
+		if !overridden[strings.ToLower(option.Keyword)] {
+			merged = append(merged, option)
+		}
+	}
+	return append(merged, overrides...)
+}
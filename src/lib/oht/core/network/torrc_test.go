@@ -0,0 +1,127 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestTor(t *testing.T, config *InitializeConfig) (tor *TorProcess, directory string) {
+	directory, err := ioutil.TempDir("", "oht-tor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Directory = directory
+	if config.SocksPort == "" {
+		config.SocksPort, config.ControlPort = "9142", "9555"
+	}
+	return InitializeTor(config), directory
+}
+
+func TestWriteConfig(t *testing.T) {
+	plugin, err := ioutil.TempFile("", "obfs4proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin.Close()
+	defer os.Remove(plugin.Name())
+
+	tests := []struct {
+		name     string
+		config   *InitializeConfig
+		override string
+		expected []string
+		absent   []string
+		err      bool
+	}{
+		{
+			name:     "defaults",
+			config:   &InitializeConfig{},
+			expected: []string{"SOCKSPort 127.0.0.1:9142 IsolateSOCKSAuth ExtendedErrors", "ControlPort 127.0.0.1:9555", "ClientOnionAuthDir {tor}/onion_auth", "DataDirectory {tor}/data", "SocksPolicy accept 127.0.0.1", "SocksPolicy reject *"},
+			absent:   []string{"UseBridges", "Bridge ", "ClientTransportPlugin", "DNSPort"},
+		},
+		{
+			name: "onion service",
+			config: &InitializeConfig{OnionServiceConfigs: []*OnionServiceConfig{
+				{DirectoryName: "onion_service", RemoteListenPort: "9042", LocalListenPort: "9043"},
+			}},
+			expected: []string{"HiddenServiceDir {tor}/onion_service", "HiddenServicePort 9042 127.0.0.1:9043"},
+		},
+		{
+			name: "bridges",
+			config: &InitializeConfig{
+				Bridges:          []string{"obfs4 192.0.2.3:443 0123456789ABCDEF cert=abc iat-mode=0", "192.0.2.4:9001"},
+				TransportPlugins: []string{"obfs4 exec " + plugin.Name()},
+			},
+			expected: []string{"UseBridges 1", "ClientTransportPlugin obfs4 exec " + plugin.Name(), "Bridge obfs4 192.0.2.3:443 0123456789ABCDEF cert=abc iat-mode=0", "Bridge 192.0.2.4:9001"},
+		},
+		{
+			name:   "bridge without transport plugin",
+			config: &InitializeConfig{Bridges: []string{"obfs4 192.0.2.3:443 0123456789ABCDEF"}},
+			err:    true,
+		},
+		{
+			name:   "missing transport plugin binary",
+			config: &InitializeConfig{Bridges: []string{"obfs4 192.0.2.3:443"}, TransportPlugins: []string{"obfs4 exec /nonexistent/obfs4proxy"}},
+			err:    true,
+		},
+		{
+			name:   "duplicate port",
+			config: &InitializeConfig{SocksPort: "9142", ControlPort: "9142"},
+			err:    true,
+		},
+		{
+			name:     "override",
+			config:   &InitializeConfig{},
+			override: "# Local changes\nsocksport 127.0.0.1:9150\nSocksPolicy accept 10.0.0.0/8\n\nLog notice stdout\n",
+			expected: []string{"socksport 127.0.0.1:9150", "SocksPolicy accept 10.0.0.0/8", "Log notice stdout", "ControlPort 127.0.0.1:9555"},
+			absent:   []string{"SOCKSPort 127.0.0.1:9142", "SocksPolicy accept 127.0.0.1", "# Local changes"},
+		},
+	}
+	for _, test := range tests {
+		tor, directory := newTestTor(t, test.config)
+		defer os.RemoveAll(directory)
+		if test.override != "" {
+			if err := ioutil.WriteFile(tor.torRC.overrideFile, []byte(test.override), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := tor.writeConfig()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected the config to be refused", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		torrc, err := ioutil.ReadFile(tor.configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(torrc), "\n")
+		has := func(expected string) bool {
+			for _, line := range lines {
+				if strings.HasPrefix(line, expected) {
+					return true
+				}
+			}
+			return false
+		}
+		for _, expected := range test.expected {
+			expected = strings.Replace(expected, "{tor}", filepath.Join(directory, "tor"), 1)
+			if !has(expected) {
+				t.Errorf("%s: expected %q in the torrc:\n%s", test.name, expected, torrc)
+			}
+		}
+		for _, absent := range test.absent {
+			if has(absent) {
+				t.Errorf("%s: expected no %q in the torrc:\n%s", test.name, absent, torrc)
+			}
+		}
+	}
+}
@@ -1,11 +1,20 @@
 package oht
 
 import (
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/multiverse-os/libs/oht/accounts"
+	"github.com/multiverse-os/libs/oht/accounts/agent"
+	"github.com/multiverse-os/libs/oht/channels"
+	"github.com/multiverse-os/libs/oht/contacts"
 	"github.com/multiverse-os/libs/oht/core/common"
+	"github.com/multiverse-os/libs/oht/core/crypto"
+	"github.com/multiverse-os/libs/oht/core/database"
+	"github.com/multiverse-os/libs/oht/core/dht"
 	"github.com/multiverse-os/libs/oht/core/network"
 	"github.com/multiverse-os/libs/oht/core/network/webui"
 
@@ -22,6 +31,9 @@ type OHT struct {
 	tor       *network.TorProcess
 	p2p       *network.Manager
 	webUI     *webui.WebUI
+	nameProxy *network.SocksServer
+	db        *database.BoltDatabase
+	dht       *dht.Store
 	Shutdown  chan os.Signal
 }
 
@@ -35,31 +47,114 @@ func NewOHT(torListenPort, torSocksPort, torControlPort, torWebUIPort string) (o
 	config := InitializeConfig(torListenPort, torSocksPort, torControlPort, torWebUIPort)
 	common.CreatePathUnlessExist(config.DataDirectory+"", 0700)
 	common.CreatePathUnlessExist(config.DataDirectory+"keys", 0700)
-	tor := network.InitializeTor(config)
+	tor := network.InitializeTor(torConfig(config))
 	p2p := p2p.InitializeP2PManager(config)
+	p2p.Config.ListenPort = config.TorConfig.ListenPort
 	webUI := webui.InitializeWebUI(tor.WebUIOnionHost, config.TorWebUIPort)
+	tor.OnRestart = func(tor *network.TorProcess) {
+		p2p.RequestReconnect()
+		oht.Interface.startIdentities()
+	}
+	names, err := network.LoadStaticResolver(common.AbsolutePath(config.DataDirectory, "names.json"))
+	if err != nil {
+		log.Println("Names: Failed to load names.json:", err)
+	}
+	db, err := database.InitializeDatabase(common.AbsolutePath(config.DataDirectory, "oht.db"))
+	if err != nil {
+		log.Fatal("Database: Failed to open oht.db: ", err)
+	}
+	store := dht.NewStore(db, p2p)
+	registerValidators(store)
+	contactList, err := contacts.InitializeContacts(config.DataDirectory, p2p)
+	if err != nil {
+		log.Fatal("Contacts: Failed to load contacts.json: ", err)
+	}
+	channelList, err := channels.InitializeChannels(config.DataDirectory, db, p2p)
+	if err != nil {
+		log.Fatal("Channels: Failed to load channels.json: ", err)
+	}
+	accountList := accounts.InitializeAccounts(crypto.NewKeyStorePassphraseKDF(common.DefaultDataDir()+"/keys", config.KeyDerivation, crypto.KDFStandard))
+	accountList.Interface.Manager.SetSeedFile(common.AbsolutePath(common.DefaultDataDir(), "keys/seed.json"), config.KeyDerivation, crypto.KDFStandard)
+	accountList.Interface.Manager.SetAgent(agent.NewClient(agent.DefaultSocket(config.DataDirectory)))
+	contactList.LocalOnionHost = func() string { return tor.OnionHost }
+	contactList.AddClientAuth = tor.AddClientAuth
+	contactList.ListenPort = config.TorConfig.ListenPort
+	nameProxy := network.InitializeSocksServer(("127.0.0.1:" + config.TorConfig.NameProxyPort), ("127.0.0.1:" + config.TorConfig.SocksPort), nil)
 	oht = &OHT{
-		Interface: NewInterface(config, tor, webUI, p2p),
+		Interface: NewInterface(config, tor, webUI, p2p, nameProxy, names, store, contactList, channelList, accountList),
 		config:    config,
 		tor:       tor,
 		p2p:       p2p,
 		webUI:     webUI,
+		nameProxy: nameProxy,
+		db:        db,
+		dht:       store,
 		Shutdown:  make(chan os.Signal, 1),
 	}
+	nameProxy.Resolver = oht.Interface
+	contactList.Locate = func(contactId string) (common.Address, string, error) {
+		return oht.Interface.locateContact(store, contactId)
+	}
+	contactList.SetStore(store)
+	channelList.SetDirectory(store)
+	if err := oht.Interface.loadIdentities(); err != nil {
+		log.Fatal("Identity: Failed to load identities.json: ", err)
+	}
 	go oht.cleanShutdown(oht.Shutdown)
 	return oht
 }
 
+// torConfig translates the client config into the one Tor is started with,
+// the bridges and transport plugins are written to the torrc as is.
+func torConfig(config *config.Config) *network.InitializeConfig {
+	return &network.InitializeConfig{
+		BinaryPath:  common.AbsolutePath(config.DataDirectory, "tor/bin"),
+		Directory:   config.DataDirectory,
+		SocksPort:   config.TorConfig.SocksPort,
+		ControlPort: config.TorConfig.ControlPort,
+		OnionServiceConfigs: []*network.OnionServiceConfig{
+			{DirectoryName: "onion_service", RemoteListenPort: config.TorConfig.ListenPort, LocalListenPort: config.TorConfig.ListenPort},
+			{DirectoryName: "webui", RemoteListenPort: "80", LocalListenPort: config.TorConfig.WebUIPort},
+		},
+		Bridges:          config.TorConfig.Bridges,
+		TransportPlugins: config.TorConfig.TransportPlugins,
+	}
+}
+
 func (oht *OHT) Start() bool {
 	oht.tor.Start()
+	if err := oht.p2p.Listen("127.0.0.1:" + oht.tor.ListenPort); err != nil {
+		log.Println("P2P: Failed to listen for peers:", err)
+	}
 	go oht.p2p.Start()
+	oht.Interface.startIdentities()
+	go oht.expireRecords()
 	return true
 }
 
+// expireRecords drops expired DHT records, such as names that were not
+// renewed, so they can be claimed again.
+func (oht *OHT) expireRecords() {
+	for range time.Tick(time.Hour) {
+		for _, identity := range oht.Interface.identityList() {
+			if removed := identity.dht.Expire(); removed > 0 {
+				log.Println("DHT: Removed", removed, "expired records of identity", identity.Name)
+			}
+		}
+	}
+}
+
 func (oht *OHT) Stop() bool {
 	oht.webUI.Server.Stop()
+	oht.nameProxy.Stop()
 	oht.tor.Stop(false)
-	oht.p2p.Stop()
+	for _, identity := range oht.Interface.identityList() {
+		identity.p2p.Stop()
+		if identity.db != nil {
+			identity.db.Close()
+		}
+	}
+	oht.db.Close()
 	os.Exit(1)
 	return true
 }